@@ -18,13 +18,40 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"github.com/rbaylon/arkgate/database"
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	"github.com/rbaylon/arkgate/modules/alerts/notify"
+	alertroutes "github.com/rbaylon/arkgate/modules/alerts/routes"
+	"github.com/rbaylon/arkgate/modules/authlog"
+	billingmodel "github.com/rbaylon/arkgate/modules/billing/model"
+	billingroutes "github.com/rbaylon/arkgate/modules/billing/routes"
+	casemodel "github.com/rbaylon/arkgate/modules/cases/model"
+	caseroutes "github.com/rbaylon/arkgate/modules/cases/routes"
+	"github.com/rbaylon/arkgate/modules/dashboard"
+	dashboardroutes "github.com/rbaylon/arkgate/modules/dashboard/routes"
+	"github.com/rbaylon/arkgate/modules/detections"
+	detectionroutes "github.com/rbaylon/arkgate/modules/detections/routes"
+	"github.com/rbaylon/arkgate/modules/dns"
+	dnsroutes "github.com/rbaylon/arkgate/modules/dns/routes"
+	"github.com/rbaylon/arkgate/modules/enrich"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	eventroutes "github.com/rbaylon/arkgate/modules/events/routes"
+	"github.com/rbaylon/arkgate/modules/export"
+	exportroutes "github.com/rbaylon/arkgate/modules/export/routes"
 	firewallmodel "github.com/rbaylon/arkgate/modules/firewall/model"
 	firewallroutes "github.com/rbaylon/arkgate/modules/firewall/routes/firewall"
 	queueroutes "github.com/rbaylon/arkgate/modules/firewall/routes/queue"
+	"github.com/rbaylon/arkgate/modules/flows/collector"
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	flowroutes "github.com/rbaylon/arkgate/modules/flows/routes"
+	"github.com/rbaylon/arkgate/modules/ingest"
 	interfacemodel "github.com/rbaylon/arkgate/modules/interface/model"
 	interfaceroutes "github.com/rbaylon/arkgate/modules/interface/routes"
 	ipmodel "github.com/rbaylon/arkgate/modules/ip/model"
@@ -35,11 +62,30 @@ import (
 	ospfdroutes "github.com/rbaylon/arkgate/modules/ospfd/routes"
 	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
 	planroutes "github.com/rbaylon/arkgate/modules/plans/routes"
+	radiusmodel "github.com/rbaylon/arkgate/modules/radius/model"
+	radiusroutes "github.com/rbaylon/arkgate/modules/radius/routes"
+	radiusserver "github.com/rbaylon/arkgate/modules/radius/server"
+	responsemodel "github.com/rbaylon/arkgate/modules/response/model"
+	banroutes "github.com/rbaylon/arkgate/modules/response/routes"
+	"github.com/rbaylon/arkgate/modules/retention"
+	retentionmodel "github.com/rbaylon/arkgate/modules/retention/model"
+	retentionroutes "github.com/rbaylon/arkgate/modules/retention/routes"
 	"github.com/rbaylon/arkgate/modules/security"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	"github.com/rbaylon/arkgate/modules/sessions/npppdlog"
+	sessionroutes "github.com/rbaylon/arkgate/modules/sessions/routes"
+	"github.com/rbaylon/arkgate/modules/stream"
+	streamroutes "github.com/rbaylon/arkgate/modules/stream/routes"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
 	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"github.com/rbaylon/arkgate/modules/subs/quota"
 	subroutes "github.com/rbaylon/arkgate/modules/subs/routes"
+	"github.com/rbaylon/arkgate/modules/subs/secret"
+	"github.com/rbaylon/arkgate/modules/suricata"
 	usermodel "github.com/rbaylon/arkgate/modules/users/model"
 	userroutes "github.com/rbaylon/arkgate/modules/users/routes"
+	vouchermodel "github.com/rbaylon/arkgate/modules/vouchers/model"
+	voucherroutes "github.com/rbaylon/arkgate/modules/vouchers/routes"
 )
 
 func main() {
@@ -64,6 +110,16 @@ func main() {
 	firewallmodel.MigrateDB(db)
 	npppdmodel.MigrateDB(db)
 	ospfdmodel.MigrateDB(db)
+	eventmodel.MigrateDB(db)
+	alertmodel.MigrateDB(db)
+	responsemodel.MigrateDB(db)
+	sessionmodel.MigrateDB(db)
+	flowmodel.MigrateDB(db)
+	retentionmodel.MigrateDB(db)
+	casemodel.MigrateDB(db)
+	radiusmodel.MigrateDB(db)
+	vouchermodel.MigrateDB(db)
+	billingmodel.MigrateDB(db)
 
 	userStore := usermodel.New(db)
 	firewallStore := firewallmodel.New(db)
@@ -71,8 +127,206 @@ func main() {
 	ipStore := ipmodel.New(db)
 	planStore := planmodel.New(db)
 	subStore := submodel.New(db)
+
+	// rotate-secrets - Add a subscriber secret key version and re-encrypt
+	// every sub with it, a running server picks the new key up by itself
+	if len(os.Args) > 1 && os.Args[1] == "rotate-secrets" {
+		keys, err := secret.Default()
+		if err != nil {
+			log.Fatal(err)
+		}
+		v, err := keys.Rotate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := subStore.Reencrypt()
+		log.Printf("Subscriber secrets: key version %d, %d re-encrypted\n", v, n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Legacy base64 passwords are encrypted on start
+	if n, err := subStore.Reencrypt(); err != nil {
+		log.Println("Subscriber secrets: ", err)
+	} else if n > 0 {
+		log.Printf("Subscriber secrets: %d encrypted\n", n)
+	}
 	npppdStore := npppdmodel.New(db)
 	ospfdStore := ospfdmodel.New(db)
+	eventStore := eventmodel.New(db)
+	if path := database.GetEnvVariable("EVENT_SIGNING_KEY"); path != "" {
+		key, err := eventmodel.LoadKey(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventStore.Key = key
+		go eventStore.RunCheckpoints(envDuration("EVENT_CHECKPOINT_INTERVAL", time.Hour))
+	}
+	alertStore := alertmodel.New(db)
+	banStore := responsemodel.New(db)
+	sessionStore := sessionmodel.New(db)
+	flowStore := flowmodel.New(db)
+	retentionStore := retentionmodel.New(db)
+	caseStore := casemodel.New(db)
+	caseStore.Bans = banStore
+	caseStore.Subs = subStore
+	radiusStore := radiusmodel.New(db)
+	voucherStore := vouchermodel.New(db)
+	billingStore := billingmodel.New(db)
+	hub := stream.New()
+
+	// Alert de-duplication window and notification channels
+	alertStore.Window = envDuration("ALERT_DEDUP_WINDOW", alertStore.Window)
+	if url := database.GetEnvVariable("ALERT_WEBHOOK_URL"); url != "" {
+		alertStore.AddNotifier(notify.NewWebhook(url))
+	}
+	if addr := database.GetEnvVariable("ALERT_SMTP_ADDR"); addr != "" {
+		n := notify.NewSmtp(addr, database.GetEnvVariable("ALERT_SMTP_FROM"), database.GetEnvVariable("ALERT_SMTP_TO"))
+		n.Username = database.GetEnvVariable("ALERT_SMTP_USER")
+		n.Password = database.GetEnvVariable("ALERT_SMTP_PW")
+		alertStore.AddNotifier(n)
+	}
+	if addr := database.GetEnvVariable("ALERT_SYSLOG_ADDR"); addr != "" {
+		alertStore.AddNotifier(notify.NewSyslog(database.GetEnvVariable("ALERT_SYSLOG_NETWORK"), addr))
+	}
+
+	alertStore.AddNotifier(hub)
+	if origins := database.GetEnvVariable("STREAM_ALLOWED_ORIGINS"); origins != "" {
+		streamroutes.Origins = strings.Split(origins, ",")
+	}
+
+	// Active response, ban the source of severe alerts into a pf table
+	if table := database.GetEnvVariable("BAN_TABLE"); table != "" {
+		banStore.Table = table
+	}
+	banStore.TTL = envDuration("BAN_TTL", banStore.TTL)
+	if sev := database.GetEnvVariable("BAN_MIN_SEVERITY"); sev != "" {
+		banStore.MinSeverity = sev
+		alertStore.AddNotifier(banStore)
+	}
+	go banStore.Run(time.Minute)
+
+	// Event ingest pipeline and log ingesters
+	pipeline := ingest.New(eventStore, alertStore)
+	pipeline.AddSink(hub)
+
+	// Subscriber, interface, reverse DNS and GeoIP context
+	enricher := enrich.New(subStore, ifaceStore)
+	if database.GetEnvVariable("ENRICH_RDNS") != "false" {
+		enricher.Resolver = enrich.NewResolver(envDuration("ENRICH_RDNS_TTL", time.Hour), envInt("ENRICH_RDNS_WORKERS", 4))
+	}
+	if dbs := database.GetEnvVariable("GEOIP_DB"); dbs != "" {
+		if geo, err := enrich.OpenGeoIP(strings.Split(dbs, ",")); err != nil {
+			log.Println("GeoIP enrichment disabled: ", err)
+		} else {
+			enricher.Geo = geo
+		}
+	}
+	pipeline.AddEnricher(enricher)
+	go enricher.Run(envDuration("ENRICH_REFRESH", time.Minute))
+
+	// Live syslog forwarding to an external SIEM
+	if addr := database.GetEnvVariable("FORWARD_ADDR"); addr != "" {
+		fwd, err := export.NewForwarder(database.GetEnvVariable("FORWARD_NETWORK"), addr,
+			database.GetEnvVariable("FORWARD_FORMAT"), database.GetEnvVariable("FORWARD_SPOOL_DIR"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ca := database.GetEnvVariable("FORWARD_TLS_CA"); ca != "" {
+			if err := fwd.LoadCA(ca); err != nil {
+				log.Fatal(err)
+			}
+		}
+		pipeline.AddSink(fwd)
+		alertStore.AddNotifier(fwd)
+		go fwd.Run()
+	}
+	go pipeline.Run()
+	if path := database.GetEnvVariable("AUTHLOG_PATH"); path != "" {
+		pipeline.AddDetector(authlog.NewBruteForce(envInt("SSH_BRUTEFORCE_THRESHOLD", 10), envDuration("SSH_BRUTEFORCE_WINDOW", 5*time.Minute)))
+		pipeline.AddDetector(authlog.NewSpraying(envInt("SSH_SPRAY_USERS", 5), envDuration("SSH_SPRAY_WINDOW", 10*time.Minute)))
+		go authlog.Ingest(path, pipeline)
+	}
+	if paths := database.GetEnvVariable("SURICATA_EVE_PATHS"); paths != "" {
+		sev := database.GetEnvVariable("SURICATA_ALERT_MIN_SEVERITY")
+		if sev == "" {
+			sev = "low"
+		}
+		pipeline.AddDetector(suricata.NewIdsAlert(sev))
+		for _, path := range strings.Split(paths, ",") {
+			go suricata.Ingest(strings.TrimSpace(path), pipeline)
+		}
+	}
+	if path := database.GetEnvVariable("UNBOUND_LOG_PATH"); path != "" {
+		go dns.Ingest(path, pipeline)
+	}
+	if lists := database.GetEnvVariable("DNS_BLOCKLIST"); lists != "" {
+		sev := database.GetEnvVariable("DNS_BLOCKLIST_SEVERITY")
+		if sev == "" {
+			sev = "medium"
+		}
+		bl := dns.NewBlocklist(strings.Split(lists, ","), sev)
+		pipeline.AddDetector(bl)
+		go bl.Watch(30 * time.Second)
+	}
+
+	// Sigma style YAML detection rules
+	detectionEngine := detections.New(database.GetEnvVariable("DETECTIONS_DIR"))
+	if detectionEngine.Dir != "" {
+		pipeline.AddDetector(detectionEngine)
+		go detectionEngine.Watch(envDuration("DETECTIONS_RELOAD", 10*time.Second))
+	}
+	if path := database.GetEnvVariable("NPPPD_LOG_PATH"); path != "" {
+		go npppdlog.Ingest(path, sessionStore)
+	}
+
+	// pflow(4) NetFlow/IPFIX collector
+	if addr := database.GetEnvVariable("FLOW_LISTEN"); addr != "" {
+		fc := collector.New(addr, flowStore)
+		fc.Bucket = envDuration("FLOW_BUCKET", fc.Bucket)
+		go func() {
+			log.Println("Flow collector: ", fc.Run())
+		}()
+	}
+
+	// RADIUS authentication and accounting for NAS devices
+	rs := radiusserver.New(database.GetEnvVariable("RADIUS_AUTH_LISTEN"), radiusStore, subStore, planStore)
+	rs.Sessions = sessionStore
+	rs.CoAPort = envInt("RADIUS_COA_PORT", rs.CoAPort)
+	rs.Events = pipeline
+	if rs.Addr != "" {
+		go func() {
+			log.Println("RADIUS server: ", rs.Run())
+		}()
+	}
+	if addr := database.GetEnvVariable("RADIUS_ACCT_LISTEN"); addr != "" {
+		go func() {
+			log.Println("RADIUS accounting: ", rs.RunAccounting(addr))
+		}()
+	}
+
+	// Subscription expiry
+	expirySched := expiry.New(subStore, planStore)
+	expirySched.AddDisconnecter(rs)
+	go expirySched.Run(envDuration("EXPIRY_INTERVAL", time.Minute))
+
+	// Plan data quotas
+	quotaEnforcer := quota.New(subStore, planStore, sessionStore)
+	quotaEnforcer.WarnPercent = float64(envInt("QUOTA_WARN_PERCENT", int(quotaEnforcer.WarnPercent)))
+	quotaEnforcer.AddNAS(rs)
+	quotaEnforcer.AddNotifier(quota.NewAlerts(alertStore))
+	go quotaEnforcer.Run(envDuration("QUOTA_INTERVAL", 5*time.Minute))
+
+	// Billing cycles and overdue suspension
+	billingStore.Expiry = expirySched
+	billingStore.AutoSuspend = database.GetEnvVariable("BILLING_AUTO_SUSPEND") == "true"
+	billingStore.SuspendGrace = envDuration("BILLING_SUSPEND_GRACE", 0)
+	go billingStore.Run(envDuration("BILLING_INTERVAL", time.Hour))
+
+	// Event retention, rollups and archival
+	retentionJob := retention.New(eventStore, retentionStore, database.GetEnvVariable("RETENTION_ARCHIVE_DIR"))
+	go retentionJob.Run(envDuration("RETENTION_INTERVAL", time.Hour))
 
 	r := chi.NewRouter()
 	r.Use(render.SetContentType(render.ContentTypeJSON))
@@ -93,6 +347,39 @@ func main() {
 	r.Mount("/api/v1/npppds", npppdroutes.NpppdRouter(npppdStore))
 	r.Mount("/api/v1/firewall", firewallroutes.FirewallRouter(firewallStore))
 	r.Mount("/api/v1/ospfd", ospfdroutes.OspfdRouter(ospfdStore))
+	r.Mount("/api/v1/events", eventroutes.EventRouter(eventStore))
+	r.Mount("/api/v1/alerts", alertroutes.AlertRouter(alertStore))
+	r.Mount("/api/v1/bans", banroutes.BanRouter(banStore))
+	r.Mount("/api/v1/sessions", sessionroutes.SessionRouter(sessionStore))
+	r.Mount("/api/v1/stream", streamroutes.StreamRouter(hub))
+	r.Mount("/api/v1/flows", flowroutes.FlowRouter(flowStore))
+	r.Mount("/api/v1/dns", dnsroutes.DnsRouter(eventStore))
+	r.Mount("/api/v1/export", exportroutes.ExportRouter(eventStore, alertStore))
+	r.Mount("/api/v1/retention", retentionroutes.RetentionRouter(retentionStore, retentionJob))
+	r.Mount("/api/v1/cases", caseroutes.CaseRouter(caseStore))
+	r.Mount("/api/v1/radius", radiusroutes.RadiusRouter(radiusStore))
+	r.Mount("/api/v1/vouchers", voucherroutes.VoucherRouter(voucherStore))
+	r.Mount("/api/v1/billing", billingroutes.BillingRouter(billingStore))
+	r.Mount("/api/v1/dashboard", dashboardroutes.DashboardRouter(dashboard.New(eventStore, retentionStore, flowStore, alertStore, banStore, subStore)))
+	r.Mount("/api/v1/detections", detectionroutes.DetectionRouter(detectionEngine, eventStore))
 
 	http.ListenAndServe(fmt.Sprintf("%s:%s", app_ip, app_port), r)
 }
+
+// envDuration - Duration setting from .env, def if unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(database.GetEnvVariable(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// envInt - Integer setting from .env, def if unset or invalid
+func envInt(key string, def int) int {
+	i, err := strconv.Atoi(database.GetEnvVariable(key))
+	if err != nil {
+		return def
+	}
+	return i
+}
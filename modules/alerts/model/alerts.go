@@ -0,0 +1,364 @@
+// Package alerts - Alert specific functions
+package alertmodel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusOpen         = "open"
+	StatusAcknowledged = "acknowledged"
+	StatusClosed       = "closed"
+)
+
+// Severities - Valid alert severities and their rank
+var Severities = map[string]int{
+	"low":      1,
+	"medium":   2,
+	"high":     3,
+	"critical": 4,
+}
+
+type Alert struct {
+	gorm.Model
+	Rule           string             `json:"rule" bson:"rule"`
+	Severity       string             `json:"severity" bson:"severity"`
+	Status         string             `json:"status" bson:"status" gorm:"index"`
+	AssigneeID     uint               `json:"assigneeid" bson:"assigneeid"`
+	SrcIp          string             `json:"src_ip" bson:"src_ip"`
+	DstIp          string             `json:"dst_ip" bson:"dst_ip"`
+	Summary        string             `json:"summary" bson:"summary"`
+	Fingerprint    string             `json:"fingerprint" bson:"fingerprint" gorm:"index"`
+	Count          int                `json:"count" bson:"count"`
+	FirstSeen      time.Time          `json:"first_seen" bson:"first_seen"`
+	LastSeen       time.Time          `json:"last_seen" bson:"last_seen"`
+	AcknowledgedAt *time.Time         `json:"acknowledged_at" bson:"acknowledged_at"`
+	ClosedAt       *time.Time         `json:"closed_at" bson:"closed_at"`
+	Events         []eventmodel.Event `json:"events,omitempty" gorm:"many2many:alert_events;"`
+}
+
+// Suppression - Drop alerts for a rule and/or source until a point in time.
+// Empty Rule or SrcIp match anything.
+type Suppression struct {
+	gorm.Model
+	Rule   string    `json:"rule" bson:"rule"`
+	SrcIp  string    `json:"src_ip" bson:"src_ip"`
+	Until  time.Time `json:"until" bson:"until"`
+	Reason string    `json:"reason" bson:"reason"`
+}
+
+// Notifier - Receives every newly raised (non duplicate) alert
+type Notifier interface {
+	Name() string
+	Notify(alert *Alert) error
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Alert{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Suppression{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Alert) Bind(r *http.Request) error {
+	if a.Severity != "" {
+		if _, ok := Severities[a.Severity]; !ok {
+			return fmt.Errorf("invalid severity %q", a.Severity)
+		}
+	}
+	for _, ev := range a.Events {
+		if ev.ID == 0 {
+			return ErrEvidence
+		}
+	}
+	return nil
+}
+
+// ErrEvidence - Evidence is linked by the id of a stored event, events only
+// enter the store through ingest so they are part of the hash chain
+var ErrEvidence = errors.New("evidence events must be ids of stored events")
+
+// evidence - Replace the alert's events with the stored events of their ids
+func (s *Storage) evidence(alert *Alert) error {
+	if len(alert.Events) == 0 {
+		return nil
+	}
+	ids, seen := make([]uint, 0, len(alert.Events)), map[uint]bool{}
+	for _, ev := range alert.Events {
+		if ev.ID == 0 {
+			return ErrEvidence
+		}
+		if !seen[ev.ID] {
+			seen[ev.ID] = true
+			ids = append(ids, ev.ID)
+		}
+	}
+	var events []eventmodel.Event
+	if err := s.DB.Where("id IN ?", ids).Find(&events).Error; err != nil {
+		return err
+	}
+	if len(events) != len(ids) {
+		return ErrEvidence
+	}
+	alert.Events = events
+	return nil
+}
+
+func (a *Suppression) Bind(r *http.Request) error {
+	if a.Until.IsZero() {
+		return errors.New("until is required")
+	}
+	return nil
+}
+
+// Key - Fingerprint used for de-duplication when none is given
+func (a *Alert) Key() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+	return a.Rule + "|" + a.SrcIp + "|" + a.DstIp
+}
+
+type Crud interface {
+	GetAll() ([]Alert, error)
+	GetById(uid uint) (*Alert, error)
+	Find(status string, severity string) ([]Alert, error)
+	Raise(alert *Alert) (*Alert, error)
+	SetStatus(alert *Alert, status string) error
+	Update(alert *Alert) error
+	Delete(alert *Alert) error
+	GetSuppressions() ([]Suppression, error)
+	AddSuppression(sup *Suppression) error
+	DeleteSuppression(sup *Suppression) error
+	TestNotifiers() map[string]string
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+	// Window - Repeats of an alert with the same fingerprint inside this
+	// window are folded into the existing alert instead of raising a new one
+	Window    time.Duration
+	notifiers []Notifier
+	mu        sync.Mutex
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB:     db,
+		Window: 15 * time.Minute,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) AddNotifier(n Notifier) {
+	s.notifiers = append(s.notifiers, n)
+}
+
+func (s *Storage) GetAll() ([]Alert, error) {
+	var alerts []Alert
+	result := s.DB.Order("last_seen desc").Find(&alerts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return alerts, nil
+}
+
+func (s *Storage) GetById(id uint) (*Alert, error) {
+	var alert Alert
+	result := s.DB.Preload("Events").First(&alert, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &alert, nil
+}
+
+func (s *Storage) Find(status string, severity string) ([]Alert, error) {
+	var alerts []Alert
+	q := s.DB.Order("last_seen desc")
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if severity != "" {
+		q = q.Where("severity = ?", severity)
+	}
+	result := q.Find(&alerts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return alerts, nil
+}
+
+// Raise - Store an alert, folding it into an open duplicate when one exists
+// inside the de-duplication window. Returns nil when the alert is suppressed.
+// Notifiers are only called for new alerts.
+func (s *Storage) Raise(alert *Alert) (*Alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.suppressed(alert, now) {
+		return nil, nil
+	}
+	if err := s.evidence(alert); err != nil {
+		return nil, err
+	}
+	if alert.Severity == "" {
+		alert.Severity = "medium"
+	}
+	alert.Fingerprint = alert.Key()
+
+	var existing Alert
+	result := s.DB.Where("fingerprint = ? AND status <> ? AND last_seen >= ?", alert.Fingerprint, StatusClosed, now.Add(-s.Window)).
+		Order("last_seen desc").First(&existing)
+	if result.Error == nil {
+		existing.Count++
+		existing.LastSeen = now
+		if Severities[alert.Severity] > Severities[existing.Severity] {
+			existing.Severity = alert.Severity
+		}
+		if err := s.DB.Save(&existing).Error; err != nil {
+			return nil, err
+		}
+		if len(alert.Events) > 0 {
+			if err := s.DB.Model(&existing).Omit("Events.*").Association("Events").Append(alert.Events); err != nil {
+				return nil, err
+			}
+		}
+		return &existing, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	alert.ID = 0
+	alert.Status = StatusOpen
+	alert.Count = 1
+	alert.FirstSeen = now
+	alert.LastSeen = now
+	if err := s.DB.Omit("Events.*").Create(alert).Error; err != nil {
+		return nil, err
+	}
+	for _, n := range s.notifiers {
+		go func(n Notifier, a Alert) {
+			if err := n.Notify(&a); err != nil {
+				log.Printf("Notifier %s: %v\n", n.Name(), err)
+			}
+		}(n, *alert)
+	}
+	return alert, nil
+}
+
+func (s *Storage) suppressed(alert *Alert, now time.Time) bool {
+	var count int64
+	s.DB.Model(&Suppression{}).
+		Where("until > ?", now).
+		Where("rule = '' OR rule = ?", alert.Rule).
+		Where("src_ip = '' OR src_ip = ?", alert.SrcIp).
+		Count(&count)
+	return count > 0
+}
+
+// SetStatus - Move an alert through its lifecycle open -> acknowledged -> closed.
+// Closed alerts may be re-opened.
+func (s *Storage) SetStatus(alert *Alert, status string) error {
+	now := time.Now()
+	switch status {
+	case StatusOpen:
+		alert.ClosedAt = nil
+		alert.AcknowledgedAt = nil
+	case StatusAcknowledged:
+		if alert.Status == StatusClosed {
+			return errors.New("closed alerts must be re-opened first")
+		}
+		alert.AcknowledgedAt = &now
+	case StatusClosed:
+		alert.ClosedAt = &now
+	default:
+		return fmt.Errorf("invalid status %q", status)
+	}
+	alert.Status = status
+	return s.Update(alert)
+}
+
+func (s *Storage) Update(alert *Alert) error {
+	result := s.DB.Omit("Events").Save(alert)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) Delete(alert *Alert) error {
+	result := s.DB.Select("Events").Delete(alert)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) GetSuppressions() ([]Suppression, error) {
+	var sups []Suppression
+	result := s.DB.Find(&sups)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return sups, nil
+}
+
+func (s *Storage) AddSuppression(sup *Suppression) error {
+	result := s.DB.Create(sup)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) DeleteSuppression(sup *Suppression) error {
+	result := s.DB.Delete(sup)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// TestNotifiers - Send a synthetic alert through every notifier and report
+// the outcome per notifier
+func (s *Storage) TestNotifiers() map[string]string {
+	now := time.Now()
+	alert := &Alert{
+		Rule:      "arkgate-notifier-test",
+		Severity:  "low",
+		Status:    StatusOpen,
+		Summary:   "Arkgate notifier test",
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	res := map[string]string{}
+	for _, n := range s.notifiers {
+		if err := n.Notify(alert); err != nil {
+			res[n.Name()] = err.Error()
+		} else {
+			res[n.Name()] = "OK"
+		}
+	}
+	return res
+}
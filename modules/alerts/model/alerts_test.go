@@ -0,0 +1,61 @@
+package alertmodel
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRaiseEvidence(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	eventmodel.MigrateDB(db)
+	MigrateDB(db)
+	events := eventmodel.New(db)
+	stored := []eventmodel.Event{{Type: "auth", Message: "one"}, {Type: "auth", Message: "two"}}
+	if err := events.AddBatch(stored); err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+
+	tests := []struct {
+		name   string
+		events []eventmodel.Event
+		err    error
+	}{
+		{"new event", []eventmodel.Event{{Type: "auth", Message: "forged"}}, ErrEvidence},
+		{"unknown id", []eventmodel.Event{{Model: gorm.Model{ID: 99}}}, ErrEvidence},
+		{"stored", []eventmodel.Event{{Model: gorm.Model{ID: stored[0].ID}, Message: "changed"}}, nil},
+		{"repeat", []eventmodel.Event{{Model: gorm.Model{ID: stored[1].ID}}, {Model: gorm.Model{ID: stored[1].ID}}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Raise(&Alert{Rule: "r", Events: tt.events}); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&eventmodel.Event{}).Count(&count)
+	if count != 2 {
+		t.Errorf("%d events stored", count)
+	}
+	alert, err := s.GetById(1)
+	if err != nil || len(alert.Events) != 2 || alert.Events[0].Message != "one" {
+		t.Errorf("evidence %+v, %v", alert, err)
+	}
+	if res, err := events.Verify(time.Time{}, time.Time{}); err != nil || !res.Ok {
+		t.Errorf("chain %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,142 @@
+// Package notify - Alert notification channels
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+)
+
+// Text - One line, human readable representation of an alert
+func Text(a *alertmodel.Alert) string {
+	return fmt.Sprintf("arkgate alert id=%d rule=%s severity=%s status=%s src=%s dst=%s count=%d summary=%q",
+		a.ID, a.Rule, a.Severity, a.Status, a.SrcIp, a.DstIp, a.Count, a.Summary)
+}
+
+// Webhook - POST the alert as JSON to a URL
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *Webhook) Name() string {
+	return "webhook"
+}
+
+func (n *Webhook) Notify(a *alertmodel.Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Smtp - Mail the alert to a list of recipients
+type Smtp struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func NewSmtp(addr string, from string, to string) *Smtp {
+	return &Smtp{
+		Addr: addr,
+		From: from,
+		To:   strings.Split(to, ","),
+	}
+}
+
+func (n *Smtp) Name() string {
+	return "smtp"
+}
+
+func (n *Smtp) Notify(a *alertmodel.Alert) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [arkgate] %s alert: %s\r\n", a.Severity, a.Rule)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", Text(a))
+	return smtp.SendMail(n.Addr, auth, n.From, n.To, msg.Bytes())
+}
+
+// Syslog - Forward the alert to a remote syslog collector
+type Syslog struct {
+	Network string // udp or tcp
+	Addr    string
+	Tag     string
+	mu      sync.Mutex
+	w       *syslog.Writer
+}
+
+func NewSyslog(network string, addr string) *Syslog {
+	if network == "" {
+		network = "udp"
+	}
+	return &Syslog{
+		Network: network,
+		Addr:    addr,
+		Tag:     "arkgate",
+	}
+}
+
+func (n *Syslog) Name() string {
+	return "syslog"
+}
+
+func (n *Syslog) Notify(a *alertmodel.Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.w == nil {
+		w, err := syslog.Dial(n.Network, n.Addr, syslog.LOG_WARNING|syslog.LOG_AUTH, n.Tag)
+		if err != nil {
+			return err
+		}
+		n.w = w
+	}
+	msg := Text(a)
+	switch a.Severity {
+	case "critical":
+		return n.w.Crit(msg)
+	case "high":
+		return n.w.Err(msg)
+	case "medium":
+		return n.w.Warning(msg)
+	default:
+		return n.w.Notice(msg)
+	}
+}
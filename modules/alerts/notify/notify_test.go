@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+)
+
+func testAlert() *alertmodel.Alert {
+	return &alertmodel.Alert{Rule: "ssh-bruteforce", Severity: "high", Status: "open", SrcIp: "203.0.113.7", Count: 1}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan alertmodel.Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alertmodel.Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		got <- a
+	}))
+	defer srv.Close()
+
+	if err := NewWebhook(srv.URL).Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-got; a.Rule != "ssh-bruteforce" || a.SrcIp != "203.0.113.7" {
+		t.Errorf("unexpected payload %+v", a)
+	}
+}
+
+func TestSmtp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		rd := bufio.NewReader(c)
+		c.Write([]byte("220 stand-in ESMTP\r\n"))
+		var data strings.Builder
+		indata := false
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if indata {
+				if line == ".\r\n" {
+					indata = false
+					c.Write([]byte("250 queued\r\n"))
+					got <- data.String()
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "DATA":
+				indata = true
+				c.Write([]byte("354 go ahead\r\n"))
+			case "QUIT":
+				c.Write([]byte("221 bye\r\n"))
+				return
+			default:
+				c.Write([]byte("250 ok\r\n"))
+			}
+		}
+	}()
+
+	if err := NewSmtp(l.Addr().String(), "arkgate@example.net", "noc@example.net").Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-got:
+		if !strings.Contains(msg, "Subject: [arkgate] high alert: ssh-bruteforce") {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if err := NewSyslog("udp", pc.LocalAddr().String()).Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, "rule=ssh-bruteforce") || !strings.HasPrefix(msg, "<35>") {
+		t.Errorf("unexpected syslog line %q", msg)
+	}
+}
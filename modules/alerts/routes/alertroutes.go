@@ -0,0 +1,246 @@
+// Package alertroutes - Arkgate API Alert module
+//
+//	Module Routes:
+//	  /api/v1/alerts
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: status, severity
+//	    Return: JSON object with list of alert objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/alerts/<alertId>
+//	    Method: GET|PUT|DELETE
+//	    Headers: Authorization Bearer
+//	    Return: JSON alert object with evidence events ( exept for delete method )
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/alerts/<alertId>/acknowledge
+//	  /api/v1/alerts/<alertId>/close
+//	  /api/v1/alerts/<alertId>/reopen
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON alert object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/alerts/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Data: JSON alert object, evidence events only by the ID of a
+//	          stored event ( "events": [{"ID": 42}] )
+//	    Return: JSON alert object, de-duplicated against open alerts
+//	    Return-Status: 200 on Success
+//	                   204 if suppressed
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/alerts/suppressions
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of suppression objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/alerts/suppressions/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON suppression object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/alerts/suppressions/<supId>
+//	    Method: DELETE
+//	    Headers: Authorization Bearer
+//	    Return-Status: 200 on Success
+//	                   400 on Bad request
+//
+//	  /api/v1/alerts/notifiers/test
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with the result per notifier
+//	    Return-Status: 200
+package alertroutes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func AlertRouter(db alertmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.Find(r.URL.Query().Get("status"), r.URL.Query().Get("severity"))
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetSuppressions()
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/suppressions/create", func(w http.ResponseWriter, r *http.Request) {
+		sup := &alertmodel.Suppression{}
+		if err := render.Bind(r, sup); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		err := db.AddSuppression(sup)
+		if err == nil {
+			render.JSON(w, r, sup)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+	})
+	r.Delete("/suppressions/{supId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "supId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid suppression ID %s", chi.URLParam(r, "supId")), http.StatusBadRequest))
+			return
+		}
+		sup := &alertmodel.Suppression{}
+		sup.ID = uint(id)
+		err = db.DeleteSuppression(sup)
+		if err == nil {
+			render.JSON(w, r, sup)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error deleting record for suppression  ID %s", chi.URLParam(r, "supId")), http.StatusBadRequest))
+	})
+	r.Post("/notifiers/test", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, db.TestNotifiers())
+	})
+	r.Get("/{alertId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "alertId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid alert ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+			return
+		}
+		alert, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, alert)
+	})
+	r.Put("/{alertId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "alertId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid alert ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+			return
+		}
+		alert, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		req := &alertmodel.Alert{}
+		if err = render.Bind(r, req); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		// Only triage fields are editable, the detection data stays as raised
+		alert.AssigneeID = req.AssigneeID
+		if req.Severity != "" {
+			alert.Severity = req.Severity
+		}
+		if req.Summary != "" {
+			alert.Summary = req.Summary
+		}
+		if req.Status != "" && req.Status != alert.Status {
+			err = db.SetStatus(alert, req.Status)
+		} else {
+			err = db.Update(alert)
+		}
+		if err == nil {
+			render.JSON(w, r, alert)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error updating record for alert  ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+	})
+	for path, status := range map[string]string{
+		"/{alertId}/acknowledge": alertmodel.StatusAcknowledged,
+		"/{alertId}/close":       alertmodel.StatusClosed,
+		"/{alertId}/reopen":      alertmodel.StatusOpen,
+	} {
+		status := status
+		r.Post(path, func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.Atoi(chi.URLParam(r, "alertId"))
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid alert ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+				return
+			}
+			alert, err := db.GetById(uint(id))
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+				return
+			}
+			err = db.SetStatus(alert, status)
+			if err == nil {
+				render.JSON(w, r, alert)
+				return
+			}
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error updating record for alert  ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+		})
+	}
+	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+		alert := &alertmodel.Alert{}
+		if err := render.Bind(r, alert); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		res, err := db.Raise(alert)
+		if errors.Is(err, alertmodel.ErrEvidence) {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid evidence", http.StatusBadRequest))
+			return
+		}
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if res == nil {
+			render.NoContent(w, r)
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Delete("/{alertId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "alertId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid alert ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+			return
+		}
+		alert := &alertmodel.Alert{}
+		alert.ID = uint(id)
+		err = db.Delete(alert)
+		if err == nil {
+			render.JSON(w, r, alert)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error deleting record for alert  ID %s", chi.URLParam(r, "alertId")), http.StatusBadRequest))
+	})
+	return r
+}
@@ -0,0 +1,124 @@
+// Package authlog - OpenBSD /var/log/authlog sshd parser and detections
+package authlog
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+	"github.com/rbaylon/arkgate/modules/localutils/tail"
+)
+
+const (
+	FailedPassword    = "failed_password"
+	InvalidUser       = "invalid_user"
+	AcceptedPublickey = "accepted_publickey"
+	AcceptedPassword  = "accepted_password"
+	Disconnect        = "disconnect"
+)
+
+// ErrNotSshd - Line is not an sshd message this parser understands
+var ErrNotSshd = errors.New("not an sshd auth line")
+
+type AuthEvent struct {
+	Time    time.Time
+	Host    string
+	Pid     int
+	Kind    string
+	User    string
+	SrcIp   string
+	SrcPort int
+	Message string
+	Raw     string
+}
+
+var (
+	syslogRe = regexp.MustCompile(`^(\w{3} [ \d]\d \d\d:\d\d:\d\d) (\S+) sshd\[(\d+)\]: (.*)$`)
+	msgRes   = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{FailedPassword, regexp.MustCompile(`^Failed (?:password|keyboard-interactive/pam) for (?:invalid user )?(\S*) from (\S+) port (\d+)`)},
+		{InvalidUser, regexp.MustCompile(`^Invalid user (\S*) from (\S+) port (\d+)`)},
+		{AcceptedPublickey, regexp.MustCompile(`^Accepted publickey for (\S+) from (\S+) port (\d+)`)},
+		{AcceptedPassword, regexp.MustCompile(`^Accepted (?:password|keyboard-interactive/pam) for (\S+) from (\S+) port (\d+)`)},
+		{Disconnect, regexp.MustCompile(`^Disconnected from (?:(?:authenticating |invalid )?user (\S+) )?(\S+) port (\d+)`)},
+		{Disconnect, regexp.MustCompile(`^Connection closed by (?:(?:authenticating |invalid )?user (\S+) )?(\S+) port (\d+)`)},
+		{Disconnect, regexp.MustCompile(`^Received disconnect from ()(\S+) port (\d+)`)},
+	}
+	severity = map[string]int{
+		FailedPassword:    2,
+		InvalidUser:       2,
+		AcceptedPublickey: 1,
+		AcceptedPassword:  1,
+		Disconnect:        0,
+	}
+)
+
+// Parse - Turn one authlog line into a typed auth event. Syslog timestamps
+// carry no year, the one closest to now is assumed.
+func Parse(line string, now time.Time) (*AuthEvent, error) {
+	m := syslogRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, ErrNotSshd
+	}
+	ts, err := time.ParseInLocation("Jan _2 15:04:05", m[1], now.Location())
+	if err != nil {
+		return nil, err
+	}
+	ts = ts.AddDate(now.Year(), 0, 0)
+	if ts.After(now.AddDate(0, 0, 1)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	pid, _ := strconv.Atoi(m[3])
+	for _, r := range msgRes {
+		mm := r.re.FindStringSubmatch(m[4])
+		if mm == nil {
+			continue
+		}
+		port, _ := strconv.Atoi(mm[3])
+		return &AuthEvent{
+			Time:    ts,
+			Host:    m[2],
+			Pid:     pid,
+			Kind:    r.kind,
+			User:    mm[1],
+			SrcIp:   mm[2],
+			SrcPort: port,
+			Message: m[4],
+			Raw:     line,
+		}, nil
+	}
+	return nil, ErrNotSshd
+}
+
+// ToEvent - Map to the arkgate event schema
+func (a *AuthEvent) ToEvent() eventmodel.Event {
+	return eventmodel.Event{
+		Timestamp: a.Time,
+		Type:      "auth",
+		Source:    a.Host,
+		Action:    a.Kind,
+		Severity:  severity[a.Kind],
+		SrcIp:     a.SrcIp,
+		SrcPort:   a.SrcPort,
+		Protocol:  "ssh",
+		Username:  a.User,
+		Message:   a.Message,
+		Raw:       a.Raw,
+	}
+}
+
+// Ingest - Follow an authlog file and publish sshd events to the pipeline
+func Ingest(path string, p *ingest.Pipeline) {
+	tail.Follow(path, false, func(line string) {
+		a, err := Parse(line, time.Now())
+		if err != nil {
+			return
+		}
+		p.Publish(a.ToEvent())
+	})
+}
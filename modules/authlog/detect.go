@@ -0,0 +1,92 @@
+package authlog
+
+import (
+	"fmt"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+)
+
+// failed - One failed login attempt. sshd logs "Invalid user" once per
+// connection and "Failed password for invalid user" for every attempt on it,
+// only the latter is counted so an attempt on an unknown account counts once.
+func failed(ev *eventmodel.Event) bool {
+	return ev.Type == "auth" && ev.Action == FailedPassword
+}
+
+// BruteForce - Threshold failed logins from one source inside Window
+type BruteForce struct {
+	Threshold int
+	window    *ingest.Window
+}
+
+func NewBruteForce(threshold int, window time.Duration) *BruteForce {
+	return &BruteForce{
+		Threshold: threshold,
+		window:    ingest.NewWindow(window),
+	}
+}
+
+func (d *BruteForce) Name() string {
+	return "ssh-bruteforce"
+}
+
+func (d *BruteForce) Inspect(ev *eventmodel.Event) []*alertmodel.Alert {
+	if !failed(ev) || ev.SrcIp == "" {
+		return nil
+	}
+	evs := d.window.Add(ev.SrcIp, ev)
+	if len(evs) < d.Threshold {
+		return nil
+	}
+	d.window.Reset(ev.SrcIp)
+	return []*alertmodel.Alert{{
+		Rule:     d.Name(),
+		Severity: "high",
+		SrcIp:    ev.SrcIp,
+		Summary:  fmt.Sprintf("%d failed SSH logins from %s within %s", len(evs), ev.SrcIp, d.window.Size),
+		Events:   evs,
+	}}
+}
+
+// Spraying - Failed logins for Users distinct accounts from one source
+// inside Window, the signature of password spraying
+type Spraying struct {
+	Users  int
+	window *ingest.Window
+}
+
+func NewSpraying(users int, window time.Duration) *Spraying {
+	return &Spraying{
+		Users:  users,
+		window: ingest.NewWindow(window),
+	}
+}
+
+func (d *Spraying) Name() string {
+	return "ssh-password-spray"
+}
+
+func (d *Spraying) Inspect(ev *eventmodel.Event) []*alertmodel.Alert {
+	if !failed(ev) || ev.SrcIp == "" {
+		return nil
+	}
+	evs := d.window.Add(ev.SrcIp, ev)
+	users := map[string]bool{}
+	for _, e := range evs {
+		users[e.Username] = true
+	}
+	if len(users) < d.Users {
+		return nil
+	}
+	d.window.Reset(ev.SrcIp)
+	return []*alertmodel.Alert{{
+		Rule:     d.Name(),
+		Severity: "high",
+		SrcIp:    ev.SrcIp,
+		Summary:  fmt.Sprintf("Failed SSH logins for %d accounts from %s within %s", len(users), ev.SrcIp, d.window.Size),
+		Events:   evs,
+	}}
+}
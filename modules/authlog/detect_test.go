@@ -0,0 +1,33 @@
+package authlog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBruteForceCounts(t *testing.T) {
+	now := time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC)
+	lines := []string{
+		"Jan 10 08:00:01 gw sshd[101]: Invalid user admin from 203.0.113.5 port 40001",
+		"Jan 10 08:00:02 gw sshd[101]: Failed password for invalid user admin from 203.0.113.5 port 40001 ssh2",
+		"Jan 10 08:00:03 gw sshd[101]: Failed password for invalid user admin from 203.0.113.5 port 40001 ssh2",
+		"Jan 10 08:00:04 gw sshd[102]: Invalid user guest from 203.0.113.5 port 40002",
+		"Jan 10 08:00:05 gw sshd[102]: Failed password for invalid user guest from 203.0.113.5 port 40002 ssh2",
+		"Jan 10 08:00:06 gw sshd[103]: Failed password for root from 203.0.113.5 port 40003 ssh2",
+	}
+	d := NewBruteForce(4, time.Hour)
+	for i, line := range lines {
+		a, err := Parse(line, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := a.ToEvent()
+		alerts := d.Inspect(&ev)
+		if last := i == len(lines)-1; (len(alerts) > 0) != last {
+			t.Fatalf("line %d: %d alerts", i, len(alerts))
+		}
+		if len(alerts) > 0 && len(alerts[0].Events) != 4 {
+			t.Errorf("%d attempts: %s", len(alerts[0].Events), alerts[0].Summary)
+		}
+	}
+}
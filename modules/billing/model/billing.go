@@ -0,0 +1,556 @@
+// Package billing - Invoices per subscriber and billing cycle from the plan
+// price, payments and overdue handling
+package billingmodel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rbaylon/arkgate/database"
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+// Invoice states. Credit is an invoice whose total is not positive, a
+// downgrade refund that is settled by hand.
+const (
+	StatusOpen    = "open"
+	StatusPaid    = "paid"
+	StatusOverdue = "overdue"
+	StatusVoid    = "void"
+	StatusCredit  = "credit"
+)
+
+const (
+	DefaultCurrency = "USD"
+	DefaultPrefix   = "INV-"
+	DefaultDueDays  = 14
+	// maxCycles - Most cycles invoiced for one sub in one run
+	maxCycles = 24
+)
+
+var (
+	ErrClosed   = errors.New("invoice is not open")
+	ErrPayments = errors.New("invoice has payments")
+	ErrCurrency = errors.New("plans bill in different currencies")
+	// errBilled - The cycle was invoiced concurrently
+	errBilled = errors.New("billing cycle already invoiced")
+)
+
+// Invoice - Amounts are in the smallest unit of Currency
+type Invoice struct {
+	gorm.Model
+	Number      string    `json:"number" bson:"number" gorm:"index"`
+	SubID       uint      `json:"subid" bson:"subid" gorm:"index"`
+	Username    string    `json:"username" bson:"username"`
+	Currency    string    `json:"currency" bson:"currency"`
+	PeriodStart time.Time `json:"period_start" bson:"period_start"`
+	PeriodEnd   time.Time `json:"period_end" bson:"period_end"`
+	IssuedAt    time.Time `json:"issued_at" bson:"issued_at"`
+	DueAt       time.Time `json:"due_at" bson:"due_at" gorm:"index"`
+	Subtotal    int64     `json:"subtotal" bson:"subtotal"`
+	Tax         int64     `json:"tax" bson:"tax"`
+	Total       int64     `json:"total" bson:"total"`
+	Paid        int64     `json:"paid" bson:"paid"`
+	Status      string    `json:"status" bson:"status" gorm:"index"`
+	Lines       []Line    `json:"lines,omitempty"`
+	Payments    []Payment `json:"payments,omitempty"`
+}
+
+type Line struct {
+	gorm.Model
+	InvoiceID   uint   `json:"invoiceid" bson:"invoiceid" gorm:"index"`
+	PlanID      uint   `json:"planid" bson:"planid"`
+	Description string `json:"description" bson:"description"`
+	Amount      int64  `json:"amount" bson:"amount"`
+	Tax         int64  `json:"tax" bson:"tax"`
+}
+
+type Payment struct {
+	gorm.Model
+	InvoiceID  uint      `json:"invoiceid" bson:"invoiceid" gorm:"index"`
+	SubID      uint      `json:"subid" bson:"subid" gorm:"index"`
+	Amount     int64     `json:"amount" bson:"amount"`
+	Method     string    `json:"method" bson:"method"`
+	Reference  string    `json:"reference" bson:"reference"`
+	PaidAt     time.Time `json:"paid_at" bson:"paid_at"`
+	RecordedBy string    `json:"recordedby" bson:"recordedby"`
+}
+
+// Filter - Query parameters accepted by Storage.GetInvoices
+type Filter struct {
+	SubID  uint
+	Status string
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Invoice{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Line{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Payment{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Payment) Bind(r *http.Request) error {
+	if a.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if a.PaidAt.IsZero() {
+		a.PaidAt = time.Now()
+	}
+	return nil
+}
+
+// Money - Amount in minor units as a decimal with two places
+func Money(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// taxOf - Tax at rate percent of amount, rounded to the minor unit
+func taxOf(amount int64, rate float64) int64 {
+	return int64(math.Round(float64(amount) * rate / 100))
+}
+
+type Crud interface {
+	GetInvoices(f *Filter) ([]Invoice, error)
+	GetInvoice(id uint) (*Invoice, error)
+	GetPayments(subid uint) ([]Payment, error)
+	Bill(now time.Time) ([]Invoice, error)
+	BillSub(sub *submodel.Sub, now time.Time) ([]Invoice, error)
+	ChangePlan(sub *submodel.Sub, oldPlanID uint, now time.Time) (*Invoice, error)
+	Pay(inv *Invoice, p *Payment) error
+	Void(inv *Invoice) error
+	Overdue(now time.Time) error
+	PDF(w io.Writer, inv *Invoice) error
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB     *gorm.DB
+	Subs   submodel.Crud
+	Plans  planmodel.Crud
+	Expiry *expiry.Scheduler
+	// Currency - Of plans without one, from BILLING_CURRENCY
+	Currency string
+	// Prefix - Of invoice numbers, from BILLING_PREFIX
+	Prefix string
+	// DueDays - Days from issue to due date, from BILLING_DUE_DAYS
+	DueDays int
+	// Issuer - Name printed on invoices, from BILLING_ISSUER
+	Issuer string
+	// AutoSuspend - Suspend subs with invoices overdue for longer than
+	// SuspendGrace until they are paid or voided
+	AutoSuspend  bool
+	SuspendGrace time.Duration
+}
+
+func New(db *gorm.DB) *Storage {
+	subs := submodel.New(db)
+	plans := planmodel.New(db)
+	s := &Storage{
+		DB:       db,
+		Subs:     subs,
+		Plans:    plans,
+		Expiry:   expiry.New(subs, plans),
+		Currency: database.GetEnvVariable("BILLING_CURRENCY"),
+		Prefix:   database.GetEnvVariable("BILLING_PREFIX"),
+		DueDays:  DefaultDueDays,
+		Issuer:   database.GetEnvVariable("BILLING_ISSUER"),
+	}
+	if s.Currency == "" {
+		s.Currency = DefaultCurrency
+	}
+	if s.Prefix == "" {
+		s.Prefix = DefaultPrefix
+	}
+	if days, err := strconv.Atoi(database.GetEnvVariable("BILLING_DUE_DAYS")); err == nil && days >= 0 {
+		s.DueDays = days
+	}
+	return s
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+// PDF - Printable invoice with the configured issuer
+func (s *Storage) PDF(w io.Writer, inv *Invoice) error {
+	return WritePDF(w, inv, s.Issuer)
+}
+
+func (s *Storage) GetInvoices(f *Filter) ([]Invoice, error) {
+	var invoices []Invoice
+	q := s.DB.Order("id desc")
+	if f.SubID != 0 {
+		q = q.Where("sub_id = ?", f.SubID)
+	}
+	if f.Status != "" {
+		q = q.Where("status = ?", f.Status)
+	}
+	result := q.Find(&invoices)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return invoices, nil
+}
+
+// GetInvoice - Invoice with its lines and payments
+func (s *Storage) GetInvoice(id uint) (*Invoice, error) {
+	var inv Invoice
+	result := s.DB.Preload("Lines").Preload("Payments").First(&inv, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &inv, nil
+}
+
+func (s *Storage) GetPayments(subid uint) ([]Payment, error) {
+	var payments []Payment
+	q := s.DB.Order("paid_at desc")
+	if subid != 0 {
+		q = q.Where("sub_id = ?", subid)
+	}
+	result := q.Find(&payments)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return payments, nil
+}
+
+func (s *Storage) currency(plan *planmodel.Plan) string {
+	if plan.Currency != "" {
+		return plan.Currency
+	}
+	return s.Currency
+}
+
+// line - Invoice line of amount with the plan's tax
+func line(plan *planmodel.Plan, desc string, amount int64) Line {
+	return Line{PlanID: plan.ID, Description: desc, Amount: amount, Tax: taxOf(amount, plan.TaxRate)}
+}
+
+func period(from, until time.Time) string {
+	return fmt.Sprintf("%s - %s", from.Format(time.DateOnly), until.Format(time.DateOnly))
+}
+
+// create - Total, number and store inv with its lines and move the sub's
+// billed period to until in the same transaction
+func (s *Storage) create(inv *Invoice, sub *submodel.Sub, from *time.Time, until time.Time, now time.Time) error {
+	inv.ID = 0
+	inv.SubID = sub.ID
+	inv.Username = sub.Username
+	inv.IssuedAt = now
+	inv.DueAt = now.AddDate(0, 0, s.DueDays)
+	inv.Subtotal, inv.Tax = 0, 0
+	for _, l := range inv.Lines {
+		inv.Subtotal += l.Amount
+		inv.Tax += l.Tax
+	}
+	inv.Total = inv.Subtotal + inv.Tax
+	inv.Status = StatusOpen
+	if inv.Total <= 0 {
+		inv.Status = StatusCredit
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(inv).Error; err != nil {
+			return err
+		}
+		inv.Number = fmt.Sprintf("%s%06d", s.Prefix, inv.ID)
+		if err := tx.Model(inv).Update("number", inv.Number).Error; err != nil {
+			return err
+		}
+		return advance(tx, sub.ID, from, until)
+	})
+}
+
+// advance - Move the billed cycle of a sub from from to until. Only the
+// billing column is written as the sub is updated elsewhere concurrently,
+// and only if nobody moved it meanwhile, errBilled otherwise.
+func advance(tx *gorm.DB, subid uint, from *time.Time, until time.Time) error {
+	q := tx.Model(&submodel.Sub{}).Where("id = ?", subid)
+	if from == nil {
+		q = q.Where("billed_until IS NULL")
+	} else {
+		// Compared as instants, stored values may carry any zone offset
+		q = q.Where("julianday(billed_until) = julianday(?)", from.UTC())
+	}
+	result := q.Update("billed_until", until.UTC())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errBilled
+	}
+	return nil
+}
+
+// Bill - Invoice every sub whose billing cycle started
+func (s *Storage) Bill(now time.Time) ([]Invoice, error) {
+	subs, err := s.Subs.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	invoices := []Invoice{}
+	for i := range subs {
+		res, err := s.BillSub(&subs[i], now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subs[i].Username, err))
+		}
+		invoices = append(invoices, res...)
+	}
+	return invoices, errors.Join(errs...)
+}
+
+// BillSub - Invoice the cycles of sub that started by now, in advance. The
+// first cycle starts now and carries the setup fee. Subs suspended for
+// overdue invoices keep being billed, inactive ones are not.
+func (s *Storage) BillSub(sub *submodel.Sub, now time.Time) ([]Invoice, error) {
+	if sub.PlanID == 0 || !sub.IsActive && !sub.BillingHold {
+		return nil, nil
+	}
+	plan, err := s.Plans.GetById(sub.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Price == 0 && plan.SetupFee == 0 {
+		return nil, nil
+	}
+	var invoices []Invoice
+	for n := 0; n < maxCycles && (sub.BilledUntil == nil || !sub.BilledUntil.After(now)); n++ {
+		inv := Invoice{Currency: s.currency(plan)}
+		inv.PeriodStart = now
+		if sub.BilledUntil != nil {
+			inv.PeriodStart = *sub.BilledUntil
+		} else if plan.SetupFee > 0 {
+			inv.Lines = append(inv.Lines, line(plan, "Setup fee "+plan.Name, plan.SetupFee))
+		}
+		inv.PeriodEnd = plan.Next(inv.PeriodStart)
+		if plan.Price > 0 {
+			inv.Lines = append(inv.Lines, line(plan, fmt.Sprintf("%s %s", plan.Name, period(inv.PeriodStart, inv.PeriodEnd)), plan.Price))
+		}
+		var err error
+		if len(inv.Lines) > 0 {
+			if err = s.create(&inv, sub, sub.BilledUntil, inv.PeriodEnd, now); err == nil {
+				invoices = append(invoices, inv)
+			}
+		} else {
+			err = advance(s.DB, sub.ID, sub.BilledUntil, inv.PeriodEnd)
+		}
+		if errors.Is(err, errBilled) {
+			// Billed by a concurrent run, which carries on from here
+			return invoices, nil
+		} else if err != nil {
+			return invoices, err
+		}
+		end := inv.PeriodEnd
+		sub.BilledUntil = &end
+	}
+	return invoices, nil
+}
+
+// ChangePlan - Prorate a plan change in the middle of an invoiced cycle: the
+// unused rest of the old plan is credited and the new plan charged for the
+// same time. The cycle still ends at BilledUntil, later cycles bill the new
+// plan. Nil when there is nothing to prorate.
+func (s *Storage) ChangePlan(sub *submodel.Sub, oldPlanID uint, now time.Time) (*Invoice, error) {
+	if oldPlanID == sub.PlanID || oldPlanID == 0 || sub.BilledUntil == nil || !sub.BilledUntil.After(now) {
+		return nil, nil
+	}
+	old, err := s.Plans.GetById(oldPlanID)
+	if err != nil {
+		return nil, err
+	}
+	end := *sub.BilledUntil
+	start := old.Prev(end)
+	if start.After(now) {
+		start = now
+	}
+	share := float64(end.Sub(now)) / float64(end.Sub(start))
+	prorate := func(amount int64) int64 {
+		return int64(math.Round(float64(amount) * share))
+	}
+	inv := Invoice{Currency: s.currency(old), PeriodStart: now, PeriodEnd: end}
+	if old.Price > 0 {
+		inv.Lines = append(inv.Lines, line(old, fmt.Sprintf("Unused %s %s", old.Name, period(now, end)), -prorate(old.Price)))
+	}
+	if sub.PlanID != 0 {
+		plan, err := s.Plans.GetById(sub.PlanID)
+		if err != nil {
+			return nil, err
+		}
+		if plan.Price > 0 {
+			if s.currency(plan) != inv.Currency && len(inv.Lines) > 0 {
+				return nil, ErrCurrency
+			}
+			inv.Currency = s.currency(plan)
+			inv.Lines = append(inv.Lines, line(plan, fmt.Sprintf("%s %s", plan.Name, period(now, end)), prorate(plan.Price)))
+		}
+	}
+	if len(inv.Lines) == 0 {
+		return nil, nil
+	}
+	if err := s.create(&inv, sub, sub.BilledUntil, end, now); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Pay - Record a payment against an open or overdue invoice, a fully paid
+// invoice lifts the sub's billing hold once nothing else is overdue
+func (s *Storage) Pay(inv *Invoice, p *Payment) error {
+	if inv.Status != StatusOpen && inv.Status != StatusOverdue {
+		return ErrClosed
+	}
+	p.ID = 0
+	p.InvoiceID = inv.ID
+	p.SubID = inv.SubID
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// Added in the DB, inv may be stale when payments come in concurrently
+		result := tx.Model(&Invoice{}).Where("id = ? AND status IN ?", inv.ID, []string{StatusOpen, StatusOverdue}).
+			Updates(map[string]interface{}{
+				"paid":   gorm.Expr("paid + ?", p.Amount),
+				"status": gorm.Expr("CASE WHEN paid + ? >= total THEN ? ELSE status END", p.Amount, StatusPaid),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrClosed
+		}
+		if err := tx.Create(p).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Invoice{}).Select("paid, status").Where("id = ?", inv.ID).Row().Scan(&inv.Paid, &inv.Status)
+	})
+	if err != nil {
+		return err
+	}
+	inv.Payments = append(inv.Payments, *p)
+	if inv.Status == StatusPaid {
+		return s.release(inv.SubID)
+	}
+	return nil
+}
+
+// Void - Cancel an invoice nothing was paid on. Decided in the DB, a
+// payment may come in after inv was read.
+func (s *Storage) Void(inv *Invoice) error {
+	result := s.DB.Model(&Invoice{}).
+		Where("id = ? AND paid = 0 AND status IN ?", inv.ID, []string{StatusOpen, StatusOverdue, StatusCredit}).
+		Update("status", StatusVoid)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := s.DB.Model(&Invoice{}).Select("paid, status").Where("id = ?", inv.ID).Row().Scan(&inv.Paid, &inv.Status); err != nil {
+			return err
+		}
+		if inv.Status == StatusVoid || inv.Status == StatusPaid || inv.Paid == 0 {
+			return ErrClosed
+		}
+		return ErrPayments
+	}
+	inv.Status = StatusVoid
+	return s.release(inv.SubID)
+}
+
+// Run - Invoice due cycles and handle overdue invoices every interval
+func (s *Storage) Run(interval time.Duration) {
+	for {
+		now := time.Now()
+		if _, err := s.Bill(now); err != nil {
+			log.Println("Billing error: ", err)
+		}
+		if err := s.Overdue(now); err != nil {
+			log.Println("Billing overdue error: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Overdue - Mark open invoices past their due date overdue and, with
+// AutoSuspend, suspend their subs once SuspendGrace has passed as well
+func (s *Storage) Overdue(now time.Time) error {
+	result := s.DB.Model(&Invoice{}).Where("status = ? AND due_at < ?", StatusOpen, now).Update("status", StatusOverdue)
+	if result.Error != nil {
+		return result.Error
+	}
+	if !s.AutoSuspend {
+		return nil
+	}
+	var ids []uint
+	result = s.DB.Model(&Invoice{}).Where("status = ? AND due_at < ?", StatusOverdue, now.Add(-s.SuspendGrace)).
+		Distinct().Pluck("sub_id", &ids)
+	if result.Error != nil {
+		return result.Error
+	}
+	var errs []error
+	suspended := false
+	for _, id := range ids {
+		sub, err := s.Subs.GetById(id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !sub.IsActive || sub.BillingHold {
+			continue
+		}
+		sub.BillingHold = true
+		if err := s.Expiry.Deactivate(sub); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.Username, err))
+		}
+		suspended = true
+	}
+	if suspended {
+		if err := npppdmodel.New(s.DB).WriteConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// release - Lift the billing hold of a sub without overdue invoices left,
+// it is only reactivated if its subscription has not expired meanwhile
+func (s *Storage) release(subid uint) error {
+	sub, err := s.Subs.GetById(subid)
+	if err != nil || !sub.BillingHold {
+		return err
+	}
+	var n int64
+	if err := s.DB.Model(&Invoice{}).Where("sub_id = ? AND status = ?", subid, StatusOverdue).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	sub.BillingHold = false
+	if sub.ExpiresAt != nil && !sub.ExpiresAt.After(time.Now()) {
+		return s.Subs.Update(sub)
+	}
+	return s.Expiry.Reactivate(sub)
+}
@@ -0,0 +1,249 @@
+package billingmodel
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testStorage - Billing over an in-memory DB, in a directory with an empty
+// .env so the npppd files and the control socket stay in it
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/.env", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("NPPPD_CONF", dir+"/npppd.conf")
+	t.Setenv("NPPPD_USERS", dir+"/npppd-users")
+	t.Setenv("SRV_SOCKET", dir+"/srv.sock")
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	submodel.MigrateDB(db)
+	planmodel.MigrateDB(db)
+	subs, plans := submodel.New(db), planmodel.New(db)
+	return &Storage{
+		DB:       db,
+		Subs:     subs,
+		Plans:    plans,
+		Expiry:   &expiry.Scheduler{Subs: subs, Plans: plans, Table: expiry.DefaultTable},
+		Currency: DefaultCurrency,
+		Prefix:   DefaultPrefix,
+		DueDays:  DefaultDueDays,
+	}
+}
+
+func testSub(t *testing.T, s *Storage, plan *planmodel.Plan) *submodel.Sub {
+	t.Helper()
+	if err := s.DB.Create(plan).Error; err != nil {
+		t.Fatal(err)
+	}
+	sub := &submodel.Sub{Username: "bob", IsActive: true, PlanID: plan.ID}
+	if err := s.DB.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+var jan = time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+
+func TestBillSub(t *testing.T) {
+	tests := []struct {
+		name   string
+		plan   planmodel.Plan
+		billed *time.Time // billed until before the run
+		totals []int64
+		until  time.Time
+	}{
+		{"first cycle with setup fee", planmodel.Plan{Price: 1000, SetupFee: 500, TaxRate: 10}, nil, []int64{1650}, jan.AddDate(0, 1, 0)},
+		{"setup fee only", planmodel.Plan{SetupFee: 500}, nil, []int64{500}, jan.AddDate(0, 1, 0)},
+		{"cycle not started", planmodel.Plan{Price: 1000}, ptr(jan.Add(time.Hour)), nil, jan.Add(time.Hour)},
+		{"missed cycles", planmodel.Plan{Price: 700, Cycle: planmodel.CycleWeekly}, ptr(jan.AddDate(0, 0, -15)), []int64{700, 700, 700}, jan.AddDate(0, 0, 6)},
+		{"duration cycle", planmodel.Plan{Price: 300, Cycle: planmodel.CycleDuration, Duration: 30}, ptr(jan), []int64{300}, jan.AddDate(0, 0, 30)},
+		{"free plan", planmodel.Plan{}, nil, nil, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStorage(t)
+			sub := testSub(t, s, &tt.plan)
+			sub.BilledUntil = tt.billed
+			s.DB.Save(sub)
+			invoices, err := s.BillSub(sub, jan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(invoices) != len(tt.totals) {
+				t.Fatalf("%d invoices", len(invoices))
+			}
+			for i, inv := range invoices {
+				if inv.Total != tt.totals[i] || inv.Status != StatusOpen {
+					t.Errorf("invoice %d: %+v", i, inv)
+				}
+				if i > 0 && !inv.PeriodStart.Equal(invoices[i-1].PeriodEnd) {
+					t.Errorf("invoice %d starts %v", i, inv.PeriodStart)
+				}
+			}
+			got, _ := s.Subs.GetById(sub.ID)
+			if tt.until.IsZero() && got.BilledUntil != nil || !tt.until.IsZero() && (got.BilledUntil == nil || !got.BilledUntil.Equal(tt.until)) {
+				t.Errorf("billed until %v, want %v", got.BilledUntil, tt.until)
+			}
+
+			// A second run finds nothing to bill
+			if again, err := s.BillSub(got, jan); err != nil || len(again) != 0 {
+				t.Errorf("billed again %d, %v", len(again), err)
+			}
+		})
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestChangePlan(t *testing.T) {
+	start := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC) // 30 day cycle
+	tests := []struct {
+		name  string
+		old   planmodel.Plan
+		new   planmodel.Plan
+		at    time.Time
+		lines []int64
+		total int64
+		state string
+	}{
+		{"upgrade half way", planmodel.Plan{Price: 3000}, planmodel.Plan{Price: 6000}, start.AddDate(0, 0, 15), []int64{-1500, 3000}, 1500, StatusOpen},
+		{"downgrade with tax", planmodel.Plan{Price: 3000, TaxRate: 10}, planmodel.Plan{Price: 1500, TaxRate: 10}, start.AddDate(0, 0, 20), []int64{-1000, 500}, -550, StatusCredit},
+		{"to a free plan", planmodel.Plan{Price: 3000}, planmodel.Plan{}, start.AddDate(0, 0, 27), []int64{-300}, -300, StatusCredit},
+		{"after the cycle", planmodel.Plan{Price: 3000}, planmodel.Plan{Price: 6000}, start.AddDate(0, 1, 0), nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStorage(t)
+			sub := testSub(t, s, &tt.old)
+			s.DB.Create(&tt.new)
+			until := start.AddDate(0, 1, 0)
+			sub.BilledUntil = &until
+			s.DB.Save(sub)
+			sub.PlanID = tt.new.ID
+			inv, err := s.ChangePlan(sub, tt.old.ID, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.lines == nil {
+				if inv != nil {
+					t.Errorf("prorated %+v", inv)
+				}
+				return
+			}
+			if inv == nil || len(inv.Lines) != len(tt.lines) {
+				t.Fatalf("invoice %+v", inv)
+			}
+			for i, l := range inv.Lines {
+				if l.Amount != tt.lines[i] {
+					t.Errorf("line %d: %d, want %d", i, l.Amount, tt.lines[i])
+				}
+			}
+			if inv.Total != tt.total || inv.Status != tt.state || !inv.PeriodEnd.Equal(until) {
+				t.Errorf("invoice %+v", inv)
+			}
+			got, _ := s.Subs.GetById(sub.ID)
+			if !got.BilledUntil.Equal(until) {
+				t.Errorf("billed until %v", got.BilledUntil)
+			}
+		})
+	}
+}
+
+func TestOverdue(t *testing.T) {
+	tests := []struct {
+		name        string
+		autoSuspend bool
+		overdueFor  time.Duration
+		suspended   bool
+	}{
+		{"within grace", true, 12 * time.Hour, false},
+		{"past grace", true, 48 * time.Hour, true},
+		{"no auto suspend", false, 48 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStorage(t)
+			s.AutoSuspend, s.SuspendGrace = tt.autoSuspend, 24*time.Hour
+			sub := testSub(t, s, &planmodel.Plan{Price: 1000})
+			invoices, err := s.BillSub(sub, jan)
+			if err != nil || len(invoices) != 1 {
+				t.Fatalf("%d invoices, %v", len(invoices), err)
+			}
+			inv := &invoices[0]
+			now := inv.DueAt.Add(tt.overdueFor)
+			// Unblocking through the missing control socket fails
+			s.Overdue(now)
+			got, _ := s.GetInvoice(inv.ID)
+			if got.Status != StatusOverdue {
+				t.Errorf("status %s", got.Status)
+			}
+			subnow, _ := s.Subs.GetById(sub.ID)
+			if subnow.BillingHold != tt.suspended || subnow.IsActive == tt.suspended {
+				t.Fatalf("hold %v, active %v", subnow.BillingHold, subnow.IsActive)
+			}
+			if !tt.suspended {
+				return
+			}
+
+			// Paying in full lifts the hold
+			if err := s.Pay(got, &Payment{Amount: got.Total}); err != nil {
+				t.Fatal(err)
+			}
+			subnow, _ = s.Subs.GetById(sub.ID)
+			if subnow.BillingHold || !subnow.IsActive {
+				t.Errorf("hold %v, active %v after payment", subnow.BillingHold, subnow.IsActive)
+			}
+		})
+	}
+}
+
+func TestVoid(t *testing.T) {
+	s := testStorage(t)
+	sub := testSub(t, s, &planmodel.Plan{Price: 1000})
+	invoices, _ := s.BillSub(sub, jan)
+	stale := invoices[0]
+	inv, _ := s.GetInvoice(stale.ID)
+	if err := s.Pay(inv, &Payment{Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// Read before the payment
+	if err := s.Void(&stale); !errors.Is(err, ErrPayments) {
+		t.Errorf("voided a paid on invoice: %v", err)
+	}
+	if got, _ := s.GetInvoice(stale.ID); got.Status != StatusOpen {
+		t.Errorf("status %s", got.Status)
+	}
+
+	credit := Invoice{SubID: sub.ID, Total: -100, Status: StatusCredit}
+	s.DB.Create(&credit)
+	if err := s.Void(&credit); err != nil || credit.Status != StatusVoid {
+		t.Errorf("credit %s, %v", credit.Status, err)
+	}
+	if err := s.Void(&credit); !errors.Is(err, ErrClosed) {
+		t.Errorf("voided twice: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package billingmodel
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rbaylon/arkgate/modules/localutils/pdf"
+)
+
+// WriteCSV - One row per invoice, amounts as decimals
+func WriteCSV(w io.Writer, invoices []Invoice) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"number", "subid", "username", "currency", "period_start", "period_end", "issued_at", "due_at",
+		"subtotal", "tax", "total", "paid", "status"})
+	for _, inv := range invoices {
+		cw.Write([]string{inv.Number, strconv.FormatUint(uint64(inv.SubID), 10), inv.Username, inv.Currency,
+			inv.PeriodStart.Format(time.DateOnly), inv.PeriodEnd.Format(time.DateOnly),
+			inv.IssuedAt.Format(time.DateOnly), inv.DueAt.Format(time.DateOnly),
+			Money(inv.Subtotal), Money(inv.Tax), Money(inv.Total), Money(inv.Paid), inv.Status})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteLinesCSV - The lines of a loaded invoice
+func WriteLinesCSV(w io.Writer, inv *Invoice) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"number", "description", "currency", "amount", "tax"})
+	for _, l := range inv.Lines {
+		cw.Write([]string{inv.Number, l.Description, inv.Currency, Money(l.Amount), Money(l.Tax)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePDF - Printable invoice of a loaded invoice, issuer is printed in the
+// heading when set
+func WritePDF(w io.Writer, inv *Invoice, issuer string) error {
+	const left, right = 56, pdf.Width - 56
+	doc := &pdf.Document{}
+	y := float64(pdf.Height - 72)
+	next := func(dy float64) {
+		y -= dy
+		if y < 72 {
+			doc.Page()
+			y = pdf.Height - 72
+		}
+	}
+	if issuer != "" {
+		doc.Text(pdf.Bold, 14, left, y, issuer)
+	}
+	doc.TextRight(pdf.Bold, 20, right, y, "INVOICE")
+	next(36)
+	for _, kv := range [][2]string{
+		{"Invoice", inv.Number},
+		{"Subscriber", inv.Username},
+		{"Period", period(inv.PeriodStart, inv.PeriodEnd)},
+		{"Issued", inv.IssuedAt.Format(time.DateOnly)},
+		{"Due", inv.DueAt.Format(time.DateOnly)},
+		{"Status", inv.Status},
+	} {
+		doc.Text(pdf.Bold, 10, left, y, kv[0])
+		doc.Text(pdf.Regular, 10, left+90, y, kv[1])
+		next(16)
+	}
+	next(16)
+	doc.Text(pdf.Bold, 10, left, y, "Description")
+	doc.TextRight(pdf.Bold, 10, right-90, y, "Tax")
+	doc.TextRight(pdf.Bold, 10, right, y, "Amount")
+	doc.Line(left, y-6, right, y-6)
+	next(22)
+	for _, l := range inv.Lines {
+		doc.Text(pdf.Regular, 10, left, y, l.Description)
+		doc.TextRight(pdf.Regular, 10, right-90, y, Money(l.Tax))
+		doc.TextRight(pdf.Regular, 10, right, y, Money(l.Amount))
+		next(16)
+	}
+	doc.Line(left, y+8, right, y+8)
+	next(8)
+	for _, kv := range [][2]string{
+		{"Subtotal", Money(inv.Subtotal)},
+		{"Tax", Money(inv.Tax)},
+		{"Total " + inv.Currency, Money(inv.Total)},
+		{"Paid", Money(inv.Paid)},
+		{"Balance due", Money(inv.Total - inv.Paid)},
+	} {
+		doc.Text(pdf.Bold, 10, right-200, y, kv[0])
+		doc.TextRight(pdf.Regular, 10, right, y, kv[1])
+		next(16)
+	}
+	if len(inv.Payments) > 0 {
+		next(16)
+		doc.Text(pdf.Bold, 10, left, y, "Payments")
+		next(16)
+		for _, p := range inv.Payments {
+			doc.Text(pdf.Regular, 10, left, y, fmt.Sprintf("%s  %s %s", p.PaidAt.Format(time.DateOnly), p.Method, p.Reference))
+			doc.TextRight(pdf.Regular, 10, right, y, Money(p.Amount))
+			next(16)
+		}
+	}
+	_, err := doc.WriteTo(w)
+	return err
+}
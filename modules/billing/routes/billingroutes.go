@@ -0,0 +1,271 @@
+// Package billingroutes - Arkgate API billing module
+//
+// Invoices are generated per sub and billing cycle from the plan price,
+// amounts are in the smallest currency unit (cents).
+//
+//	Module Routes:
+//	  /api/v1/billing/invoices
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: subid, status (open, paid, overdue, void or credit)
+//	    Return: JSON object with list of invoice objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/invoices/export
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: subid, status
+//	    Return: CSV of the invoices
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/invoices/generate
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of the invoices generated for every
+//	            sub whose billing cycle started
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/billing/invoices/<invoiceId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON invoice object with lines and payments
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/invoices/<invoiceId>/export?format=pdf|csv
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: Printable PDF invoice (default) or CSV of its lines
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/invoices/<invoiceId>/pay
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON payment object with amount, method, reference and paid_at
+//	          (default now)
+//	    Return: JSON invoice object, paid once the payments cover the total
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   409 on Invoice not open
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/invoices/<invoiceId>/void
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON invoice object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   409 on Invoice not open or with payments
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/subs/<subId>/bill
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of the invoices generated for the sub
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/billing/payments
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: subid
+//	    Return: JSON object with list of payment objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package billingroutes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	billingmodel "github.com/rbaylon/arkgate/modules/billing/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func BillingRouter(db billingmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	// filter - Invoice filter of the query, renders the error itself
+	filter := func(w http.ResponseWriter, r *http.Request) *billingmodel.Filter {
+		f := &billingmodel.Filter{Status: r.URL.Query().Get("status")}
+		if v := r.URL.Query().Get("subid"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", v), http.StatusBadRequest))
+				return nil
+			}
+			f.SubID = uint(id)
+		}
+		return f
+	}
+	// load - Invoice of the invoiceId URL parameter
+	load := func(w http.ResponseWriter, r *http.Request) *billingmodel.Invoice {
+		id, err := strconv.Atoi(chi.URLParam(r, "invoiceId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid invoice ID %s", chi.URLParam(r, "invoiceId")), http.StatusBadRequest))
+			return nil
+		}
+		inv, err := db.GetInvoice(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return nil
+		}
+		return inv
+	}
+	// closed - Render the error of a payment or void
+	closed := func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, billingmodel.ErrClosed) || errors.Is(err, billingmodel.ErrPayments) {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invoice not open", http.StatusConflict))
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+	}
+
+	r.Get("/invoices", func(w http.ResponseWriter, r *http.Request) {
+		f := filter(w, r)
+		if f == nil {
+			return
+		}
+		res, errdb := db.GetInvoices(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/invoices/export", func(w http.ResponseWriter, r *http.Request) {
+		f := filter(w, r)
+		if f == nil {
+			return
+		}
+		res, errdb := db.GetInvoices(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=invoices.csv")
+		if err := billingmodel.WriteCSV(w, res); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Export error", http.StatusInternalServerError))
+		}
+	})
+	r.Post("/invoices/generate", func(w http.ResponseWriter, r *http.Request) {
+		res, err := db.Bill(time.Now())
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Billing error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/invoices/{invoiceId}", func(w http.ResponseWriter, r *http.Request) {
+		if inv := load(w, r); inv != nil {
+			render.JSON(w, r, inv)
+		}
+	})
+	r.Get("/invoices/{invoiceId}/export", func(w http.ResponseWriter, r *http.Request) {
+		inv := load(w, r)
+		if inv == nil {
+			return
+		}
+		var err error
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", inv.Number))
+			err = db.PDF(w, inv)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", inv.Number))
+			err = billingmodel.WriteLinesCSV(w, inv)
+		default:
+			render.Render(w, r, utils.ErrInvalidRequest(fmt.Errorf("unknown format %s", format), "Invalid format", http.StatusBadRequest))
+			return
+		}
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Export error", http.StatusInternalServerError))
+		}
+	})
+	r.Post("/invoices/{invoiceId}/pay", func(w http.ResponseWriter, r *http.Request) {
+		inv := load(w, r)
+		if inv == nil {
+			return
+		}
+		p := &billingmodel.Payment{}
+		if err := render.Bind(r, p); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		p.RecordedBy = security.Username(r)
+		if err := db.Pay(inv, p); err != nil {
+			closed(w, r, err)
+			return
+		}
+		render.JSON(w, r, inv)
+	})
+	r.Post("/invoices/{invoiceId}/void", func(w http.ResponseWriter, r *http.Request) {
+		inv := load(w, r)
+		if inv == nil {
+			return
+		}
+		if err := db.Void(inv); err != nil {
+			closed(w, r, err)
+			return
+		}
+		render.JSON(w, r, inv)
+	})
+	r.Post("/subs/{subId}/bill", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		sub, err := submodel.New(db.GetDB()).GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		res, err := db.BillSub(sub, time.Now())
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Billing error", http.StatusBadRequest))
+			return
+		}
+		if res == nil {
+			res = []billingmodel.Invoice{}
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/payments", func(w http.ResponseWriter, r *http.Request) {
+		f := filter(w, r)
+		if f == nil {
+			return
+		}
+		res, errdb := db.GetPayments(f.SubID)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	return r
+}
@@ -0,0 +1,616 @@
+// Package cases - Incident case specific functions
+package casemodel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	responsemodel "github.com/rbaylon/arkgate/modules/response/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	usermodel "github.com/rbaylon/arkgate/modules/users/model"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusOpen          = "open"
+	StatusInvestigating = "investigating"
+	StatusResolved      = "resolved"
+	StatusClosed        = "closed"
+
+	ActionBan     = "ban"     // ban Target through the response module
+	ActionUnban   = "unban"   // lift the active ban of Target
+	ActionSuspend = "suspend" // deactivate subscriber SubID
+	ActionResume  = "resume"  // reactivate subscriber SubID
+	ActionManual  = "manual"  // taken outside arkgate, recorded only
+)
+
+// Statuses - Valid case statuses
+var Statuses = map[string]bool{
+	StatusOpen:          true,
+	StatusInvestigating: true,
+	StatusResolved:      true,
+	StatusClosed:        true,
+}
+
+// Case - An investigation grouping alerts and events
+type Case struct {
+	gorm.Model
+	Title       string             `json:"title" bson:"title"`
+	Description string             `json:"description" bson:"description"`
+	Status      string             `json:"status" bson:"status" gorm:"index"`
+	Severity    string             `json:"severity" bson:"severity"`
+	AssigneeID  uint               `json:"assigneeid" bson:"assigneeid" gorm:"index"`
+	CreatedBy   string             `json:"created_by" bson:"created_by"`
+	ClosedAt    *time.Time         `json:"closed_at" bson:"closed_at"`
+	Alerts      []alertmodel.Alert `json:"alerts,omitempty" gorm:"many2many:case_alerts;"`
+	Events      []eventmodel.Event `json:"events,omitempty" gorm:"many2many:case_events;"`
+	Notes       []Note             `json:"notes,omitempty"`
+	Actions     []Action           `json:"actions,omitempty"`
+	History     []History          `json:"history,omitempty"`
+}
+
+// Note - Timeline note written by an analyst
+type Note struct {
+	gorm.Model
+	CaseID uint   `json:"caseid" bson:"caseid" gorm:"index"`
+	Author string `json:"author" bson:"author"`
+	Body   string `json:"body" bson:"body"`
+}
+
+// Action - Response action taken for a case. Ban, unban, suspend and resume
+// are carried out when recorded, Error holds why one failed.
+type Action struct {
+	gorm.Model
+	CaseID uint   `json:"caseid" bson:"caseid" gorm:"index"`
+	Kind   string `json:"kind" bson:"kind"`
+	Target string `json:"target" bson:"target"` // address for ban and unban
+	SubID  uint   `json:"subid" bson:"subid"`   // subscriber for suspend and resume
+	TTL    int    `json:"ttl" bson:"ttl"`       // ban seconds, response default when 0
+	BanID  uint   `json:"banid" bson:"banid"`
+	Detail string `json:"detail" bson:"detail"`
+	Author string `json:"author" bson:"author"`
+	Error  string `json:"error" bson:"error"`
+}
+
+// History - One change to a case
+type History struct {
+	ID     uint      `json:"id" gorm:"primarykey"`
+	CaseID uint      `json:"caseid" bson:"caseid" gorm:"index"`
+	At     time.Time `json:"at" bson:"at"`
+	Author string    `json:"author" bson:"author"`
+	Field  string    `json:"field" bson:"field"`
+	Old    string    `json:"old" bson:"old"`
+	New    string    `json:"new" bson:"new"`
+}
+
+// Entry - One line of the case timeline
+type Entry struct {
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind"` // note, action, change, alert, event
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+}
+
+// Change - Body of a case update, fields left out are kept and an
+// assigneeid of 0 unassigns the case
+type Change struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Severity    string `json:"severity"`
+	AssigneeID  *uint  `json:"assigneeid"`
+}
+
+// Apply - Copy the fields given in the change to c
+func (a *Change) Apply(c *Case) {
+	if a.Title != "" {
+		c.Title = a.Title
+	}
+	if a.Description != "" {
+		c.Description = a.Description
+	}
+	if a.Status != "" {
+		c.Status = a.Status
+	}
+	if a.Severity != "" {
+		c.Severity = a.Severity
+	}
+	if a.AssigneeID != nil {
+		c.AssigneeID = *a.AssigneeID
+	}
+}
+
+// Link - Body of requests adding alerts or events to a case
+type Link struct {
+	Ids []uint `json:"ids"`
+}
+
+// Filter - Query parameters accepted by Storage.Find
+type Filter struct {
+	Status     string
+	AssigneeID uint
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Case{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Note{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Action{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&History{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Case) Bind(r *http.Request) error {
+	if a.Status != "" && !Statuses[a.Status] {
+		return fmt.Errorf("invalid status %q", a.Status)
+	}
+	if a.Severity != "" {
+		if _, ok := alertmodel.Severities[a.Severity]; !ok {
+			return fmt.Errorf("invalid severity %q", a.Severity)
+		}
+	}
+	return nil
+}
+
+// Bind interface as required by go-chi/render
+func (a *Change) Bind(r *http.Request) error {
+	return (&Case{Status: a.Status, Severity: a.Severity}).Bind(r)
+}
+
+// Bind interface as required by go-chi/render
+func (a *Link) Bind(r *http.Request) error {
+	if len(a.Ids) == 0 {
+		return errors.New("ids is required")
+	}
+	return nil
+}
+
+// Bind interface as required by go-chi/render
+func (a *Note) Bind(r *http.Request) error {
+	if a.Body == "" {
+		return errors.New("body is required")
+	}
+	return nil
+}
+
+// Bind interface as required by go-chi/render
+func (a *Action) Bind(r *http.Request) error {
+	switch a.Kind {
+	case ActionBan, ActionUnban:
+		if a.Target == "" {
+			return fmt.Errorf("%s needs a target address", a.Kind)
+		}
+	case ActionSuspend, ActionResume:
+		if a.SubID == 0 {
+			return fmt.Errorf("%s needs a subid", a.Kind)
+		}
+	case ActionManual:
+		if a.Detail == "" {
+			return errors.New("manual actions need a detail")
+		}
+	default:
+		return fmt.Errorf("invalid action %q, use ban, unban, suspend, resume or manual", a.Kind)
+	}
+	return nil
+}
+
+type Crud interface {
+	Find(f *Filter) ([]Case, error)
+	GetById(uid uint) (*Case, error)
+	Add(c *Case) error
+	Update(c *Case, author string) error
+	Delete(c *Case) error
+	AddAlerts(c *Case, ids []uint, author string) error
+	RemoveAlert(c *Case, id uint, author string) error
+	AddEvents(c *Case, ids []uint, author string) error
+	RemoveEvent(c *Case, id uint, author string) error
+	AddNote(c *Case, note *Note) error
+	TakeAction(c *Case, action *Action) error
+	Timeline(c *Case) []Entry
+	Report(c *Case) (string, error)
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+	// Bans and Subs carry out response actions, actions of a missing
+	// store are refused
+	Bans responsemodel.Crud
+	Subs submodel.Crud
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) Find(f *Filter) ([]Case, error) {
+	var cases []Case
+	q := s.DB.Order("updated_at desc")
+	if f.Status != "" {
+		q = q.Where("status = ?", f.Status)
+	}
+	if f.AssigneeID != 0 {
+		q = q.Where("assignee_id = ?", f.AssigneeID)
+	}
+	result := q.Find(&cases)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return cases, nil
+}
+
+func (s *Storage) GetById(id uint) (*Case, error) {
+	var c Case
+	result := s.DB.Preload("Alerts").Preload("Events").
+		Preload("Notes", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Preload("Actions", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Preload("History", func(db *gorm.DB) *gorm.DB { return db.Order("at") }).
+		First(&c, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &c, nil
+}
+
+func (s *Storage) checkAssignee(id uint) error {
+	if id == 0 {
+		return nil
+	}
+	var user usermodel.User
+	if err := s.DB.First(&user, id).Error; err != nil {
+		return fmt.Errorf("assignee %d: %w", id, err)
+	}
+	return nil
+}
+
+func (s *Storage) Add(c *Case) error {
+	if c.Title == "" {
+		return errors.New("title is required")
+	}
+	if err := s.checkAssignee(c.AssigneeID); err != nil {
+		return err
+	}
+	if c.Status == "" {
+		c.Status = StatusOpen
+	}
+	if c.Severity == "" {
+		c.Severity = "medium"
+	}
+	c.Alerts, c.Events, c.Notes, c.Actions, c.History = nil, nil, nil, nil, nil
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(c).Error; err != nil {
+			return err
+		}
+		h := History{CaseID: c.ID, At: time.Now(), Author: c.CreatedBy, Field: "case", New: c.Title}
+		return tx.Create(&h).Error
+	})
+}
+
+// Update - Save the editable fields of a case, recording every changed
+// field in its history
+func (s *Storage) Update(c *Case, author string) error {
+	var old Case
+	if err := s.DB.First(&old, c.ID).Error; err != nil {
+		return err
+	}
+	if c.AssigneeID != old.AssigneeID {
+		if err := s.checkAssignee(c.AssigneeID); err != nil {
+			return err
+		}
+	}
+	if c.Status != old.Status {
+		if c.Status == StatusClosed {
+			now := time.Now()
+			c.ClosedAt = &now
+		} else {
+			c.ClosedAt = nil
+		}
+	}
+	now := time.Now()
+	var changes []History
+	change := func(field, o, n string) {
+		if o != n {
+			changes = append(changes, History{CaseID: c.ID, At: now, Author: author, Field: field, Old: o, New: n})
+		}
+	}
+	change("title", old.Title, c.Title)
+	change("description", old.Description, c.Description)
+	change("status", old.Status, c.Status)
+	change("severity", old.Severity, c.Severity)
+	change("assignee", strconv.Itoa(int(old.AssigneeID)), strconv.Itoa(int(c.AssigneeID)))
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Case{}).Where("id = ?", c.ID).Select("title", "description", "status", "severity", "assignee_id", "closed_at").
+			Updates(map[string]interface{}{
+				"title": c.Title, "description": c.Description, "status": c.Status,
+				"severity": c.Severity, "assignee_id": c.AssigneeID, "closed_at": c.ClosedAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(changes) > 0 {
+			return tx.Create(&changes).Error
+		}
+		return nil
+	})
+}
+
+// Delete - Soft delete a case with its notes and actions, the links to
+// alerts and events and the history stay with it so it can be restored
+func (s *Storage) Delete(c *Case) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("case_id = ?", c.ID).Delete(&Note{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("case_id = ?", c.ID).Delete(&Action{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(c).Error
+	})
+}
+
+func (s *Storage) record(c *Case, author, field, o, n string) error {
+	return s.DB.Create(&History{CaseID: c.ID, At: time.Now(), Author: author, Field: field, Old: o, New: n}).Error
+}
+
+func (s *Storage) AddAlerts(c *Case, ids []uint, author string) error {
+	var alerts []alertmodel.Alert
+	if err := s.DB.Find(&alerts, ids).Error; err != nil {
+		return err
+	}
+	if len(alerts) != len(ids) {
+		return fmt.Errorf("%d of %d alerts not found", len(ids)-len(alerts), len(ids))
+	}
+	if err := s.DB.Model(c).Association("Alerts").Append(alerts); err != nil {
+		return err
+	}
+	for _, a := range alerts {
+		if err := s.record(c, author, "alert", "", strconv.Itoa(int(a.ID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) RemoveAlert(c *Case, id uint, author string) error {
+	a := alertmodel.Alert{}
+	a.ID = id
+	if err := s.DB.Model(c).Association("Alerts").Delete(&a); err != nil {
+		return err
+	}
+	return s.record(c, author, "alert", strconv.Itoa(int(id)), "")
+}
+
+func (s *Storage) AddEvents(c *Case, ids []uint, author string) error {
+	var events []eventmodel.Event
+	if err := s.DB.Find(&events, ids).Error; err != nil {
+		return err
+	}
+	if len(events) != len(ids) {
+		return fmt.Errorf("%d of %d events not found", len(ids)-len(events), len(ids))
+	}
+	if err := s.DB.Model(c).Association("Events").Append(events); err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := s.record(c, author, "event", "", strconv.Itoa(int(ev.ID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) RemoveEvent(c *Case, id uint, author string) error {
+	ev := eventmodel.Event{}
+	ev.ID = id
+	if err := s.DB.Model(c).Association("Events").Delete(&ev); err != nil {
+		return err
+	}
+	return s.record(c, author, "event", strconv.Itoa(int(id)), "")
+}
+
+func (s *Storage) AddNote(c *Case, note *Note) error {
+	note.ID = 0
+	note.CaseID = c.ID
+	result := s.DB.Create(note)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// TakeAction - Carry out a response action and record it with its outcome.
+// Failed actions are recorded too and their error returned.
+func (s *Storage) TakeAction(c *Case, action *Action) error {
+	action.ID = 0
+	action.CaseID = c.ID
+	err := s.carryOut(c, action)
+	if err != nil {
+		action.Error = err.Error()
+	}
+	if dberr := s.DB.Create(action).Error; dberr != nil {
+		return dberr
+	}
+	return err
+}
+
+func (s *Storage) carryOut(c *Case, action *Action) error {
+	switch action.Kind {
+	case ActionBan, ActionUnban:
+		if s.Bans == nil {
+			return errors.New("active response is not configured")
+		}
+		if action.Kind == ActionBan {
+			reason := fmt.Sprintf("case %d: %s", c.ID, c.Title)
+			if action.Detail != "" {
+				reason = fmt.Sprintf("case %d: %s", c.ID, action.Detail)
+			}
+			ban, err := s.Bans.Ban(action.Target, time.Duration(action.TTL)*time.Second, reason, fmt.Sprintf("case-%d", c.ID), 0)
+			if err != nil {
+				return err
+			}
+			action.BanID = ban.ID
+			return nil
+		}
+		bans, err := s.Bans.GetAll(false)
+		if err != nil {
+			return err
+		}
+		for i := range bans {
+			if bans[i].Ip == action.Target {
+				action.BanID = bans[i].ID
+				return s.Bans.Unban(&bans[i])
+			}
+		}
+		return fmt.Errorf("%s is not banned", action.Target)
+	case ActionSuspend, ActionResume:
+		if s.Subs == nil {
+			return errors.New("subscribers are not configured")
+		}
+		sub, err := s.Subs.GetById(action.SubID)
+		if err != nil {
+			return err
+		}
+		sub.IsActive = action.Kind == ActionResume
+		if err := s.Subs.Update(sub); err != nil {
+			return err
+		}
+		return npppdmodel.New(s.Subs.GetDB()).WriteConfig()
+	}
+	return nil
+}
+
+// Timeline - Notes, actions, changes and linked evidence of a loaded case
+// in time order
+func (s *Storage) Timeline(c *Case) []Entry {
+	var tl []Entry
+	for _, n := range c.Notes {
+		tl = append(tl, Entry{At: n.CreatedAt, Kind: "note", Author: n.Author, Text: n.Body})
+	}
+	for _, a := range c.Actions {
+		text := a.Kind
+		switch {
+		case a.Target != "":
+			text += " " + a.Target
+		case a.SubID != 0:
+			text += fmt.Sprintf(" subscriber %d", a.SubID)
+		}
+		if a.Detail != "" {
+			text += ": " + a.Detail
+		}
+		if a.Error != "" {
+			text += " (failed: " + a.Error + ")"
+		}
+		tl = append(tl, Entry{At: a.CreatedAt, Kind: "action", Author: a.Author, Text: text})
+	}
+	for _, h := range c.History {
+		var text string
+		switch {
+		case h.Field == "case":
+			text = "opened " + h.New
+		case h.Old == "":
+			text = fmt.Sprintf("%s %s added", h.Field, h.New)
+		case h.New == "" && (h.Field == "alert" || h.Field == "event"):
+			text = fmt.Sprintf("%s %s removed", h.Field, h.Old)
+		default:
+			text = fmt.Sprintf("%s changed from %q to %q", h.Field, h.Old, h.New)
+		}
+		tl = append(tl, Entry{At: h.At, Kind: "change", Author: h.Author, Text: text})
+	}
+	for _, a := range c.Alerts {
+		tl = append(tl, Entry{At: a.FirstSeen, Kind: "alert", Text: fmt.Sprintf("alert %d [%s] %s", a.ID, a.Severity, a.Summary)})
+	}
+	for _, ev := range c.Events {
+		tl = append(tl, Entry{At: ev.Timestamp, Kind: "event", Text: fmt.Sprintf("event %d %s %s %s -> %s %s", ev.ID, ev.Type, ev.Action, ev.SrcIp, ev.DstIp, ev.Message)})
+	}
+	sort.SliceStable(tl, func(i, j int) bool {
+		return tl[i].At.Before(tl[j].At)
+	})
+	return tl
+}
+
+// Report - Plain text case report with the timeline and linked evidence of
+// a loaded case, for handing over or attaching to a ticket
+func (s *Storage) Report(c *Case) (string, error) {
+	assignee := "unassigned"
+	if c.AssigneeID != 0 {
+		var user usermodel.User
+		if err := s.DB.First(&user, c.AssigneeID).Error; err == nil {
+			assignee = user.Username
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Case %d: %s\n\n", c.ID, c.Title)
+	fmt.Fprintf(&b, "Status:   %s\n", c.Status)
+	fmt.Fprintf(&b, "Severity: %s\n", c.Severity)
+	fmt.Fprintf(&b, "Assignee: %s\n", assignee)
+	fmt.Fprintf(&b, "Opened:   %s by %s\n", c.CreatedAt.UTC().Format(time.RFC3339), c.CreatedBy)
+	if c.ClosedAt != nil {
+		fmt.Fprintf(&b, "Closed:   %s\n", c.ClosedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Exported: %s\n", time.Now().UTC().Format(time.RFC3339))
+	if c.Description != "" {
+		fmt.Fprintf(&b, "\n%s\n", c.Description)
+	}
+
+	fmt.Fprintf(&b, "\n## Timeline\n\n")
+	for _, e := range s.Timeline(c) {
+		author := ""
+		if e.Author != "" {
+			author = " (" + e.Author + ")"
+		}
+		fmt.Fprintf(&b, "- %s %-6s %s%s\n", e.At.UTC().Format(time.RFC3339), e.Kind, e.Text, author)
+	}
+
+	fmt.Fprintf(&b, "\n## Alerts (%d)\n\n", len(c.Alerts))
+	for _, a := range c.Alerts {
+		fmt.Fprintf(&b, "- %d [%s] %s: %s, %s -> %s, %d times %s to %s, %s\n", a.ID, a.Severity, a.Rule, a.Summary,
+			a.SrcIp, a.DstIp, a.Count, a.FirstSeen.UTC().Format(time.RFC3339), a.LastSeen.UTC().Format(time.RFC3339), a.Status)
+	}
+
+	fmt.Fprintf(&b, "\n## Events (%d)\n\n", len(c.Events))
+	for _, ev := range c.Events {
+		fmt.Fprintf(&b, "- %d %s %s %s %s:%d -> %s:%d %s (hash %s)\n", ev.ID, ev.Timestamp.UTC().Format(time.RFC3339), ev.Type,
+			ev.Action, ev.SrcIp, ev.SrcPort, ev.DstIp, ev.DstPort, ev.Message, ev.Hash)
+	}
+
+	fmt.Fprintf(&b, "\n## Actions (%d)\n\n", len(c.Actions))
+	for _, a := range c.Actions {
+		outcome := "done"
+		if a.Error != "" {
+			outcome = "failed: " + a.Error
+		}
+		target := a.Target
+		if a.SubID != 0 {
+			target = fmt.Sprintf("subscriber %d", a.SubID)
+		}
+		fmt.Fprintf(&b, "- %s %s %s by %s, %s %s\n", a.CreatedAt.UTC().Format(time.RFC3339), a.Kind, target, a.Author, outcome, a.Detail)
+	}
+	return b.String(), nil
+}
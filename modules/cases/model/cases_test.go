@@ -0,0 +1,31 @@
+package casemodel
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChangeApply(t *testing.T) {
+	tests := []struct {
+		name, body string
+		want       Case
+	}{
+		{"status only", `{"status":"closed"}`, Case{Title: "t", Status: "closed", Severity: "low", AssigneeID: 3}},
+		{"reassign", `{"assigneeid":5}`, Case{Title: "t", Status: "open", Severity: "low", AssigneeID: 5}},
+		{"unassign", `{"assigneeid":0}`, Case{Title: "t", Status: "open", Severity: "low"}},
+		{"title and severity", `{"title":"u","severity":"high"}`, Case{Title: "u", Status: "open", Severity: "high", AssigneeID: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ch Change
+			if err := json.Unmarshal([]byte(tt.body), &ch); err != nil {
+				t.Fatal(err)
+			}
+			c := Case{Title: "t", Status: "open", Severity: "low", AssigneeID: 3}
+			ch.Apply(&c)
+			if c.Title != tt.want.Title || c.Status != tt.want.Status || c.Severity != tt.want.Severity || c.AssigneeID != tt.want.AssigneeID {
+				t.Errorf("got %+v", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+// Package caseroutes - Arkgate API Case module
+//
+//	Module Routes:
+//	  /api/v1/cases
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: status, assignee (user ID)
+//	    Return: JSON object with list of case objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON case object with title, description, severity, assigneeid
+//	    Return: JSON case object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>
+//	    Method: GET|PUT|DELETE
+//	    Headers: Authorization Bearer
+//	    Body: JSON case object with title, description, status, severity,
+//	          assigneeid (PUT), fields left out are kept and assigneeid 0
+//	          unassigns
+//	    Return: JSON case object with alerts, events, notes, actions and
+//	            history ( exept for delete method )
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/alerts
+//	  /api/v1/cases/<caseId>/events
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object {"ids": [<alert or event ID>, ...]}
+//	    Return: JSON case object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/alerts/<alertId>
+//	  /api/v1/cases/<caseId>/events/<eventId>
+//	    Method: DELETE
+//	    Headers: Authorization Bearer
+//	    Return: JSON case object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/notes
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object {"body": "<text>"}
+//	    Return: JSON note object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/actions
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON action object, kind ban or unban with target (IP) and ttl
+//	          (seconds), suspend or resume with subid, manual with detail
+//	    Return: JSON action object, error is set if the action failed
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/timeline
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON list of timeline entries, oldest first
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/cases/<caseId>/report
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: format=text (default) or json
+//	    Return: Case report as text or as JSON case object with timeline
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package caseroutes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	casemodel "github.com/rbaylon/arkgate/modules/cases/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func CaseRouter(db casemodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	// load - Case of the caseId URL parameter, renders the error itself
+	load := func(w http.ResponseWriter, r *http.Request) *casemodel.Case {
+		id, err := strconv.Atoi(chi.URLParam(r, "caseId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid case ID %s", chi.URLParam(r, "caseId")), http.StatusBadRequest))
+			return nil
+		}
+		c, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return nil
+		}
+		return c
+	}
+	// reload - Render the case again after a change
+	reload := func(w http.ResponseWriter, r *http.Request, c *casemodel.Case) {
+		c, err := db.GetById(c.ID)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, c)
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		f := &casemodel.Filter{Status: r.URL.Query().Get("status")}
+		if v := r.URL.Query().Get("assignee"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid user ID %s", v), http.StatusBadRequest))
+				return
+			}
+			f.AssigneeID = uint(id)
+		}
+		res, errdb := db.Find(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+		c := &casemodel.Case{}
+		if err := render.Bind(r, c); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		c.ID = 0
+		c.ClosedAt = nil
+		c.CreatedBy = security.Username(r)
+		if err := db.Add(c); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusBadRequest))
+			return
+		}
+		reload(w, r, c)
+	})
+	r.Get("/{caseId}", func(w http.ResponseWriter, r *http.Request) {
+		if c := load(w, r); c != nil {
+			render.JSON(w, r, c)
+		}
+	})
+	r.Put("/{caseId}", func(w http.ResponseWriter, r *http.Request) {
+		c := load(w, r)
+		if c == nil {
+			return
+		}
+		req := &casemodel.Change{}
+		if err := render.Bind(r, req); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		req.Apply(c)
+		if err := db.Update(c, security.Username(r)); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error updating record for case  ID %s", chi.URLParam(r, "caseId")), http.StatusBadRequest))
+			return
+		}
+		reload(w, r, c)
+	})
+	r.Delete("/{caseId}", func(w http.ResponseWriter, r *http.Request) {
+		c := load(w, r)
+		if c == nil {
+			return
+		}
+		if err := db.Delete(c); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error deleting record for case  ID %s", chi.URLParam(r, "caseId")), http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, c)
+	})
+
+	link := func(add func(c *casemodel.Case, ids []uint, author string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			c := load(w, r)
+			if c == nil {
+				return
+			}
+			req := &casemodel.Link{}
+			if err := render.Bind(r, req); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+				return
+			}
+			if err := add(c, req.Ids, security.Username(r)); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusBadRequest))
+				return
+			}
+			reload(w, r, c)
+		}
+	}
+	unlink := func(param string, remove func(c *casemodel.Case, id uint, author string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			c := load(w, r)
+			if c == nil {
+				return
+			}
+			id, err := strconv.Atoi(chi.URLParam(r, param))
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid ID %s", chi.URLParam(r, param)), http.StatusBadRequest))
+				return
+			}
+			if err := remove(c, uint(id), security.Username(r)); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+				return
+			}
+			reload(w, r, c)
+		}
+	}
+	r.Post("/{caseId}/alerts", link(db.AddAlerts))
+	r.Delete("/{caseId}/alerts/{alertId}", unlink("alertId", db.RemoveAlert))
+	r.Post("/{caseId}/events", link(db.AddEvents))
+	r.Delete("/{caseId}/events/{eventId}", unlink("eventId", db.RemoveEvent))
+
+	r.Post("/{caseId}/notes", func(w http.ResponseWriter, r *http.Request) {
+		c := load(w, r)
+		if c == nil {
+			return
+		}
+		note := &casemodel.Note{}
+		if err := render.Bind(r, note); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		note.Author = security.Username(r)
+		if err := db.AddNote(c, note); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, note)
+	})
+	r.Post("/{caseId}/actions", func(w http.ResponseWriter, r *http.Request) {
+		c := load(w, r)
+		if c == nil {
+			return
+		}
+		action := &casemodel.Action{}
+		if err := render.Bind(r, action); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		action.Author = security.Username(r)
+		action.Error = ""
+		// A failed action is still recorded, its error is part of the result
+		if err := db.TakeAction(c, action); err != nil && action.ID == 0 {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, action)
+	})
+	r.Get("/{caseId}/timeline", func(w http.ResponseWriter, r *http.Request) {
+		if c := load(w, r); c != nil {
+			render.JSON(w, r, db.Timeline(c))
+		}
+	})
+	r.Get("/{caseId}/report", func(w http.ResponseWriter, r *http.Request) {
+		c := load(w, r)
+		if c == nil {
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "json":
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=case-%d.json", c.ID))
+			render.JSON(w, r, struct {
+				*casemodel.Case
+				Timeline []casemodel.Entry `json:"timeline"`
+			}{c, db.Timeline(c)})
+		case "", "text":
+			report, err := db.Report(c)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=case-%d.txt", c.ID))
+			w.Write([]byte(report))
+		default:
+			render.Render(w, r, utils.ErrInvalidRequest(errors.New("use text or json"), "Invalid format", http.StatusBadRequest))
+		}
+	})
+	return r
+}
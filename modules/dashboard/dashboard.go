@@ -0,0 +1,376 @@
+// Package dashboard - Aggregates for the security dashboard. Event counts
+// come from the hourly rollups for every complete hour they cover and from
+// the raw events only for the edges of the window, so wide windows stay
+// cheap.
+package dashboard
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	responsemodel "github.com/rbaylon/arkgate/modules/response/model"
+	retentionmodel "github.com/rbaylon/arkgate/modules/retention/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+// Windows - Selectable dashboard windows
+var Windows = map[string]time.Duration{
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// BlockActions - Event actions counted as blocked traffic
+var BlockActions = []string{"block", "blocked", "drop", "reject"}
+
+// minuteWindow - Widest window the rate series is given per minute, wider
+// ones use hourly points
+const minuteWindow = 6 * time.Hour
+
+// Count - One row of a top-N list
+type Count struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// Point - Events of one action within one step of the rate series
+type Point struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Count     int64     `json:"count"`
+	PerMinute float64   `json:"per_minute"`
+}
+
+// Talker - Traffic of one subscriber
+type Talker struct {
+	SubID    uint   `json:"subid"`
+	Username string `json:"username"`
+	flowmodel.Top
+}
+
+// AlertCount - Alerts of one severity, Active are open or acknowledged and
+// New were first seen inside the window
+type AlertCount struct {
+	Severity string `json:"severity"`
+	Active   int64  `json:"active"`
+	New      int64  `json:"new"`
+}
+
+// BanCount - Active bans and bans added inside the window
+type BanCount struct {
+	Active int64 `json:"active"`
+	New    int64 `json:"new"`
+}
+
+// Summary - Every dashboard aggregate for one window
+type Summary struct {
+	Window         string       `json:"window"`
+	Since          time.Time    `json:"since"`
+	Until          time.Time    `json:"until"`
+	BlockedSources []Count      `json:"blocked_sources"`
+	TargetedPorts  []Count      `json:"targeted_ports"`
+	EventRate      []Point      `json:"event_rate"`
+	Talkers        []Talker     `json:"talkers"`
+	Alerts         []AlertCount `json:"alerts"`
+	Bans           BanCount     `json:"bans"`
+}
+
+type Dashboard struct {
+	Events  eventmodel.Crud
+	Rollups retentionmodel.Crud
+	Flows   flowmodel.Crud
+	Alerts  alertmodel.Crud
+	Bans    responsemodel.Crud
+	Subs    submodel.Crud
+}
+
+func New(events eventmodel.Crud, rollups retentionmodel.Crud, flows flowmodel.Crud,
+	alerts alertmodel.Crud, bans responsemodel.Crud, subs submodel.Crud) *Dashboard {
+	return &Dashboard{
+		Events:  events,
+		Rollups: rollups,
+		Flows:   flows,
+		Alerts:  alerts,
+		Bans:    bans,
+		Subs:    subs,
+	}
+}
+
+// Window - Time range of a named window ending now
+func Window(name string, now time.Time) (time.Time, time.Time, error) {
+	d, ok := Windows[name]
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown window %q, use 15m, 1h, 6h, 24h, 7d or 30d", name)
+	}
+	return now.Add(-d), now, nil
+}
+
+// span - Part of a window answered from one source
+type span struct {
+	since, until time.Time
+}
+
+// split - Hours of the UTC range [since, until) covered by the hourly
+// rollups and the parts left for the raw events
+func (d *Dashboard) split(since, until time.Time) (rolled *span, raw []span, err error) {
+	through, err := d.Rollups.GetThrough(retentionmodel.PeriodHour)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := since.Truncate(time.Hour)
+	if start.Before(since) {
+		start = start.Add(time.Hour)
+	}
+	end := until.Truncate(time.Hour)
+	if through.Before(end) {
+		end = through.UTC()
+	}
+	if !start.Before(end) {
+		return nil, []span{{since, until}}, nil
+	}
+	if since.Before(start) {
+		raw = append(raw, span{since, start})
+	}
+	if end.Before(until) {
+		raw = append(raw, span{end, until})
+	}
+	return &span{start, end}, raw, nil
+}
+
+// top - Event counts grouped by col, where is applied to rollups and events
+// alike so it may only use columns both have
+func (d *Dashboard) top(since, until time.Time, col string, limit int, where func(q *gorm.DB) *gorm.DB) ([]Count, error) {
+	// Events and rollups are stored in UTC
+	since, until = since.UTC(), until.UTC()
+	rolled, raw, err := d.split(since, until)
+	if err != nil {
+		return nil, err
+	}
+	totals := map[string]int64{}
+	add := func(q *gorm.DB) error {
+		var rows []Count
+		if err := where(q).Group(col).Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, r := range rows {
+			totals[r.Key] += r.Count
+		}
+		return nil
+	}
+	if rolled != nil {
+		q := d.Rollups.GetDB().Model(&retentionmodel.Rollup{}).
+			Select("CAST("+col+" AS TEXT) AS key, SUM(count) AS count").
+			Where("period = ? AND bucket_start >= ? AND bucket_start < ?", retentionmodel.PeriodHour, rolled.since, rolled.until)
+		if err := add(q); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range raw {
+		q := d.Events.GetDB().Model(&eventmodel.Event{}).
+			Select("CAST("+col+" AS TEXT) AS key, COUNT(*) AS count").
+			Where("timestamp >= ? AND timestamp < ?", s.since, s.until)
+		if err := add(q); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]Count, 0, len(totals))
+	for k, c := range totals {
+		res = append(res, Count{Key: k, Count: c})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// BlockedSources - Sources with the most blocked events
+func (d *Dashboard) BlockedSources(since, until time.Time, limit int) ([]Count, error) {
+	return d.top(since, until, "src_ip", limit, func(q *gorm.DB) *gorm.DB {
+		return q.Where("action IN ? AND src_ip <> ''", BlockActions)
+	})
+}
+
+// TargetedPorts - Destination ports seen in the most events
+func (d *Dashboard) TargetedPorts(since, until time.Time, limit int) ([]Count, error) {
+	return d.top(since, until, "dst_port", limit, func(q *gorm.DB) *gorm.DB {
+		return q.Where("dst_port <> 0")
+	})
+}
+
+// EventRate - Events per action, per minute for windows up to six hours
+// and per hour beyond
+func (d *Dashboard) EventRate(since, until time.Time) ([]Point, error) {
+	since, until = since.UTC(), until.UTC()
+	step, format := time.Hour, "%Y-%m-%dT%H:00:00Z"
+	if until.Sub(since) <= minuteWindow {
+		step, format = time.Minute, "%Y-%m-%dT%H:%M:00Z"
+	}
+	type row struct {
+		Bucket string
+		Action string
+		Count  int64
+	}
+	points := map[[2]string]int64{}
+	add := func(q *gorm.DB) error {
+		var rows []row
+		if err := q.Group("bucket, action").Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, r := range rows {
+			points[[2]string{r.Bucket, r.Action}] += r.Count
+		}
+		return nil
+	}
+	raw := []span{{since, until}}
+	if step == time.Hour {
+		var rolled *span
+		var err error
+		if rolled, raw, err = d.split(since, until); err != nil {
+			return nil, err
+		}
+		if rolled != nil {
+			q := d.Rollups.GetDB().Model(&retentionmodel.Rollup{}).
+				Select("strftime(?, bucket_start) AS bucket, action, SUM(count) AS count", format).
+				Where("period = ? AND bucket_start >= ? AND bucket_start < ?", retentionmodel.PeriodHour, rolled.since, rolled.until)
+			if err := add(q); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range raw {
+		q := d.Events.GetDB().Model(&eventmodel.Event{}).
+			Select("strftime(?, timestamp) AS bucket, action, COUNT(*) AS count", format).
+			Where("timestamp >= ? AND timestamp < ?", s.since, s.until)
+		if err := add(q); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]Point, 0, len(points))
+	for k, c := range points {
+		t, err := time.Parse(time.RFC3339, k[0])
+		if err != nil {
+			continue
+		}
+		res = append(res, Point{Time: t, Action: k[1], Count: c, PerMinute: float64(c) / step.Minutes()})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Time.Equal(res[j].Time) {
+			return res[i].Time.Before(res[j].Time)
+		}
+		return res[i].Action < res[j].Action
+	})
+	return res, nil
+}
+
+// Talkers - Subscribers with the most traffic from the flow buckets
+func (d *Dashboard) Talkers(since, until time.Time, limit int) ([]Talker, error) {
+	tops, err := d.Flows.Top(&flowmodel.Filter{Since: since, Until: until}, "sub")
+	if err != nil {
+		return nil, err
+	}
+	subs, err := d.Subs.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string, len(subs))
+	for _, s := range subs {
+		names[s.ID] = s.Username
+	}
+	res := []Talker{}
+	for _, t := range tops {
+		id, err := strconv.Atoi(t.Key)
+		if err != nil || id == 0 {
+			continue
+		}
+		res = append(res, Talker{SubID: uint(id), Username: names[uint(id)], Top: t})
+		if limit > 0 && len(res) == limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+// AlertCounts - Active and new alerts per severity, highest first
+func (d *Dashboard) AlertCounts(since time.Time) ([]AlertCount, error) {
+	var rows []AlertCount
+	result := d.Alerts.GetDB().Model(&alertmodel.Alert{}).
+		Select("severity, SUM(CASE WHEN status <> ? THEN 1 ELSE 0 END) AS active, "+
+			"SUM(CASE WHEN first_seen >= ? THEN 1 ELSE 0 END) AS new", alertmodel.StatusClosed, since).
+		Where("status <> ? OR first_seen >= ?", alertmodel.StatusClosed, since).
+		Group("severity").Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	res := make([]AlertCount, 0, len(alertmodel.Severities))
+	for sev := range alertmodel.Severities {
+		c := AlertCount{Severity: sev}
+		for _, r := range rows {
+			if r.Severity == sev {
+				c = r
+			}
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return alertmodel.Severities[res[i].Severity] > alertmodel.Severities[res[j].Severity]
+	})
+	return res, nil
+}
+
+// BanCounts - Size of the ban list
+func (d *Dashboard) BanCounts(since time.Time) (*BanCount, error) {
+	var c BanCount
+	result := d.Bans.GetDB().Model(&responsemodel.Ban{}).
+		Select("COALESCE(SUM(CASE WHEN active THEN 1 ELSE 0 END), 0) AS active, "+
+			"COALESCE(SUM(CASE WHEN created_at >= ? THEN 1 ELSE 0 END), 0) AS new", since).
+		Scan(&c)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &c, nil
+}
+
+// Summary - All aggregates of a window at once
+func (d *Dashboard) Summary(window string, now time.Time, limit int) (*Summary, error) {
+	since, until, err := Window(window, now)
+	if err != nil {
+		return nil, err
+	}
+	s := &Summary{Window: window, Since: since, Until: until}
+	if s.BlockedSources, err = d.BlockedSources(since, until, limit); err != nil {
+		return nil, err
+	}
+	if s.TargetedPorts, err = d.TargetedPorts(since, until, limit); err != nil {
+		return nil, err
+	}
+	if s.EventRate, err = d.EventRate(since, until); err != nil {
+		return nil, err
+	}
+	if s.Talkers, err = d.Talkers(since, until, limit); err != nil {
+		return nil, err
+	}
+	if s.Alerts, err = d.AlertCounts(since); err != nil {
+		return nil, err
+	}
+	bans, err := d.BanCounts(since)
+	if err != nil {
+		return nil, err
+	}
+	s.Bans = *bans
+	return s, nil
+}
@@ -0,0 +1,154 @@
+// Package dashboardroutes - Arkgate API Dashboard module
+//
+// Every route takes window=15m|1h|6h|24h|7d|30d (default 24h) and, for
+// top lists, limit (default 10).
+//
+//	Module Routes:
+//	  /api/v1/dashboard
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window, limit
+//	    Return: JSON object with every aggregate below
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/blocked-sources
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window, limit
+//	    Return: JSON list of source addresses with blocked event counts
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/ports
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window, limit
+//	    Return: JSON list of destination ports with event counts
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/event-rate
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window
+//	    Return: JSON list of points with event count and rate per minute by
+//	            action, per minute up to 6h and per hour beyond
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/talkers
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window, limit
+//	    Return: JSON list of subscribers with flow, packet and byte totals
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/alerts
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window
+//	    Return: JSON list of active and new alert counts by severity
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dashboard/bans
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: window
+//	    Return: JSON object with active and new ban counts
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package dashboardroutes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/rbaylon/arkgate/modules/dashboard"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+// query - Window name, its range and the top list limit
+type query struct {
+	window       string
+	since, until time.Time
+	limit        int
+}
+
+func parseQuery(r *http.Request) (*query, error) {
+	q := &query{window: r.URL.Query().Get("window"), limit: 10}
+	if q.window == "" {
+		q.window = "24h"
+	}
+	var err error
+	if q.since, q.until, err = dashboard.Window(q.window, time.Now()); err != nil {
+		return nil, err
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func DashboardRouter(d *dashboard.Dashboard) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	// handle - Parse the query and render what fn returns
+	handle := func(fn func(q *query) (interface{}, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			q, err := parseQuery(r)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid query", http.StatusBadRequest))
+				return
+			}
+			res, err := fn(q)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+				return
+			}
+			render.JSON(w, r, res)
+		}
+	}
+
+	r.Get("/", handle(func(q *query) (interface{}, error) {
+		return d.Summary(q.window, q.until, q.limit)
+	}))
+	r.Get("/blocked-sources", handle(func(q *query) (interface{}, error) {
+		return d.BlockedSources(q.since, q.until, q.limit)
+	}))
+	r.Get("/ports", handle(func(q *query) (interface{}, error) {
+		return d.TargetedPorts(q.since, q.until, q.limit)
+	}))
+	r.Get("/event-rate", handle(func(q *query) (interface{}, error) {
+		return d.EventRate(q.since, q.until)
+	}))
+	r.Get("/talkers", handle(func(q *query) (interface{}, error) {
+		return d.Talkers(q.since, q.until, q.limit)
+	}))
+	r.Get("/alerts", handle(func(q *query) (interface{}, error) {
+		return d.AlertCounts(q.since)
+	}))
+	r.Get("/bans", handle(func(q *query) (interface{}, error) {
+		return d.BanCounts(q.since)
+	}))
+	return r
+}
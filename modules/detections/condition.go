@@ -0,0 +1,219 @@
+package detections
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+type matcher func(ev *eventmodel.Event) bool
+
+// aggregation - "| count(field) by group > n" part of a condition
+type aggregation struct {
+	Field   string   `json:"field,omitempty"` // count distinct values, all events when empty
+	GroupBy []string `json:"group_by,omitempty"`
+	Op      string   `json:"op"`
+	Value   int      `json:"value"`
+}
+
+func (a *aggregation) match(n int) bool {
+	switch a.Op {
+	case ">":
+		return n > a.Value
+	case ">=":
+		return n >= a.Value
+	case "==", "=":
+		return n == a.Value
+	}
+	return false
+}
+
+var aggRe = regexp.MustCompile(`^count\(\s*([\w]*)\s*\)(?:\s+by\s+([\w,\s]+?))?\s*(>=|<=|==|=|>|<)\s*(\d+)$`)
+
+// parseAggregation - Parse the part of a condition after the pipe
+func parseAggregation(s string) (*aggregation, error) {
+	m := aggRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("invalid aggregation %q, expected count([field]) [by field] > n", s)
+	}
+	a := &aggregation{Field: m[1], Op: m[3]}
+	a.Value, _ = strconv.Atoi(m[4])
+	if a.Op == "<" || a.Op == "<=" {
+		return nil, fmt.Errorf("aggregation %q can not fire on a live stream, use > or >=", s)
+	}
+	if a.Field != "" {
+		if _, ok := fields[a.Field]; !ok {
+			return nil, fmt.Errorf("unknown field %q in aggregation", a.Field)
+		}
+	}
+	if m[2] != "" {
+		for _, g := range strings.Split(m[2], ",") {
+			g = strings.TrimSpace(g)
+			if _, ok := fields[g]; !ok {
+				return nil, fmt.Errorf("unknown group by field %q", g)
+			}
+			a.GroupBy = append(a.GroupBy, g)
+		}
+	}
+	return a, nil
+}
+
+// condition - Recursive descent parser for Sigma conditions:
+//
+//	expr    = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | primary
+//	primary = "(" expr ")" | ("1" | "all") "of" (pattern | "them") | name
+type condition struct {
+	tokens     []string
+	pos        int
+	selections map[string]matcher
+}
+
+var tokenRe = regexp.MustCompile(`\(|\)|[^\s()]+`)
+
+func compileCondition(s string, selections map[string]matcher) (matcher, error) {
+	c := &condition{
+		tokens:     tokenRe.FindAllString(s, -1),
+		selections: selections,
+	}
+	if len(c.tokens) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	m, err := c.expr()
+	if err != nil {
+		return nil, err
+	}
+	if c.pos < len(c.tokens) {
+		return nil, fmt.Errorf("unexpected %q in condition", c.tokens[c.pos])
+	}
+	return m, nil
+}
+
+func (c *condition) peek() string {
+	if c.pos < len(c.tokens) {
+		return strings.ToLower(c.tokens[c.pos])
+	}
+	return ""
+}
+
+func (c *condition) next() string {
+	t := c.peek()
+	c.pos++
+	return t
+}
+
+func (c *condition) expr() (matcher, error) {
+	left, err := c.and()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek() == "or" {
+		c.next()
+		right, err := c.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ev *eventmodel.Event) bool { return l(ev) || right(ev) }
+	}
+	return left, nil
+}
+
+func (c *condition) and() (matcher, error) {
+	left, err := c.not()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek() == "and" {
+		c.next()
+		right, err := c.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ev *eventmodel.Event) bool { return l(ev) && right(ev) }
+	}
+	return left, nil
+}
+
+func (c *condition) not() (matcher, error) {
+	if c.peek() == "not" {
+		c.next()
+		m, err := c.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(ev *eventmodel.Event) bool { return !m(ev) }, nil
+	}
+	return c.primary()
+}
+
+func (c *condition) primary() (matcher, error) {
+	if c.pos >= len(c.tokens) {
+		return nil, fmt.Errorf("condition ends unexpectedly")
+	}
+	t := c.tokens[c.pos]
+	c.pos++
+	switch strings.ToLower(t) {
+	case "(":
+		m, err := c.expr()
+		if err != nil {
+			return nil, err
+		}
+		if c.next() != ")" {
+			return nil, fmt.Errorf("missing ) in condition")
+		}
+		return m, nil
+	case "1", "any", "all":
+		if c.next() != "of" {
+			return nil, fmt.Errorf("expected of after %q", t)
+		}
+		if c.pos >= len(c.tokens) {
+			return nil, fmt.Errorf("expected selection pattern after of")
+		}
+		pattern := c.tokens[c.pos]
+		c.pos++
+		if strings.ToLower(pattern) == "them" {
+			pattern = "*"
+		}
+		var ms []matcher
+		for name, m := range c.selections {
+			if ok, _ := path.Match(pattern, name); ok {
+				ms = append(ms, m)
+			}
+		}
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("no selection matches %q", pattern)
+		}
+		if strings.ToLower(t) == "all" {
+			return func(ev *eventmodel.Event) bool {
+				for _, m := range ms {
+					if !m(ev) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(ev *eventmodel.Event) bool {
+			for _, m := range ms {
+				if m(ev) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case ")", "and", "or", "not", "of":
+		return nil, fmt.Errorf("unexpected %q in condition", t)
+	}
+	m, ok := c.selections[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown selection %q in condition", t)
+	}
+	return m, nil
+}
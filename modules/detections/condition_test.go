@@ -0,0 +1,185 @@
+package detections
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rbaylon/arkgate/modules/authlog"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+func TestCompileCondition(t *testing.T) {
+	is := func(action string) matcher {
+		return func(ev *eventmodel.Event) bool { return ev.Action == action }
+	}
+	has := func(user string) matcher {
+		return func(ev *eventmodel.Event) bool { return ev.Username == user }
+	}
+	selections := map[string]matcher{
+		"fail":     is("failed_password"),
+		"invalid":  is("invalid_user"),
+		"root":     has("root"),
+		"sel_fail": is("failed_password"),
+		"sel_root": has("root"),
+	}
+	failRoot := &eventmodel.Event{Action: "failed_password", Username: "root"}
+	failBob := &eventmodel.Event{Action: "failed_password", Username: "bob"}
+	accept := &eventmodel.Event{Action: "accepted_password", Username: "root"}
+
+	tests := []struct {
+		cond string
+		want [3]bool // failRoot, failBob, accept
+		err  string
+	}{
+		{cond: "fail", want: [3]bool{true, true, false}},
+		{cond: "fail and root", want: [3]bool{true, false, false}},
+		{cond: "fail or root", want: [3]bool{true, true, true}},
+		{cond: "fail and not root", want: [3]bool{false, true, false}},
+		{cond: "not not fail", want: [3]bool{true, true, false}},
+		// and binds tighter than or
+		{cond: "invalid or fail and root", want: [3]bool{true, false, false}},
+		{cond: "(invalid or fail) and not root", want: [3]bool{false, true, false}},
+		{cond: "FAIL AND ROOT", err: "unknown selection"},
+		{cond: "fail AND root", want: [3]bool{true, false, false}},
+		{cond: "1 of sel_*", want: [3]bool{true, true, true}},
+		{cond: "any of sel_*", want: [3]bool{true, true, true}},
+		{cond: "all of sel_*", want: [3]bool{true, false, false}},
+		{cond: "all of them", want: [3]bool{false, false, false}},
+		{cond: "1 of them", want: [3]bool{true, true, true}},
+		{cond: "", err: "empty condition"},
+		{cond: "fail and", err: "ends unexpectedly"},
+		{cond: "(fail or root", err: "missing )"},
+		{cond: "fail root", err: "unexpected \"root\""},
+		{cond: "fail )", err: "unexpected \")\""},
+		{cond: "and fail", err: "unexpected \"and\""},
+		{cond: "nope", err: "unknown selection"},
+		{cond: "1 of", err: "expected selection pattern"},
+		{cond: "1 fail", err: "expected of"},
+		{cond: "all of x_*", err: "no selection matches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cond, func(t *testing.T) {
+			m, err := compileCondition(tt.cond, selections)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, ev := range []*eventmodel.Event{failRoot, failBob, accept} {
+				if got := m(ev); got != tt.want[i] {
+					t.Errorf("event %d: got %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+	tests := []struct {
+		in   string
+		want aggregation
+		err  string
+	}{
+		{in: "count() > 5", want: aggregation{Op: ">", Value: 5}},
+		{in: " count() by src_ip >= 10 ", want: aggregation{GroupBy: []string{"src_ip"}, Op: ">=", Value: 10}},
+		{in: "count(username) by src_ip, dst_ip = 3", want: aggregation{Field: "username", GroupBy: []string{"src_ip", "dst_ip"}, Op: "=", Value: 3}},
+		{in: "count() < 5", err: "live stream"},
+		{in: "count() <= 5", err: "live stream"},
+		{in: "count(nope) > 1", err: "unknown field"},
+		{in: "count() by nope > 1", err: "unknown group by field"},
+		{in: "sum(x) > 1", err: "invalid aggregation"},
+		{in: "count() > many", err: "invalid aggregation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			a, err := parseAggregation(tt.in)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Field != tt.want.Field || a.Op != tt.want.Op || a.Value != tt.want.Value ||
+				strings.Join(a.GroupBy, ",") != strings.Join(tt.want.GroupBy, ",") {
+				t.Errorf("got %+v, want %+v", *a, tt.want)
+			}
+		})
+	}
+	for n, want := range map[int]bool{9: false, 10: true, 11: true} {
+		if got := (&aggregation{Op: ">=", Value: 10}).match(n); got != want {
+			t.Errorf(">= 10 with %d: got %v", n, got)
+		}
+	}
+}
+
+func TestParseTimeframe(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "5m", want: 5 * time.Minute},
+		{in: "2d", want: 48 * time.Hour},
+		{in: "0d", err: true},
+		{in: "-1d", err: true},
+		{in: "999999999d", err: true},
+		{in: "d", err: true},
+		{in: "0s", err: true},
+		{in: "-5m", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			d, err := parseTimeframe(tt.in)
+			if (err != nil) != tt.err || d != tt.want {
+				t.Errorf("got %v, %v", d, err)
+			}
+		})
+	}
+}
+
+// TestPackageExample - The rule in the package doc fires on authlog events
+func TestPackageExample(t *testing.T) {
+	r, err := Compile(`title: SSH brute force
+id: ssh-bruteforce
+level: high
+detection:
+  selection:
+    type: auth
+    action:
+      - failed_password
+      - invalid_user
+  timeframe: 5m
+  condition: selection | count() by src_ip >= 10
+`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	lines := []string{
+		"Oct 19 10:00:01 gw sshd[1]: Failed password for root from 203.0.113.7 port 50001 ssh2",
+		"Oct 19 10:00:02 gw sshd[1]: Invalid user admin from 203.0.113.7 port 50002",
+	}
+	for i := 0; i < 10; i++ {
+		a, err := authlog.Parse(lines[i%2], now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := a.ToEvent()
+		ev.Timestamp = now
+		alert := r.Eval(&ev)
+		if (alert != nil) != (i == 9) {
+			t.Fatalf("event %d: alert %v", i+1, alert)
+		}
+		if alert != nil && (alert.SrcIp != "203.0.113.7" || alert.Severity != "high" || len(alert.Events) != 10) {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package detections - Sigma style YAML detection rules compiled against the
+// event schema. Rules are loaded from a directory, reloaded when the files
+// change and run as a Detector in the ingest pipeline.
+//
+//	title: SSH brute force
+//	id: ssh-bruteforce
+//	level: high
+//	detection:
+//	  selection:
+//	    type: auth
+//	    action:
+//	      - failed_password
+//	      - invalid_user
+//	  timeframe: 5m
+//	  condition: selection | count() by src_ip >= 10
+package detections
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+var (
+	// ErrNotFound - No loaded rule with the requested id
+	ErrNotFound = errors.New("detection rule not found")
+	// ErrNoDir - Rules can not be saved without a rule directory
+	ErrNoDir = errors.New("no detection rule directory configured")
+)
+
+// Engine - Rules loaded from Dir
+type Engine struct {
+	Dir string
+
+	mu     sync.RWMutex
+	rules  []*Rule
+	mtimes map[string]time.Time
+}
+
+func New(dir string) *Engine {
+	e := &Engine{
+		Dir:    dir,
+		mtimes: map[string]time.Time{},
+	}
+	if err := e.Load(); err != nil {
+		log.Println("Detections: ", err)
+	}
+	return e
+}
+
+// Load - Read every *.yml and *.yaml file in Dir, replacing the rules in
+// use. Files that fail to compile are kept with their error and do not run.
+// Rules whose source did not change keep their aggregation windows.
+func (e *Engine) Load() error {
+	files, err := e.files()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := map[string]*Rule{}
+	for _, r := range e.rules {
+		old[r.File] = r
+	}
+	var rules []*Rule
+	mtimes := map[string]time.Time{}
+	ids := map[string]string{}
+	for _, path := range files {
+		if st, err := os.Stat(path); err == nil {
+			mtimes[path] = st.ModTime()
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			rules = append(rules, &Rule{File: path, Error: err.Error()})
+			continue
+		}
+		if o, ok := old[path]; ok && o.Source == string(src) {
+			rules = append(rules, o)
+			ids[o.Id] = path
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		r, err := Compile(string(src), id)
+		if err != nil {
+			rules = append(rules, &Rule{Id: id, File: path, Source: string(src), Error: err.Error()})
+			continue
+		}
+		r.File = path
+		if other, ok := ids[r.Id]; ok {
+			r.Error = fmt.Sprintf("duplicate rule id %s, already used by %s", r.Id, other)
+			r.match = nil
+		} else {
+			ids[r.Id] = path
+		}
+		rules = append(rules, r)
+	}
+	e.rules = rules
+	e.mtimes = mtimes
+	return nil
+}
+
+func (e *Engine) files() ([]string, error) {
+	var files []string
+	if e.Dir == "" {
+		return nil, nil
+	}
+	for _, ext := range []string{"*.yml", "*.yaml"} {
+		m, err := filepath.Glob(filepath.Join(e.Dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, m...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Watch - Reload the rules whenever a file is added, changed or removed
+func (e *Engine) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		files, err := e.files()
+		if err != nil {
+			continue
+		}
+		e.mu.RLock()
+		changed := len(files) != len(e.mtimes)
+		for _, path := range files {
+			st, err := os.Stat(path)
+			if err == nil && !st.ModTime().Equal(e.mtimes[path]) {
+				changed = true
+			}
+		}
+		e.mu.RUnlock()
+		if changed {
+			if err := e.Load(); err != nil {
+				log.Println("Detections: ", err)
+			}
+			log.Printf("Detections reloaded, %d rules\n", len(e.Rules()))
+		}
+	}
+}
+
+// Rules - All loaded rules, including the ones that failed to compile
+func (e *Engine) Rules() []*Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]*Rule{}, e.rules...)
+}
+
+// Get - Loaded rule by id
+func (e *Engine) Get(id string) (*Rule, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, r := range e.rules {
+		if r.Id == id {
+			return r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Save - Validate a rule and write it to Dir as <id>.yml. id names the rule
+// when its source has none, an existing rule with the same id is replaced.
+func (e *Engine) Save(source, id string) (*Rule, error) {
+	if e.Dir == "" {
+		return nil, ErrNoDir
+	}
+	r, err := Compile(source, id)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(e.Dir, r.Id+".yml")
+	if old, err := e.Get(r.Id); err == nil && old.File != "" {
+		path = old.File
+	}
+	if err := os.WriteFile(path, []byte(source), 0640); err != nil {
+		return nil, err
+	}
+	if err := e.Load(); err != nil {
+		return nil, err
+	}
+	return e.Get(r.Id)
+}
+
+// Delete - Remove the file of a rule
+func (e *Engine) Delete(id string) (*Rule, error) {
+	r, err := e.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(r.File); err != nil {
+		return nil, err
+	}
+	return r, e.Load()
+}
+
+func (e *Engine) Name() string {
+	return "detections"
+}
+
+func (e *Engine) Inspect(ev *eventmodel.Event) []*alertmodel.Alert {
+	// Write lock, evaluating updates the aggregation windows
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var alerts []*alertmodel.Alert
+	for _, r := range e.rules {
+		if !r.Enabled || r.Error != "" {
+			continue
+		}
+		if a := r.Eval(ev); a != nil {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// TestResult - Outcome of running a rule over stored events
+type TestResult struct {
+	Rule    *Rule               `json:"rule"`
+	Events  int                 `json:"events"`
+	Matches int                 `json:"matches"`
+	Alerts  []*alertmodel.Alert `json:"alerts"`
+}
+
+// Test - Run a rule over events, oldest first, without raising alerts.
+// The rule is compiled again so live windows are not touched.
+func Test(source string, events []eventmodel.Event) (*TestResult, error) {
+	r, err := Compile(source, "test")
+	if err != nil {
+		return nil, err
+	}
+	res := &TestResult{Rule: r, Events: len(events), Alerts: []*alertmodel.Alert{}}
+	for i := range events {
+		if r.match(&events[i]) {
+			res.Matches++
+		}
+		if a := r.Eval(&events[i]); a != nil {
+			res.Alerts = append(res.Alerts, a)
+		}
+	}
+	return res, nil
+}
+
+// RuleRequest - Body of rule create, update and test requests. Tests run
+// Source, or the loaded rule Id, over the stored events matching the
+// filter.
+type RuleRequest struct {
+	Source string    `json:"source"`
+	Id     string    `json:"id"`
+	Type   string    `json:"type"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Limit  int       `json:"limit"`
+}
+
+func (rr *RuleRequest) Bind(r *http.Request) error {
+	if rr.Source == "" && rr.Id == "" {
+		return errors.New("source or id is required")
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package detectionroutes - Arkgate API Detections module
+//
+//	Module Routes:
+//	  /api/v1/detections
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON list of loaded rules, rules that failed to compile have
+//	            error set
+//	    Return-Status: 200 on Success
+//
+//	  /api/v1/detections/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object {"source": "<YAML rule>"}
+//	    Return: JSON rule object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/detections/test
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object with source (YAML rule) or id (loaded rule) and
+//	          the event filter type, since, until (RFC3339), limit
+//	    Return: JSON object with the number of matching events and the
+//	            alerts the rule would have raised
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/detections/reload
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON list of loaded rules
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/detections/<ruleId>
+//	    Method: GET, PUT, DELETE
+//	    Headers: Authorization Bearer
+//	    Body: JSON object {"source": "<YAML rule>"} (PUT)
+//	    Return: JSON rule object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   404 on Not found
+//	                   400 on Bad request
+package detectionroutes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/rbaylon/arkgate/modules/detections"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func DetectionRouter(engine *detections.Engine, events eventmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	notFound := func(w http.ResponseWriter, r *http.Request, err error) {
+		status := http.StatusInternalServerError
+		if errors.Is(err, detections.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, "Rule error", status))
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, engine.Rules())
+	})
+	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+		data := &detections.RuleRequest{}
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid request", http.StatusBadRequest))
+			return
+		}
+		rule, err := engine.Save(data.Source, data.Id)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid rule", http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, rule)
+	})
+	r.Post("/test", func(w http.ResponseWriter, r *http.Request) {
+		data := &detections.RuleRequest{}
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid request", http.StatusBadRequest))
+			return
+		}
+		source := data.Source
+		if source == "" {
+			rule, err := engine.Get(data.Id)
+			if err != nil {
+				notFound(w, r, err)
+				return
+			}
+			source = rule.Source
+		}
+		f := &eventmodel.Filter{
+			Type:  data.Type,
+			Since: data.Since,
+			Until: data.Until,
+			Limit: data.Limit,
+		}
+		if f.Since.IsZero() {
+			f.Since = time.Now().Add(-24 * time.Hour)
+		}
+		if f.Limit <= 0 {
+			f.Limit = 10000
+		}
+		evs, err := events.Find(f)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		// Find returns the newest first, windows need them in order
+		for i, j := 0, len(evs)-1; i < j; i, j = i+1, j-1 {
+			evs[i], evs[j] = evs[j], evs[i]
+		}
+		res, err := detections.Test(source, evs)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid rule", http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := engine.Load(); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Rule error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, engine.Rules())
+	})
+	r.Get("/{ruleId}", func(w http.ResponseWriter, r *http.Request) {
+		rule, err := engine.Get(chi.URLParam(r, "ruleId"))
+		if err != nil {
+			notFound(w, r, err)
+			return
+		}
+		render.JSON(w, r, rule)
+	})
+	r.Put("/{ruleId}", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "ruleId")
+		if _, err := engine.Get(id); err != nil {
+			notFound(w, r, err)
+			return
+		}
+		data := &detections.RuleRequest{}
+		if err := render.Bind(r, data); err != nil || data.Source == "" {
+			render.Render(w, r, utils.ErrInvalidRequest(errors.New("source is required"), "Invalid request", http.StatusBadRequest))
+			return
+		}
+		rule, err := engine.Save(data.Source, id)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid rule", http.StatusBadRequest))
+			return
+		}
+		if rule.Id != id {
+			// Renamed, drop the old file
+			if _, err := engine.Delete(id); err != nil {
+				notFound(w, r, err)
+				return
+			}
+		}
+		render.JSON(w, r, rule)
+	})
+	r.Delete("/{ruleId}", func(w http.ResponseWriter, r *http.Request) {
+		rule, err := engine.Delete(chi.URLParam(r, "ruleId"))
+		if err != nil {
+			notFound(w, r, err)
+			return
+		}
+		render.JSON(w, r, rule)
+	})
+	return r
+}
@@ -0,0 +1,442 @@
+package detections
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+	"gopkg.in/yaml.v3"
+)
+
+// fields - Event schema fields usable in rules, by their JSON name
+var fields = map[string]func(e *eventmodel.Event) string{
+	"type":         func(e *eventmodel.Event) string { return e.Type },
+	"source":       func(e *eventmodel.Event) string { return e.Source },
+	"action":       func(e *eventmodel.Event) string { return e.Action },
+	"severity":     func(e *eventmodel.Event) string { return strconv.Itoa(e.Severity) },
+	"src_ip":       func(e *eventmodel.Event) string { return e.SrcIp },
+	"src_port":     func(e *eventmodel.Event) string { return strconv.Itoa(e.SrcPort) },
+	"dst_ip":       func(e *eventmodel.Event) string { return e.DstIp },
+	"dst_port":     func(e *eventmodel.Event) string { return strconv.Itoa(e.DstPort) },
+	"protocol":     func(e *eventmodel.Event) string { return e.Protocol },
+	"username":     func(e *eventmodel.Event) string { return e.Username },
+	"signature_id": func(e *eventmodel.Event) string { return strconv.Itoa(e.SignatureId) },
+	"signature":    func(e *eventmodel.Event) string { return e.Signature },
+	"category":     func(e *eventmodel.Event) string { return e.Category },
+	"domain":       func(e *eventmodel.Event) string { return e.Domain },
+	"query_type":   func(e *eventmodel.Event) string { return e.QueryType },
+	"rcode":        func(e *eventmodel.Event) string { return e.Rcode },
+	"message":      func(e *eventmodel.Event) string { return e.Message },
+	"raw":          func(e *eventmodel.Event) string { return e.Raw },
+	"subscriber":   func(e *eventmodel.Event) string { return e.Subscriber },
+	"interface":    func(e *eventmodel.Event) string { return e.Interface },
+	"subnet":       func(e *eventmodel.Event) string { return e.Subnet },
+	"src_host":     func(e *eventmodel.Event) string { return e.SrcHost },
+	"dst_host":     func(e *eventmodel.Event) string { return e.DstHost },
+	"src_country":  func(e *eventmodel.Event) string { return e.SrcCountry },
+	"dst_country":  func(e *eventmodel.Event) string { return e.DstCountry },
+	"src_asn":      func(e *eventmodel.Event) string { return strconv.FormatUint(uint64(e.SrcAsn), 10) },
+	"dst_asn":      func(e *eventmodel.Event) string { return strconv.FormatUint(uint64(e.DstAsn), 10) },
+}
+
+// reserved - Detection keys that are not selections
+var reserved = map[string]bool{
+	"condition": true,
+	"timeframe": true,
+	"count":     true,
+	"group_by":  true,
+}
+
+// levels - Sigma levels as alert severities
+var levels = map[string]string{
+	"informational": "low",
+	"low":           "low",
+	"medium":        "medium",
+	"high":          "high",
+	"critical":      "critical",
+}
+
+var idRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// RuleFile - YAML layout of a rule
+type RuleFile struct {
+	Id          string                 `yaml:"id"`
+	Title       string                 `yaml:"title"`
+	Description string                 `yaml:"description"`
+	Level       string                 `yaml:"level"`
+	Enabled     *bool                  `yaml:"enabled"`
+	Tags        []string               `yaml:"tags"`
+	Detection   map[string]interface{} `yaml:"detection"`
+}
+
+// Rule - A loaded rule. Rules that fail to compile are kept with Error set
+// so they show up in the API.
+type Rule struct {
+	Id          string        `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Level       string        `json:"level"`
+	Enabled     bool          `json:"enabled"`
+	Tags        []string      `json:"tags"`
+	Timeframe   time.Duration `json:"timeframe"`
+	Aggregation *aggregation  `json:"aggregation,omitempty"`
+	File        string        `json:"file"`
+	Source      string        `json:"source"`
+	Error       string        `json:"error,omitempty"`
+
+	match  matcher
+	window *ingest.Window
+}
+
+// Compile - Parse and compile a YAML rule. id is used when the rule has
+// none, rules loaded from files default to the file name.
+func Compile(source, id string) (*Rule, error) {
+	var rf RuleFile
+	if err := yaml.Unmarshal([]byte(source), &rf); err != nil {
+		return nil, err
+	}
+	if rf.Id == "" {
+		rf.Id = id
+	}
+	if rf.Id == "" {
+		return nil, errors.New("id is required")
+	}
+	if !idRe.MatchString(rf.Id) {
+		return nil, fmt.Errorf("invalid rule id %q", rf.Id)
+	}
+	r := &Rule{
+		Id:          rf.Id,
+		Title:       rf.Title,
+		Description: rf.Description,
+		Level:       strings.ToLower(rf.Level),
+		Enabled:     rf.Enabled == nil || *rf.Enabled,
+		Tags:        rf.Tags,
+		Source:      source,
+	}
+	if r.Title == "" {
+		r.Title = r.Id
+	}
+	if r.Level == "" {
+		r.Level = "medium"
+	}
+	if _, ok := levels[r.Level]; !ok {
+		return nil, fmt.Errorf("invalid level %q", rf.Level)
+	}
+	if len(rf.Detection) == 0 {
+		return nil, errors.New("detection is required")
+	}
+
+	selections := map[string]matcher{}
+	for name, v := range rf.Detection {
+		if reserved[name] {
+			continue
+		}
+		m, err := compileSelection(v)
+		if err != nil {
+			return nil, fmt.Errorf("selection %s: %w", name, err)
+		}
+		selections[name] = m
+	}
+	if len(selections) == 0 {
+		return nil, errors.New("detection has no selection")
+	}
+
+	cond, _ := rf.Detection["condition"].(string)
+	if cond == "" {
+		if len(selections) > 1 {
+			return nil, errors.New("condition is required with more than one selection")
+		}
+		cond = "all of them"
+	}
+	expr, agg, _ := strings.Cut(cond, "|")
+	var err error
+	if r.match, err = compileCondition(expr, selections); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(agg) != "" {
+		if r.Aggregation, err = parseAggregation(agg); err != nil {
+			return nil, err
+		}
+	} else if v, ok := rf.Detection["count"]; ok {
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("count must be a positive number")
+		}
+		r.Aggregation = &aggregation{Op: ">=", Value: n}
+		switch g := rf.Detection["group_by"].(type) {
+		case nil:
+		case string:
+			r.Aggregation.GroupBy = []string{g}
+		case []interface{}:
+			for _, f := range g {
+				r.Aggregation.GroupBy = append(r.Aggregation.GroupBy, fmt.Sprint(f))
+			}
+		default:
+			return nil, errors.New("group_by must be a field or a list of fields")
+		}
+		for _, f := range r.Aggregation.GroupBy {
+			if _, ok := fields[f]; !ok {
+				return nil, fmt.Errorf("unknown group_by field %q", f)
+			}
+		}
+	}
+
+	if tf, ok := rf.Detection["timeframe"]; ok {
+		if r.Timeframe, err = parseTimeframe(fmt.Sprint(tf)); err != nil {
+			return nil, err
+		}
+	}
+	if r.Aggregation != nil {
+		if r.Timeframe == 0 {
+			return nil, errors.New("timeframe is required with count")
+		}
+		r.window = ingest.NewWindow(r.Timeframe)
+	}
+	return r, nil
+}
+
+// maxDays - Longest timeframe in days a time.Duration holds
+const maxDays = int(math.MaxInt64 / int64(24*time.Hour))
+
+// parseTimeframe - Go durations plus the Sigma day suffix
+func parseTimeframe(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 || n > maxDays {
+			return 0, fmt.Errorf("invalid timeframe %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeframe %q", s)
+	}
+	return d, nil
+}
+
+// compileSelection - A map is the AND of its fields, a list of maps the OR
+// of them and a list of strings keywords searched in message and raw
+func compileSelection(v interface{}) (matcher, error) {
+	switch s := v.(type) {
+	case map[string]interface{}:
+		return compileMap(s)
+	case []interface{}:
+		var ms []matcher
+		for _, item := range s {
+			switch it := item.(type) {
+			case map[string]interface{}:
+				m, err := compileMap(it)
+				if err != nil {
+					return nil, err
+				}
+				ms = append(ms, m)
+			default:
+				vm, err := compileValue("contains", fmt.Sprint(it))
+				if err != nil {
+					return nil, err
+				}
+				ms = append(ms, func(ev *eventmodel.Event) bool {
+					return vm(ev.Message) || vm(ev.Raw)
+				})
+			}
+		}
+		return func(ev *eventmodel.Event) bool {
+			for _, m := range ms {
+				if m(ev) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, errors.New("must be a map or a list")
+}
+
+func compileMap(s map[string]interface{}) (matcher, error) {
+	// Sorted for stable error messages
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ms []matcher
+	for _, k := range keys {
+		parts := strings.Split(k, "|")
+		get, ok := fields[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", parts[0])
+		}
+		mod, all := "", false
+		for _, p := range parts[1:] {
+			if p == "all" {
+				all = true
+			} else if mod == "" {
+				mod = p
+			} else {
+				return nil, fmt.Errorf("%s: only one modifier besides all is supported", k)
+			}
+		}
+		var values []interface{}
+		if l, ok := s[k].([]interface{}); ok {
+			values = l
+		} else {
+			values = []interface{}{s[k]}
+		}
+		var vms []func(string) bool
+		for _, v := range values {
+			str := ""
+			if v != nil {
+				str = fmt.Sprint(v)
+			}
+			vm, err := compileValue(mod, str)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			vms = append(vms, vm)
+		}
+		ms = append(ms, func(ev *eventmodel.Event) bool {
+			val := get(ev)
+			for _, vm := range vms {
+				if vm(val) != all {
+					return !all
+				}
+			}
+			return all
+		})
+	}
+	return func(ev *eventmodel.Event) bool {
+		for _, m := range ms {
+			if !m(ev) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileValue - Case insensitive value match, plain values support * and ?
+// wildcards like Sigma
+func compileValue(mod, want string) (func(string) bool, error) {
+	lw := strings.ToLower(want)
+	switch mod {
+	case "":
+		if strings.ContainsAny(want, "*?") {
+			return func(v string) bool {
+				ok, _ := path.Match(lw, strings.ToLower(v))
+				return ok
+			}, nil
+		}
+		return func(v string) bool { return strings.EqualFold(v, want) }, nil
+	case "contains":
+		return func(v string) bool { return strings.Contains(strings.ToLower(v), lw) }, nil
+	case "startswith":
+		return func(v string) bool { return strings.HasPrefix(strings.ToLower(v), lw) }, nil
+	case "endswith":
+		return func(v string) bool { return strings.HasSuffix(strings.ToLower(v), lw) }, nil
+	case "re":
+		re, err := regexp.Compile(want)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case "cidr":
+		_, n, err := net.ParseCIDR(want)
+		if err != nil {
+			return nil, err
+		}
+		return func(v string) bool {
+			ip := net.ParseIP(v)
+			return ip != nil && n.Contains(ip)
+		}, nil
+	case "gt", "gte", "lt", "lte":
+		w, err := strconv.ParseFloat(want, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number", mod)
+		}
+		return func(v string) bool {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return false
+			}
+			switch mod {
+			case "gt":
+				return f > w
+			case "gte":
+				return f >= w
+			case "lt":
+				return f < w
+			}
+			return f <= w
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown modifier %q", mod)
+}
+
+// Eval - Feed one event to the rule, returns an alert when it fires
+func (r *Rule) Eval(ev *eventmodel.Event) *alertmodel.Alert {
+	if r.match == nil || !r.match(ev) {
+		return nil
+	}
+	a := &alertmodel.Alert{
+		Rule:     r.Id,
+		Severity: levels[r.Level],
+		SrcIp:    ev.SrcIp,
+		DstIp:    ev.DstIp,
+		Summary:  r.Title,
+	}
+	if r.Aggregation == nil {
+		a.Events = []eventmodel.Event{*ev}
+		return a
+	}
+
+	var key []string
+	for _, g := range r.Aggregation.GroupBy {
+		key = append(key, g+"="+fields[g](ev))
+	}
+	k := strings.Join(key, " ")
+	evs := r.window.Add(k, ev)
+	n := len(evs)
+	if f := r.Aggregation.Field; f != "" {
+		distinct := map[string]bool{}
+		for i := range evs {
+			distinct[fields[f](&evs[i])] = true
+		}
+		n = len(distinct)
+	}
+	if !r.Aggregation.match(n) {
+		return nil
+	}
+	r.window.Reset(k)
+	// Addresses only identify the alert when the events were grouped by them
+	if !r.groups("src_ip") {
+		a.SrcIp = ""
+	}
+	if !r.groups("dst_ip") {
+		a.DstIp = ""
+	}
+	a.Summary = fmt.Sprintf("%s: %d events within %s", r.Title, n, r.Timeframe)
+	if k != "" {
+		a.Summary = fmt.Sprintf("%s: %d events for %s within %s", r.Title, n, k, r.Timeframe)
+	}
+	a.Events = evs
+	return a
+}
+
+func (r *Rule) groups(field string) bool {
+	for _, g := range r.Aggregation.GroupBy {
+		if g == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+// Blocklist - Domain blocklist matched against DNS queries. Files hold one
+// domain per line, hosts file lines ("0.0.0.0 bad.example") and # comments
+// are accepted. A listed domain also matches all of its subdomains.
+type Blocklist struct {
+	Paths    []string
+	Severity string
+
+	mu      sync.RWMutex
+	domains map[string]bool
+	mtimes  map[string]time.Time
+}
+
+func NewBlocklist(paths []string, severity string) *Blocklist {
+	b := &Blocklist{
+		Paths:    paths,
+		Severity: severity,
+		domains:  map[string]bool{},
+		mtimes:   map[string]time.Time{},
+	}
+	if err := b.Load(); err != nil {
+		log.Println("DNS blocklist: ", err)
+	}
+	return b
+}
+
+// Load - Read all lists, replacing the domains in use
+func (b *Blocklist) Load() error {
+	domains := map[string]bool{}
+	mtimes := map[string]time.Time{}
+	var lasterr error
+	for _, path := range b.Paths {
+		f, err := os.Open(path)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		if st, err := f.Stat(); err == nil {
+			mtimes[path] = st.ModTime()
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			d := fields[len(fields)-1]
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if d != "" && d != "localhost" {
+				domains[d] = true
+			}
+		}
+		f.Close()
+	}
+	b.mu.Lock()
+	b.domains = domains
+	b.mtimes = mtimes
+	b.mu.Unlock()
+	return lasterr
+}
+
+// Watch - Reload the lists whenever one of the files changes
+func (b *Blocklist) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed := false
+		b.mu.RLock()
+		for _, path := range b.Paths {
+			st, err := os.Stat(path)
+			if err == nil && !st.ModTime().Equal(b.mtimes[path]) {
+				changed = true
+			}
+		}
+		b.mu.RUnlock()
+		if changed {
+			if err := b.Load(); err != nil {
+				log.Println("DNS blocklist: ", err)
+			}
+			log.Printf("DNS blocklist reloaded, %d domains\n", b.Len())
+		}
+	}
+}
+
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.domains)
+}
+
+// Match - Listed domain matching name or one of its parents
+func (b *Blocklist) Match(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for name != "" {
+		if b.domains[name] {
+			return name, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", false
+}
+
+func (b *Blocklist) Name() string {
+	return "dns-blocklist"
+}
+
+// Inspect - Alert on lookups of listed domains, one alert per client and
+// listed domain, query and reply lines of a lookup fold into it as well
+func (b *Blocklist) Inspect(ev *eventmodel.Event) []*alertmodel.Alert {
+	if ev.Type != "dns" || ev.Domain == "" {
+		return nil
+	}
+	listed, ok := b.Match(ev.Domain)
+	if !ok {
+		return nil
+	}
+	return []*alertmodel.Alert{{
+		Rule:        b.Name(),
+		Severity:    b.Severity,
+		SrcIp:       ev.SrcIp,
+		Summary:     fmt.Sprintf("%s queried blocklisted domain %s (%s)", ev.SrcIp, ev.Domain, listed),
+		Fingerprint: b.Name() + "|" + ev.SrcIp + "|" + listed,
+		Events:      []eventmodel.Event{*ev},
+	}}
+}
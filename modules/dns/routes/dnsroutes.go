@@ -0,0 +1,69 @@
+// Package dnsroutes - Arkgate API DNS analytics module
+//
+//	Module Routes:
+//	  /api/v1/dns/top-domains
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: src (client), since, until (RFC3339), limit
+//	    Return: JSON list of queried domains with query and client counts
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/dns/top-clients
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: domain, since, until (RFC3339), limit
+//	    Return: JSON list of clients with query and distinct domain counts
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package dnsroutes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/rbaylon/arkgate/modules/dns"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	eventroutes "github.com/rbaylon/arkgate/modules/events/routes"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func DnsRouter(db eventmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	top := func(by, distinct string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f, err := eventroutes.ParseFilter(r)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+				return
+			}
+			// Replies repeat the name of their query, count each lookup once
+			f.Type, f.Action = "dns", dns.KindQuery
+			if r.URL.Query().Get("limit") == "" {
+				f.Limit = 20
+			}
+			if f.Since.IsZero() {
+				f.Since = time.Now().Add(-24 * time.Hour)
+			}
+			res, errdb := db.Top(f, by, distinct)
+			if errdb != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+				return
+			}
+			render.JSON(w, r, res)
+		}
+	}
+	r.Get("/top-domains", top("domain", "src_ip"))
+	r.Get("/top-clients", top("src_ip", "domain"))
+	return r
+}
@@ -0,0 +1,127 @@
+// Package dns - unbound query and reply log parser and domain blocklist
+package dns
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+	"github.com/rbaylon/arkgate/modules/localutils/tail"
+)
+
+const (
+	KindQuery = "query"
+	KindReply = "reply"
+)
+
+// ErrNotQuery - Line is not an unbound query or reply log line
+var ErrNotQuery = errors.New("not an unbound query line")
+
+type Query struct {
+	Time     time.Time
+	Host     string
+	Kind     string
+	Client   string
+	Name     string
+	Type     string
+	Class    string
+	Rcode    string
+	Duration time.Duration
+	Cached   bool
+	Size     int
+	Raw      string
+}
+
+var (
+	// unbound logfile with epoch timestamps, or syslog
+	fileRe   = regexp.MustCompile(`^\[(\d+)\] unbound\[[\d:]+\] (.*)$`)
+	syslogRe = regexp.MustCompile(`^(\w{3} [ \d]\d \d\d:\d\d:\d\d) (?:(\S+) )?unbound(?::? ?\[[\d:]+\]:?) (.*)$`)
+	msgRe    = regexp.MustCompile(`^(?:info|query|reply): (\S+) (\S+) (\S+) (\S+)(?: (\S+) ([\d.]+) (\d) (\d+))?$`)
+)
+
+// Parse - Turn one unbound log-queries or log-replies line into a query.
+// Syslog timestamps carry no year, the one closest to now is assumed.
+func Parse(line string, now time.Time) (*Query, error) {
+	var ts time.Time
+	var host, msg string
+	if m := fileRe.FindStringSubmatch(line); m != nil {
+		secs, _ := strconv.ParseInt(m[1], 10, 64)
+		ts, msg = time.Unix(secs, 0), m[2]
+	} else if m := syslogRe.FindStringSubmatch(line); m != nil {
+		var err error
+		ts, err = time.ParseInLocation("Jan _2 15:04:05", m[1], now.Location())
+		if err != nil {
+			return nil, err
+		}
+		ts = ts.AddDate(now.Year(), 0, 0)
+		if ts.After(now.AddDate(0, 0, 1)) {
+			ts = ts.AddDate(-1, 0, 0)
+		}
+		host, msg = m[2], m[3]
+	} else {
+		return nil, ErrNotQuery
+	}
+	m := msgRe.FindStringSubmatch(msg)
+	if m == nil {
+		return nil, ErrNotQuery
+	}
+	q := &Query{
+		Time:   ts,
+		Host:   host,
+		Kind:   KindQuery,
+		Client: m[1],
+		Name:   strings.ToLower(strings.TrimSuffix(m[2], ".")),
+		Type:   m[3],
+		Class:  m[4],
+		Raw:    line,
+	}
+	if q.Name == "" {
+		q.Name = "."
+	}
+	if m[5] != "" {
+		q.Kind = KindReply
+		q.Rcode = m[5]
+		secs, _ := strconv.ParseFloat(m[6], 64)
+		q.Duration = time.Duration(secs * float64(time.Second))
+		q.Cached = m[7] == "1"
+		q.Size, _ = strconv.Atoi(m[8])
+	}
+	return q, nil
+}
+
+// ToEvent - Map to the arkgate event schema
+func (q *Query) ToEvent() eventmodel.Event {
+	source := q.Host
+	if source == "" {
+		source = "unbound"
+	}
+	return eventmodel.Event{
+		Timestamp: q.Time,
+		Type:      "dns",
+		Source:    source,
+		Action:    q.Kind,
+		SrcIp:     q.Client,
+		DstPort:   53,
+		Protocol:  "dns",
+		Domain:    q.Name,
+		QueryType: q.Type,
+		Rcode:     q.Rcode,
+		Message:   strings.TrimSpace(q.Name + " " + q.Type + " " + q.Class + " " + q.Rcode),
+		Raw:       q.Raw,
+	}
+}
+
+// Ingest - Follow an unbound log and publish DNS events to the pipeline
+func Ingest(path string, p *ingest.Pipeline) {
+	tail.Follow(path, false, func(line string) {
+		q, err := Parse(line, time.Now())
+		if err != nil {
+			return
+		}
+		p.Publish(q.ToEvent())
+	})
+}
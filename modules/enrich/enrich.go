@@ -0,0 +1,142 @@
+// Package enrich - Pipeline stage adding subscriber, interface, reverse DNS
+// and GeoIP/ASN context to events before they are stored
+package enrich
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	interfacemodel "github.com/rbaylon/arkgate/modules/interface/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+type subnet struct {
+	net    *net.IPNet
+	device string
+}
+
+// Enricher - Subscribers and local subnets are read from the DB on Load and
+// refreshed by Run, lookups during ingest never touch the DB
+type Enricher struct {
+	Subs   submodel.Crud
+	Ifaces interfacemodel.Crud
+	// Geo - Country and ASN databases, no GeoIP context when nil
+	Geo *GeoIP
+	// Resolver - Reverse DNS cache, no host names when nil
+	Resolver *Resolver
+
+	mu      sync.RWMutex
+	subs    map[string]*submodel.Sub
+	subnets []subnet
+}
+
+func New(subs submodel.Crud, ifaces interfacemodel.Crud) *Enricher {
+	e := &Enricher{
+		Subs:   subs,
+		Ifaces: ifaces,
+		subs:   map[string]*submodel.Sub{},
+	}
+	if err := e.Load(); err != nil {
+		log.Println("Enrich: ", err)
+	}
+	return e
+}
+
+// Load - Read subscribers by framed IP and interface subnets, most specific
+// subnet first
+func (e *Enricher) Load() error {
+	all, err := e.Subs.GetAll()
+	if err != nil {
+		return err
+	}
+	subs := make(map[string]*submodel.Sub, len(all))
+	for i := range all {
+		if ip := net.ParseIP(all[i].FramedIp); ip != nil {
+			subs[ip.String()] = &all[i]
+		}
+	}
+	ifaces, err := e.Ifaces.GetAll()
+	if err != nil {
+		return err
+	}
+	var subnets []subnet
+	for _, iface := range ifaces {
+		for _, ip := range iface.Ips {
+			_, n, err := net.ParseCIDR(ip.Ip + "/" + strconv.Itoa(ip.Prefix))
+			if err != nil {
+				continue
+			}
+			subnets = append(subnets, subnet{net: n, device: iface.Device})
+		}
+	}
+	sort.SliceStable(subnets, func(i, j int) bool {
+		a, _ := subnets[i].net.Mask.Size()
+		b, _ := subnets[j].net.Mask.Size()
+		return a > b
+	})
+	e.mu.Lock()
+	e.subs = subs
+	e.subnets = subnets
+	e.mu.Unlock()
+	return nil
+}
+
+// Run - Reload subscribers and subnets every interval, never returns
+func (e *Enricher) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.Load(); err != nil {
+			log.Println("Enrich: ", err)
+		}
+	}
+}
+
+// Enrich - Ingest pipeline Enricher
+func (e *Enricher) Enrich(ev *eventmodel.Event) {
+	src := net.ParseIP(ev.SrcIp)
+	dst := net.ParseIP(ev.DstIp)
+
+	e.mu.RLock()
+	for _, ip := range []net.IP{src, dst} {
+		if ip == nil {
+			continue
+		}
+		if sub, ok := e.subs[ip.String()]; ok && ev.SubID == 0 {
+			ev.SubID = sub.ID
+			ev.Subscriber = sub.Username
+		}
+		if ev.Interface == "" {
+			for _, s := range e.subnets {
+				if s.net.Contains(ip) {
+					ev.Interface = s.device
+					ev.Subnet = s.net.String()
+					break
+				}
+			}
+		}
+	}
+	e.mu.RUnlock()
+
+	if e.Resolver != nil {
+		if src != nil {
+			ev.SrcHost, _ = e.Resolver.Lookup(src)
+		}
+		if dst != nil {
+			ev.DstHost, _ = e.Resolver.Lookup(dst)
+		}
+	}
+	if e.Geo != nil {
+		if src != nil {
+			g := e.Geo.Lookup(src)
+			ev.SrcCountry, ev.SrcAsn, ev.SrcAsOrg = g.Country, g.Asn, g.AsOrg
+		}
+		if dst != nil {
+			g := e.Geo.Lookup(dst)
+			ev.DstCountry, ev.DstAsn, ev.DstAsOrg = g.Country, g.Asn, g.AsOrg
+		}
+	}
+}
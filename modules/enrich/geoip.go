@@ -0,0 +1,71 @@
+package enrich
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Geo - Country and autonomous system of an address
+type Geo struct {
+	Country string `json:"country"`
+	Asn     uint   `json:"asn"`
+	AsOrg   string `json:"as_org"`
+}
+
+// record - Fields read from GeoLite2/GeoIP2 Country, City and ASN databases
+type record struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIP - MaxMind format databases, e.g. a country and an ASN database.
+// Every database is consulted and the first value found for a field wins.
+type GeoIP struct {
+	readers []*maxminddb.Reader
+}
+
+func OpenGeoIP(paths []string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.readers = append(g.readers, r)
+	}
+	return g, nil
+}
+
+func (g *GeoIP) Close() {
+	for _, r := range g.readers {
+		r.Close()
+	}
+	g.readers = nil
+}
+
+// Lookup - Geo context of a public address, empty for local ones
+func (g *GeoIP) Lookup(ip net.IP) Geo {
+	var geo Geo
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return geo
+	}
+	for _, r := range g.readers {
+		var rec record
+		if err := r.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if geo.Country == "" {
+			geo.Country = rec.Country.IsoCode
+		}
+		if geo.Asn == 0 {
+			geo.Asn = rec.AutonomousSystemNumber
+			geo.AsOrg = rec.AutonomousSystemOrganization
+		}
+	}
+	return geo
+}
@@ -0,0 +1,96 @@
+package enrich
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cached struct {
+	name    string
+	expires time.Time
+}
+
+// Resolver - Reverse DNS cache. Lookups never block ingest: a miss queues
+// the address for a background worker and returns no name, events seen
+// after the answer arrived carry it. Failed lookups are cached as well.
+type Resolver struct {
+	TTL time.Duration
+	// MaxEntries - Cache size after which expired entries are dropped and,
+	// if still full, the whole cache is cleared
+	MaxEntries int
+	Timeout    time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]cached
+	pending map[string]bool
+	queue   chan string
+}
+
+func NewResolver(ttl time.Duration, workers int) *Resolver {
+	r := &Resolver{
+		TTL:        ttl,
+		MaxEntries: 50000,
+		Timeout:    2 * time.Second,
+		cache:      map[string]cached{},
+		pending:    map[string]bool{},
+		queue:      make(chan string, 1024),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// Lookup - Cached name of ip, ok is false when the answer is not known yet
+func (r *Resolver) Lookup(ip net.IP) (string, bool) {
+	key := ip.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.cache[key]; ok && time.Now().Before(c.expires) {
+		return c.name, true
+	}
+	if !r.pending[key] {
+		select {
+		case r.queue <- key:
+			r.pending[key] = true
+		default:
+			// Queue full, retried on a later event
+		}
+	}
+	return "", false
+}
+
+func (r *Resolver) work() {
+	for key := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+		names, _ := net.DefaultResolver.LookupAddr(ctx, key)
+		cancel()
+		name := ""
+		if len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+		r.mu.Lock()
+		delete(r.pending, key)
+		if len(r.cache) >= r.MaxEntries {
+			r.expire()
+		}
+		r.cache[key] = cached{name: name, expires: time.Now().Add(r.TTL)}
+		r.mu.Unlock()
+	}
+}
+
+// expire - Called with r.mu held
+func (r *Resolver) expire() {
+	now := time.Now()
+	for k, c := range r.cache {
+		if now.After(c.expires) {
+			delete(r.cache, k)
+		}
+	}
+	if len(r.cache) >= r.MaxEntries {
+		r.cache = map[string]cached{}
+	}
+}
@@ -0,0 +1,584 @@
+package eventmodel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ChainVersion - Version of the event hash layout written to new batches.
+// Version 2 adds the enrichment context, batches of version 1 are still
+// verified with the old layout.
+const ChainVersion = 2
+
+// Problems reported by Storage.Verify
+const (
+	ProblemChain      = "chain"      // batch does not link to its predecessor
+	ProblemGap        = "gap"        // batches or event ids are missing
+	ProblemModified   = "modified"   // event or batch content differs from its hash
+	ProblemDeleted    = "deleted"    // event was soft deleted
+	ProblemMissing    = "missing"    // event of a batch is gone
+	ProblemUnchained  = "unchained"  // event stored outside the chain
+	ProblemCheckpoint = "checkpoint" // checkpoint signature or hash mismatch
+	ProblemPrune      = "prune"      // pruned batch without a valid prune record
+)
+
+// EventBatch - One link of the hash chain. Hash covers PrevHash and the
+// hashes of events FirstEventID to LastEventID.
+type EventBatch struct {
+	gorm.Model
+	Version      int       `json:"version" bson:"version"`
+	FirstEventID uint      `json:"first_event_id" bson:"first_event_id"`
+	LastEventID  uint      `json:"last_event_id" bson:"last_event_id"`
+	Count        int       `json:"count" bson:"count"`
+	MinTime      time.Time `json:"min_time" bson:"min_time" gorm:"index"`
+	MaxTime      time.Time `json:"max_time" bson:"max_time" gorm:"index"`
+	PrevHash     string    `json:"prev_hash" bson:"prev_hash"`
+	Hash         string    `json:"hash" bson:"hash"`
+	// Pruned - Events of the batch were removed by retention, their hashes
+	// are kept in PrunedHashes, one per line, so the chain still verifies
+	Pruned       bool   `json:"pruned" bson:"pruned"`
+	PrunedHashes string `json:"-" bson:"pruned_hashes"`
+}
+
+// Checkpoint - Batch hash signed with the server key
+type Checkpoint struct {
+	gorm.Model
+	BatchID   uint      `json:"batchid" bson:"batchid" gorm:"index"`
+	Hash      string    `json:"hash" bson:"hash"`
+	SignedAt  time.Time `json:"signed_at" bson:"signed_at"`
+	PublicKey string    `json:"public_key" bson:"public_key"` // hex
+	Signature string    `json:"signature" bson:"signature"`   // base64
+}
+
+// PruneRecord - Signed statement that retention removed the events of a
+// batch, covers the batch hash and the digest of the hashes kept for them.
+// Without it anyone able to write the DB could delete events and mark
+// their batch pruned.
+type PruneRecord struct {
+	gorm.Model
+	BatchID   uint      `json:"batchid" bson:"batchid" gorm:"uniqueIndex"`
+	Hash      string    `json:"hash" bson:"hash"`
+	Digest    string    `json:"digest" bson:"digest"`
+	SignedAt  time.Time `json:"signed_at" bson:"signed_at"`
+	PublicKey string    `json:"public_key" bson:"public_key"` // hex, empty when unsigned
+	Signature string    `json:"signature" bson:"signature"`   // base64
+}
+
+// Problem - One finding of Storage.Verify
+type Problem struct {
+	Kind    string `json:"kind"`
+	BatchID uint   `json:"batchid,omitempty"`
+	EventID uint   `json:"eventid,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// VerifyReport - Result of verifying the chain over a time range
+type VerifyReport struct {
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	Ok          bool      `json:"ok"`
+	Batches     int       `json:"batches"`
+	Events      int       `json:"events"`
+	Checkpoints int       `json:"checkpoints"`
+	// Unsigned - Verified batches newer than the last checkpoint
+	Unsigned  int       `json:"unsigned"`
+	PublicKey string    `json:"public_key"`
+	Problems  []Problem `json:"problems"`
+}
+
+func (r *VerifyReport) problem(kind string, batch, event uint, format string, a ...interface{}) {
+	r.Problems = append(r.Problems, Problem{kind, batch, event, fmt.Sprintf(format, a...)})
+}
+
+// ComputeHash - Content hash of an event in the layout of a chain version,
+// covers its ID so renumbering shows
+func (e *Event) ComputeHash(version int) string {
+	fields := []interface{}{
+		e.ID, e.Timestamp.UTC().UnixNano(), e.Type, e.Source, e.Action, e.Severity,
+		e.SrcIp, e.SrcPort, e.DstIp, e.DstPort, e.Protocol, e.Username,
+		e.SignatureId, e.Signature, e.Category, e.Domain, e.QueryType, e.Rcode,
+		e.Message, e.Raw,
+	}
+	if version >= 2 {
+		fields = append(fields, e.SubID, e.Subscriber, e.Interface, e.Subnet,
+			e.SrcHost, e.DstHost, e.SrcCountry, e.DstCountry,
+			e.SrcAsn, e.DstAsn, e.SrcAsOrg, e.DstAsOrg)
+	}
+	b, _ := json.Marshal(fields)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func batchHash(b *EventBatch, hashes []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%s|%d|%d|%d\n", b.Version, b.PrevHash, b.FirstEventID, b.LastEventID, b.Count)
+	for _, eh := range hashes {
+		fmt.Fprintln(h, eh)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func checkpointMessage(c *Checkpoint) []byte {
+	return []byte(fmt.Sprintf("arkgate-checkpoint|%d|%s|%d", c.BatchID, c.Hash, c.SignedAt.Unix()))
+}
+
+func pruneMessage(p *PruneRecord) []byte {
+	return []byte(fmt.Sprintf("arkgate-prune|%d|%s|%s|%d", p.BatchID, p.Hash, p.Digest, p.SignedAt.Unix()))
+}
+
+// prunedDigest - Digest of the hashes a pruned batch keeps
+func prunedDigest(hashes string) string {
+	sum := sha256.Sum256([]byte(hashes))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadKey - Read the ed25519 server key from a PEM file, creating the file
+// and its directory with a fresh key when it does not exist
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, out, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+// chain - Assign ids and hashes to events and store them with their batch.
+// Called with s.mu held.
+func (s *Storage) chain(events []Event) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var prev EventBatch
+		result := tx.Order("id desc").Limit(1).Find(&prev)
+		if result.Error != nil {
+			return result.Error
+		}
+		// Pruning may have removed the newest events, ids are never reused
+		var maxid uint
+		if err := tx.Unscoped().Model(&Event{}).Select("COALESCE(MAX(id), 0)").Scan(&maxid).Error; err != nil {
+			return err
+		}
+		if prev.LastEventID > maxid {
+			maxid = prev.LastEventID
+		}
+		b := EventBatch{
+			Version:      ChainVersion,
+			FirstEventID: maxid + 1,
+			LastEventID:  maxid + uint(len(events)),
+			Count:        len(events),
+			MinTime:      events[0].Timestamp,
+			MaxTime:      events[0].Timestamp,
+			PrevHash:     prev.Hash,
+		}
+		hashes := make([]string, len(events))
+		for i := range events {
+			events[i].ID = maxid + uint(i) + 1
+			if events[i].Timestamp.Before(b.MinTime) {
+				b.MinTime = events[i].Timestamp
+			}
+			if events[i].Timestamp.After(b.MaxTime) {
+				b.MaxTime = events[i].Timestamp
+			}
+			events[i].Hash = events[i].ComputeHash(b.Version)
+			hashes[i] = events[i].Hash
+		}
+		b.Hash = batchHash(&b, hashes)
+		if err := tx.Create(&b).Error; err != nil {
+			return err
+		}
+		for i := range events {
+			events[i].BatchID = b.ID
+		}
+		return tx.CreateInBatches(&events, 500).Error
+	})
+}
+
+// Checkpoint - Sign the newest batch unless it is already signed
+func (s *Storage) Checkpoint() (*Checkpoint, error) {
+	if s.Key == nil {
+		return nil, errors.New("no signing key configured")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last EventBatch
+	result := s.DB.Order("id desc").Limit(1).Find(&last)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if last.ID == 0 {
+		return nil, nil
+	}
+	var cp Checkpoint
+	result = s.DB.Order("id desc").Limit(1).Find(&cp)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if cp.BatchID == last.ID {
+		return &cp, nil
+	}
+	cp = Checkpoint{
+		BatchID:   last.ID,
+		Hash:      last.Hash,
+		SignedAt:  time.Now().Truncate(time.Second),
+		PublicKey: hex.EncodeToString(s.Key.Public().(ed25519.PublicKey)),
+	}
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, checkpointMessage(&cp)))
+	result = s.DB.Create(&cp)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &cp, nil
+}
+
+// RunCheckpoints - Sign the chain head every interval
+func (s *Storage) RunCheckpoints(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := s.Checkpoint(); err != nil {
+			log.Println("Event checkpoint error: ", err)
+		}
+	}
+}
+
+func (s *Storage) GetCheckpoints(limit int) ([]Checkpoint, error) {
+	var cps []Checkpoint
+	result := s.DB.Order("id desc").Limit(limit).Find(&cps)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return cps, nil
+}
+
+// Verify - Recompute the chain for batches holding events between since and
+// until, reporting broken links, gaps, modified, deleted or unchained
+// events, bad checkpoints and pruned batches without a valid prune record
+func (s *Storage) Verify(since, until time.Time) (*VerifyReport, error) {
+	rep := &VerifyReport{Since: since, Until: until, Problems: []Problem{}}
+	if s.Key != nil {
+		rep.PublicKey = hex.EncodeToString(s.Key.Public().(ed25519.PublicKey))
+	}
+	q := s.DB.Order("id")
+	if !since.IsZero() {
+		q = q.Where("max_time >= ?", since.UTC())
+	}
+	if !until.IsZero() {
+		q = q.Where("min_time < ?", until.UTC())
+	}
+	var batches []EventBatch
+	if err := q.Find(&batches).Error; err != nil {
+		return nil, err
+	}
+	rep.Batches = len(batches)
+
+	var prev *EventBatch
+	if len(batches) > 0 {
+		var p EventBatch
+		if err := s.DB.Where("id < ?", batches[0].ID).Order("id desc").Limit(1).Find(&p).Error; err != nil {
+			return nil, err
+		}
+		if p.ID != 0 {
+			prev = &p
+		} else if batches[0].PrevHash != "" {
+			rep.problem(ProblemGap, batches[0].ID, 0, "predecessor of batch %d is missing", batches[0].ID)
+		}
+	}
+	for i := range batches {
+		b := &batches[i]
+		if prev != nil {
+			if b.PrevHash != prev.Hash {
+				rep.problem(ProblemChain, b.ID, 0, "batch %d does not link to batch %d", b.ID, prev.ID)
+			}
+			if b.ID != prev.ID+1 || b.FirstEventID != prev.LastEventID+1 {
+				rep.problem(ProblemGap, b.ID, 0, "batches or events missing between batch %d and %d", prev.ID, b.ID)
+			}
+		}
+		if err := s.verifyBatch(b, rep); err != nil {
+			return nil, err
+		}
+		prev = b
+	}
+
+	// Events added behind the chain's back, older events predate chaining
+	if len(batches) > 0 {
+		var stray []Event
+		q := s.DB.Unscoped().Where("id > ? AND (batch_id IS NULL OR batch_id = 0)", batches[0].FirstEventID)
+		if !since.IsZero() {
+			q = q.Where("timestamp >= ?", since.UTC())
+		}
+		if !until.IsZero() {
+			q = q.Where("timestamp < ?", until.UTC())
+		}
+		if err := q.Find(&stray).Error; err != nil {
+			return nil, err
+		}
+		for _, e := range stray {
+			rep.problem(ProblemUnchained, 0, e.ID, "event %d is not part of any batch", e.ID)
+		}
+	}
+
+	if err := s.verifyCheckpoints(batches, rep); err != nil {
+		return nil, err
+	}
+	rep.Ok = len(rep.Problems) == 0
+	return rep, nil
+}
+
+func (s *Storage) verifyBatch(b *EventBatch, rep *VerifyReport) error {
+	var events []Event
+	result := s.DB.Unscoped().Where("id BETWEEN ? AND ?", b.FirstEventID, b.LastEventID).Order("id").Find(&events)
+	if result.Error != nil {
+		return result.Error
+	}
+	rep.Events += len(events)
+	var pruned []string
+	if b.Pruned {
+		if err := s.verifyPrune(b, rep); err != nil {
+			return err
+		}
+		pruned = strings.Split(b.PrunedHashes, "\n")
+		if len(pruned) != b.Count {
+			rep.problem(ProblemModified, b.ID, 0, "batch %d lists %d of %d pruned hashes", b.ID, len(pruned), b.Count)
+			pruned = nil
+		}
+	} else if len(events) != b.Count {
+		rep.problem(ProblemMissing, b.ID, 0, "batch %d holds %d of %d events", b.ID, len(events), b.Count)
+	}
+	byid := make(map[uint]*Event, len(events))
+	for i := range events {
+		byid[events[i].ID] = &events[i]
+	}
+	hashes := make([]string, 0, b.Count)
+	for id := b.FirstEventID; id <= b.LastEventID; id++ {
+		var listed string
+		if pruned != nil {
+			listed = pruned[id-b.FirstEventID]
+		}
+		e, ok := byid[id]
+		if !ok {
+			if !b.Pruned {
+				rep.problem(ProblemMissing, b.ID, id, "event %d is gone", id)
+			}
+			hashes = append(hashes, listed)
+			continue
+		}
+		h := e.ComputeHash(b.Version)
+		hashes = append(hashes, h)
+		switch {
+		case e.BatchID != b.ID:
+			rep.problem(ProblemModified, b.ID, id, "event %d claims batch %d", id, e.BatchID)
+		case h != e.Hash || (pruned != nil && h != listed):
+			rep.problem(ProblemModified, b.ID, id, "event %d content does not match its hash", id)
+		}
+		if e.DeletedAt.Valid {
+			rep.problem(ProblemDeleted, b.ID, id, "event %d was deleted at %s", id, e.DeletedAt.Time.Format(time.RFC3339))
+		}
+	}
+	if batchHash(b, hashes) != b.Hash {
+		rep.problem(ProblemModified, b.ID, 0, "batch %d hash does not match its events", b.ID)
+	}
+	return nil
+}
+
+// verifyPrune - Check the prune record of a pruned batch. Unsigned records
+// are only accepted when the verifier has no key either.
+func (s *Storage) verifyPrune(b *EventBatch, rep *VerifyReport) error {
+	var rec PruneRecord
+	result := s.DB.Where("batch_id = ?", b.ID).Limit(1).Find(&rec)
+	if result.Error != nil {
+		return result.Error
+	}
+	if rec.ID == 0 {
+		rep.problem(ProblemPrune, b.ID, 0, "batch %d is marked pruned without a prune record", b.ID)
+		return nil
+	}
+	if rec.Hash != b.Hash || rec.Digest != prunedDigest(b.PrunedHashes) {
+		rep.problem(ProblemPrune, b.ID, 0, "prune record %d does not match batch %d", rec.ID, b.ID)
+		return nil
+	}
+	if rec.Signature == "" {
+		if rep.PublicKey != "" {
+			rep.problem(ProblemPrune, b.ID, 0, "prune record %d is not signed", rec.ID)
+		}
+		return nil
+	}
+	pub, err := hex.DecodeString(rec.PublicKey)
+	sig, err2 := base64.StdEncoding.DecodeString(rec.Signature)
+	switch {
+	case err != nil || err2 != nil || len(pub) != ed25519.PublicKeySize:
+		rep.problem(ProblemPrune, b.ID, 0, "prune record %d is malformed", rec.ID)
+	case rep.PublicKey != "" && rec.PublicKey != rep.PublicKey:
+		rep.problem(ProblemPrune, b.ID, 0, "prune record %d was signed by another key", rec.ID)
+	case !ed25519.Verify(pub, pruneMessage(&rec), sig):
+		rep.problem(ProblemPrune, b.ID, 0, "prune record %d signature is invalid", rec.ID)
+	}
+	return nil
+}
+
+func (s *Storage) verifyCheckpoints(batches []EventBatch, rep *VerifyReport) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	first, last := batches[0].ID, batches[len(batches)-1].ID
+	var cps []Checkpoint
+	result := s.DB.Where("batch_id BETWEEN ? AND ?", first, last).Order("batch_id").Find(&cps)
+	if result.Error != nil {
+		return result.Error
+	}
+	rep.Checkpoints = len(cps)
+	hashes := make(map[uint]string, len(batches))
+	for _, b := range batches {
+		hashes[b.ID] = b.Hash
+	}
+	var signed uint
+	for i := range cps {
+		cp := &cps[i]
+		pub, err := hex.DecodeString(cp.PublicKey)
+		sig, err2 := base64.StdEncoding.DecodeString(cp.Signature)
+		switch {
+		case err != nil || err2 != nil || len(pub) != ed25519.PublicKeySize:
+			rep.problem(ProblemCheckpoint, cp.BatchID, 0, "checkpoint %d is malformed", cp.ID)
+			continue
+		case rep.PublicKey != "" && cp.PublicKey != rep.PublicKey:
+			rep.problem(ProblemCheckpoint, cp.BatchID, 0, "checkpoint %d was signed by another key", cp.ID)
+			continue
+		case !ed25519.Verify(pub, checkpointMessage(cp), sig):
+			rep.problem(ProblemCheckpoint, cp.BatchID, 0, "checkpoint %d signature is invalid", cp.ID)
+			continue
+		case hashes[cp.BatchID] != cp.Hash:
+			rep.problem(ProblemCheckpoint, cp.BatchID, 0, "checkpoint %d does not match batch %d", cp.ID, cp.BatchID)
+			continue
+		}
+		signed = cp.BatchID
+	}
+	for _, b := range batches {
+		if b.ID > signed {
+			rep.Unsigned++
+		}
+	}
+	return nil
+}
+
+// Prune - Permanently remove events matching f, Limit at a time. archive is
+// called with every chunk before it is deleted and aborts the prune on
+// error. Batches losing events keep the hashes of all their events so the
+// chain still verifies. Returns the number of events removed.
+func (s *Storage) Prune(f *Filter, archive func(events []Event) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Limit <= 0 {
+		f.Limit = 1000
+	}
+	total := 0
+	for {
+		var events []Event
+		result := s.filter(f).Unscoped().Order("id").Find(&events)
+		if result.Error != nil {
+			return total, result.Error
+		}
+		if len(events) == 0 {
+			return total, nil
+		}
+		if archive != nil {
+			if err := archive(events); err != nil {
+				return total, err
+			}
+		}
+		err := s.DB.Transaction(func(tx *gorm.DB) error {
+			ids := make([]uint, len(events))
+			batches := map[uint]bool{}
+			for i, e := range events {
+				ids[i] = e.ID
+				if e.BatchID != 0 {
+					batches[e.BatchID] = true
+				}
+			}
+			for id := range batches {
+				if err := s.keepHashes(tx, id); err != nil {
+					return err
+				}
+			}
+			return tx.Unscoped().Delete(&Event{}, ids).Error
+		})
+		if err != nil {
+			return total, err
+		}
+		total += len(events)
+	}
+}
+
+// keepHashes - Record the event hashes of a batch before its first prune,
+// with a prune record signed by the server key when one is configured
+func (s *Storage) keepHashes(tx *gorm.DB, id uint) error {
+	var b EventBatch
+	if err := tx.First(&b, id).Error; err != nil {
+		return err
+	}
+	if b.Pruned {
+		return nil
+	}
+	var events []Event
+	result := tx.Unscoped().Select("id", "hash").Where("id BETWEEN ? AND ?", b.FirstEventID, b.LastEventID).Order("id").Find(&events)
+	if result.Error != nil {
+		return result.Error
+	}
+	byid := make(map[uint]string, len(events))
+	for _, e := range events {
+		byid[e.ID] = e.Hash
+	}
+	hashes := make([]string, 0, b.Count)
+	for i := b.FirstEventID; i <= b.LastEventID; i++ {
+		hashes = append(hashes, byid[i])
+	}
+	kept := strings.Join(hashes, "\n")
+	if err := tx.Model(&b).Updates(map[string]interface{}{"pruned": true, "pruned_hashes": kept}).Error; err != nil {
+		return err
+	}
+	rec := PruneRecord{BatchID: b.ID, Hash: b.Hash, Digest: prunedDigest(kept), SignedAt: time.Now().Truncate(time.Second)}
+	if s.Key != nil {
+		rec.PublicKey = hex.EncodeToString(s.Key.Public().(ed25519.PublicKey))
+		rec.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, pruneMessage(&rec)))
+	}
+	return tx.Create(&rec).Error
+}
@@ -0,0 +1,130 @@
+package eventmodel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testChain - Storage with a signing key and two batches, old events of
+// type "old" and new ones of type "new"
+func testChain(t *testing.T) *Storage {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	s := New(db)
+	if _, s.Key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := s.AddBatch([]Event{{Type: "old", Timestamp: now.Add(-48 * time.Hour)}, {Type: "old", Timestamp: now.Add(-48 * time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBatch([]Event{{Type: "new", Timestamp: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func problems(t *testing.T, s *Storage) []string {
+	t.Helper()
+	rep, err := s.Verify(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, p := range rep.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	if rep.Ok != (len(kinds) == 0) {
+		t.Errorf("ok %v with problems %v", rep.Ok, kinds)
+	}
+	return kinds
+}
+
+func TestVerify(t *testing.T) {
+	s := testChain(t)
+	if p := problems(t, s); len(p) != 0 {
+		t.Fatalf("fresh chain: %v", p)
+	}
+	s.DB.Model(&Event{}).Where("id = ?", 3).Update("message", "changed")
+	if p := problems(t, s); !slices.Contains(p, ProblemModified) {
+		t.Errorf("modified event: %v", p)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := testChain(t)
+	n, err := s.Prune(&Filter{Type: "old"}, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("pruned %d, %v", n, err)
+	}
+	if p := problems(t, s); len(p) != 0 {
+		t.Errorf("after prune: %v", p)
+	}
+
+	// The record covers the kept hashes
+	s.DB.Model(&EventBatch{}).Where("id = ?", 1).Update("pruned_hashes", "x\ny")
+	if p := problems(t, s); !slices.Contains(p, ProblemPrune) {
+		t.Errorf("edited hashes: %v", p)
+	}
+}
+
+func TestForgedPrune(t *testing.T) {
+	tests := []struct {
+		name  string
+		forge func(s *Storage, b *EventBatch, kept string)
+	}{
+		{"no record", func(s *Storage, b *EventBatch, kept string) {}},
+		{"unsigned record", func(s *Storage, b *EventBatch, kept string) {
+			s.DB.Create(&PruneRecord{BatchID: b.ID, Hash: b.Hash, Digest: prunedDigest(kept), SignedAt: time.Now()})
+		}},
+		{"other key", func(s *Storage, b *EventBatch, kept string) {
+			pub, key, _ := ed25519.GenerateKey(rand.Reader)
+			rec := PruneRecord{BatchID: b.ID, Hash: b.Hash, Digest: prunedDigest(kept), SignedAt: time.Now().Truncate(time.Second)}
+			rec.PublicKey = hex.EncodeToString(pub)
+			rec.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, pruneMessage(&rec)))
+			s.DB.Create(&rec)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testChain(t)
+			// Delete the events behind retention's back and paste their hashes
+			var events []Event
+			s.DB.Where("batch_id = ?", 1).Order("id").Find(&events)
+			hashes := make([]string, len(events))
+			for i, e := range events {
+				hashes[i] = e.Hash
+			}
+			kept := strings.Join(hashes, "\n")
+			s.DB.Unscoped().Where("batch_id = ?", 1).Delete(&Event{})
+			s.DB.Model(&EventBatch{}).Where("id = ?", 1).Updates(map[string]interface{}{"pruned": true, "pruned_hashes": kept})
+			var b EventBatch
+			s.DB.First(&b, 1)
+			tt.forge(s, &b, kept)
+			if p := problems(t, s); !slices.Contains(p, ProblemPrune) {
+				t.Errorf("forged prune verifies: %v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+// Package events - Security event specific functions
+package eventmodel
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Event struct {
+	gorm.Model
+	Timestamp   time.Time `json:"timestamp" bson:"timestamp" gorm:"index"`
+	Type        string    `json:"type" bson:"type" gorm:"index"` // pflog, auth, ids, dns, ...
+	Source      string    `json:"source" bson:"source"`          // host or ingester that produced the event
+	Action      string    `json:"action" bson:"action"`
+	Severity    int       `json:"severity" bson:"severity"`
+	SrcIp       string    `json:"src_ip" bson:"src_ip" gorm:"index"`
+	SrcPort     int       `json:"src_port" bson:"src_port"`
+	DstIp       string    `json:"dst_ip" bson:"dst_ip"`
+	DstPort     int       `json:"dst_port" bson:"dst_port"`
+	Protocol    string    `json:"protocol" bson:"protocol"`
+	Username    string    `json:"username" bson:"username"`
+	SignatureId int       `json:"signature_id" bson:"signature_id" gorm:"index"` // IDS signature
+	Signature   string    `json:"signature" bson:"signature"`
+	Category    string    `json:"category" bson:"category"`
+	Domain      string    `json:"domain" bson:"domain" gorm:"index"` // DNS query name, HTTP host or TLS SNI
+	QueryType   string    `json:"query_type" bson:"query_type"`
+	Rcode       string    `json:"rcode" bson:"rcode"`
+	Message     string    `json:"message" bson:"message"`
+	Raw         string    `json:"raw" bson:"raw"`
+	// Context added by the enrichment stage before the event is stored
+	SubID      uint   `json:"subid" bson:"subid" gorm:"index"`
+	Subscriber string `json:"subscriber" bson:"subscriber"`
+	Interface  string `json:"interface" bson:"interface"`
+	Subnet     string `json:"subnet" bson:"subnet"`
+	SrcHost    string `json:"src_host" bson:"src_host"`
+	DstHost    string `json:"dst_host" bson:"dst_host"`
+	SrcCountry string `json:"src_country" bson:"src_country"`
+	DstCountry string `json:"dst_country" bson:"dst_country"`
+	SrcAsn     uint   `json:"src_asn" bson:"src_asn"`
+	DstAsn     uint   `json:"dst_asn" bson:"dst_asn"`
+	SrcAsOrg   string `json:"src_as_org" bson:"src_as_org"`
+	DstAsOrg   string `json:"dst_as_org" bson:"dst_as_org"`
+	BatchID    uint   `json:"batchid" bson:"batchid" gorm:"index"`
+	Hash       string `json:"hash" bson:"hash"`
+}
+
+// Filter - Query parameters accepted by Storage.Find
+type Filter struct {
+	Type   string
+	Action string
+	SrcIp  string
+	DstIp  string
+	Domain string
+	SubID  uint
+	// NotTypes - Types excluded when Type is empty
+	NotTypes []string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// Count - One row of a top-N aggregate, Distinct counts the distinct
+// values of a second column within the group
+type Count struct {
+	Key      string `json:"key"`
+	Count    int64  `json:"count"`
+	Distinct int64  `json:"distinct"`
+}
+
+// topColumns - Columns Storage.Top may group by
+var topColumns = map[string]bool{
+	"type":         true,
+	"action":       true,
+	"src_ip":       true,
+	"dst_ip":       true,
+	"dst_port":     true,
+	"username":     true,
+	"signature_id": true,
+	"domain":       true,
+	"query_type":   true,
+	"rcode":        true,
+	"subscriber":   true,
+	"interface":    true,
+	"src_country":  true,
+	"dst_country":  true,
+	"src_asn":      true,
+	"dst_asn":      true,
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Event{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&EventBatch{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Checkpoint{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&PruneRecord{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateUTC(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateUTC - Rewrite timestamps stored with a local zone offset in UTC.
+// SQLite compares the stored strings, so every row and every bound has to
+// be in the same zone. The instants and therefore the hashes do not change.
+func migrateUTC(db *gorm.DB) error {
+	var events []Event
+	err := db.Unscoped().Select("id, timestamp").Where("timestamp NOT LIKE ?", "%+00:00").
+		FindInBatches(&events, 1000, func(tx *gorm.DB, n int) error {
+			for _, e := range events {
+				if err := db.Unscoped().Model(&Event{}).Where("id = ?", e.ID).
+					UpdateColumn("timestamp", e.Timestamp.UTC()).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+	var batches []EventBatch
+	if err := db.Where("min_time NOT LIKE ? OR max_time NOT LIKE ?", "%+00:00", "%+00:00").Find(&batches).Error; err != nil {
+		return err
+	}
+	for _, b := range batches {
+		err := db.Model(&EventBatch{}).Where("id = ?", b.ID).
+			UpdateColumns(map[string]interface{}{"min_time": b.MinTime.UTC(), "max_time": b.MaxTime.UTC()}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bind interface as required by go-chi/render
+func (a *Event) Bind(r *http.Request) error {
+	return nil
+}
+
+type Crud interface {
+	GetAll() ([]Event, error)
+	GetById(uid uint) (*Event, error)
+	Add(event *Event) error
+	AddBatch(events []Event) error
+	Find(f *Filter) ([]Event, error)
+	Each(f *Filter, fn func(events []Event) error) error
+	Top(f *Filter, by string, distinct string) ([]Count, error)
+	Delete(event *Event) error
+	Checkpoint() (*Checkpoint, error)
+	GetCheckpoints(limit int) ([]Checkpoint, error)
+	Verify(since, until time.Time) (*VerifyReport, error)
+	Prune(f *Filter, archive func(events []Event) error) (int, error)
+	GetDB() *gorm.DB
+}
+
+// Storage - Events are only ever appended through Add and AddBatch, which
+// chain them, see chain.go
+type Storage struct {
+	DB *gorm.DB
+	// Key - Server key signing checkpoints
+	Key ed25519.PrivateKey
+	mu  sync.Mutex
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) Add(event *Event) error {
+	events := []Event{*event}
+	if err := s.AddBatch(events); err != nil {
+		return err
+	}
+	*event = events[0]
+	return nil
+}
+
+// AddBatch - Store events as one link of the hash chain, ids and hashes are
+// set on the given events
+func (s *Storage) AddBatch(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	for i := range events {
+		if events[i].Timestamp.IsZero() {
+			events[i].Timestamp = time.Now()
+		}
+		// Stored in UTC so string comparisons in SQLite order correctly
+		events[i].Timestamp = events[i].Timestamp.UTC()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chain(events)
+}
+
+func (s *Storage) GetAll() ([]Event, error) {
+	var events []Event
+	result := s.DB.Order("timestamp desc").Find(&events)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return events, nil
+}
+
+func (s *Storage) GetById(id uint) (*Event, error) {
+	var event Event
+	result := s.DB.First(&event, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &event, nil
+}
+
+func (s *Storage) filter(f *Filter) *gorm.DB {
+	q := s.DB.Model(&Event{})
+	if f.Type != "" {
+		q = q.Where("type = ?", f.Type)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.Type == "" && len(f.NotTypes) > 0 {
+		q = q.Where("type NOT IN ?", f.NotTypes)
+	}
+	if f.SrcIp != "" {
+		q = q.Where("src_ip = ?", f.SrcIp)
+	}
+	if f.DstIp != "" {
+		q = q.Where("dst_ip = ?", f.DstIp)
+	}
+	if f.Domain != "" {
+		q = q.Where("domain = ?", f.Domain)
+	}
+	if f.SubID != 0 {
+		q = q.Where("sub_id = ?", f.SubID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("timestamp >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("timestamp < ?", f.Until.UTC())
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	return q
+}
+
+func (s *Storage) Find(f *Filter) ([]Event, error) {
+	var events []Event
+	result := s.filter(f).Order("timestamp desc").Find(&events)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return events, nil
+}
+
+// Each - Hand every event matching f to fn in pages, oldest first. A
+// limit in f caps the total number of events.
+func (s *Storage) Each(f *Filter, fn func(events []Event) error) error {
+	page := *f
+	var last *Event
+	total := 0
+	for {
+		page.Limit = 1000
+		if f.Limit > 0 && f.Limit-total < page.Limit {
+			page.Limit = f.Limit - total
+		}
+		if page.Limit <= 0 {
+			return nil
+		}
+		q := s.filter(&page).Order("timestamp, id")
+		if last != nil {
+			at := last.Timestamp.UTC()
+			q = q.Where("(timestamp > ? OR (timestamp = ? AND id > ?))", at, at, last.ID)
+		}
+		var events []Event
+		if err := q.Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if err := fn(events); err != nil {
+			return err
+		}
+		total += len(events)
+		last = &events[len(events)-1]
+	}
+}
+
+// Top - Event counts grouped by column by, most frequent first. When
+// distinct is set the distinct values of that column are counted too.
+func (s *Storage) Top(f *Filter, by string, distinct string) ([]Count, error) {
+	if !topColumns[by] {
+		return nil, fmt.Errorf("cannot aggregate events by %q", by)
+	}
+	if distinct != "" && !topColumns[distinct] {
+		return nil, fmt.Errorf("cannot count distinct %q", distinct)
+	}
+	sel := "CAST(" + by + " AS TEXT) AS key, COUNT(*) AS count"
+	if distinct != "" {
+		sel += ", COUNT(DISTINCT " + distinct + ") AS \"distinct\""
+	}
+	var res []Count
+	result := s.filter(f).Select(sel).Where(by + " <> ''").Group(by).Order("count desc").Scan(&res)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return res, nil
+}
+
+func (s *Storage) Delete(event *Event) error {
+	result := s.DB.Delete(event)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package eventroutes - Arkgate API Event module
+//
+//	Module Routes:
+//	  /api/v1/events
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: type, src, dst, domain, sub (subscriber ID), since, until (RFC3339), limit
+//	    Return: JSON object with list of event objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/events/verify
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: since, until (RFC3339)
+//	    Return: JSON verification report, "ok" is false and "problems" lists
+//	            broken links, gaps, modified, deleted or unchained events,
+//	            bad checkpoints and pruned batches without a valid signed
+//	            prune record when the chain does not verify
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/events/checkpoints
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: limit
+//	    Return: JSON list of signed checkpoints, newest first
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/events/<eventId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON event object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package eventroutes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func EventRouter(db eventmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		f, err := ParseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		res, errdb := db.Find(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/verify", func(w http.ResponseWriter, r *http.Request) {
+		f, err := ParseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		rep, errdb := db.Verify(f.Since, f.Until)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, rep)
+	})
+	r.Get("/checkpoints", func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid limit %s", v), http.StatusBadRequest))
+				return
+			}
+			limit = l
+		}
+		cps, errdb := db.GetCheckpoints(limit)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, cps)
+	})
+	r.Get("/{eventId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "eventId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid event ID %s", chi.URLParam(r, "eventId")), http.StatusBadRequest))
+			return
+		}
+		event, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, event)
+	})
+	return r
+}
+
+// ParseFilter - Build an event filter from the request query string
+func ParseFilter(r *http.Request) (*eventmodel.Filter, error) {
+	q := r.URL.Query()
+	f := &eventmodel.Filter{
+		Type:   q.Get("type"),
+		SrcIp:  q.Get("src"),
+		DstIp:  q.Get("dst"),
+		Domain: q.Get("domain"),
+		Limit:  1000,
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("sub"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		f.SubID = uint(id)
+	}
+	return f, nil
+}
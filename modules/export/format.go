@@ -0,0 +1,218 @@
+// Package export - Event and alert serialisation for external SIEMs and the
+// syslog forwarder
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+const (
+	FormatCEF  = "cef"
+	FormatLEEF = "leef"
+	FormatJSON = "jsonl"
+
+	Vendor  = "Arkgate"
+	Product = "arkgate"
+	Version = "1.0"
+)
+
+// Formats - Supported format names and their content types
+var Formats = map[string]string{
+	FormatCEF:  "text/plain; charset=utf-8",
+	FormatLEEF: "text/plain; charset=utf-8",
+	FormatJSON: "application/x-ndjson",
+}
+
+// Valid - Check a format name
+func Valid(format string) error {
+	if _, ok := Formats[format]; !ok {
+		return fmt.Errorf("unknown export format %q, use cef, leef or jsonl", format)
+	}
+	return nil
+}
+
+// kv - Ordered extension fields, empty values are left out
+type kv [][2]string
+
+func (x *kv) add(k, v string) {
+	if v != "" && v != "0" {
+		*x = append(*x, [2]string{k, v})
+	}
+}
+
+var (
+	cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefValue  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	leefValue = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+func cef(sigid, name string, severity int, ext kv) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|", Vendor, Product, Version,
+		cefHeader.Replace(sigid), cefHeader.Replace(name), severity)
+	for i, f := range ext {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f[0] + "=" + cefValue.Replace(f[1]))
+	}
+	return b.String()
+}
+
+func leef(eventid string, ext kv) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|", Vendor, Product, Version, cefHeader.Replace(eventid))
+	for i, f := range ext {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(f[0] + "=" + leefValue.Replace(f[1]))
+	}
+	return b.String()
+}
+
+func millis(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// leefTimeFormat - Java date pattern of leefTime
+const leefTimeFormat = "MMM dd yyyy HH:mm:ss.SSS z"
+
+func leefTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("Jan 02 2006 15:04:05.000 MST")
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+// eventSeverity - Event severity 0 to 4 on the 0 to 10 CEF and LEEF scale
+func eventSeverity(s int) int {
+	switch {
+	case s <= 0:
+		return 1
+	case s >= 4:
+		return 10
+	}
+	return []int{1, 3, 5, 8}[s]
+}
+
+var alertSeverity = map[string]int{
+	"low":      3,
+	"medium":   5,
+	"high":     8,
+	"critical": 10,
+}
+
+func eventId(ev *eventmodel.Event) string {
+	if ev.SignatureId != 0 {
+		return ev.Type + ":" + itoa(ev.SignatureId)
+	}
+	if ev.Action != "" {
+		return ev.Type + ":" + ev.Action
+	}
+	return ev.Type
+}
+
+// Event - Serialise one event
+func Event(format string, ev *eventmodel.Event) (string, error) {
+	switch format {
+	case FormatJSON:
+		b, err := json.Marshal(ev)
+		return string(b), err
+	case FormatCEF:
+		name := ev.Signature
+		if name == "" {
+			name = ev.Message
+		}
+		var x kv
+		x.add("rt", millis(ev.Timestamp))
+		x.add("externalId", strconv.FormatUint(uint64(ev.ID), 10))
+		x.add("cat", ev.Type)
+		x.add("act", ev.Action)
+		x.add("src", ev.SrcIp)
+		x.add("spt", itoa(ev.SrcPort))
+		x.add("dst", ev.DstIp)
+		x.add("dpt", itoa(ev.DstPort))
+		x.add("app", ev.Protocol)
+		x.add("suser", ev.Username)
+		x.add("dhost", ev.Domain)
+		x.add("dvchost", ev.Source)
+		if ev.Category != "" {
+			x.add("cs1Label", "category")
+			x.add("cs1", ev.Category)
+		}
+		x.add("msg", ev.Message)
+		return cef(eventId(ev), name, eventSeverity(ev.Severity), x), nil
+	case FormatLEEF:
+		var x kv
+		x.add("devTime", leefTime(ev.Timestamp))
+		x.add("devTimeFormat", leefTimeFormat)
+		x.add("externalId", strconv.FormatUint(uint64(ev.ID), 10))
+		x.add("cat", ev.Type)
+		x.add("sev", itoa(eventSeverity(ev.Severity)))
+		x.add("action", ev.Action)
+		x.add("src", ev.SrcIp)
+		x.add("srcPort", itoa(ev.SrcPort))
+		x.add("dst", ev.DstIp)
+		x.add("dstPort", itoa(ev.DstPort))
+		x.add("proto", ev.Protocol)
+		x.add("usrName", ev.Username)
+		x.add("domain", ev.Domain)
+		x.add("signature", ev.Signature)
+		x.add("identHostName", ev.Source)
+		x.add("msg", ev.Message)
+		return leef(eventId(ev), x), nil
+	}
+	return "", Valid(format)
+}
+
+// Alert - Serialise one alert
+func Alert(format string, a *alertmodel.Alert) (string, error) {
+	switch format {
+	case FormatJSON:
+		b, err := json.Marshal(a)
+		return string(b), err
+	case FormatCEF:
+		var x kv
+		x.add("rt", millis(a.LastSeen))
+		x.add("start", millis(a.FirstSeen))
+		x.add("end", millis(a.LastSeen))
+		x.add("externalId", strconv.FormatUint(uint64(a.ID), 10))
+		x.add("cat", "alert")
+		x.add("src", a.SrcIp)
+		x.add("dst", a.DstIp)
+		x.add("cnt", itoa(a.Count))
+		x.add("cs1Label", "status")
+		x.add("cs1", a.Status)
+		x.add("msg", a.Summary)
+		return cef("alert:"+a.Rule, a.Summary, alertSeverity[a.Severity], x), nil
+	case FormatLEEF:
+		var x kv
+		x.add("devTime", leefTime(a.LastSeen))
+		x.add("devTimeFormat", leefTimeFormat)
+		x.add("externalId", strconv.FormatUint(uint64(a.ID), 10))
+		x.add("cat", "alert")
+		x.add("sev", itoa(alertSeverity[a.Severity]))
+		x.add("src", a.SrcIp)
+		x.add("dst", a.DstIp)
+		x.add("count", itoa(a.Count))
+		x.add("status", a.Status)
+		x.add("msg", a.Summary)
+		return leef("alert:"+a.Rule, x), nil
+	}
+	return "", Valid(format)
+}
@@ -0,0 +1,292 @@
+package export
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+// syslog facility auth, like the syslog alert notifier
+const facility = 4
+
+// Forwarder - Live forwarding of events and alerts to a remote syslog
+// target over udp, tcp or tls, one RFC 5424 message per line. While the
+// target is unreachable messages are spooled to disk and replayed in order
+// once it is back.
+type Forwarder struct {
+	Network string // udp, tcp or tls
+	Addr    string
+	Format  string
+	Events  bool
+	Alerts  bool
+	TLS     *tls.Config
+	// Spool - Buffer file, no buffering when empty
+	Spool string
+	// MaxSpool - Spool size in bytes after which messages are dropped
+	MaxSpool int64
+	Retry    time.Duration
+
+	hostname string
+	queue    chan string
+	conn     net.Conn
+	dropped  atomic.Int64
+}
+
+func NewForwarder(network, addr, format, spooldir string) (*Forwarder, error) {
+	if err := Valid(format); err != nil {
+		return nil, err
+	}
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown forward network %q, use udp, tcp or tls", network)
+	}
+	f := &Forwarder{
+		Network:  network,
+		Addr:     addr,
+		Format:   format,
+		Events:   true,
+		Alerts:   true,
+		MaxSpool: 512 << 20,
+		Retry:    5 * time.Second,
+		queue:    make(chan string, 8192),
+	}
+	if spooldir != "" {
+		if err := os.MkdirAll(spooldir, 0750); err != nil {
+			return nil, err
+		}
+		f.Spool = filepath.Join(spooldir, "forward.spool")
+	}
+	f.hostname, _ = os.Hostname()
+	if f.hostname == "" {
+		f.hostname = "-"
+	}
+	return f, nil
+}
+
+// LoadCA - Trust only the CA certificates in a PEM file for tls targets
+func (f *Forwarder) LoadCA(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no certificates", path)
+	}
+	f.TLS = &tls.Config{RootCAs: pool}
+	return nil
+}
+
+// Dropped - Messages lost to a full queue or spool
+func (f *Forwarder) Dropped() int64 {
+	return f.dropped.Load()
+}
+
+// Consume - Sink for the ingest pipeline
+func (f *Forwarder) Consume(events []eventmodel.Event) {
+	if !f.Events {
+		return
+	}
+	for i := range events {
+		line, err := Event(f.Format, &events[i])
+		if err != nil {
+			continue
+		}
+		f.enqueue(f.frame(events[i].Timestamp, syslogSeverity(events[i].Severity), line))
+	}
+}
+
+func (f *Forwarder) Name() string {
+	return "forwarder"
+}
+
+// Notify - Notifier for new alerts
+func (f *Forwarder) Notify(a *alertmodel.Alert) error {
+	if !f.Alerts {
+		return nil
+	}
+	line, err := Alert(f.Format, a)
+	if err != nil {
+		return err
+	}
+	sev := map[string]int{"low": 5, "medium": 4, "high": 3, "critical": 2}[a.Severity]
+	f.enqueue(f.frame(a.LastSeen, sev, line))
+	return nil
+}
+
+func syslogSeverity(s int) int {
+	switch {
+	case s <= 0:
+		return 6
+	case s >= 4:
+		return 2
+	}
+	return 6 - s
+}
+
+// frame - RFC 5424 syslog message
+func (f *Forwarder) frame(ts time.Time, severity int, msg string) string {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return fmt.Sprintf("<%d>1 %s %s arkgate - - - %s", facility*8+severity, ts.UTC().Format(time.RFC3339Nano), f.hostname, msg)
+}
+
+func (f *Forwarder) enqueue(msg string) {
+	select {
+	case f.queue <- msg:
+	default:
+		f.dropped.Add(1)
+	}
+}
+
+// Run - Deliver queued messages, never returns
+func (f *Forwarder) Run() {
+	retry := time.NewTicker(f.Retry)
+	defer retry.Stop()
+	for {
+		select {
+		case msg := <-f.queue:
+			if f.spooled() {
+				f.spool(msg)
+				continue
+			}
+			if err := f.send(msg); err != nil {
+				log.Printf("Forwarder %s: %v, spooling\n", f.Addr, err)
+				f.spool(msg)
+			}
+		case <-retry.C:
+			if f.spooled() {
+				if err := f.replay(); err != nil {
+					log.Printf("Forwarder %s: %v, replay postponed\n", f.Addr, err)
+				}
+			}
+		}
+	}
+}
+
+func (f *Forwarder) dial() error {
+	if f.conn != nil {
+		return nil
+	}
+	var err error
+	switch f.Network {
+	case "tls":
+		d := &net.Dialer{Timeout: 10 * time.Second}
+		f.conn, err = tls.DialWithDialer(d, "tcp", f.Addr, f.TLS)
+	default:
+		f.conn, err = net.DialTimeout(f.Network, f.Addr, 10*time.Second)
+	}
+	return err
+}
+
+func (f *Forwarder) send(msg string) error {
+	if err := f.dial(); err != nil {
+		f.conn = nil
+		return err
+	}
+	if f.Network != "udp" {
+		msg += "\n"
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(f.conn, msg); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (f *Forwarder) spooled() bool {
+	if f.Spool == "" {
+		return false
+	}
+	st, err := os.Stat(f.Spool)
+	return err == nil && st.Size() > 0
+}
+
+func (f *Forwarder) spool(msg string) {
+	if f.Spool == "" {
+		f.dropped.Add(1)
+		return
+	}
+	if st, err := os.Stat(f.Spool); err == nil && st.Size() > f.MaxSpool {
+		f.dropped.Add(1)
+		return
+	}
+	fd, err := os.OpenFile(f.Spool, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Println("Forwarder spool: ", err)
+		f.dropped.Add(1)
+		return
+	}
+	defer fd.Close()
+	if _, err := fmt.Fprintln(fd, msg); err != nil {
+		f.dropped.Add(1)
+	}
+}
+
+// replay - Send spooled messages in order, keeping the unsent rest
+func (f *Forwarder) replay() error {
+	fd, err := os.Open(f.Spool)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+	var sent int64
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if serr := f.send(strings.TrimSuffix(line, "\n")); serr != nil {
+			if err := f.truncate(fd, sent); err != nil {
+				return err
+			}
+			return serr
+		}
+		sent += int64(len(line))
+	}
+	fd.Close()
+	return os.Remove(f.Spool)
+}
+
+// truncate - Drop the first n bytes of the spool
+func (f *Forwarder) truncate(fd *os.File, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if _, err := fd.Seek(n, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := f.Spool + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, fd); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Spool)
+}
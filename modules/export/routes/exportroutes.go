@@ -0,0 +1,124 @@
+// Package exportroutes - Arkgate API Export module
+//
+//	Module Routes:
+//	  /api/v1/export/events
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: format=cef|leef|jsonl plus the /api/v1/events filters, every
+//	           matching event is exported unless limit is given
+//	    Return: One serialised event per line, oldest first
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/export/alerts
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: format=cef|leef|jsonl, status, severity
+//	    Return: One serialised alert per line
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package exportroutes
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	eventroutes "github.com/rbaylon/arkgate/modules/events/routes"
+	"github.com/rbaylon/arkgate/modules/export"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func attach(w http.ResponseWriter, format, name string) *bufio.Writer {
+	ext := "log"
+	if format == export.FormatJSON {
+		ext = "jsonl"
+	}
+	w.Header().Set("Content-Type", export.Formats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("arkgate-%s-%s.%s", name, time.Now().Format("20060102-150405"), ext)))
+	return bufio.NewWriter(w)
+}
+
+func ExportRouter(events eventmodel.Crud, alerts alertmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if err := export.Valid(format); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid format", http.StatusBadRequest))
+			return
+		}
+		f, err := eventroutes.ParseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		if r.URL.Query().Get("limit") == "" {
+			f.Limit = 0
+		}
+		// Events are written page by page, the headers go out with the first
+		var out *bufio.Writer
+		errdb := events.Each(f, func(res []eventmodel.Event) error {
+			if out == nil {
+				out = attach(w, format, "events")
+			}
+			for i := range res {
+				line, err := export.Event(format, &res[i])
+				if err != nil {
+					continue
+				}
+				out.WriteString(line + "\n")
+			}
+			return out.Flush()
+		})
+		if errdb != nil && out == nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if errdb != nil {
+			// Too late for an error status, abort so the client sees an
+			// incomplete transfer rather than a short file
+			log.Println("Event export error: ", errdb)
+			panic(http.ErrAbortHandler)
+		}
+		if out == nil {
+			attach(w, format, "events")
+		}
+	})
+	r.Get("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if err := export.Valid(format); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid format", http.StatusBadRequest))
+			return
+		}
+		res, errdb := alerts.Find(r.URL.Query().Get("status"), r.URL.Query().Get("severity"))
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		out := attach(w, format, "alerts")
+		for i := range res {
+			line, err := export.Alert(format, &res[i])
+			if err != nil {
+				continue
+			}
+			out.WriteString(line + "\n")
+		}
+		out.Flush()
+	})
+	return r
+}
@@ -0,0 +1,176 @@
+// Package collector - UDP NetFlow/IPFIX collector aggregating into flowmodel
+package collector
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	"github.com/rbaylon/arkgate/modules/flows/netflow"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+type aggKey struct {
+	bucket   int64
+	exporter string
+	src      string
+	dst      string
+	port     int
+	protocol int
+}
+
+type subnet struct {
+	net   *net.IPNet
+	subid uint
+}
+
+type Collector struct {
+	Addr string
+	// Bucket - Aggregation interval, flows are flushed once their bucket closed
+	Bucket time.Duration
+
+	db      flowmodel.Crud
+	decoder *netflow.Decoder
+	mu      sync.Mutex
+	agg     map[aggKey]*flowmodel.Flow
+	smu     sync.RWMutex
+	subs    map[string]uint
+	nets    []subnet
+}
+
+func New(addr string, db flowmodel.Crud) *Collector {
+	return &Collector{
+		Addr:    addr,
+		Bucket:  time.Minute,
+		db:      db,
+		decoder: netflow.NewDecoder(),
+		agg:     map[aggKey]*flowmodel.Flow{},
+		subs:    map[string]uint{},
+	}
+}
+
+// Run - Receive exports until the socket fails
+func (c *Collector) Run() error {
+	conn, err := net.ListenPacket("udp", c.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.refreshSubs()
+	go func() {
+		for range time.Tick(c.Bucket) {
+			c.refreshSubs()
+			if err := c.Flush(false); err != nil {
+				log.Println("Flow flush error: ", err)
+			}
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		exporter := addr.String()
+		if ua, ok := addr.(*net.UDPAddr); ok {
+			exporter = ua.IP.String()
+		}
+		recs, err := c.decoder.Decode(exporter, buf[:n])
+		if err != nil && len(recs) == 0 {
+			continue
+		}
+		c.Add(exporter, recs, time.Now())
+	}
+}
+
+// Add - Fold decoded records into the current aggregation buckets
+func (c *Collector) Add(exporter string, recs []netflow.Record, now time.Time) {
+	bucket := now.Truncate(c.Bucket)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range recs {
+		if r.SrcIp == nil || r.DstIp == nil {
+			continue
+		}
+		f := flowmodel.Flow{
+			BucketStart: bucket,
+			Exporter:    exporter,
+			SrcIp:       r.SrcIp.String(),
+			DstIp:       r.DstIp.String(),
+			Protocol:    int(r.Protocol),
+		}
+		if id := c.subFor(r.SrcIp); id != 0 {
+			f.SubID, f.Direction, f.RemoteIp, f.Port = id, flowmodel.DirectionOut, f.DstIp, int(r.DstPort)
+		} else if id := c.subFor(r.DstIp); id != 0 {
+			f.SubID, f.Direction, f.RemoteIp, f.Port = id, flowmodel.DirectionIn, f.SrcIp, int(r.SrcPort)
+		} else {
+			f.RemoteIp, f.Port = f.DstIp, int(r.DstPort)
+		}
+		k := aggKey{bucket.Unix(), exporter, f.SrcIp, f.DstIp, f.Port, f.Protocol}
+		a, ok := c.agg[k]
+		if !ok {
+			a = &f
+			c.agg[k] = a
+		}
+		a.Flows++
+		a.Packets += r.Packets
+		a.Octets += r.Octets
+	}
+}
+
+// Flush - Store closed buckets, or every bucket when all is set
+func (c *Collector) Flush(all bool) error {
+	cur := time.Now().Truncate(c.Bucket).Unix()
+	var flows []flowmodel.Flow
+	c.mu.Lock()
+	for k, f := range c.agg {
+		if all || k.bucket < cur {
+			flows = append(flows, *f)
+			delete(c.agg, k)
+		}
+	}
+	c.mu.Unlock()
+	return c.db.AddBatch(flows)
+}
+
+func (c *Collector) subFor(ip net.IP) uint {
+	c.smu.RLock()
+	defer c.smu.RUnlock()
+	if id, ok := c.subs[ip.String()]; ok {
+		return id
+	}
+	for _, n := range c.nets {
+		if n.net.Contains(ip) {
+			return n.subid
+		}
+	}
+	return 0
+}
+
+// refreshSubs - Reload the FramedIp to subscriber map
+func (c *Collector) refreshSubs() {
+	subs, err := submodel.New(c.db.GetDB()).GetAll()
+	if err != nil {
+		log.Println("Flow sub refresh error: ", err)
+		return
+	}
+	m := map[string]uint{}
+	var nets []subnet
+	for _, s := range subs {
+		if strings.Contains(s.FramedIp, "/") {
+			if _, n, err := net.ParseCIDR(s.FramedIp); err == nil {
+				nets = append(nets, subnet{n, s.ID})
+			}
+		} else if ip := net.ParseIP(s.FramedIp); ip != nil {
+			m[ip.String()] = s.ID
+		}
+	}
+	c.smu.Lock()
+	c.subs = m
+	c.nets = nets
+	c.smu.Unlock()
+}
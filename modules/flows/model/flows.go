@@ -0,0 +1,185 @@
+// Package flows - Aggregated flow records from pflow exports
+package flowmodel
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DirectionOut = "out" // subscriber is the source
+	DirectionIn  = "in"  // subscriber is the destination
+)
+
+// Flow - Flows aggregated per bucket, exporter, addresses, service port and
+// protocol. Port is the service side port, the destination port for
+// outbound flows and the source port for inbound ones, so client ephemeral
+// ports do not explode the table.
+type Flow struct {
+	gorm.Model
+	BucketStart time.Time `json:"bucket_start" bson:"bucket_start" gorm:"index"`
+	Exporter    string    `json:"exporter" bson:"exporter"`
+	SubID       uint      `json:"subid" bson:"subid" gorm:"index"`
+	Direction   string    `json:"direction" bson:"direction"`
+	SrcIp       string    `json:"src_ip" bson:"src_ip"`
+	DstIp       string    `json:"dst_ip" bson:"dst_ip"`
+	RemoteIp    string    `json:"remote_ip" bson:"remote_ip"`
+	Port        int       `json:"port" bson:"port"`
+	Protocol    int       `json:"protocol" bson:"protocol"`
+	Flows       uint64    `json:"flows" bson:"flows"`
+	Packets     uint64    `json:"packets" bson:"packets"`
+	Octets      uint64    `json:"octets" bson:"octets"`
+}
+
+// Filter - Query parameters accepted by Storage.Find and Storage.Top
+type Filter struct {
+	SubID uint
+	SrcIp string
+	DstIp string
+	Port  int
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// Top - One row of a top-N aggregate
+type Top struct {
+	Key       string `json:"key"`
+	Flows     uint64 `json:"flows"`
+	Packets   uint64 `json:"packets"`
+	Octets    uint64 `json:"octets"`
+	OctetsIn  uint64 `json:"octets_in"`
+	OctetsOut uint64 `json:"octets_out"`
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Flow{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = migrateUTC(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateUTC - Rewrite buckets stored with a local offset in UTC
+func migrateUTC(db *gorm.DB) error {
+	var flows []Flow
+	return db.Unscoped().Select("id, bucket_start").Where("bucket_start NOT LIKE ?", "%+00:00").
+		FindInBatches(&flows, 1000, func(tx *gorm.DB, n int) error {
+			for _, f := range flows {
+				if err := db.Unscoped().Model(&Flow{}).Where("id = ?", f.ID).
+					UpdateColumn("bucket_start", f.BucketStart.UTC()).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// Bind interface as required by go-chi/render
+func (a *Flow) Bind(r *http.Request) error {
+	return nil
+}
+
+type Crud interface {
+	AddBatch(flows []Flow) error
+	Find(f *Filter) ([]Flow, error)
+	Top(f *Filter, by string) ([]Top, error)
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) AddBatch(flows []Flow) error {
+	if len(flows) == 0 {
+		return nil
+	}
+	for i := range flows {
+		// Stored in UTC so string comparisons in SQLite order correctly
+		flows[i].BucketStart = flows[i].BucketStart.UTC()
+	}
+	result := s.DB.CreateInBatches(&flows, 500)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) filter(f *Filter) *gorm.DB {
+	q := s.DB.Model(&Flow{})
+	if f.SubID != 0 {
+		q = q.Where("sub_id = ?", f.SubID)
+	}
+	if f.SrcIp != "" {
+		q = q.Where("src_ip = ?", f.SrcIp)
+	}
+	if f.DstIp != "" {
+		q = q.Where("dst_ip = ?", f.DstIp)
+	}
+	if f.Port != 0 {
+		q = q.Where("port = ?", f.Port)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("bucket_start >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("bucket_start < ?", f.Until.UTC())
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	return q
+}
+
+func (s *Storage) Find(f *Filter) ([]Flow, error) {
+	var flows []Flow
+	result := s.filter(f).Order("bucket_start desc").Find(&flows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return flows, nil
+}
+
+// Top - Traffic totals grouped by "remote" (destination address as seen
+// from the subscriber), "port", "sub" or "src"
+func (s *Storage) Top(f *Filter, by string) ([]Top, error) {
+	var col string
+	switch by {
+	case "port":
+		col = "CAST(protocol AS TEXT) || '/' || CAST(port AS TEXT)"
+	case "sub":
+		col = "CAST(sub_id AS TEXT)"
+	case "src":
+		col = "src_ip"
+	default:
+		col = "remote_ip"
+	}
+	var res []Top
+	result := s.filter(f).
+		Select(col + " AS key, SUM(flows) AS flows, SUM(packets) AS packets, SUM(octets) AS octets, " +
+			"SUM(CASE WHEN direction = 'in' THEN octets ELSE 0 END) AS octets_in, " +
+			"SUM(CASE WHEN direction = 'out' THEN octets ELSE 0 END) AS octets_out").
+		Group("key").Order("octets desc").Scan(&res)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return res, nil
+}
@@ -0,0 +1,51 @@
+package flowmodel
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestFilterZones(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	s := New(db)
+
+	east := time.FixedZone("EST", -5*3600)
+	bucket := time.Date(2026, 1, 10, 8, 0, 0, 0, east)
+	if err := s.AddBatch([]Flow{{BucketStart: bucket, SubID: 1, SrcIp: "10.0.0.2", Octets: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		since, until time.Time
+		want         int
+	}{
+		{"local", bucket.Add(-time.Hour), bucket.Add(time.Hour), 1},
+		{"utc", bucket.Add(-time.Hour).UTC(), bucket.Add(time.Hour).UTC(), 1},
+		{"other zone", bucket.In(time.FixedZone("JST", 9*3600)), bucket.Add(time.Minute).In(time.FixedZone("JST", 9*3600)), 1},
+		{"before", bucket.Add(-time.Hour).UTC(), bucket.UTC(), 0},
+		{"after", bucket.Add(time.Minute), bucket.Add(time.Hour), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows, err := s.Find(&Filter{Since: tt.since, Until: tt.until})
+			if err != nil || len(flows) != tt.want {
+				t.Errorf("Find: %d flows, %v", len(flows), err)
+			}
+			tops, err := s.Top(&Filter{Since: tt.since, Until: tt.until}, "sub")
+			if err != nil || len(tops) != tt.want {
+				t.Errorf("Top: %d rows, %v", len(tops), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Package netflow - NetFlow v5, v9 and IPFIX decoder for pflow(4) exports
+package netflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Information elements used by the collector, same numbering in v9 and IPFIX
+const (
+	ieOctets        = 1
+	iePackets       = 2
+	ieProtocol      = 4
+	ieSrcPort       = 7
+	ieSrcIpv4       = 8
+	ieDstPort       = 11
+	ieDstIpv4       = 12
+	ieSrcIpv6       = 27
+	ieDstIpv6       = 28
+	ieOctetsTotal   = 85
+	iePacketsTotal  = 86
+	ieStartSeconds  = 150
+	ieEndSeconds    = 151
+	ieStartMillisec = 152
+	ieEndMillisec   = 153
+)
+
+var (
+	ErrShort   = errors.New("netflow: short packet")
+	ErrVersion = errors.New("netflow: unsupported version")
+)
+
+// MaxTemplates - Templates kept per exporter, further templates of an
+// exporter are ignored until it withdraws some
+const MaxTemplates = 512
+
+// Record - One decoded flow
+type Record struct {
+	SrcIp    net.IP
+	DstIp    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	Packets  uint64
+	Octets   uint64
+	Start    time.Time
+	End      time.Time
+}
+
+type field struct {
+	id     uint16
+	length uint16
+}
+
+type template struct {
+	fields []field
+}
+
+// Decoder - Keeps v9 and IPFIX templates per exporter and domain. Data
+// sets that arrive before their template are skipped.
+type Decoder struct {
+	mu        sync.Mutex
+	templates map[string]*template
+	// counts - Templates per exporter
+	counts map[string]int
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		templates: map[string]*template{},
+		counts:    map[string]int{},
+	}
+}
+
+// Decode - Decode one export packet received from exporter
+func (d *Decoder) Decode(exporter string, pkt []byte) ([]Record, error) {
+	if len(pkt) < 2 {
+		return nil, ErrShort
+	}
+	switch binary.BigEndian.Uint16(pkt) {
+	case 5:
+		return decodeV5(pkt)
+	case 9:
+		return d.decodeV9(exporter, pkt)
+	case 10:
+		return d.decodeIpfix(exporter, pkt)
+	}
+	return nil, ErrVersion
+}
+
+func decodeV5(pkt []byte) ([]Record, error) {
+	if len(pkt) < 24 {
+		return nil, ErrShort
+	}
+	count := int(binary.BigEndian.Uint16(pkt[2:]))
+	uptime := binary.BigEndian.Uint32(pkt[4:])
+	secs := binary.BigEndian.Uint32(pkt[8:])
+	nsecs := binary.BigEndian.Uint32(pkt[12:])
+	sampling := uint64(binary.BigEndian.Uint16(pkt[22:]) & 0x3fff)
+	if sampling == 0 {
+		sampling = 1
+	}
+	if len(pkt) < 24+count*48 {
+		return nil, ErrShort
+	}
+	boot := time.Unix(int64(secs), int64(nsecs)).Add(-time.Duration(uptime) * time.Millisecond)
+	recs := make([]Record, 0, count)
+	for i := 0; i < count; i++ {
+		b := pkt[24+i*48:]
+		recs = append(recs, Record{
+			SrcIp:    net.IP(append([]byte{}, b[0:4]...)),
+			DstIp:    net.IP(append([]byte{}, b[4:8]...)),
+			Packets:  uint64(binary.BigEndian.Uint32(b[16:])) * sampling,
+			Octets:   uint64(binary.BigEndian.Uint32(b[20:])) * sampling,
+			Start:    boot.Add(time.Duration(binary.BigEndian.Uint32(b[24:])) * time.Millisecond),
+			End:      boot.Add(time.Duration(binary.BigEndian.Uint32(b[28:])) * time.Millisecond),
+			SrcPort:  binary.BigEndian.Uint16(b[32:]),
+			DstPort:  binary.BigEndian.Uint16(b[34:]),
+			Protocol: b[38],
+		})
+	}
+	return recs, nil
+}
+
+func (d *Decoder) decodeV9(exporter string, pkt []byte) ([]Record, error) {
+	if len(pkt) < 20 {
+		return nil, ErrShort
+	}
+	secs := time.Unix(int64(binary.BigEndian.Uint32(pkt[8:])), 0)
+	domain := binary.BigEndian.Uint32(pkt[16:])
+	var recs []Record
+	for b := pkt[20:]; len(b) >= 4; {
+		id := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < 4 || length > len(b) {
+			return recs, ErrShort
+		}
+		body := b[4:length]
+		b = b[length:]
+		switch {
+		case id == 0:
+			d.parseTemplates(9, exporter, domain, body)
+		case id == 1:
+			// Options templates carry no flows
+		case id >= 256:
+			recs = append(recs, d.parseData(9, exporter, domain, id, body, secs)...)
+		}
+	}
+	return recs, nil
+}
+
+func (d *Decoder) decodeIpfix(exporter string, pkt []byte) ([]Record, error) {
+	if len(pkt) < 16 {
+		return nil, ErrShort
+	}
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if total > len(pkt) || total < 16 {
+		return nil, ErrShort
+	}
+	secs := time.Unix(int64(binary.BigEndian.Uint32(pkt[4:])), 0)
+	domain := binary.BigEndian.Uint32(pkt[12:])
+	var recs []Record
+	for b := pkt[16:total]; len(b) >= 4; {
+		id := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < 4 || length > len(b) {
+			return recs, ErrShort
+		}
+		body := b[4:length]
+		b = b[length:]
+		switch {
+		case id == 2:
+			d.parseTemplates(10, exporter, domain, body)
+		case id == 3:
+			// Options templates carry no flows
+		case id >= 256:
+			recs = append(recs, d.parseData(10, exporter, domain, id, body, secs)...)
+		}
+	}
+	return recs, nil
+}
+
+func key(version int, exporter string, domain uint32, id uint16) string {
+	return fmt.Sprintf("%d|%s|%d|%d", version, exporter, domain, id)
+}
+
+func (d *Decoder) parseTemplates(version int, exporter string, domain uint32, b []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(b) >= 4 {
+		id := binary.BigEndian.Uint16(b)
+		count := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if id < 256 {
+			// Set padding
+			return
+		}
+		k := key(version, exporter, domain, id)
+		if count == 0 {
+			// Template withdrawal
+			if _, ok := d.templates[k]; ok {
+				delete(d.templates, k)
+				d.counts[exporter]--
+			}
+			continue
+		}
+		t := &template{}
+		for i := 0; i < count; i++ {
+			if len(b) < 4 {
+				return
+			}
+			f := field{id: binary.BigEndian.Uint16(b), length: binary.BigEndian.Uint16(b[2:])}
+			b = b[4:]
+			if version == 10 && f.id&0x8000 != 0 {
+				// Enterprise specific element, skip the enterprise number
+				if len(b) < 4 {
+					return
+				}
+				b = b[4:]
+				f.id = 0
+			}
+			if f.length == 0 {
+				// A record of such fields would take no bytes, the whole
+				// template is unusable
+				return
+			}
+			t.fields = append(t.fields, f)
+		}
+		if _, ok := d.templates[k]; !ok {
+			if d.counts[exporter] >= MaxTemplates {
+				continue
+			}
+			d.counts[exporter]++
+		}
+		d.templates[k] = t
+	}
+}
+
+func (d *Decoder) parseData(version int, exporter string, domain uint32, id uint16, b []byte, export time.Time) []Record {
+	d.mu.Lock()
+	t := d.templates[key(version, exporter, domain, id)]
+	d.mu.Unlock()
+	if t == nil || len(t.fields) == 0 {
+		return nil
+	}
+	var recs []Record
+	for len(b) > 0 {
+		left := len(b)
+		rec := Record{Start: export, End: export}
+		ok := true
+		for _, f := range t.fields {
+			n := int(f.length)
+			if n == 0xffff {
+				// IPFIX variable length element
+				if len(b) < 1 {
+					ok = false
+					break
+				}
+				n = int(b[0])
+				b = b[1:]
+				if n == 255 {
+					if len(b) < 2 {
+						ok = false
+						break
+					}
+					n = int(binary.BigEndian.Uint16(b))
+					b = b[2:]
+				}
+			}
+			if n > len(b) {
+				ok = false
+				break
+			}
+			apply(&rec, f.id, b[:n])
+			b = b[n:]
+		}
+		if !ok || len(b) == left {
+			// Trailing padding, a truncated record or a template that
+			// consumes nothing
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func apply(rec *Record, id uint16, b []byte) {
+	switch id {
+	case ieOctets, ieOctetsTotal:
+		rec.Octets = beUint(b)
+	case iePackets, iePacketsTotal:
+		rec.Packets = beUint(b)
+	case ieProtocol:
+		rec.Protocol = uint8(beUint(b))
+	case ieSrcPort:
+		rec.SrcPort = uint16(beUint(b))
+	case ieDstPort:
+		rec.DstPort = uint16(beUint(b))
+	case ieSrcIpv4, ieSrcIpv6:
+		rec.SrcIp = net.IP(append([]byte{}, b...))
+	case ieDstIpv4, ieDstIpv6:
+		rec.DstIp = net.IP(append([]byte{}, b...))
+	case ieStartSeconds:
+		rec.Start = time.Unix(int64(beUint(b)), 0)
+	case ieEndSeconds:
+		rec.End = time.Unix(int64(beUint(b)), 0)
+	case ieStartMillisec:
+		rec.Start = time.UnixMilli(int64(beUint(b)))
+	case ieEndMillisec:
+		rec.End = time.UnixMilli(int64(beUint(b)))
+	}
+}
@@ -0,0 +1,203 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func be16(v ...uint16) []byte {
+	b := make([]byte, 0, 2*len(v))
+	for _, x := range v {
+		b = binary.BigEndian.AppendUint16(b, x)
+	}
+	return b
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func join(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// set - Flowset or IPFIX set with its header
+func set(id uint16, body ...[]byte) []byte {
+	b := join(body...)
+	return join(be16(id, uint16(4+len(b))), b)
+}
+
+// tmpl - Template record of id with field id and length pairs
+func tmpl(id uint16, fields ...uint16) []byte {
+	return join(be16(id, uint16(len(fields)/2)), be16(fields...))
+}
+
+// flowFields - Template fields of the flows used by the tests
+var flowFields = []uint16{
+	ieSrcIpv4, 4, ieDstIpv4, 4, ieSrcPort, 2, ieDstPort, 2, ieProtocol, 1, iePackets, 4, ieOctets, 4,
+}
+
+var flowData = join([]byte{10, 0, 0, 1}, []byte{192, 0, 2, 9}, be16(51000, 443), []byte{6}, be32(3), be32(1500))
+
+func v9(sets ...[]byte) []byte {
+	return join(be16(9, uint16(len(sets))), be32(1000), be32(1700000000), be32(1), be32(7), join(sets...))
+}
+
+func ipfix(sets ...[]byte) []byte {
+	b := join(sets...)
+	return join(be16(10, uint16(16+len(b))), be32(1700000000), be32(1), be32(7), b)
+}
+
+func checkFlow(t *testing.T, rec Record) {
+	t.Helper()
+	if rec.SrcIp.String() != "10.0.0.1" || rec.DstIp.String() != "192.0.2.9" || rec.SrcPort != 51000 ||
+		rec.DstPort != 443 || rec.Protocol != 6 || rec.Packets != 3 || rec.Octets != 1500 {
+		t.Errorf("unexpected record %+v", rec)
+	}
+}
+
+func TestDecodeV5(t *testing.T) {
+	hdr := join(be16(5, 1), be32(60000), be32(1700000000), be32(0), be32(1), []byte{0, 0}, be16(0))
+	rec := join([]byte{10, 0, 0, 1}, []byte{192, 0, 2, 9}, make([]byte, 8), be32(3), be32(1500),
+		be32(59000), be32(59500), be16(51000, 443), []byte{0, 0, 6, 0}, make([]byte, 8))
+	recs, err := NewDecoder().Decode("x", join(hdr, rec))
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d records, %v", len(recs), err)
+	}
+	checkFlow(t, recs[0])
+	if want := time.Unix(1700000000, 0).Add(-time.Second); !recs[0].Start.Equal(want) {
+		t.Errorf("start %v, want %v", recs[0].Start, want)
+	}
+
+	// Sampling interval scales the counters
+	hdr = join(be16(5, 1), be32(60000), be32(1700000000), be32(0), be32(1), []byte{0, 0}, be16(0x4000|10))
+	recs, err = NewDecoder().Decode("x", join(hdr, rec))
+	if err != nil || len(recs) != 1 || recs[0].Packets != 30 || recs[0].Octets != 15000 {
+		t.Errorf("sampled record %+v, %v", recs, err)
+	}
+}
+
+func TestDecodeV9(t *testing.T) {
+	d := NewDecoder()
+	// Data before its template is skipped
+	recs, err := d.Decode("x", v9(set(256, flowData)))
+	if err != nil || len(recs) != 0 {
+		t.Fatalf("data without template: %d records, %v", len(recs), err)
+	}
+	recs, err = d.Decode("x", v9(set(0, tmpl(256, flowFields...)), set(256, flowData, flowData, []byte{0, 0})))
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("got %d records, %v", len(recs), err)
+	}
+	checkFlow(t, recs[0])
+	// Templates are per exporter
+	if recs, _ := d.Decode("y", v9(set(256, flowData))); len(recs) != 0 {
+		t.Errorf("template leaked to another exporter")
+	}
+}
+
+func TestDecodeIpfix(t *testing.T) {
+	d := NewDecoder()
+	fields := append([]uint16{0x8000 | 100, 4}, flowFields...)
+	tpl := join(be16(256, uint16(len(fields)/2), fields[0], fields[1]), be32(32473), be16(fields[2:]...))
+	data := join([]byte{1, 2, 3, 4}, flowData)
+	recs, err := d.Decode("x", ipfix(set(2, tpl), set(256, data)))
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d records, %v", len(recs), err)
+	}
+	checkFlow(t, recs[0])
+
+	// Variable length elements
+	d.Decode("x", ipfix(set(2, tmpl(257, append([]uint16{ieSrcPort, 0xffff}, flowFields...)...))))
+	recs, err = d.Decode("x", ipfix(set(257, []byte{2}, be16(1), flowData)))
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("variable length: %d records, %v", len(recs), err)
+	}
+	checkFlow(t, recs[0])
+
+	// Withdrawal
+	d.Decode("x", ipfix(set(2, be16(256, 0))))
+	if recs, _ := d.Decode("x", ipfix(set(256, data))); len(recs) != 0 {
+		t.Errorf("withdrawn template still decodes")
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  []byte
+		err  error
+	}{
+		{"empty", nil, ErrShort},
+		{"version", be16(7, 0), ErrVersion},
+		{"v5 header", be16(5, 1), ErrShort},
+		{"v5 count", join(be16(5, 30), make([]byte, 20+48)), ErrShort},
+		{"v9 header", be16(9, 0, 0, 0), ErrShort},
+		{"v9 set length", v9(be16(256, 200), flowData), ErrShort},
+		{"v9 set length under header", v9(be16(256, 2)), ErrShort},
+		{"ipfix total", join(be16(10, 400), make([]byte, 14)), ErrShort},
+		{"ipfix total under header", join(be16(10, 8), make([]byte, 14)), ErrShort},
+		{"ipfix truncated template", ipfix(set(2, be16(256, 5, ieSrcIpv4, 4))), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoder().Decode("x", tt.pkt); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestZeroLengthTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		tpl  []byte
+		pkt  func(...[]byte) []byte
+		set  uint16
+	}{
+		{"v9", tmpl(256, ieSrcIpv4, 0, ieDstIpv4, 0), v9, 0},
+		{"ipfix", tmpl(256, ieSrcIpv4, 0), ipfix, 2},
+		{"v9 one zero field", tmpl(256, ieSrcIpv4, 4, ieDstIpv4, 0), v9, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder()
+			d.Decode("x", tt.pkt(set(tt.set, tt.tpl)))
+			done := make(chan int)
+			go func() {
+				recs, _ := d.Decode("x", tt.pkt(set(256, flowData)))
+				done <- len(recs)
+			}()
+			select {
+			case n := <-done:
+				if n != 0 {
+					t.Errorf("got %d records from a rejected template", n)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("decode does not terminate")
+			}
+		})
+	}
+}
+
+func TestTemplateCap(t *testing.T) {
+	d := NewDecoder()
+	for id := 0; id < MaxTemplates+100; id++ {
+		d.Decode("x", v9(set(0, tmpl(uint16(256+id), flowFields...))))
+	}
+	d.Decode("y", v9(set(0, tmpl(256, flowFields...))))
+	if n := d.counts["x"]; n != MaxTemplates || len(d.templates) != MaxTemplates+1 {
+		t.Errorf("kept %d templates for x, %d in total", n, len(d.templates))
+	}
+	// Known templates can still be replaced
+	d.Decode("x", v9(set(0, tmpl(256, ieSrcIpv4, 4))))
+	if recs, _ := d.Decode("x", v9(set(256, []byte{10, 0, 0, 1}))); len(recs) != 1 {
+		t.Errorf("template update rejected")
+	}
+	if recs, _ := d.Decode("x", v9(set(256+MaxTemplates, flowData))); len(recs) != 0 {
+		t.Errorf("template over the cap was stored")
+	}
+}
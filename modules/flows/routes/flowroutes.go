@@ -0,0 +1,138 @@
+// Package flowroutes - Arkgate API Flow module
+//
+//	Module Routes:
+//	  /api/v1/flows
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: sub, src, dst, port, since, until (RFC3339), limit
+//	    Return: JSON object with list of aggregated flow objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/flows/top
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: by=remote|port|sub|src plus the /api/v1/flows filters
+//	    Return: JSON list of traffic totals ordered by octets
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/flows/subs/<subId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: by=remote|port, since, until, limit
+//	    Return: JSON list of the sub traffic totals by destination or port
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package flowroutes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func FlowRouter(db flowmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		res, errdb := db.Find(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/top", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		res, errdb := db.Top(f, r.URL.Query().Get("by"))
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/subs/{subId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		f, err := parseFilter(r)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+			return
+		}
+		f.SubID = uint(id)
+		res, errdb := db.Top(f, r.URL.Query().Get("by"))
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	return r
+}
+
+func parseFilter(r *http.Request) (*flowmodel.Filter, error) {
+	q := r.URL.Query()
+	f := &flowmodel.Filter{
+		SrcIp: q.Get("src"),
+		DstIp: q.Get("dst"),
+		Limit: 100,
+	}
+	var err error
+	if v := q.Get("sub"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		f.SubID = uint(id)
+	}
+	if v := q.Get("port"); v != "" {
+		if f.Port, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	} else {
+		f.Since = time.Now().Add(-24 * time.Hour)
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,147 @@
+// Package ingest - Event pipeline shared by every log and sensor ingester.
+//
+// Ingesters Publish events, the pipeline runs every Enricher over them,
+// stores them in batches, hands them to every Sink and runs every
+// registered Detector over them. Alerts raised by detectors carry the
+// triggering events as evidence and go through alertmodel, which handles
+// de-duplication, notifiers and active response.
+package ingest
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+// Detector - Inspect a stored event and return the alerts it triggers
+type Detector interface {
+	Name() string
+	Inspect(ev *eventmodel.Event) []*alertmodel.Alert
+}
+
+// Enricher - Add context to an event before it is stored
+type Enricher interface {
+	Enrich(ev *eventmodel.Event)
+}
+
+// Sink - Receives every stored batch, e.g. the live stream hub
+type Sink interface {
+	Consume(events []eventmodel.Event)
+}
+
+type Pipeline struct {
+	Events eventmodel.Crud
+	Alerts alertmodel.Crud
+	// Interval - Maximum time a published event waits before being stored
+	Interval time.Duration
+	// BatchSize - Flush early once this many events are pending
+	BatchSize int
+
+	enrichers []Enricher
+	detectors []Detector
+	sinks     []Sink
+	mu        sync.Mutex // serialises Submit, detectors are stateful
+	pmu       sync.Mutex
+	pending   []eventmodel.Event
+	kick      chan struct{}
+}
+
+func New(events eventmodel.Crud, alerts alertmodel.Crud) *Pipeline {
+	return &Pipeline{
+		Events:    events,
+		Alerts:    alerts,
+		Interval:  time.Second,
+		BatchSize: 500,
+		kick:      make(chan struct{}, 1),
+	}
+}
+
+func (p *Pipeline) AddEnricher(e Enricher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enrichers = append(p.enrichers, e)
+}
+
+func (p *Pipeline) AddDetector(d Detector) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.detectors = append(p.detectors, d)
+}
+
+func (p *Pipeline) AddSink(s Sink) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sinks = append(p.sinks, s)
+}
+
+// Publish - Queue an event for the next batch
+func (p *Pipeline) Publish(ev eventmodel.Event) {
+	p.pmu.Lock()
+	p.pending = append(p.pending, ev)
+	full := len(p.pending) >= p.BatchSize
+	p.pmu.Unlock()
+	if full {
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush - Submit every queued event
+func (p *Pipeline) Flush() error {
+	p.pmu.Lock()
+	batch := p.pending
+	p.pending = nil
+	p.pmu.Unlock()
+	return p.Submit(batch)
+}
+
+// Run - Flush queued events every Interval or once a batch is full
+func (p *Pipeline) Run() {
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.kick:
+		}
+		if err := p.Flush(); err != nil {
+			log.Println("Ingest error: ", err)
+		}
+	}
+}
+
+// Submit - Enrich and store a batch of events and run the detectors over it
+func (p *Pipeline) Submit(events []eventmodel.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range events {
+		for _, e := range p.enrichers {
+			e.Enrich(&events[i])
+		}
+	}
+	if err := p.Events.AddBatch(events); err != nil {
+		return err
+	}
+	for _, s := range p.sinks {
+		s.Consume(events)
+	}
+	for i := range events {
+		for _, d := range p.detectors {
+			for _, alert := range d.Inspect(&events[i]) {
+				if _, err := p.Alerts.Raise(alert); err != nil {
+					log.Printf("Detector %s: %v\n", d.Name(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
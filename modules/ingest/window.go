@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+// Window - Per key sliding window of events, keyed by e.g. source address.
+// Event timestamps drive the window so replayed logs behave like live ones.
+type Window struct {
+	Size   time.Duration
+	events map[string][]eventmodel.Event
+	adds   int
+}
+
+func NewWindow(size time.Duration) *Window {
+	return &Window{
+		Size:   size,
+		events: map[string][]eventmodel.Event{},
+	}
+}
+
+// Add - Append ev under key and return the events still inside the window
+func (w *Window) Add(key string, ev *eventmodel.Event) []eventmodel.Event {
+	w.adds++
+	if w.adds%1000 == 0 {
+		w.sweep(ev.Timestamp)
+	}
+	evs := append(w.events[key], *ev)
+	cut := ev.Timestamp.Add(-w.Size)
+	i := 0
+	for i < len(evs) && evs[i].Timestamp.Before(cut) {
+		i++
+	}
+	evs = evs[i:]
+	w.events[key] = evs
+	return evs
+}
+
+// Get - Events currently held for key
+func (w *Window) Get(key string) []eventmodel.Event {
+	return w.events[key]
+}
+
+// Reset - Forget every event held for key
+func (w *Window) Reset(key string) {
+	delete(w.events, key)
+}
+
+// sweep - Drop keys with no events inside the window, bounds memory when
+// scanned from many sources
+func (w *Window) sweep(now time.Time) {
+	cut := now.Add(-w.Size)
+	for k, evs := range w.events {
+		if len(evs) == 0 || evs[len(evs)-1].Timestamp.Before(cut) {
+			delete(w.events, k)
+		}
+	}
+}
@@ -3,9 +3,9 @@ package localutils
 import (
 	b64 "encoding/base64"
 	"errors"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
 
 	"github.com/rbaylon/arkgate/database"
 )
@@ -29,7 +29,7 @@ func SendCmd(s string) error {
 	servsocket := database.GetEnvVariable("SRV_SOCKET")
 	c, err := net.Dial("unix", servsocket)
 	if err != nil {
-		log.Fatal("Dial error", err)
+		return err
 	}
 	defer c.Close()
 
@@ -64,3 +64,37 @@ func GenerateConfigFile(path string, content []string) error {
 	}
 	return nil
 }
+
+// ReplaceConfigFile - Write content to a temporary file created with perm
+// next to path and rename it over path, readers never see a partial file
+// and the content is never readable beyond perm
+func ReplaceConfigFile(path string, content []string, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
+	if err = file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+	for _, s := range content {
+		if _, err = file.WriteString(s); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,110 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A4 portrait in points
+const (
+	Width  = 595
+	Height = 842
+)
+
+// Fonts, the standard Type1 fonts every reader has
+const (
+	Regular = "F1"
+	Bold    = "F2"
+)
+
+// Document - Minimal PDF 1.4 writer for plain text and lines on A4 pages
+type Document struct {
+	pages []*bytes.Buffer
+}
+
+// Page - Start a new page, drawing goes to the last page
+func (d *Document) Page() {
+	b := &bytes.Buffer{}
+	b.WriteString("0.5 w\n")
+	d.pages = append(d.pages, b)
+}
+
+func (d *Document) current() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.Page()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// Text - Write s with its baseline starting at x, y from the bottom left
+func (d *Document) Text(font string, size int, x, y float64, s string) {
+	fmt.Fprintf(d.current(), "BT /%s %d Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, y, escape(s))
+}
+
+// TextRight - Write s ending at x, widths are estimated for Helvetica
+func (d *Document) TextRight(font string, size int, x, y float64, s string) {
+	d.Text(font, size, x-float64(len(s))*float64(size)*0.55, y, s)
+}
+
+func (d *Document) Rect(x, y, w, h float64) {
+	fmt.Fprintf(d.current(), "%.1f %.1f %.1f %.1f re S\n", x, y, w, h)
+}
+
+func (d *Document) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.current(), "%.1f %.1f m %.1f %.1f l S\n", x1, y1, x2, y2)
+}
+
+// escape - s as a PDF string literal body, the standard fonts only cover
+// ASCII
+func escape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 32 || c > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// WriteTo - Write the document, an empty one gets a blank page
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	d.current()
+	// Objects: catalog, page tree, two fonts, then a page and its content
+	// stream per page
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>")
+	for i, content := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>",
+			Width, Height, Regular, Bold, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	n, err := w.Write(out.Bytes())
+	return int64(n), err
+}
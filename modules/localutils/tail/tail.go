@@ -0,0 +1,86 @@
+package tail
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Interval - How often an idle file is polled for new data
+var Interval = time.Second
+
+// Follow - Call fn for every line appended to path, like tail -F. Survives
+// log rotation and truncation. Starts at the end of the file unless
+// fromStart is set. Only returns if fn is nil.
+func Follow(path string, fromStart bool, fn func(line string)) {
+	if fn == nil {
+		return
+	}
+	warned := false
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			if !warned {
+				log.Printf("Tail %s: %v, retrying\n", path, err)
+				warned = true
+			}
+			time.Sleep(5 * Interval)
+			continue
+		}
+		warned = false
+		if !fromStart {
+			f.Seek(0, io.SeekEnd)
+		}
+		follow(f, path, fn)
+		f.Close()
+		// Rotated files are read from the top
+		fromStart = true
+	}
+}
+
+func follow(f *os.File, path string, fn func(line string)) {
+	rd := bufio.NewReader(f)
+	partial := ""
+	for {
+		line, err := rd.ReadString('\n')
+		if err == nil {
+			fn(strings.TrimRight(partial+line, "\r\n"))
+			partial = ""
+			continue
+		}
+		partial += line
+		if err != io.EOF {
+			return
+		}
+		time.Sleep(Interval)
+
+		cur, err := f.Stat()
+		if err != nil {
+			return
+		}
+		st, err := os.Stat(path)
+		if err != nil || !os.SameFile(cur, st) {
+			// Rotated, drain what is left of the old file first
+			for {
+				line, err := rd.ReadString('\n')
+				if line != "" {
+					fn(strings.TrimRight(partial+line, "\r\n"))
+					partial = ""
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err == nil && st.Size() < pos-int64(rd.Buffered()) {
+			// Truncated in place
+			f.Seek(0, io.SeekStart)
+			rd.Reset(f)
+			partial = ""
+		}
+	}
+}
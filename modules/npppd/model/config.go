@@ -0,0 +1,138 @@
+package npppdmodel
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rbaylon/arkgate/database"
+	"github.com/rbaylon/arkgate/modules/localutils"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+const (
+	DefaultConfPath  = "/etc/npppd/npppd.conf"
+	DefaultUsersPath = "/etc/npppd/npppd-users"
+)
+
+// ConfPaths - npppd.conf and npppd-users locations from NPPPD_CONF and
+// NPPPD_USERS
+func ConfPaths() (string, string) {
+	conf, users := database.GetEnvVariable("NPPPD_CONF"), database.GetEnvVariable("NPPPD_USERS")
+	if conf == "" {
+		conf = DefaultConfPath
+	}
+	if users == "" {
+		users = DefaultUsersPath
+	}
+	return conf, users
+}
+
+// RenderConf - npppd.conf lines, one pppoe tunnel, ipcp pool and pppac
+// interface per Npppd, all authenticated against the local users file.
+// Npppds that are invalid or have no network or interface are left out
+// and logged.
+func RenderConf(npppds []Npppd, usersPath string) []string {
+	lines := []string{
+		"# Generated by arkgate, changes are overwritten\n",
+		"authentication LOCAL type local {\n",
+		"\tusers-file \"" + usersPath + "\"\n",
+		"}\n",
+	}
+	for i, n := range npppds {
+		if n.Network == "" || n.IfaceDevice == "" {
+			log.Printf("npppd.conf: npppd %d: no network or interface, skipped\n", n.ID)
+			continue
+		}
+		if err := npppds[i].Validate(); err != nil {
+			log.Printf("npppd.conf: npppd %d: %v, skipped\n", n.ID, err)
+			continue
+		}
+		p, _ := NewPool(&npppds[i])
+		tunnel, ipcp, iface := fmt.Sprintf("PPPOE%d", n.ID), fmt.Sprintf("IPCP%d", n.ID), fmt.Sprintf("pppac%d", i)
+		lines = append(lines,
+			"\n# "+n.Name+"\n",
+			"tunnel "+tunnel+" protocol pppoe {\n",
+			"\tlisten on interface "+n.IfaceDevice+"\n",
+			"}\n",
+			"ipcp "+ipcp+" {\n",
+		)
+		for _, r := range p.Ranges() {
+			lines = append(lines, "\tpool-address "+r+"\n")
+		}
+		if dns := strings.Fields(strings.ReplaceAll(n.DNSservers, ",", " ")); len(dns) > 0 {
+			lines = append(lines, "\tdns-servers "+strings.Join(dns, " ")+"\n")
+		}
+		lines = append(lines,
+			"}\n",
+			"interface "+iface+" address "+p.Gateway.String()+" ipcp "+ipcp+"\n",
+			"bind tunnel from "+tunnel+" authenticated by LOCAL to "+iface+"\n",
+		)
+	}
+	return lines
+}
+
+// capEscape - v as a getcap(3) string value, the field separator, escape
+// and control introducer characters and anything unprintable as octal
+func capEscape(v string) string {
+	var b strings.Builder
+	for _, c := range []byte(v) {
+		if c < 0x20 || c == 0x7f || c == ':' || c == '\\' || c == '^' {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// RenderUsers - npppd-users lines for the active subs, suspended subs and
+// subs blocked over quota are left out so they can not authenticate. Subs
+// whose secret can not be decrypted are left out and logged.
+func RenderUsers(subs []submodel.Sub) []string {
+	lines := []string{"# Generated by arkgate, changes are overwritten\n"}
+	for _, sub := range subs {
+		if !sub.IsActive || sub.BillingHold || sub.QuotaState == submodel.QuotaBlocked {
+			continue
+		}
+		if err := submodel.ValidUsername(sub.Username); err != nil {
+			log.Printf("npppd-users: %v\n", err)
+			continue
+		}
+		pw, err := sub.Secret()
+		if err != nil {
+			log.Printf("npppd-users: %s: %v\n", sub.Username, err)
+			continue
+		}
+		lines = append(lines, sub.Username+":\\\n", "\t:password="+capEscape(pw)+":")
+		if sub.FramedIp != "" {
+			lines = append(lines, "\\\n\t:framed-ip-address="+sub.FramedIp+":")
+		}
+		lines = append(lines, "\n")
+	}
+	return lines
+}
+
+// WriteConfig - Regenerate npppd.conf and npppd-users from the DB and ask
+// the helper to reload npppd
+func (s *Storage) WriteConfig() error {
+	npppds, err := s.GetAll()
+	if err != nil {
+		return err
+	}
+	var subs []submodel.Sub
+	result := s.DB.Order("username").Find(&subs)
+	if result.Error != nil {
+		return result.Error
+	}
+	confPath, usersPath := ConfPaths()
+	// Holds the clear text passwords, written first and on its own so
+	// suspended subs are locked out whatever state npppd.conf is in
+	if err = localutils.ReplaceConfigFile(usersPath, RenderUsers(subs), 0600); err != nil {
+		return err
+	}
+	if err = localutils.ReplaceConfigFile(confPath, RenderConf(npppds, usersPath), 0644); err != nil {
+		return err
+	}
+	return localutils.SendCmd("NPPPD RELOAD")
+}
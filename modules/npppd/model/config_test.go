@@ -0,0 +1,68 @@
+package npppdmodel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Npppd
+		err  bool
+	}{
+		{"valid", Npppd{Name: "lan pppoe", Network: "10.0.0.0/24", IfaceDevice: "vlan100", DNSservers: "1.1.1.1, 9.9.9.9"}, false},
+		{"no network", Npppd{Name: "spare"}, false},
+		{"name newline", Npppd{Name: "x\n}\nauthentication X type radius {"}, true},
+		{"name quote", Npppd{Name: `x"`}, true},
+		{"interface", Npppd{Name: "x", IfaceDevice: "em0\nlisten on interface em1"}, true},
+		{"interface quote", Npppd{Name: "x", IfaceDevice: `em0"`}, true},
+		{"dns", Npppd{Name: "x", DNSservers: "1.1.1.1\n}"}, true},
+		{"dns name", Npppd{Name: "x", DNSservers: "dns.example.com"}, true},
+		{"network", Npppd{Name: "x", Network: "10.0.0.0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.n.Validate(); (err != nil) != tt.err {
+				t.Errorf("got %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRenderConf(t *testing.T) {
+	npppds := []Npppd{
+		{Name: "spare"},
+		{Name: "bad\nname", Network: "10.1.0.0/24", IfaceDevice: "em1"},
+		{Name: "lan", Network: "10.0.0.0/29", IfaceDevice: "em0", DNSservers: "10.0.0.1,9.9.9.9"},
+	}
+	npppds[2].ID = 3
+	conf := strings.Join(RenderConf(npppds, "/etc/npppd/npppd-users"), "")
+	for _, want := range []string{
+		"\tusers-file \"/etc/npppd/npppd-users\"\n",
+		"tunnel PPPOE3 protocol pppoe {\n\tlisten on interface em0\n}\n",
+		"\tpool-address 10.0.0.2-10.0.0.6\n\tdns-servers 10.0.0.1 9.9.9.9\n",
+		"interface pppac2 address 10.0.0.1 ipcp IPCP3\n",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("missing %q in\n%s", want, conf)
+		}
+	}
+	if strings.Contains(conf, "em1") || strings.Contains(conf, "spare") {
+		t.Errorf("invalid npppd rendered\n%s", conf)
+	}
+}
+
+func TestCapEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"pw1":          "pw1",
+		"p:w\\^":       "p\\072w\\134\\136",
+		"a\nb\x7f":     "a\\012b\\177",
+		"ü":            "ü",
+		":password=x:": "\\072password=x\\072",
+	} {
+		if got := capEscape(in); got != want {
+			t.Errorf("capEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -2,8 +2,13 @@
 package npppdmodel
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"unicode"
 
 	submodel "github.com/rbaylon/arkgate/modules/subs/model"
 	"gorm.io/gorm"
@@ -15,7 +20,10 @@ type Npppd struct {
 	Network     string `json:"network" bson:"network"`
 	IfaceDevice string `json:"ifacedevice" bson:"ifacedevice"`
 	DNSservers  string `json:"dnsservers" bson:"dnsservers"`
-	Subs        []submodel.Sub
+	// Reserved - Addresses, a-b ranges and CIDRs of Network never given to
+	// subs
+	Reserved string `json:"reserved" bson:"reserved"`
+	Subs     []submodel.Sub
 }
 
 // MigrateDB - Create the table if not exist in DB
@@ -26,9 +34,33 @@ func MigrateDB(db *gorm.DB) {
 	}
 }
 
+var ifaceRe = regexp.MustCompile(`^[a-z]+[0-9]+$`)
+
+// Validate - Check the fields rendered into npppd.conf, a newline or quote
+// would let a value add its own directives
+func (a *Npppd) Validate() error {
+	if strings.ContainsAny(a.Name, "\"'\\") || strings.IndexFunc(a.Name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid npppd name %q", a.Name)
+	}
+	if a.IfaceDevice != "" && !ifaceRe.MatchString(a.IfaceDevice) {
+		return fmt.Errorf("invalid interface %q", a.IfaceDevice)
+	}
+	for _, dns := range strings.Fields(strings.ReplaceAll(a.DNSservers, ",", " ")) {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid DNS server %q", dns)
+		}
+	}
+	if a.Network != "" {
+		if _, err := NewPool(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Bind interface as required by go-chi/render
 func (a *Npppd) Bind(r *http.Request) error {
-	return nil
+	return a.Validate()
 }
 
 type Crud interface {
@@ -38,6 +70,9 @@ type Crud interface {
 	Update(npppd *Npppd) error
 	Delete(npppd *Npppd) error
 	GetByDevice(ifacedevice string) (*Npppd, error)
+	WriteConfig() error
+	AssignIp(sub *submodel.Sub, save func() error) error
+	Utilisation(n *Npppd) (*Utilisation, error)
 }
 
 type Storage struct {
@@ -0,0 +1,256 @@
+package npppdmodel
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+var (
+	ErrPoolFull    = errors.New("address pool exhausted")
+	ErrOutsidePool = errors.New("address is outside the npppd pool")
+	ErrIpInUse     = errors.New("address is assigned to another sub")
+)
+
+// assignMu - Serializes picking an address and saving the sub holding it
+var assignMu sync.Mutex
+
+// Pool - Addresses of an Npppd network that can be given to subs, the
+// network, gateway and broadcast addresses and the reserved ranges excluded
+type Pool struct {
+	Network  netip.Prefix
+	Gateway  netip.Addr
+	First    netip.Addr
+	Last     netip.Addr
+	Reserved [][2]netip.Addr
+}
+
+// Utilisation - Address usage of an Npppd pool
+type Utilisation struct {
+	NpppdID  uint    `json:"npppdid"`
+	Name     string  `json:"name"`
+	Network  string  `json:"network"`
+	Size     int     `json:"size"`
+	Reserved int     `json:"reserved"`
+	Assigned int     `json:"assigned"`
+	Free     int     `json:"free"`
+	Percent  float64 `json:"percent"`
+	// Outside - Addresses of the npppd's subs that are not in its pool
+	Outside []string `json:"outside"`
+}
+
+// ParseReserved - Ranges of a list of addresses, a-b ranges and CIDRs
+// separated by commas or spaces
+func ParseReserved(s string) ([][2]netip.Addr, error) {
+	var ranges [][2]netip.Addr
+	for _, f := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		switch {
+		case strings.Contains(f, "/"):
+			p, err := netip.ParsePrefix(f)
+			if err != nil {
+				return nil, err
+			}
+			p = p.Masked()
+			ranges = append(ranges, [2]netip.Addr{p.Addr(), lastAddr(p)})
+		case strings.Contains(f, "-"):
+			from, to, _ := strings.Cut(f, "-")
+			a, err := netip.ParseAddr(from)
+			if err != nil {
+				return nil, err
+			}
+			b, err := netip.ParseAddr(to)
+			if err != nil {
+				return nil, err
+			}
+			if b.Less(a) {
+				return nil, fmt.Errorf("range %s ends before it starts", f)
+			}
+			ranges = append(ranges, [2]netip.Addr{a, b})
+		default:
+			a, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, [2]netip.Addr{a, a})
+		}
+	}
+	return ranges, nil
+}
+
+// lastAddr - Broadcast address of an IPv4 prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	last := p.Addr()
+	for n := 0; n < 32-p.Bits(); n++ {
+		b := last.As4()
+		b[3-n/8] |= 1 << (n % 8)
+		last = netip.AddrFrom4(b)
+	}
+	return last
+}
+
+// NewPool - Pool of n, its network has to be IPv4 /30 or larger
+func NewPool(n *Npppd) (*Pool, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(n.Network))
+	if err != nil {
+		return nil, err
+	}
+	if !p.Addr().Is4() || p.Bits() > 30 {
+		return nil, fmt.Errorf("%s is not an IPv4 network of /30 or larger", n.Network)
+	}
+	reserved, err := ParseReserved(n.Reserved)
+	if err != nil {
+		return nil, err
+	}
+	p = p.Masked()
+	gw := p.Addr().Next()
+	return &Pool{
+		Network:  p,
+		Gateway:  gw,
+		First:    gw.Next(),
+		Last:     lastAddr(p).Prev(),
+		Reserved: reserved,
+	}, nil
+}
+
+// Contains - Whether a can be given to a sub
+func (p *Pool) Contains(a netip.Addr) bool {
+	if a.Less(p.First) || p.Last.Less(a) {
+		return false
+	}
+	for _, r := range p.Reserved {
+		if !a.Less(r[0]) && !r[1].Less(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ranges - The pool as a-b ranges around the reserved addresses
+func (p *Pool) Ranges() []string {
+	var ranges []string
+	var start netip.Addr
+	for a := p.First; ; a = a.Next() {
+		in := p.Contains(a)
+		if in && !start.IsValid() {
+			start = a
+		}
+		if start.IsValid() && (!in || a == p.Last) {
+			end := a
+			if !in {
+				end = a.Prev()
+			}
+			ranges = append(ranges, start.String()+"-"+end.String())
+			start = netip.Addr{}
+		}
+		if a == p.Last {
+			return ranges
+		}
+	}
+}
+
+// assigned - Framed IPs of every sub but the one with id except
+func (s *Storage) assigned(except uint) (map[netip.Addr]uint, error) {
+	var subs []submodel.Sub
+	result := s.DB.Where("framed_ip <> '' AND id <> ?", except).Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	ips := map[netip.Addr]uint{}
+	for _, sub := range subs {
+		if a, err := netip.ParseAddr(sub.FramedIp); err == nil {
+			ips[a] = sub.ID
+		}
+	}
+	return ips, nil
+}
+
+// AssignIp - Give sub the next free address of its npppd pool, or check
+// the one it was given, then save it with save while no other sub can
+// take the same address. Subs without an npppd only have to use an
+// address nobody else has.
+func (s *Storage) AssignIp(sub *submodel.Sub, save func() error) error {
+	assignMu.Lock()
+	defer assignMu.Unlock()
+	used, err := s.assigned(sub.ID)
+	if err != nil {
+		return err
+	}
+	sub.FramedIp = strings.TrimSpace(sub.FramedIp)
+	var pool *Pool
+	if sub.NpppdID != 0 {
+		n, err := s.GetById(sub.NpppdID)
+		if err != nil {
+			return err
+		}
+		if pool, err = NewPool(n); err != nil {
+			return err
+		}
+	}
+	switch {
+	case sub.FramedIp == "" && pool != nil:
+		for a := pool.First; !pool.Last.Less(a); a = a.Next() {
+			if _, ok := used[a]; !ok && pool.Contains(a) {
+				sub.FramedIp = a.String()
+				break
+			}
+		}
+		if sub.FramedIp == "" {
+			return ErrPoolFull
+		}
+	case sub.FramedIp != "":
+		a, err := netip.ParseAddr(sub.FramedIp)
+		if err != nil {
+			return err
+		}
+		if pool != nil && !pool.Contains(a) {
+			return ErrOutsidePool
+		}
+		if _, ok := used[a]; ok {
+			return ErrIpInUse
+		}
+		sub.FramedIp = a.String()
+	}
+	return save()
+}
+
+// Utilisation - Address usage of the pool of n
+func (s *Storage) Utilisation(n *Npppd) (*Utilisation, error) {
+	pool, err := NewPool(n)
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.assigned(0)
+	if err != nil {
+		return nil, err
+	}
+	u := &Utilisation{
+		NpppdID: n.ID,
+		Name:    n.Name,
+		Network: pool.Network.String(),
+		Outside: []string{},
+	}
+	for a := pool.First; !pool.Last.Less(a); a = a.Next() {
+		if !pool.Contains(a) {
+			u.Reserved++
+			continue
+		}
+		u.Size++
+		if _, ok := used[a]; ok {
+			u.Assigned++
+		}
+	}
+	for _, sub := range n.Subs {
+		if a, err := netip.ParseAddr(sub.FramedIp); err == nil && !pool.Contains(a) {
+			u.Outside = append(u.Outside, sub.FramedIp)
+		}
+	}
+	u.Free = u.Size - u.Assigned
+	if u.Size > 0 {
+		u.Percent = float64(u.Assigned) * 100 / float64(u.Size)
+	}
+	return u, nil
+}
@@ -0,0 +1,174 @@
+package npppdmodel
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		network, reserved string
+		first, last, gw   string
+		err               bool
+	}{
+		{network: "10.0.0.0/24", first: "10.0.0.2", last: "10.0.0.254", gw: "10.0.0.1"},
+		{network: " 10.0.0.77/24 ", first: "10.0.0.2", last: "10.0.0.254", gw: "10.0.0.1"},
+		{network: "10.0.0.4/30", first: "10.0.0.6", last: "10.0.0.6", gw: "10.0.0.5"},
+		{network: "10.0.0.0/31", err: true},
+		{network: "10.0.0.0/32", err: true},
+		{network: "fd00::/64", err: true},
+		{network: "10.0.0.0", err: true},
+		{network: "10.0.0.0/24", reserved: "10.0.0.9-10.0.0.3", err: true},
+		{network: "10.0.0.0/24", reserved: "10.0.0.x", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+" "+tt.reserved, func(t *testing.T) {
+			p, err := NewPool(&Npppd{Network: tt.network, Reserved: tt.reserved})
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got pool %+v, want an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.First.String() != tt.first || p.Last.String() != tt.last || p.Gateway.String() != tt.gw {
+				t.Errorf("got %s-%s gw %s", p.First, p.Last, p.Gateway)
+			}
+		})
+	}
+}
+
+func TestPoolContainsRanges(t *testing.T) {
+	p, err := NewPool(&Npppd{Network: "10.0.0.0/28", Reserved: "10.0.0.2, 10.0.0.5-10.0.0.6 10.0.0.12/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.0":  false, // network
+		"10.0.0.1":  false, // gateway
+		"10.0.0.2":  false, // reserved
+		"10.0.0.3":  true,
+		"10.0.0.4":  true,
+		"10.0.0.5":  false,
+		"10.0.0.6":  false,
+		"10.0.0.7":  true,
+		"10.0.0.11": true,
+		"10.0.0.12": false,
+		"10.0.0.14": false,
+		"10.0.0.15": false, // broadcast
+		"10.0.1.3":  false,
+	} {
+		if got := p.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if got := strings.Join(p.Ranges(), " "); got != "10.0.0.3-10.0.0.4 10.0.0.7-10.0.0.11" {
+		t.Errorf("Ranges() = %s", got)
+	}
+
+	// Everything reserved
+	p, _ = NewPool(&Npppd{Network: "10.0.0.0/29", Reserved: "10.0.0.0/29"})
+	if r := p.Ranges(); len(r) != 0 {
+		t.Errorf("Ranges() of a reserved pool = %v", r)
+	}
+	// A range ending on the last address
+	p, _ = NewPool(&Npppd{Network: "10.0.0.0/29", Reserved: "10.0.0.3"})
+	if got := strings.Join(p.Ranges(), " "); got != "10.0.0.2-10.0.0.2 10.0.0.4-10.0.0.6" {
+		t.Errorf("Ranges() = %s", got)
+	}
+}
+
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	submodel.MigrateDB(db)
+	return New(db)
+}
+
+func TestAssignIp(t *testing.T) {
+	s := testStorage(t)
+	n := &Npppd{Name: "pppx0", Network: "10.0.0.0/29", Reserved: "10.0.0.3"}
+	if err := s.Add(n); err != nil {
+		t.Fatal(err)
+	}
+	subs := submodel.New(s.DB)
+	assign := func(sub *submodel.Sub) error {
+		return s.AssignIp(sub, func() error { return subs.Add(sub) })
+	}
+
+	// Free addresses in order, around the reserved one
+	var ips []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		sub := &submodel.Sub{Username: name, NpppdID: n.ID}
+		if err := assign(sub); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ips = append(ips, sub.FramedIp)
+	}
+	if got := strings.Join(ips, " "); got != "10.0.0.2 10.0.0.4 10.0.0.5 10.0.0.6" {
+		t.Errorf("assigned %s", got)
+	}
+	if err := assign(&submodel.Sub{Username: "e", NpppdID: n.ID}); !errors.Is(err, ErrPoolFull) {
+		t.Errorf("full pool: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		sub  submodel.Sub
+		err  error
+	}{
+		{"taken", submodel.Sub{Username: "f", NpppdID: n.ID, FramedIp: "10.0.0.4"}, ErrIpInUse},
+		{"reserved", submodel.Sub{Username: "f", NpppdID: n.ID, FramedIp: "10.0.0.3"}, ErrOutsidePool},
+		{"gateway", submodel.Sub{Username: "f", NpppdID: n.ID, FramedIp: "10.0.0.1"}, ErrOutsidePool},
+		{"other network", submodel.Sub{Username: "f", NpppdID: n.ID, FramedIp: "192.0.2.1"}, ErrOutsidePool},
+		{"taken without npppd", submodel.Sub{Username: "f", FramedIp: "10.0.0.2"}, ErrIpInUse},
+		{"free without npppd", submodel.Sub{Username: "f", FramedIp: " 192.0.2.1 "}, nil},
+		{"none without npppd", submodel.Sub{Username: "g"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := tt.sub
+			if err := assign(&sub); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// A sub keeps its own address on update
+	var a submodel.Sub
+	s.DB.Where("username = ?", "a").First(&a)
+	if err := s.AssignIp(&a, func() error { return subs.Update(&a) }); err != nil || a.FramedIp != "10.0.0.2" {
+		t.Errorf("update kept %s, %v", a.FramedIp, err)
+	}
+	// An invalid address is rejected before anything is saved
+	saved := false
+	err := s.AssignIp(&submodel.Sub{Username: "h", FramedIp: "10.0.0"}, func() error { saved = true; return nil })
+	if err == nil || saved {
+		t.Errorf("invalid address: %v, saved %v", err, saved)
+	}
+
+	u, err := s.Utilisation(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Size != 4 || u.Reserved != 1 || u.Assigned != 4 || u.Free != 0 || u.Percent != 100 {
+		t.Errorf("utilisation %+v", u)
+	}
+}
@@ -1,5 +1,9 @@
 // Package npppdroutes - Arkgate API Npppd module
 //
+// Every change regenerates npppd.conf and npppd-users and reloads npppd.
+// Sub addresses are allocated from the network, without the network,
+// gateway and broadcast addresses and the reserved ones.
+//
 //	Module Routes:
 //	  /api/v1/npppds
 //	    Method: GET
@@ -8,6 +12,13 @@
 //	    Return-Status: 200 on Success
 //	                   500 on Error
 //
+//	  /api/v1/npppds/pools
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of pool utilisation objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
 //	  /api/v1/npppds/<npppdId>
 //	    Method: GET|PUT|DELETE
 //	    Headers: Authorization Bearer
@@ -16,6 +27,15 @@
 //	                   500 on Error
 //	                   400 on Bad request
 //
+//	  /api/v1/npppds/<npppdId>/pool
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with size, reserved, assigned and free addresses
+//	            of the npppd pool and the sub addresses outside of it
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
 //	  /api/v1/npppds/create
 //	    Method: POST
 //	    Headers: Authorization Bearer
@@ -27,6 +47,7 @@ package npppdroutes
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -52,6 +73,41 @@ func NpppdRouter(db npppdmodel.Crud) chi.Router {
 		}
 		render.JSON(w, r, res)
 	})
+	r.Get("/pools", func(w http.ResponseWriter, r *http.Request) {
+		npppds, errdb := db.GetAll()
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		res := []npppdmodel.Utilisation{}
+		for i := range npppds {
+			u, err := db.Utilisation(&npppds[i])
+			if err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid pool of npppd %s", npppds[i].Name), http.StatusInternalServerError))
+				return
+			}
+			res = append(res, *u)
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/{npppdId}/pool", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "npppdId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid npppd ID %s", chi.URLParam(r, "npppdId")), http.StatusBadRequest))
+			return
+		}
+		npppd, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		u, err := db.Utilisation(npppd)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid pool", http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, u)
+	})
 	r.Get("/{npppdId}", func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "npppdId"))
 		if err != nil {
@@ -79,6 +135,9 @@ func NpppdRouter(db npppdmodel.Crud) chi.Router {
 		npppd.ID = uint(id)
 		err = db.Update(npppd)
 		if err == nil {
+			if cfgerr := db.WriteConfig(); cfgerr != nil {
+				log.Println(cfgerr)
+			}
 			render.JSON(w, r, npppd)
 			return
 		}
@@ -92,6 +151,9 @@ func NpppdRouter(db npppdmodel.Crud) chi.Router {
 		}
 		err := db.Add(npppd)
 		if err == nil {
+			if cfgerr := db.WriteConfig(); cfgerr != nil {
+				log.Println(cfgerr)
+			}
 			render.JSON(w, r, npppd)
 			return
 		}
@@ -111,6 +173,9 @@ func NpppdRouter(db npppdmodel.Crud) chi.Router {
 		npppd.ID = uint(id)
 		err = db.Delete(npppd)
 		if err == nil {
+			if cfgerr := db.WriteConfig(); cfgerr != nil {
+				log.Println(cfgerr)
+			}
 			render.JSON(w, r, npppd)
 			return
 		}
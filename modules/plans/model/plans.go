@@ -2,21 +2,55 @@
 package planmodel
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	submodel "github.com/rbaylon/arkgate/modules/subs/model"
 	"gorm.io/gorm"
 )
 
+// Quota actions
+const (
+	QuotaThrottle = "throttle"
+	QuotaBlock    = "block"
+)
+
+// Billing cycles
+const (
+	CycleMonthly  = "monthly"
+	CycleWeekly   = "weekly"
+	CycleYearly   = "yearly"
+	CycleDuration = "duration"
+)
+
 type Plan struct {
 	gorm.Model
 	Name       string `json:"planname" bson:"planname"`
 	Downspeed  int    `json:"downspeed" bson:"downspeed"`
 	Upspeed    int    `json:"upspeed" bson:"upspeed"`
 	Burstspeed int    `json:"burstspeed" bson:"burstspeed"`
-	Duration   int    `json:"duration" bson:"duration"`
-	Subs       []submodel.Sub
+	Duration   int    `json:"duration" bson:"duration"` // days, subscription period
+	// Quota - Bytes per billing period, up and down, 0 for unlimited. Once
+	// used up QuotaAction "throttle" limits the sub to the throttle speeds
+	// (kbit/s), "block" cuts it off until the period rolls over.
+	Quota        uint64 `json:"quota" bson:"quota"`
+	QuotaAction  string `json:"quotaaction" bson:"quotaaction"`
+	ThrottleDown int    `json:"throttledown" bson:"throttledown"`
+	ThrottleUp   int    `json:"throttleup" bson:"throttleup"`
+	// Price, SetupFee - In the smallest unit of Currency (cents), Price is
+	// charged every Cycle: "monthly" (default), "weekly", "yearly" or
+	// "duration" for every Duration days. TaxRate is a percentage added to
+	// both.
+	Price    int64   `json:"price" bson:"price"`
+	Currency string  `json:"currency" bson:"currency"`
+	Cycle    string  `json:"cycle" bson:"cycle"`
+	SetupFee int64   `json:"setupfee" bson:"setupfee"`
+	TaxRate  float64 `json:"taxrate" bson:"taxrate"`
+	Subs     []submodel.Sub
 }
 
 // MigrateDB - Create the table if not exist in DB
@@ -29,9 +63,57 @@ func MigrateDB(db *gorm.DB) {
 
 // Bind interface as required by go-chi/render
 func (a *Plan) Bind(r *http.Request) error {
+	switch a.Cycle {
+	case "", CycleMonthly, CycleWeekly, CycleYearly:
+	case CycleDuration:
+		if a.Duration <= 0 {
+			return errors.New("cycle duration needs a plan duration")
+		}
+	default:
+		return fmt.Errorf("unknown cycle %s", a.Cycle)
+	}
+	switch a.QuotaAction {
+	case "", QuotaThrottle, QuotaBlock:
+	default:
+		return fmt.Errorf("unknown quota action %s, use throttle or block", a.QuotaAction)
+	}
+	if a.Price < 0 || a.SetupFee < 0 || a.TaxRate < 0 {
+		return errors.New("price, setupfee and taxrate can not be negative")
+	}
+	a.Currency = strings.ToUpper(a.Currency)
 	return nil
 }
 
+// Next - End of the billing cycle starting at from
+func (a *Plan) Next(from time.Time) time.Time {
+	switch a.Cycle {
+	case CycleWeekly:
+		return from.AddDate(0, 0, 7)
+	case CycleYearly:
+		return from.AddDate(1, 0, 0)
+	case CycleDuration:
+		if a.Duration > 0 {
+			return from.AddDate(0, 0, a.Duration)
+		}
+	}
+	return from.AddDate(0, 1, 0)
+}
+
+// Prev - Start of the billing cycle ending at until
+func (a *Plan) Prev(until time.Time) time.Time {
+	switch a.Cycle {
+	case CycleWeekly:
+		return until.AddDate(0, 0, -7)
+	case CycleYearly:
+		return until.AddDate(-1, 0, 0)
+	case CycleDuration:
+		if a.Duration > 0 {
+			return until.AddDate(0, 0, -a.Duration)
+		}
+	}
+	return until.AddDate(0, -1, 0)
+}
+
 type Crud interface {
 	GetAll() ([]Plan, error)
 	GetById(uid uint) (*Plan, error)
@@ -0,0 +1,139 @@
+// Package radiusmodel - RADIUS clients (NAS) allowed to query the server
+package radiusmodel
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type Client struct {
+	gorm.Model
+	Name string `json:"name" bson:"name"`
+	// Network - NAS address or CIDR, the most specific match supplies the secret
+	Network string `json:"network" bson:"network"`
+	Secret  string `json:"secret" bson:"secret"`
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Client{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Client) Bind(r *http.Request) error {
+	if a.Secret == "" {
+		return errors.New("secret is required")
+	}
+	_, err := a.IPNet()
+	return err
+}
+
+// IPNet - Network as a CIDR, a plain address is a single host
+func (a *Client) IPNet() (*net.IPNet, error) {
+	s := strings.TrimSpace(a.Network)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid client network " + a.Network)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+type Crud interface {
+	GetAll() ([]Client, error)
+	GetById(uid uint) (*Client, error)
+	Add(client *Client) error
+	Update(client *Client) error
+	Delete(client *Client) error
+	Match(ip net.IP) (*Client, error)
+}
+
+type Storage struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) Add(client *Client) error {
+	result := s.DB.Create(client)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) GetAll() ([]Client, error) {
+	var clients []Client
+	result := s.DB.Find(&clients)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return clients, nil
+}
+
+func (s *Storage) GetById(id uint) (*Client, error) {
+	var client Client
+	result := s.DB.First(&client, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &client, nil
+}
+
+// Match - Client with the most specific network containing ip
+func (s *Storage) Match(ip net.IP) (*Client, error) {
+	clients, err := s.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var best *Client
+	bits := -1
+	for i := range clients {
+		n, err := clients[i].IPNet()
+		if err != nil || !n.Contains(ip) {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones > bits {
+			best, bits = &clients[i], ones
+		}
+	}
+	if best == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return best, nil
+}
+
+func (s *Storage) Update(client *Client) error {
+	result := s.DB.Save(client)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) Delete(client *Client) error {
+	result := s.DB.Delete(client)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package radiusroutes - Arkgate API RADIUS module
+//
+// Clients are the NAS devices allowed to query the RADIUS server, each with
+// its own shared secret.
+//
+//	Module Routes:
+//	  /api/v1/radius/clients
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of client objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/radius/clients/<clientId>
+//	    Method: GET|PUT|DELETE
+//	    Headers: Authorization Bearer
+//	    Body: JSON client object with name, network (address or CIDR) and
+//	          secret (PUT)
+//	    Return: JSON client object ( exept for delete method )
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/radius/clients/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON client object with name, network and secret
+//	    Return: JSON client object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package radiusroutes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	radiusmodel "github.com/rbaylon/arkgate/modules/radius/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func RadiusRouter(db radiusmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	// load - Client of the clientId URL parameter, renders the error itself
+	load := func(w http.ResponseWriter, r *http.Request) *radiusmodel.Client {
+		id, err := strconv.Atoi(chi.URLParam(r, "clientId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid client ID %s", chi.URLParam(r, "clientId")), http.StatusBadRequest))
+			return nil
+		}
+		client, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return nil
+		}
+		return client
+	}
+
+	r.Get("/clients", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetAll()
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/clients/{clientId}", func(w http.ResponseWriter, r *http.Request) {
+		if client := load(w, r); client != nil {
+			render.JSON(w, r, client)
+		}
+	})
+	r.Put("/clients/{clientId}", func(w http.ResponseWriter, r *http.Request) {
+		client := load(w, r)
+		if client == nil {
+			return
+		}
+		if err := render.Bind(r, client); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		if err := db.Update(client); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error updating record for client  ID %s", chi.URLParam(r, "clientId")), http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, client)
+	})
+	r.Post("/clients/create", func(w http.ResponseWriter, r *http.Request) {
+		client := &radiusmodel.Client{}
+		if err := render.Bind(r, client); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		client.ID = 0
+		if err := db.Add(client); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, client)
+	})
+	r.Delete("/clients/{clientId}", func(w http.ResponseWriter, r *http.Request) {
+		client := load(w, r)
+		if client == nil {
+			return
+		}
+		if err := db.Delete(client); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error deleting record for client  ID %s", chi.URLParam(r, "clientId")), http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, client)
+	})
+	return r
+}
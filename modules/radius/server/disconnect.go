@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+// Disconnect - RFC 5176 Disconnect-Request to the NAS of every open
+// accounting session of sub
+func (s *Server) Disconnect(sub *submodel.Sub) error {
+	return s.tell(sub, radius.CodeDisconnectRequest, nil)
+}
+
+// Reauthorize - RFC 5176 CoA-Request with the current rate limits of sub,
+// after its quota state changed
+func (s *Server) Reauthorize(sub *submodel.Sub) error {
+	return s.tell(sub, radius.CodeCoARequest, func(p *radius.Packet) {
+		s.rateLimit(p, sub)
+	})
+}
+
+// tell - Send a request with code to the NAS of every open accounting
+// session of sub, fill adds the attributes beyond the session identity
+func (s *Server) tell(sub *submodel.Sub, code radius.Code, fill func(p *radius.Packet)) error {
+	if s.Sessions == nil {
+		return nil
+	}
+	sessions, err := s.Sessions.GetBySub(sub.ID)
+	if err != nil {
+		return err
+	}
+	ack := radius.CodeDisconnectACK
+	if code == radius.CodeCoARequest {
+		ack = radius.CodeCoAACK
+	}
+	var errs []error
+	for _, sess := range sessions {
+		if sess.StoppedAt != nil || sess.AcctSessionId == "" || sess.NasIp == "" {
+			continue
+		}
+		client, err := s.Clients.Match(net.ParseIP(sess.NasIp))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("NAS %s: %w", sess.NasIp, err))
+			continue
+		}
+		p := radius.New(code, []byte(client.Secret))
+		rfc2865.UserName_SetString(p, sess.Username)
+		rfc2866.AcctSessionID_SetString(p, sess.AcctSessionId)
+		if fill != nil {
+			fill(p)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		resp, err := radius.Exchange(ctx, p, net.JoinHostPort(sess.NasIp, strconv.Itoa(s.CoAPort)))
+		cancel()
+		if err == nil && resp.Code != ack {
+			err = fmt.Errorf("%s", resp.Code)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s on %s: %w", code, sess.AcctSessionId, sess.NasIp, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,382 @@
+// Package server - RADIUS authentication server for NAS devices backed by
+// submodel.Sub, supporting PAP, CHAP and MS-CHAPv2, and accounting receiver
+// feeding the session usage ledger
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	radiusmodel "github.com/rbaylon/arkgate/modules/radius/model"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2759"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/rfc3079"
+	"layeh.com/radius/vendors/microsoft"
+	"layeh.com/radius/vendors/mikrotik"
+	"layeh.com/radius/vendors/wispr"
+)
+
+const (
+	MethodPAP      = "pap"
+	MethodCHAP     = "chap"
+	MethodMSCHAPv2 = "mschapv2"
+)
+
+var (
+	ErrNoCredentials = errors.New("no supported credentials in request")
+	ErrBadPassword   = errors.New("wrong password")
+	ErrInactive      = errors.New("subscriber is not active")
+	ErrExpired       = errors.New("subscription expired")
+	ErrQuota         = errors.New("data quota used up")
+	ErrBillingHold   = errors.New("suspended for overdue invoices")
+)
+
+type Server struct {
+	Addr    string
+	Clients radiusmodel.Crud
+	Subs    submodel.Crud
+	Plans   planmodel.Crud
+	// Sessions - Accounting store, required by RunAccounting
+	Sessions sessionmodel.Crud
+	// Events - Optional pipeline receiving an auth event per request
+	Events *ingest.Pipeline
+	// CoAPort - NAS port receiving Disconnect-Requests
+	CoAPort int
+}
+
+func New(addr string, clients radiusmodel.Crud, subs submodel.Crud, plans planmodel.Crud) *Server {
+	return &Server{
+		Addr:    addr,
+		Clients: clients,
+		Subs:    subs,
+		Plans:   plans,
+		CoAPort: 3799,
+	}
+}
+
+// RADIUSSecret - Secret of the client the request came from, requests from
+// unknown addresses get an empty secret and are dropped
+func (s *Server) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	ua, ok := remoteAddr.(*net.UDPAddr)
+	if !ok {
+		return nil, nil
+	}
+	c, err := s.Clients.Match(ua.IP)
+	if err != nil {
+		log.Println("RADIUS request from unknown client ", ua.IP)
+		return nil, nil
+	}
+	return []byte(c.Secret), nil
+}
+
+// Run - Serve Access-Requests until the socket fails
+func (s *Server) Run() error {
+	srv := radius.PacketServer{
+		Addr:         s.Addr,
+		Handler:      radius.HandlerFunc(s.ServeRADIUS),
+		SecretSource: s,
+	}
+	return srv.ListenAndServe()
+}
+
+// RunAccounting - Serve Accounting-Requests on addr until the socket fails
+func (s *Server) RunAccounting(addr string) error {
+	srv := radius.PacketServer{
+		Addr:         addr,
+		Handler:      radius.HandlerFunc(s.ServeAccounting),
+		SecretSource: s,
+	}
+	return srv.ListenAndServe()
+}
+
+// ServeAccounting - Record the packet and acknowledge it. A packet that
+// could not be stored is not acknowledged so the NAS sends it again.
+func (s *Server) ServeAccounting(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccountingRequest {
+		return
+	}
+	rec := Record(r)
+	if rec == nil {
+		log.Println("RADIUS accounting packet without usable status from ", r.RemoteAddr)
+	} else if err := s.Sessions.Account(rec); err != nil {
+		log.Println("RADIUS accounting error: ", err)
+		return
+	}
+	if err := w.Write(r.Response(radius.CodeAccountingResponse)); err != nil {
+		log.Println("RADIUS write error: ", err)
+	}
+}
+
+// Record - Accounting request as a session record, nil for status types
+// that carry no usage
+func Record(r *radius.Request) *sessionmodel.Record {
+	p := r.Packet
+	rec := &sessionmodel.Record{
+		Host:      rfc2865.NASIdentifier_GetString(p),
+		SessionId: rfc2866.AcctSessionID_GetString(p),
+		Username:  rfc2865.UserName_GetString(p),
+		Time:      rfc2869.EventTimestamp_Get(p),
+		Duration:  int(rfc2866.AcctSessionTime_Get(p)),
+		InOctets:  sessionmodel.Octets(uint32(rfc2866.AcctInputOctets_Get(p)), uint32(rfc2869.AcctInputGigawords_Get(p))),
+		OutOctets: sessionmodel.Octets(uint32(rfc2866.AcctOutputOctets_Get(p)), uint32(rfc2869.AcctOutputGigawords_Get(p))),
+	}
+	if ip := rfc2865.FramedIPAddress_Get(p); ip != nil {
+		rec.FramedIp = ip.String()
+	}
+	if ip := rfc2865.NASIPAddress_Get(p); ip != nil {
+		rec.NasIp = ip.String()
+	} else if ua, ok := r.RemoteAddr.(*net.UDPAddr); ok {
+		rec.NasIp = ua.IP.String()
+	}
+	if rec.Host == "" {
+		rec.Host = rec.NasIp
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	switch rfc2866.AcctStatusType_Get(p) {
+	case rfc2866.AcctStatusType_Value_Start:
+		rec.Status = sessionmodel.AcctStart
+	case rfc2866.AcctStatusType_Value_InterimUpdate:
+		rec.Status = sessionmodel.AcctInterim
+	case rfc2866.AcctStatusType_Value_Stop:
+		rec.Status = sessionmodel.AcctStop
+	case rfc2866.AcctStatusType_Value_AccountingOn, rfc2866.AcctStatusType_Value_AccountingOff:
+		rec.Status = sessionmodel.AcctReset
+	default:
+		return nil
+	}
+	if rec.Status != sessionmodel.AcctReset && rec.SessionId == "" {
+		return nil
+	}
+	return rec
+}
+
+func (s *Server) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		return
+	}
+	username := rfc2865.UserName_GetString(r.Packet)
+	resp, method, err := s.authenticate(r, username)
+	action := "accept"
+	if err != nil {
+		action = "reject"
+		resp = r.Response(radius.CodeAccessReject)
+		rfc2865.ReplyMessage_SetString(resp, "Authentication failed")
+	}
+	if err := w.Write(resp); err != nil {
+		log.Println("RADIUS write error: ", err)
+	}
+	s.publish(r, username, method, action, err)
+}
+
+// credentials - Authentication method of an Access-Request, empty when it
+// carries no supported credentials
+func credentials(p *radius.Packet) string {
+	switch {
+	case len(rfc2865.UserPassword_Get(p)) > 0:
+		return MethodPAP
+	case len(rfc2865.CHAPPassword_Get(p)) == 17:
+		return MethodCHAP
+	case len(microsoft.MSCHAP2Response_Get(p)) == 50:
+		return MethodMSCHAPv2
+	}
+	return ""
+}
+
+// withoutDomain - Windows clients send MS-CHAPv2 names as DOMAIN\user, the
+// sub is user
+func withoutDomain(username string) string {
+	if i := strings.LastIndex(username, `\`); i >= 0 {
+		return username[i+1:]
+	}
+	return username
+}
+
+func (s *Server) authenticate(r *radius.Request, username string) (*radius.Packet, string, error) {
+	method := credentials(r.Packet)
+	if method == "" {
+		return nil, method, ErrNoCredentials
+	}
+	if method == MethodMSCHAPv2 {
+		username = withoutDomain(username)
+	}
+	sub, err := s.Subs.GetByUsername(username)
+	if err != nil {
+		return nil, method, err
+	}
+	password, err := sub.Secret()
+	if err != nil {
+		return nil, method, err
+	}
+	resp := r.Response(radius.CodeAccessAccept)
+	switch method {
+	case MethodPAP:
+		given := rfc2865.UserPassword_Get(r.Packet)
+		if subtle.ConstantTimeCompare(given, []byte(password)) != 1 {
+			return nil, method, ErrBadPassword
+		}
+	case MethodCHAP:
+		if !checkCHAP(r.Packet, password) {
+			return nil, method, ErrBadPassword
+		}
+	case MethodMSCHAPv2:
+		if err := mschapv2(r.Packet, resp, username, password); err != nil {
+			return nil, method, err
+		}
+	}
+	if !sub.IsActive {
+		return nil, method, ErrInactive
+	}
+	if sub.BillingHold {
+		return nil, method, ErrBillingHold
+	}
+	if sub.QuotaState == submodel.QuotaBlocked {
+		return nil, method, ErrQuota
+	}
+	// Not deactivated by the expiry scheduler yet
+	if sub.ExpiresAt != nil && !time.Now().Before(*sub.ExpiresAt) {
+		return nil, method, ErrExpired
+	}
+	rfc2865.ServiceType_Set(resp, rfc2865.ServiceType_Value_FramedUser)
+	rfc2865.FramedProtocol_Set(resp, rfc2865.FramedProtocol_Value_PPP)
+	if ip := net.ParseIP(sub.FramedIp); ip != nil && ip.To4() != nil {
+		rfc2865.FramedIPAddress_Set(resp, ip)
+	}
+	s.rateLimit(resp, sub)
+	return resp, method, nil
+}
+
+// rateLimit - Rate limits of the sub's plan, its throttle speeds once over
+// quota
+func (s *Server) rateLimit(p *radius.Packet, sub *submodel.Sub) {
+	if sub.PlanID == 0 || s.Plans == nil {
+		return
+	}
+	plan, err := s.Plans.GetById(sub.PlanID)
+	if err != nil {
+		return
+	}
+	if sub.QuotaState == submodel.QuotaThrottled {
+		RateLimit(p, plan.ThrottleUp, plan.ThrottleDown, 0)
+		return
+	}
+	RateLimit(p, plan.Upspeed, plan.Downspeed, plan.Burstspeed)
+}
+
+// RateLimit - Speeds (kbit/s) as MikroTik and WISPr attributes, understood
+// by most NAS devices
+func RateLimit(p *radius.Packet, up, down, burst int) {
+	if up <= 0 && down <= 0 {
+		return
+	}
+	// rx/tx from the NAS point of view, upload first
+	limit := fmt.Sprintf("%dk/%dk", up, down)
+	if burst > 0 {
+		limit += fmt.Sprintf(" %dk/%dk", burst, burst)
+	}
+	mikrotik.MikrotikRateLimit_SetString(p, limit)
+	if up > 0 {
+		wispr.WISPrBandwidthMaxUp_Set(p, wispr.WISPrBandwidthMaxUp(up*1000))
+	}
+	if down > 0 {
+		wispr.WISPrBandwidthMaxDown_Set(p, wispr.WISPrBandwidthMaxDown(down*1000))
+	}
+}
+
+// checkCHAP - RFC 1994 response, MD5 over id, password and challenge. The
+// challenge defaults to the request authenticator.
+func checkCHAP(p *radius.Packet, password string) bool {
+	chap := rfc2865.CHAPPassword_Get(p)
+	challenge := rfc2865.CHAPChallenge_Get(p)
+	if len(challenge) == 0 {
+		challenge = p.Authenticator[:]
+	}
+	h := md5.New()
+	h.Write(chap[:1])
+	h.Write([]byte(password))
+	h.Write(challenge)
+	return subtle.ConstantTimeCompare(h.Sum(nil), chap[1:]) == 1
+}
+
+// mschapv2 - RFC 2759 check, adds the success and MPPE key attributes to resp
+func mschapv2(p, resp *radius.Packet, username, password string) error {
+	challenge := microsoft.MSCHAPChallenge_Get(p)
+	response := microsoft.MSCHAP2Response_Get(p)
+	if len(challenge) != 16 {
+		return ErrNoCredentials
+	}
+	// RFC 2548 2.3.2, ident, flags, peer challenge, reserved, NT response
+	ident, peerChallenge, peerResponse := response[0], response[2:18], response[26:50]
+	// A DOMAIN\user name is hashed without the domain
+	name := withoutDomain(username)
+	ntResponse, err := rfc2759.GenerateNTResponse(challenge, peerChallenge, []byte(name), []byte(password))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ntResponse, peerResponse) {
+		return ErrBadPassword
+	}
+	authResponse, err := rfc2759.GenerateAuthenticatorResponse(challenge, peerChallenge, ntResponse, []byte(name), []byte(password))
+	if err != nil {
+		return err
+	}
+	recvKey, err := rfc3079.MakeKey(ntResponse, []byte(password), false)
+	if err != nil {
+		return err
+	}
+	sendKey, err := rfc3079.MakeKey(ntResponse, []byte(password), true)
+	if err != nil {
+		return err
+	}
+	microsoft.MSCHAP2Success_Add(resp, append([]byte{ident}, authResponse...))
+	microsoft.MSMPPERecvKey_Add(resp, recvKey)
+	microsoft.MSMPPESendKey_Add(resp, sendKey)
+	microsoft.MSMPPEEncryptionPolicy_Add(resp, microsoft.MSMPPEEncryptionPolicy_Value_EncryptionAllowed)
+	microsoft.MSMPPEEncryptionTypes_Add(resp, microsoft.MSMPPEEncryptionTypes_Value_RC440or128BitAllowed)
+	return nil
+}
+
+func (s *Server) publish(r *radius.Request, username, method, action string, err error) {
+	if s.Events == nil {
+		return
+	}
+	ev := eventmodel.Event{
+		Timestamp: time.Now(),
+		Type:      "auth",
+		Source:    rfc2865.NASIdentifier_GetString(r.Packet),
+		Action:    action,
+		Severity:  1,
+		Protocol:  "radius",
+		Username:  username,
+		Message:   fmt.Sprintf("RADIUS %s %s for %s", method, action, username),
+	}
+	// The NAS is the peer, the subscriber address is not known yet
+	if ua, ok := r.RemoteAddr.(*net.UDPAddr); ok {
+		ev.SrcIp = ua.IP.String()
+		if ev.Source == "" {
+			ev.Source = ev.SrcIp
+		}
+	}
+	if err != nil {
+		ev.Severity = 2
+		ev.Message += ": " + err.Error()
+	}
+	s.Events.Publish(ev)
+}
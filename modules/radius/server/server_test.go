@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	radiusmodel "github.com/rbaylon/arkgate/modules/radius/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/vendors/microsoft"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCheckCHAP(t *testing.T) {
+	challenge := unhex(t, "0102030405060708090a0b0c0d0e0f10")
+	authenticator := unhex(t, "202122232425262728292a2b2c2d2e2f")
+	tests := []struct {
+		name      string
+		response  string
+		challenge bool
+		password  string
+		want      bool
+	}{
+		{"challenge attribute", "7a560af49b8664d020001c6e316da100", true, "pw1", true},
+		{"wrong password", "7a560af49b8664d020001c6e316da100", true, "pw2", false},
+		{"authenticator as challenge", "17ec1c85deda2a5590df663c09a425bc", false, "pw1", true},
+		{"response to the other challenge", "17ec1c85deda2a5590df663c09a425bc", true, "pw1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+			copy(p.Authenticator[:], authenticator)
+			rfc2865.CHAPPassword_Set(p, append([]byte{7}, unhex(t, tt.response)...))
+			if tt.challenge {
+				rfc2865.CHAPChallenge_Set(p, challenge)
+			}
+			if got := checkCHAP(p, tt.password); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMSCHAPv2 - RFC 2759 section 9.2 test vectors
+func TestMSCHAPv2(t *testing.T) {
+	challenge := unhex(t, "5b5d7c7d7b3f2f3e3c2c602132262628")
+	peerChallenge := unhex(t, "21402324255e262a28295f2b3a337c7e")
+	ntResponse := unhex(t, "82309ecd8d708b5ea08faa3981cd83544233114a3d85d6df")
+	request := func(challenge []byte) *radius.Packet {
+		p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+		response := make([]byte, 50)
+		response[0] = 9
+		copy(response[2:18], peerChallenge)
+		copy(response[26:50], ntResponse)
+		microsoft.MSCHAPChallenge_Set(p, challenge)
+		microsoft.MSCHAP2Response_Set(p, response)
+		return p
+	}
+	tests := []struct {
+		name      string
+		username  string
+		password  string
+		challenge []byte
+		err       error
+	}{
+		{"valid", "User", "clientPass", challenge, nil},
+		{"domain prefix", `EXAMPLE\User`, "clientPass", challenge, nil},
+		{"wrong password", "User", "serverPass", challenge, ErrBadPassword},
+		{"wrong username", "Other", "clientPass", challenge, ErrBadPassword},
+		{"short challenge", "User", "clientPass", challenge[:8], ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := request(tt.challenge)
+			resp := p.Response(radius.CodeAccessAccept)
+			err := mschapv2(p, resp, tt.username, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			success := microsoft.MSCHAP2Success_Get(resp)
+			if want := "\x09S=407A5589115FD0D6209F510FE9C04566932CDA56"; string(success) != want {
+				t.Errorf("success %q, want %q", success, want)
+			}
+			if len(microsoft.MSMPPERecvKey_Get(resp, p)) == 0 || len(microsoft.MSMPPESendKey_Get(resp, p)) == 0 {
+				t.Error("MPPE keys missing")
+			}
+		})
+	}
+}
+
+// testServer - Server over an in-memory DB answering on a loopback port,
+// with sub User holding the RFC 2759 test password
+func testServer(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/.env", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("SUB_SECRET_KEYFILE", dir+"/sub-secrets.key")
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	radiusmodel.MigrateDB(db)
+	submodel.MigrateDB(db)
+	db.Create(&radiusmodel.Client{Name: "nas", Network: "127.0.0.1", Secret: "secret"})
+	sub := &submodel.Sub{Username: "User", IsActive: true}
+	if err := sub.SetPassword("clientPass"); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(sub)
+
+	s := New("", radiusmodel.New(db), submodel.New(db), nil)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &radius.PacketServer{Handler: radius.HandlerFunc(s.ServeRADIUS), SecretSource: s}
+	go srv.Serve(conn)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return conn.LocalAddr().String()
+}
+
+func TestAccessRequest(t *testing.T) {
+	addr := testServer(t)
+	challenge := unhex(t, "5b5d7c7d7b3f2f3e3c2c602132262628")
+	response := make([]byte, 50)
+	response[0] = 9
+	copy(response[2:18], unhex(t, "21402324255e262a28295f2b3a337c7e"))
+	copy(response[26:50], unhex(t, "82309ecd8d708b5ea08faa3981cd83544233114a3d85d6df"))
+	mschap := func(p *radius.Packet) {
+		microsoft.MSCHAPChallenge_Set(p, challenge)
+		microsoft.MSCHAP2Response_Set(p, response)
+	}
+	pap := func(p *radius.Packet) {
+		rfc2865.UserPassword_SetString(p, "clientPass")
+	}
+	tests := []struct {
+		name     string
+		username string
+		fill     func(p *radius.Packet)
+		want     radius.Code
+	}{
+		{"mschapv2", "User", mschap, radius.CodeAccessAccept},
+		{"mschapv2 with domain", `EXAMPLE\User`, mschap, radius.CodeAccessAccept},
+		{"mschapv2 other user", `EXAMPLE\Other`, mschap, radius.CodeAccessReject},
+		{"pap", "User", pap, radius.CodeAccessAccept},
+		{"pap keeps the domain", `EXAMPLE\User`, pap, radius.CodeAccessReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+			rfc2865.UserName_SetString(p, tt.username)
+			tt.fill(p)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			resp, err := radius.Exchange(ctx, p, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.want {
+				t.Fatalf("got %v, want %v", resp.Code, tt.want)
+			}
+			if tt.want == radius.CodeAccessAccept && rfc2865.ServiceType_Get(resp) != rfc2865.ServiceType_Value_FramedUser {
+				t.Error("accept without service type")
+			}
+		})
+	}
+}
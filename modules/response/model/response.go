@@ -0,0 +1,318 @@
+// Package response - Active response (auto-ban) specific functions
+package responsemodel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	"github.com/rbaylon/arkgate/modules/localutils"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+type Ban struct {
+	gorm.Model
+	Ip        string     `json:"ip" bson:"ip" gorm:"index"`
+	Reason    string     `json:"reason" bson:"reason"`
+	Rule      string     `json:"rule" bson:"rule"`
+	AlertID   uint       `json:"alertid" bson:"alertid"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+	Active    bool       `json:"active" bson:"active" gorm:"index"`
+	RemovedAt *time.Time `json:"removed_at" bson:"removed_at"`
+	TTL       int        `json:"ttl,omitempty" bson:"ttl" gorm:"-"` // seconds, used on create only
+}
+
+// Allow - Address or network that must never be banned
+type Allow struct {
+	gorm.Model
+	Cidr    string `json:"cidr" bson:"cidr"`
+	Comment string `json:"comment" bson:"comment"`
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Ban{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Allow{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Ban) Bind(r *http.Request) error {
+	if net.ParseIP(a.Ip) == nil {
+		return fmt.Errorf("invalid ip %q", a.Ip)
+	}
+	return nil
+}
+
+func (a *Allow) Bind(r *http.Request) error {
+	if _, err := parseNet(a.Cidr); err != nil {
+		return err
+	}
+	return nil
+}
+
+type Crud interface {
+	GetAll(all bool) ([]Ban, error)
+	GetById(uid uint) (*Ban, error)
+	Ban(ip string, ttl time.Duration, reason string, rule string, alertid uint) (*Ban, error)
+	Unban(ban *Ban) error
+	GetAllowlist() ([]Allow, error)
+	AddAllow(allow *Allow) error
+	DeleteAllow(allow *Allow) error
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+	// Table - pf table managed through the helper daemon
+	Table string
+	// TTL - Ban duration when none is given
+	TTL time.Duration
+	// MinSeverity - Alerts at or above this severity ban their source
+	MinSeverity string
+	mu          sync.Mutex
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB:          db,
+		Table:       "arkgate_bans",
+		TTL:         time.Hour,
+		MinSeverity: "high",
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) GetAll(all bool) ([]Ban, error) {
+	var bans []Ban
+	q := s.DB.Order("expires_at desc")
+	if !all {
+		q = q.Where("active = ?", true)
+	}
+	result := q.Find(&bans)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return bans, nil
+}
+
+func (s *Storage) GetById(id uint) (*Ban, error) {
+	var ban Ban
+	result := s.DB.First(&ban, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &ban, nil
+}
+
+// Ban - Add ip to the pf table for ttl. An active ban for the same address
+// is extended instead of duplicated.
+func (s *Storage) Ban(ip string, ttl time.Duration, reason string, rule string, alertid uint) (*Ban, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid ip %q", ip)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allowed, err := s.Allowed(ip)
+	if err != nil {
+		return nil, err
+	}
+	if allowed {
+		return nil, fmt.Errorf("%s is allowlisted", ip)
+	}
+	if ttl <= 0 {
+		ttl = s.TTL
+	}
+	expires := time.Now().Add(ttl)
+
+	var ban Ban
+	result := s.DB.Where("ip = ? AND active = ?", ip, true).First(&ban)
+	if result.Error == nil {
+		if expires.After(ban.ExpiresAt) {
+			ban.ExpiresAt = expires
+		}
+		if err := s.DB.Save(&ban).Error; err != nil {
+			return nil, err
+		}
+		return &ban, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	if err := localutils.SendCmd(fmt.Sprintf("PFTABLE ADD %s %s", s.Table, ip)); err != nil {
+		return nil, err
+	}
+	ban = Ban{Ip: ip, Reason: reason, Rule: rule, AlertID: alertid, ExpiresAt: expires, Active: true}
+	if err := s.DB.Create(&ban).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("Banned %s until %s: %s\n", ip, expires.Format(time.RFC3339), reason)
+	return &ban, nil
+}
+
+// Unban - Remove the address from the pf table and mark the ban inactive
+func (s *Storage) Unban(ban *Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ban.Active {
+		return nil
+	}
+	if err := localutils.SendCmd(fmt.Sprintf("PFTABLE DEL %s %s", s.Table, ban.Ip)); err != nil {
+		return err
+	}
+	now := time.Now()
+	ban.Active = false
+	ban.RemovedAt = &now
+	result := s.DB.Save(ban)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Expire - Lift every ban whose TTL elapsed. A ban that can not be lifted
+// does not hold up the others, it is retried on the next run.
+func (s *Storage) Expire() error {
+	var bans []Ban
+	result := s.DB.Where("active = ? AND expires_at <= ?", true, time.Now()).Find(&bans)
+	if result.Error != nil {
+		return result.Error
+	}
+	var errs []error
+	for i := range bans {
+		if err := s.Unban(&bans[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", bans[i].Ip, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync - Re-add every active ban, pf tables do not survive a reboot
+func (s *Storage) Sync() error {
+	bans, err := s.GetAll(false)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, ban := range bans {
+		if err := localutils.SendCmd(fmt.Sprintf("PFTABLE ADD %s %s", s.Table, ban.Ip)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ban.Ip, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run - Sync the pf table then expire bans every interval
+func (s *Storage) Run(interval time.Duration) {
+	if err := s.Sync(); err != nil {
+		log.Println("Ban sync error: ", err)
+	}
+	for range time.Tick(interval) {
+		if err := s.Expire(); err != nil {
+			log.Println("Ban expiry error: ", err)
+		}
+	}
+}
+
+// Allowed - True if ip is on the allowlist or belongs to a subscriber
+func (s *Storage) Allowed(ip string) (bool, error) {
+	addr := net.ParseIP(ip)
+	allows, err := s.GetAllowlist()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range allows {
+		n, err := parseNet(a.Cidr)
+		if err == nil && n.Contains(addr) {
+			return true, nil
+		}
+	}
+	var fips []string
+	result := s.DB.Model(&submodel.Sub{}).Where("framed_ip <> ''").Pluck("framed_ip", &fips)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	for _, fip := range fips {
+		n, err := parseNet(fip)
+		if err == nil && n.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Storage) GetAllowlist() ([]Allow, error) {
+	var allows []Allow
+	result := s.DB.Find(&allows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return allows, nil
+}
+
+func (s *Storage) AddAllow(allow *Allow) error {
+	result := s.DB.Create(allow)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) DeleteAllow(allow *Allow) error {
+	result := s.DB.Delete(allow)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Name - alertmodel.Notifier, bans the source of severe alerts
+func (s *Storage) Name() string {
+	return "active-response"
+}
+
+func (s *Storage) Notify(alert *alertmodel.Alert) error {
+	if alert.SrcIp == "" || alertmodel.Severities[alert.Severity] < alertmodel.Severities[s.MinSeverity] {
+		return nil
+	}
+	reason := alert.Summary
+	if reason == "" {
+		reason = alert.Rule
+	}
+	_, err := s.Ban(alert.SrcIp, s.TTL, reason, alert.Rule, alert.ID)
+	return err
+}
+
+// parseNet - Accept a single address or a CIDR
+func parseNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
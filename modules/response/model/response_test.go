@@ -0,0 +1,78 @@
+package responsemodel
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testStorage - Bans over an in-memory DB and a control socket failing every
+// command for the address fail
+func testStorage(t *testing.T, fail string) *Storage {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/.env", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("SRV_SOCKET", dir+"/srv.sock")
+	l, err := net.Listen("unix", dir+"/srv.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 256)
+			n, _ := c.Read(buf)
+			if strings.HasSuffix(string(buf[:n]), " "+fail) {
+				c.Write([]byte("ERR"))
+			} else {
+				c.Write([]byte("OK"))
+			}
+			c.Close()
+		}
+	}()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	return New(db)
+}
+
+func TestExpire(t *testing.T) {
+	s := testStorage(t, "192.0.2.2")
+	past := time.Now().Add(-time.Minute)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		s.DB.Create(&Ban{Ip: ip, ExpiresAt: past, Active: true})
+	}
+	s.DB.Create(&Ban{Ip: "192.0.2.4", ExpiresAt: time.Now().Add(time.Hour), Active: true})
+
+	err := s.Expire()
+	if err == nil || !strings.Contains(err.Error(), "192.0.2.2") {
+		t.Errorf("error %v", err)
+	}
+	var active []string
+	s.DB.Model(&Ban{}).Where("active = ?", true).Order("ip").Pluck("ip", &active)
+	if strings.Join(active, ",") != "192.0.2.2,192.0.2.4" {
+		t.Errorf("still active %v", active)
+	}
+}
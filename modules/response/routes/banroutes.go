@@ -0,0 +1,162 @@
+// Package banroutes - Arkgate API Active response module
+//
+//	Module Routes:
+//	  /api/v1/bans
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: all=true to include lifted bans
+//	    Return: JSON object with list of ban objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/bans/<banId>
+//	    Method: GET|DELETE
+//	    Headers: Authorization Bearer
+//	    Return: JSON ban object, DELETE lifts the ban
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/bans/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON ban object
+//	    Return-Status: 200 on Success
+//	                   400 on Bad request or allowlisted address
+//
+//	  /api/v1/bans/allowlist
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of allow objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/bans/allowlist/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON allow object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/bans/allowlist/<allowId>
+//	    Method: DELETE
+//	    Headers: Authorization Bearer
+//	    Return-Status: 200 on Success
+//	                   400 on Bad request
+package banroutes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	responsemodel "github.com/rbaylon/arkgate/modules/response/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func BanRouter(db responsemodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetAll(r.URL.Query().Get("all") == "true")
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/allowlist", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetAllowlist()
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/allowlist/create", func(w http.ResponseWriter, r *http.Request) {
+		allow := &responsemodel.Allow{}
+		if err := render.Bind(r, allow); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		err := db.AddAllow(allow)
+		if err == nil {
+			render.JSON(w, r, allow)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+	})
+	r.Delete("/allowlist/{allowId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "allowId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid allow ID %s", chi.URLParam(r, "allowId")), http.StatusBadRequest))
+			return
+		}
+		allow := &responsemodel.Allow{}
+		allow.ID = uint(id)
+		err = db.DeleteAllow(allow)
+		if err == nil {
+			render.JSON(w, r, allow)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error deleting record for allow  ID %s", chi.URLParam(r, "allowId")), http.StatusBadRequest))
+	})
+	r.Get("/{banId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "banId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid ban ID %s", chi.URLParam(r, "banId")), http.StatusBadRequest))
+			return
+		}
+		ban, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, ban)
+	})
+	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+		req := &responsemodel.Ban{}
+		if err := render.Bind(r, req); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		reason := req.Reason
+		if reason == "" {
+			reason = "manual"
+		}
+		ban, err := db.Ban(req.Ip, time.Duration(req.TTL)*time.Second, reason, "manual", 0)
+		if err == nil {
+			render.JSON(w, r, ban)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error banning %s", req.Ip), http.StatusBadRequest))
+	})
+	r.Delete("/{banId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "banId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid ban ID %s", chi.URLParam(r, "banId")), http.StatusBadRequest))
+			return
+		}
+		ban, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		err = db.Unban(ban)
+		if err == nil {
+			render.JSON(w, r, ban)
+			return
+		}
+		render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Error lifting ban ID %s", chi.URLParam(r, "banId")), http.StatusBadRequest))
+	})
+	return r
+}
@@ -0,0 +1,241 @@
+// Package retention - Event retention policies and rollups
+package retentionmodel
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// AnyType - Policy applied to event types without a policy of their own
+	AnyType = "*"
+	// AlertType - Policy applied to closed alerts instead of events
+	AlertType = "alert"
+
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// Policy - How long one event type is kept. Zero days keeps data forever.
+type Policy struct {
+	gorm.Model
+	Type       string `json:"type" bson:"type" gorm:"uniqueIndex"`
+	Days       int    `json:"days" bson:"days"`               // raw events
+	HourlyDays int    `json:"hourly_days" bson:"hourly_days"` // hourly rollups
+	DailyDays  int    `json:"daily_days" bson:"daily_days"`   // daily rollups
+	Archive    bool   `json:"archive" bson:"archive"`         // write expired events to the archive first
+}
+
+// Rollup - Event counts per period by type, source, destination, port and
+// action, kept after the raw events expire
+type Rollup struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	Period      string    `json:"period" bson:"period" gorm:"uniqueIndex:idx_rollup"`
+	BucketStart time.Time `json:"bucket_start" bson:"bucket_start" gorm:"uniqueIndex:idx_rollup;index"`
+	Type        string    `json:"type" bson:"type" gorm:"uniqueIndex:idx_rollup"`
+	SrcIp       string    `json:"src_ip" bson:"src_ip" gorm:"uniqueIndex:idx_rollup"`
+	DstIp       string    `json:"dst_ip" bson:"dst_ip" gorm:"uniqueIndex:idx_rollup"`
+	DstPort     int       `json:"dst_port" bson:"dst_port" gorm:"uniqueIndex:idx_rollup"`
+	Action      string    `json:"action" bson:"action" gorm:"uniqueIndex:idx_rollup"`
+	Count       int64     `json:"count" bson:"count"`
+}
+
+// RollupState - Rollups of a period are complete up to Through
+type RollupState struct {
+	Period  string `gorm:"primarykey"`
+	Through time.Time
+}
+
+// RollupFilter - Query parameters accepted by Storage.FindRollups
+type RollupFilter struct {
+	Period string
+	Type   string
+	SrcIp  string
+	DstIp  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Policy{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&Rollup{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.AutoMigrate(&RollupState{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Policy) Bind(r *http.Request) error {
+	if a.Type == "" {
+		return errors.New("type is required, use * for all types")
+	}
+	if a.Days < 0 || a.HourlyDays < 0 || a.DailyDays < 0 {
+		return errors.New("days can not be negative")
+	}
+	return nil
+}
+
+type Crud interface {
+	GetAll() ([]Policy, error)
+	GetById(uid uint) (*Policy, error)
+	Add(policy *Policy) error
+	Update(policy *Policy) error
+	Delete(policy *Policy) error
+	FindRollups(f *RollupFilter) ([]Rollup, error)
+	AddRollups(rollups []Rollup) error
+	DeleteRollups(period, typ string, notTypes []string, before time.Time) (int64, error)
+	GetThrough(period string) (time.Time, error)
+	SetThrough(period string, through time.Time) error
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) GetAll() ([]Policy, error) {
+	var policies []Policy
+	result := s.DB.Order("type").Find(&policies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policies, nil
+}
+
+func (s *Storage) GetById(id uint) (*Policy, error) {
+	var policy Policy
+	result := s.DB.First(&policy, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &policy, nil
+}
+
+func (s *Storage) Add(policy *Policy) error {
+	result := s.DB.Create(policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) Update(policy *Policy) error {
+	result := s.DB.Save(policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) Delete(policy *Policy) error {
+	// Hard delete so the type can get a new policy
+	result := s.DB.Unscoped().Delete(policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (s *Storage) FindRollups(f *RollupFilter) ([]Rollup, error) {
+	var rollups []Rollup
+	q := s.DB.Order("bucket_start desc, count desc")
+	if f.Period != "" {
+		q = q.Where("period = ?", f.Period)
+	}
+	if f.Type != "" {
+		q = q.Where("type = ?", f.Type)
+	}
+	if f.SrcIp != "" {
+		q = q.Where("src_ip = ?", f.SrcIp)
+	}
+	if f.DstIp != "" {
+		q = q.Where("dst_ip = ?", f.DstIp)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("bucket_start >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("bucket_start < ?", f.Until.UTC())
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	result := q.Find(&rollups)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return rollups, nil
+}
+
+// AddRollups - Store rollups, replacing the count of existing rows so
+// re-rolling a period is harmless
+func (s *Storage) AddRollups(rollups []Rollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	result := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "period"}, {Name: "bucket_start"}, {Name: "type"}, {Name: "src_ip"}, {Name: "dst_ip"}, {Name: "dst_port"}, {Name: "action"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("excluded.count")}),
+	}).CreateInBatches(&rollups, 500)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// DeleteRollups - Remove rollups of a period older than before, for one
+// type or for every type not in notTypes when typ is AnyType
+func (s *Storage) DeleteRollups(period, typ string, notTypes []string, before time.Time) (int64, error) {
+	q := s.DB.Where("period = ? AND bucket_start < ?", period, before.UTC())
+	if typ != AnyType {
+		q = q.Where("type = ?", typ)
+	} else if len(notTypes) > 0 {
+		q = q.Where("type NOT IN ?", notTypes)
+	}
+	result := q.Delete(&Rollup{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
+
+func (s *Storage) GetThrough(period string) (time.Time, error) {
+	var state RollupState
+	result := s.DB.Where("period = ?", period).Limit(1).Find(&state)
+	if result.Error != nil {
+		return time.Time{}, result.Error
+	}
+	return state.Through, nil
+}
+
+func (s *Storage) SetThrough(period string, through time.Time) error {
+	result := s.DB.Save(&RollupState{Period: period, Through: through})
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+// Package retention - Background job rolling up, archiving and expiring
+// events according to the retention policies
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	retentionmodel "github.com/rbaylon/arkgate/modules/retention/model"
+)
+
+// ErrNoArchiveDir - Policy asks for archival but no directory is configured
+var ErrNoArchiveDir = errors.New("policy archives but no archive directory is configured")
+
+// Result - What one run of the job did
+type Result struct {
+	Hours          int      `json:"hours"` // hourly buckets rolled up
+	Days           int      `json:"days"`  // daily buckets rolled up
+	Archived       int      `json:"archived"`
+	Deleted        int      `json:"deleted"`
+	Alerts         int      `json:"alerts"`
+	RollupsDeleted int64    `json:"rollups_deleted"`
+	Files          []string `json:"files"`
+	Errors         []string `json:"errors"`
+}
+
+type Job struct {
+	Events     eventmodel.Crud
+	Store      retentionmodel.Crud
+	ArchiveDir string
+	mu         sync.Mutex
+}
+
+func New(events eventmodel.Crud, store retentionmodel.Crud, dir string) *Job {
+	return &Job{
+		Events:     events,
+		Store:      store,
+		ArchiveDir: dir,
+	}
+}
+
+// Run - Run the job every interval
+func (j *Job) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		res := j.RunOnce(time.Now())
+		for _, e := range res.Errors {
+			log.Println("Retention: ", e)
+		}
+	}
+}
+
+// RunOnce - Roll up closed periods, then archive and remove expired data.
+// Events arriving after their hour was rolled up are not counted.
+func (j *Job) RunOnce(now time.Time) *Result {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	res := &Result{Files: []string{}, Errors: []string{}}
+	fail := func(err error) {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	if err := j.rollHours(now, res); err != nil {
+		fail(err)
+	}
+	if err := j.rollDays(res); err != nil {
+		fail(err)
+	}
+
+	policies, err := j.Store.GetAll()
+	if err != nil {
+		fail(err)
+		return res
+	}
+	var typed []string
+	for _, p := range policies {
+		if p.Type != retentionmodel.AnyType {
+			typed = append(typed, p.Type)
+		}
+	}
+	for _, p := range policies {
+		if err := j.expire(&p, typed, now, res); err != nil {
+			fail(fmt.Errorf("%s: %w", p.Type, err))
+		}
+	}
+	return res
+}
+
+func (j *Job) rollHours(now time.Time, res *Result) error {
+	through, err := j.Store.GetThrough(retentionmodel.PeriodHour)
+	if err != nil {
+		return err
+	}
+	db := j.Events.GetDB()
+	if through.IsZero() {
+		var first eventmodel.Event
+		if err := db.Order("timestamp").Limit(1).Find(&first).Error; err != nil {
+			return err
+		}
+		if first.ID == 0 {
+			return nil
+		}
+		through = first.Timestamp.UTC().Truncate(time.Hour)
+	}
+	end := now.UTC().Truncate(time.Hour)
+	for h := through.UTC(); h.Before(end); h = h.Add(time.Hour) {
+		var rollups []retentionmodel.Rollup
+		result := db.Model(&eventmodel.Event{}).
+			Select("type, src_ip, dst_ip, dst_port, action, COUNT(*) AS count").
+			Where("timestamp >= ? AND timestamp < ?", h, h.Add(time.Hour)).
+			Group("type, src_ip, dst_ip, dst_port, action").Scan(&rollups)
+		if result.Error != nil {
+			return result.Error
+		}
+		for i := range rollups {
+			rollups[i].Period = retentionmodel.PeriodHour
+			rollups[i].BucketStart = h
+		}
+		if err := j.Store.AddRollups(rollups); err != nil {
+			return err
+		}
+		if err := j.Store.SetThrough(retentionmodel.PeriodHour, h.Add(time.Hour)); err != nil {
+			return err
+		}
+		res.Hours++
+	}
+	return nil
+}
+
+// rollDays - Daily rollups are built from the hourly ones of the day
+func (j *Job) rollDays(res *Result) error {
+	hours, err := j.Store.GetThrough(retentionmodel.PeriodHour)
+	if err != nil || hours.IsZero() {
+		return err
+	}
+	through, err := j.Store.GetThrough(retentionmodel.PeriodDay)
+	if err != nil {
+		return err
+	}
+	db := j.Store.GetDB()
+	if through.IsZero() {
+		var first retentionmodel.Rollup
+		if err := db.Where("period = ?", retentionmodel.PeriodHour).Order("bucket_start").Limit(1).Find(&first).Error; err != nil {
+			return err
+		}
+		if first.ID == 0 {
+			return nil
+		}
+		through = first.BucketStart.UTC().Truncate(24 * time.Hour)
+	}
+	for d := through.UTC(); !d.Add(24 * time.Hour).After(hours); d = d.Add(24 * time.Hour) {
+		var rollups []retentionmodel.Rollup
+		result := db.Model(&retentionmodel.Rollup{}).
+			Select("type, src_ip, dst_ip, dst_port, action, SUM(count) AS count").
+			Where("period = ? AND bucket_start >= ? AND bucket_start < ?", retentionmodel.PeriodHour, d, d.Add(24*time.Hour)).
+			Group("type, src_ip, dst_ip, dst_port, action").Scan(&rollups)
+		if result.Error != nil {
+			return result.Error
+		}
+		for i := range rollups {
+			rollups[i].Period = retentionmodel.PeriodDay
+			rollups[i].BucketStart = d
+		}
+		if err := j.Store.AddRollups(rollups); err != nil {
+			return err
+		}
+		if err := j.Store.SetThrough(retentionmodel.PeriodDay, d.Add(24*time.Hour)); err != nil {
+			return err
+		}
+		res.Days++
+	}
+	return nil
+}
+
+func (j *Job) expire(p *retentionmodel.Policy, typed []string, now time.Time, res *Result) error {
+	if p.Days > 0 {
+		if p.Archive && j.ArchiveDir == "" {
+			return ErrNoArchiveDir
+		}
+		cutoff := now.AddDate(0, 0, -p.Days)
+		if p.Type == retentionmodel.AlertType {
+			if err := j.expireAlerts(p, cutoff, res); err != nil {
+				return err
+			}
+		} else {
+			f := &eventmodel.Filter{Until: cutoff, Limit: 1000}
+			if p.Type == retentionmodel.AnyType {
+				f.NotTypes = append([]string{retentionmodel.AlertType}, typed...)
+			} else {
+				f.Type = p.Type
+			}
+			n, err := j.Events.Prune(f, func(events []eventmodel.Event) error {
+				if p.Archive {
+					if err := j.archiveEvents(events, res); err != nil {
+						return err
+					}
+					res.Archived += len(events)
+				}
+				ids := make([]uint, len(events))
+				for i, e := range events {
+					ids[i] = e.ID
+				}
+				// Alerts keep their summary, not the expired evidence
+				return j.Events.GetDB().Exec("DELETE FROM alert_events WHERE event_id IN ?", ids).Error
+			})
+			res.Deleted += n
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range []struct {
+		period string
+		days   int
+	}{{retentionmodel.PeriodHour, p.HourlyDays}, {retentionmodel.PeriodDay, p.DailyDays}} {
+		if r.days <= 0 {
+			continue
+		}
+		n, err := j.Store.DeleteRollups(r.period, p.Type, typed, now.AddDate(0, 0, -r.days))
+		if err != nil {
+			return err
+		}
+		res.RollupsDeleted += n
+	}
+	return nil
+}
+
+func (j *Job) expireAlerts(p *retentionmodel.Policy, cutoff time.Time, res *Result) error {
+	db := j.Events.GetDB()
+	for {
+		var alerts []alertmodel.Alert
+		result := db.Where("status = ? AND last_seen < ?", alertmodel.StatusClosed, cutoff).Order("id").Limit(500).Find(&alerts)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(alerts) == 0 {
+			return nil
+		}
+		if p.Archive {
+			parts := map[string][]interface{}{}
+			var names []string
+			for i := range alerts {
+				name := fmt.Sprintf("alerts-%s.jsonl.gz", alerts[i].LastSeen.UTC().Format("2006-01-02"))
+				if _, ok := parts[name]; !ok {
+					names = append(names, name)
+				}
+				parts[name] = append(parts[name], &alerts[i])
+			}
+			for _, name := range names {
+				if err := j.write(name, parts[name], res); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range alerts {
+			if err := db.Select("Events").Unscoped().Delete(&alerts[i]).Error; err != nil {
+				return err
+			}
+		}
+		res.Alerts += len(alerts)
+	}
+}
+
+var unsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// archiveEvents - Append events to one gzip JSON-lines file per type and
+// event day
+func (j *Job) archiveEvents(events []eventmodel.Event, res *Result) error {
+	parts := map[string][]interface{}{}
+	var names []string
+	for i := range events {
+		e := &events[i]
+		name := fmt.Sprintf("events-%s-%s.jsonl.gz", unsafe.ReplaceAllString(e.Type, "_"), e.Timestamp.UTC().Format("2006-01-02"))
+		if _, ok := parts[name]; !ok {
+			names = append(names, name)
+		}
+		parts[name] = append(parts[name], e)
+	}
+	for _, name := range names {
+		if err := j.write(name, parts[name], res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write - Append records as a new gzip member, concatenated members read
+// back as one stream with zcat or gzip.Reader
+func (j *Job) write(name string, records []interface{}, res *Result) error {
+	if err := os.MkdirAll(j.ArchiveDir, 0750); err != nil {
+		return err
+	}
+	path := filepath.Join(j.ArchiveDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for _, p := range res.Files {
+		if p == path {
+			return nil
+		}
+	}
+	res.Files = append(res.Files, path)
+	return nil
+}
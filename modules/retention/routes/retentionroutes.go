@@ -0,0 +1,184 @@
+// Package retentionroutes - Arkgate API Retention module
+//
+//	Module Routes:
+//	  /api/v1/retention
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of retention policy objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/retention/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON policy object, type is an event type, "*" for types
+//	          without a policy or "alert" for closed alerts
+//	    Return: JSON policy object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/retention/rollups
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: period=hour|day, type, src, dst, since, until (RFC3339), limit
+//	    Return: JSON list of rollup objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/retention/run
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON result of a retention run started now
+//	    Return-Status: 200 on Success
+//
+//	  /api/v1/retention/<policyId>
+//	    Method: GET, PUT, DELETE
+//	    Headers: Authorization Bearer
+//	    Body: JSON policy object (PUT)
+//	    Return: JSON policy object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package retentionroutes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/rbaylon/arkgate/modules/retention"
+	retentionmodel "github.com/rbaylon/arkgate/modules/retention/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func RetentionRouter(db retentionmodel.Crud, job *retention.Job) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		policies, err := db.GetAll()
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, policies)
+	})
+	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+		data := &retentionmodel.Policy{}
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid request", http.StatusBadRequest))
+			return
+		}
+		data.ID = 0
+		if err := db.Add(data); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, data)
+	})
+	r.Get("/rollups", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := &retentionmodel.RollupFilter{
+			Period: q.Get("period"),
+			Type:   q.Get("type"),
+			SrcIp:  q.Get("src"),
+			DstIp:  q.Get("dst"),
+			Limit:  1000,
+		}
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+				return
+			}
+		}
+		if v := q.Get("until"); v != "" {
+			if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil {
+				render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid filter", http.StatusBadRequest))
+				return
+			}
+		}
+		rollups, errdb := db.FindRollups(f)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, rollups)
+	})
+	r.Post("/run", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, job.RunOnce(time.Now()))
+	})
+	r.Get("/{policyId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "policyId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid policy ID %s", chi.URLParam(r, "policyId")), http.StatusBadRequest))
+			return
+		}
+		policy, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, policy)
+	})
+	r.Put("/{policyId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "policyId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid policy ID %s", chi.URLParam(r, "policyId")), http.StatusBadRequest))
+			return
+		}
+		policy, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		data := &retentionmodel.Policy{}
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid request", http.StatusBadRequest))
+			return
+		}
+		policy.Type = data.Type
+		policy.Days = data.Days
+		policy.HourlyDays = data.HourlyDays
+		policy.DailyDays = data.DailyDays
+		policy.Archive = data.Archive
+		if err := db.Update(policy); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, policy)
+	})
+	r.Delete("/{policyId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "policyId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid policy ID %s", chi.URLParam(r, "policyId")), http.StatusBadRequest))
+			return
+		}
+		policy, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if err := db.Delete(policy); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, policy)
+	})
+	return r
+}
@@ -95,6 +95,12 @@ func TokenRequired(next http.Handler) http.Handler {
 	})
 }
 
+// ValidateToken - Check a bearer token taken from somewhere other than the
+// Authorization header
+func ValidateToken(token string) error {
+	return validateToken(token)
+}
+
 func createToken(username string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		jwt.MapClaims{
@@ -122,3 +128,24 @@ func validateToken(tokenString string) error {
 	}
 	return nil
 }
+
+// Username - User the bearer token of a request was issued to, empty when
+// the token is missing or invalid
+func Username(r *http.Request) string {
+	reqtoken := r.Header.Get("Authorization")
+	if len(reqtoken) <= len("Bearer ") {
+		return ""
+	}
+	token, err := jwt.Parse(reqtoken[len("Bearer "):], func(token *jwt.Token) (interface{}, error) {
+		return secretKey, nil
+	})
+	if err != nil || !token.Valid {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	username, _ := claims["username"].(string)
+	return username
+}
@@ -0,0 +1,194 @@
+package sessionmodel
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	AcctStart   = "start"
+	AcctInterim = "interim"
+	AcctStop    = "stop"
+	// AcctReset - Accounting-On/Off, the NAS restarted and lost its sessions
+	AcctReset = "reset"
+)
+
+// Usage - Ledger of a subscriber's traffic and online time per UTC day.
+// Only counter increases are added so replayed packets never count twice.
+type Usage struct {
+	gorm.Model
+	SubID     uint      `json:"subid" bson:"subid" gorm:"uniqueIndex:idx_usage_sub_day"`
+	Day       time.Time `json:"day" bson:"day" gorm:"uniqueIndex:idx_usage_sub_day"`
+	InOctets  uint64    `json:"in_octets" bson:"in_octets"`
+	OutOctets uint64    `json:"out_octets" bson:"out_octets"`
+	Seconds   uint64    `json:"seconds" bson:"seconds"`
+	Sessions  int       `json:"sessions" bson:"sessions"`
+}
+
+// Record - One accounting packet, counters are totals since session start
+type Record struct {
+	Status    string
+	Host      string
+	NasIp     string
+	SessionId string
+	Username  string
+	FramedIp  string
+	Time      time.Time
+	Duration  int
+	InOctets  uint64
+	OutOctets uint64
+}
+
+// Total - Usage summed over a period
+type Total struct {
+	SubID     uint      `json:"subid"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	InOctets  uint64    `json:"in_octets"`
+	OutOctets uint64    `json:"out_octets"`
+	Seconds   uint64    `json:"seconds"`
+	Sessions  int       `json:"sessions"`
+	Days      []Usage   `json:"days"`
+	Active    []Session `json:"active"`
+}
+
+// Octets - Counter from its 32 bit value and the Gigawords overflow count
+func Octets(octets, gigawords uint32) uint64 {
+	return uint64(gigawords)<<32 | uint64(octets)
+}
+
+// Account - Apply an accounting record to its session and the usage ledger,
+// a reset closes every open RADIUS session of the host. Duplicates and
+// packets arriving out of order are harmless: a start for a known session is
+// ignored, counters only move forward and a session stays stopped once a
+// stop was seen. A session already recorded from the npppd log is accounted
+// on that record, see twin.
+func (s *Storage) Account(rec *Record) error {
+	rec.Time = rec.Time.UTC()
+	if rec.Status == AcctReset {
+		return s.DB.Model(&Session{}).
+			Where("host = ? AND acct_session_id <> '' AND stopped_at IS NULL", rec.Host).
+			Update("stopped_at", rec.Time).Error
+	}
+	err := s.account(rec)
+	if errors.Is(err, errRecorded) {
+		// Another packet of the session stored it first
+		err = s.account(rec)
+	}
+	return err
+}
+
+// errRecorded - The session was stored by a concurrent packet
+var errRecorded = errors.New("session recorded meanwhile")
+
+func (s *Storage) account(rec *Record) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var sess Session
+		result := tx.Where("host = ? AND acct_session_id = ?", rec.Host, rec.SessionId).First(&sess)
+		if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		found := result.Error == nil
+		isNew := false
+		if !found {
+			sess = Session{
+				Host:          rec.Host,
+				NasIp:         rec.NasIp,
+				AcctSessionId: rec.SessionId,
+				Username:      rec.Username,
+				FramedIp:      rec.FramedIp,
+				Auth:          "radius",
+				StartedAt:     rec.Time.Add(-time.Duration(rec.Duration) * time.Second),
+			}
+			// A session of the npppd log takes the accounting of its twin
+			if twin, err := twin(tx, &sess, true); err != nil {
+				return err
+			} else if twin != nil {
+				twin.Host, twin.AcctSessionId = rec.Host, rec.SessionId
+				sess = *twin
+			} else {
+				(&Storage{DB: tx}).resolveSub(&sess)
+				isNew = true
+			}
+		} else if rec.Status == AcctStart {
+			return nil
+		}
+		if sess.FramedIp == "" {
+			sess.FramedIp = rec.FramedIp
+		}
+		if sess.NasIp == "" {
+			sess.NasIp = rec.NasIp
+		}
+		if err := ledger(tx, &sess, rec.InOctets, rec.OutOctets, rec.Duration, rec.Time, isNew); err != nil {
+			return err
+		}
+		if rec.Status == AcctStop && sess.StoppedAt == nil {
+			stopped := rec.Time
+			sess.StoppedAt = &stopped
+		}
+		if !isNew {
+			return tx.Save(&sess).Error
+		}
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&sess)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return errRecorded
+		}
+		return result.Error
+	})
+}
+
+// ledger - Move the session counters forward and add the increase to the
+// subscriber's day
+func ledger(tx *gorm.DB, sess *Session, in, out uint64, duration int, at time.Time, isNew bool) error {
+	u := Usage{SubID: sess.SubID, Day: at.UTC().Truncate(24 * time.Hour)}
+	if isNew {
+		u.Sessions = 1
+	}
+	if in > sess.InOctets {
+		u.InOctets, sess.InOctets = in-sess.InOctets, in
+	}
+	if out > sess.OutOctets {
+		u.OutOctets, sess.OutOctets = out-sess.OutOctets, out
+	}
+	if duration > sess.Duration {
+		u.Seconds, sess.Duration = uint64(duration-sess.Duration), duration
+	}
+	if sess.SubID == 0 || u.InOctets+u.OutOctets+u.Seconds == 0 && u.Sessions == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "sub_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"in_octets":  gorm.Expr("usages.in_octets + ?", u.InOctets),
+			"out_octets": gorm.Expr("usages.out_octets + ?", u.OutOctets),
+			"seconds":    gorm.Expr("usages.seconds + ?", u.Seconds),
+			"sessions":   gorm.Expr("usages.sessions + ?", u.Sessions),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&u).Error
+}
+
+// Usage - Ledger totals of a subscriber between since and until, with the
+// sessions still open
+func (s *Storage) Usage(subid uint, since, until time.Time) (*Total, error) {
+	t := &Total{SubID: subid, Since: since, Until: until, Days: []Usage{}}
+	result := s.DB.Where("sub_id = ? AND day >= ? AND day < ?", subid, since.UTC().Truncate(24*time.Hour), until.UTC()).
+		Order("day").Find(&t.Days)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, d := range t.Days {
+		t.InOctets += d.InOctets
+		t.OutOctets += d.OutOctets
+		t.Seconds += d.Seconds
+		t.Sessions += d.Sessions
+	}
+	result = s.DB.Where("sub_id = ? AND stopped_at IS NULL", subid).Order("started_at desc").Find(&t.Active)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return t, nil
+}
@@ -0,0 +1,324 @@
+// Package sessions - Subscriber PPP session history
+package sessionmodel
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+type Session struct {
+	gorm.Model
+	Host       string     `json:"host" bson:"host" gorm:"uniqueIndex:idx_sessions_host_acct,priority:1"`
+	PppId      int        `json:"pppid" bson:"pppid"`
+	SubID      uint       `json:"subid" bson:"subid" gorm:"index"`
+	Username   string     `json:"username" bson:"username" gorm:"index"`
+	FramedIp   string     `json:"fip" bson:"fip" gorm:"index"`
+	Tunnel     string     `json:"tunnel" bson:"tunnel"`
+	Layer2From string     `json:"layer2from" bson:"layer2from"`
+	Auth       string     `json:"auth" bson:"auth"`
+	Iface      string     `json:"iface" bson:"iface"`
+	StartedAt  time.Time  `json:"started_at" bson:"started_at" gorm:"index"`
+	StoppedAt  *time.Time `json:"stopped_at" bson:"stopped_at" gorm:"index"`
+	Duration   int        `json:"duration" bson:"duration"` // seconds
+	InOctets   uint64     `json:"in_octets" bson:"in_octets"`
+	OutOctets  uint64     `json:"out_octets" bson:"out_octets"`
+	// AcctSessionId - Acct-Session-Id of sessions reported by RADIUS
+	// accounting, unique per host
+	AcctSessionId string        `json:"acct_session_id" bson:"acct_session_id" gorm:"uniqueIndex:idx_sessions_host_acct,priority:2,where:acct_session_id <> ''"`
+	NasIp         string        `json:"nas_ip" bson:"nas_ip"`
+	Sub           *submodel.Sub `json:"sub,omitempty" gorm:"-"`
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	if db.Migrator().HasColumn(&Session{}, "acct_session_id") {
+		if err := dedupeAcct(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := db.AutoMigrate(&Session{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = migrateUTC(db); err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&Usage{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateUTC - Rewrite session times stored with a local offset in UTC,
+// they are compared as text so every row has to use the same offset
+func migrateUTC(db *gorm.DB) error {
+	var sessions []Session
+	return db.Unscoped().Select("id, started_at, stopped_at").
+		Where("started_at NOT LIKE ? OR stopped_at NOT LIKE ?", "%+00:00", "%+00:00").
+		FindInBatches(&sessions, 1000, func(tx *gorm.DB, n int) error {
+			for _, sess := range sessions {
+				cols := map[string]interface{}{"started_at": sess.StartedAt.UTC()}
+				if sess.StoppedAt != nil {
+					cols["stopped_at"] = sess.StoppedAt.UTC()
+				}
+				if err := db.Unscoped().Model(&Session{}).Where("id = ?", sess.ID).UpdateColumns(cols).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// dedupeAcct - Merge sessions recorded more than once for the same
+// Acct-Session-Id of a host so the unique index can be created. The row
+// stored first is kept with the furthest counters, usage already added to
+// the ledger stays as it is.
+func dedupeAcct(db *gorm.DB) error {
+	var dups []Session
+	err := db.Unscoped().Model(&Session{}).Select("host, acct_session_id").Where("acct_session_id <> ''").
+		Group("host, acct_session_id").Having("COUNT(*) > 1").Find(&dups).Error
+	if err != nil {
+		return err
+	}
+	for _, d := range dups {
+		var rows []Session
+		err := db.Unscoped().Where("host = ? AND acct_session_id = ?", d.Host, d.AcctSessionId).Order("id").Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		keep := rows[0]
+		for _, r := range rows[1:] {
+			keep.InOctets = max(keep.InOctets, r.InOctets)
+			keep.OutOctets = max(keep.OutOctets, r.OutOctets)
+			keep.Duration = max(keep.Duration, r.Duration)
+			if keep.StoppedAt == nil {
+				keep.StoppedAt = r.StoppedAt
+			}
+			if err := db.Unscoped().Delete(&Session{}, r.ID).Error; err != nil {
+				return err
+			}
+		}
+		err = db.Unscoped().Model(&Session{}).Where("id = ?", keep.ID).UpdateColumns(map[string]interface{}{
+			"in_octets": keep.InOctets, "out_octets": keep.OutOctets, "duration": keep.Duration, "stopped_at": keep.StoppedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bind interface as required by go-chi/render
+func (a *Session) Bind(r *http.Request) error {
+	return nil
+}
+
+type Crud interface {
+	GetAll(active bool) ([]Session, error)
+	GetById(uid uint) (*Session, error)
+	GetBySub(subid uint) ([]Session, error)
+	Lookup(ip string, at time.Time) ([]Session, error)
+	Start(sess *Session) error
+	Stop(sess *Session) error
+	Account(rec *Record) error
+	Usage(subid uint, since, until time.Time) (*Total, error)
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB: db,
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) GetAll(active bool) ([]Session, error) {
+	var sessions []Session
+	q := s.DB.Order("started_at desc")
+	if active {
+		q = q.Where("stopped_at IS NULL")
+	}
+	result := q.Find(&sessions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return sessions, nil
+}
+
+func (s *Storage) GetById(id uint) (*Session, error) {
+	var sess Session
+	result := s.DB.First(&sess, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &sess, nil
+}
+
+func (s *Storage) GetBySub(subid uint) ([]Session, error) {
+	var sessions []Session
+	result := s.DB.Where("sub_id = ?", subid).Order("started_at desc").Find(&sessions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return sessions, nil
+}
+
+// Lookup - Sessions that held ip at the given time, with their subscriber
+func (s *Storage) Lookup(ip string, at time.Time) ([]Session, error) {
+	var sessions []Session
+	at = at.UTC()
+	result := s.DB.Where("framed_ip = ? AND started_at <= ? AND (stopped_at IS NULL OR stopped_at >= ?)", ip, at, at).
+		Order("started_at desc").Find(&sessions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for i := range sessions {
+		if sessions[i].SubID == 0 {
+			continue
+		}
+		var sub submodel.Sub
+		if err := s.DB.First(&sub, sessions[i].SubID).Error; err == nil {
+			sessions[i].Sub = &sub
+		}
+	}
+	return sessions, nil
+}
+
+// Start - Record a new session. An open session with the same ppp id on the
+// same host belongs to a previous npppd run and is closed first. A session
+// RADIUS accounting already reported is completed instead, see twin.
+// Session times are stored in UTC.
+func (s *Storage) Start(sess *Session) error {
+	sess.StartedAt = sess.StartedAt.UTC()
+	s.DB.Model(&Session{}).
+		Where("host = ? AND ppp_id = ? AND stopped_at IS NULL", sess.Host, sess.PppId).
+		Update("stopped_at", sess.StartedAt)
+	if twin, err := twin(s.DB, sess, false); err != nil {
+		return err
+	} else if twin != nil {
+		twin.PppId, twin.Tunnel, twin.Layer2From, twin.Auth, twin.Iface = sess.PppId, sess.Tunnel, sess.Layer2From, sess.Auth, sess.Iface
+		if err := s.DB.Save(twin).Error; err != nil {
+			return err
+		}
+		*sess = *twin
+		return nil
+	}
+	s.resolveSub(sess)
+	result := s.DB.Create(sess)
+	if result.Error != nil {
+		return result.Error
+	}
+	return ledger(s.DB, sess, 0, 0, 0, sess.StartedAt, true)
+}
+
+// Stop - Close the matching open session with its final counters and add
+// them to the usage ledger. If the start was never seen it is reconstructed
+// from the reported duration.
+func (s *Storage) Stop(sess *Session) error {
+	stopped := sess.StoppedAt.UTC()
+	sess.StoppedAt = &stopped
+	var open Session
+	isNew := false
+	result := s.DB.Where("host = ? AND ppp_id = ? AND username = ? AND stopped_at IS NULL", sess.Host, sess.PppId, sess.Username).
+		Order("started_at desc").First(&open)
+	if result.Error != nil {
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		started := *sess
+		started.StartedAt = sess.StoppedAt.Add(-time.Duration(sess.Duration) * time.Second)
+		if twin, err := twin(s.DB, &started, false); err != nil {
+			return err
+		} else if twin != nil {
+			return s.stopTwin(sess, twin)
+		}
+		open = *sess
+		open.StartedAt = sess.StoppedAt.Add(-time.Duration(sess.Duration) * time.Second)
+		open.Duration, open.InOctets, open.OutOctets = 0, 0, 0
+		s.resolveSub(&open)
+		isNew = true
+	}
+	open.StoppedAt = sess.StoppedAt
+	if err := ledger(s.DB, &open, sess.InOctets, sess.OutOctets, sess.Duration, *sess.StoppedAt, isNew); err != nil {
+		return err
+	}
+	if open.FramedIp == "" {
+		open.FramedIp = sess.FramedIp
+	}
+	result = s.DB.Save(&open)
+	if result.Error != nil {
+		return result.Error
+	}
+	*sess = open
+	return nil
+}
+
+// stopTwin - Final npppd counters for a session RADIUS accounting reported,
+// it may have been stopped by accounting already
+func (s *Storage) stopTwin(sess *Session, twin *Session) error {
+	twin.PppId = sess.PppId
+	if twin.StoppedAt == nil {
+		twin.StoppedAt = sess.StoppedAt
+	}
+	if err := ledger(s.DB, twin, sess.InOctets, sess.OutOctets, sess.Duration, *sess.StoppedAt, false); err != nil {
+		return err
+	}
+	if err := s.DB.Save(twin).Error; err != nil {
+		return err
+	}
+	*sess = *twin
+	return nil
+}
+
+// twinWindow - Largest difference between the start times the npppd log and
+// RADIUS accounting give one PPP session
+const twinWindow = time.Minute
+
+// twin - The session recorded by the other source for the PPP session sess
+// of the npppd log (radius false) or of RADIUS accounting. Both report the
+// same user and address starting at about the same time, the hosts may
+// differ as accounting names the NAS by its NAS-Identifier or address.
+func twin(db *gorm.DB, sess *Session, radius bool) (*Session, error) {
+	if sess.Username == "" || sess.FramedIp == "" {
+		return nil, nil
+	}
+	q := db.Where("username = ? AND framed_ip = ? AND started_at BETWEEN ? AND ?",
+		sess.Username, sess.FramedIp, sess.StartedAt.Add(-twinWindow), sess.StartedAt.Add(twinWindow))
+	if radius {
+		q = q.Where("acct_session_id = ''")
+	} else {
+		q = q.Where("acct_session_id <> '' AND ppp_id IN ?", []int{0, sess.PppId})
+	}
+	var t Session
+	result := q.Order("started_at desc").First(&t)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &t, nil
+}
+
+func (s *Storage) resolveSub(sess *Session) {
+	if sess.SubID != 0 || sess.Username == "" {
+		return
+	}
+	sub, err := submodel.New(s.DB).GetByUsername(sess.Username)
+	if err == nil {
+		sess.SubID = sub.ID
+	}
+}
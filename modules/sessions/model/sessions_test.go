@@ -0,0 +1,213 @@
+package sessionmodel
+
+import (
+	"testing"
+	"time"
+
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	submodel.MigrateDB(db)
+	return New(db)
+}
+
+func TestLookup(t *testing.T) {
+	s := testStorage(t)
+	east := time.FixedZone("EST", -5*3600)
+	started := time.Date(2026, 1, 10, 8, 0, 0, 0, east)
+	if err := s.Start(&Session{Host: "gw", PppId: 1, Username: "bob", FramedIp: "10.0.0.2", StartedAt: started}); err != nil {
+		t.Fatal(err)
+	}
+	stopped := started.Add(time.Hour)
+	if err := s.Stop(&Session{Host: "gw", PppId: 1, Username: "bob", StoppedAt: &stopped, Duration: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"local", started.Add(30 * time.Minute), 1},
+		{"utc", started.Add(30 * time.Minute).UTC(), 1},
+		{"other zone", started.Add(59 * time.Minute).In(time.FixedZone("JST", 9*3600)), 1},
+		{"before", started.Add(-time.Minute).UTC(), 0},
+		{"after", stopped.Add(time.Minute), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.Lookup("10.0.0.2", tt.at)
+			if err != nil || len(res) != tt.want {
+				t.Errorf("got %d sessions, %v", len(res), err)
+			}
+		})
+	}
+}
+
+// testSub - Sub bob the sessions of the tests belong to
+func testSub(t *testing.T, s *Storage) uint {
+	t.Helper()
+	sub := &submodel.Sub{Username: "bob", IsActive: true}
+	if err := s.DB.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+	return sub.ID
+}
+
+func TestAccount(t *testing.T) {
+	start := time.Date(2026, 1, 10, 8, 0, 0, 0, time.UTC)
+	rec := func(status string, after, in, out int) *Record {
+		return &Record{Status: status, Host: "nas", SessionId: "a1", Username: "bob", FramedIp: "10.0.0.2",
+			Time: start.Add(time.Duration(after) * time.Second), Duration: after, InOctets: uint64(in), OutOctets: uint64(out)}
+	}
+	tests := []struct {
+		name    string
+		records []*Record
+		stopped bool
+	}{
+		{"in order", []*Record{rec(AcctStart, 0, 0, 0), rec(AcctInterim, 60, 100, 10), rec(AcctStop, 120, 300, 30)}, true},
+		{"duplicates", []*Record{rec(AcctStart, 0, 0, 0), rec(AcctStart, 0, 0, 0), rec(AcctInterim, 60, 100, 10),
+			rec(AcctInterim, 60, 100, 10), rec(AcctStop, 120, 300, 30), rec(AcctStop, 120, 300, 30)}, true},
+		{"stop first", []*Record{rec(AcctStop, 120, 300, 30), rec(AcctInterim, 60, 100, 10), rec(AcctStart, 0, 0, 0)}, true},
+		{"interim after stop", []*Record{rec(AcctStart, 0, 0, 0), rec(AcctStop, 120, 300, 30), rec(AcctInterim, 60, 100, 10)}, true},
+		{"no start", []*Record{rec(AcctInterim, 60, 100, 10), rec(AcctInterim, 120, 300, 30)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStorage(t)
+			subid := testSub(t, s)
+			for _, r := range tt.records {
+				if err := s.Account(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var sessions []Session
+			s.DB.Find(&sessions)
+			if len(sessions) != 1 {
+				t.Fatalf("%d sessions", len(sessions))
+			}
+			sess := sessions[0]
+			if !sess.StartedAt.Equal(start) || (sess.StoppedAt != nil) != tt.stopped || sess.InOctets != 300 || sess.OutOctets != 30 {
+				t.Errorf("session %+v", sess)
+			}
+			total, err := s.Usage(subid, start, start.Add(24*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total.InOctets != 300 || total.OutOctets != 30 || total.Seconds != 120 || total.Sessions != 1 {
+				t.Errorf("usage %+v", total)
+			}
+		})
+	}
+}
+
+func TestAcctUnique(t *testing.T) {
+	s := testStorage(t)
+	sess := Session{Host: "nas", AcctSessionId: "a1", StartedAt: time.Now()}
+	if err := s.DB.Create(&sess).Error; err != nil {
+		t.Fatal(err)
+	}
+	dup := Session{Host: "nas", AcctSessionId: "a1", StartedAt: time.Now()}
+	if err := s.DB.Create(&dup).Error; err == nil {
+		t.Error("stored a second session for the same Acct-Session-Id")
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.DB.Create(&Session{Host: "nas", PppId: i, StartedAt: time.Now()}).Error; err != nil {
+			t.Errorf("npppd log session: %v", err)
+		}
+	}
+}
+
+func TestDedupeAcct(t *testing.T) {
+	s := testStorage(t)
+	s.DB.Exec("DROP INDEX idx_sessions_host_acct")
+	stopped := time.Now().UTC()
+	s.DB.Create(&Session{Host: "nas", AcctSessionId: "a1", InOctets: 100, Duration: 60})
+	s.DB.Create(&Session{Host: "nas", AcctSessionId: "a1", InOctets: 300, OutOctets: 30, Duration: 120, StoppedAt: &stopped})
+	s.DB.Create(&Session{Host: "other", AcctSessionId: "a1"})
+	MigrateDB(s.DB)
+	var sessions []Session
+	s.DB.Unscoped().Order("id").Find(&sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions", len(sessions))
+	}
+	if got := sessions[0]; got.ID != 1 || got.InOctets != 300 || got.OutOctets != 30 || got.Duration != 120 || got.StoppedAt == nil {
+		t.Errorf("kept %+v", got)
+	}
+}
+
+func TestTwin(t *testing.T) {
+	start := time.Date(2026, 1, 10, 8, 0, 0, 0, time.UTC)
+	stopped := start.Add(2 * time.Minute)
+	npppdStart := func(s *Storage) error {
+		return s.Start(&Session{Host: "gw", PppId: 7, Username: "bob", FramedIp: "10.0.0.2", Auth: "pap", StartedAt: start.Add(2 * time.Second)})
+	}
+	npppdStop := func(s *Storage) error {
+		return s.Stop(&Session{Host: "gw", PppId: 7, Username: "bob", FramedIp: "10.0.0.2", StoppedAt: &stopped, Duration: 118, InOctets: 300, OutOctets: 30})
+	}
+	acct := func(status string, after, in, out int) func(s *Storage) error {
+		return func(s *Storage) error {
+			return s.Account(&Record{Status: status, Host: "nas", SessionId: "a1", Username: "bob", FramedIp: "10.0.0.2",
+				Time: start.Add(time.Duration(after) * time.Second), Duration: after, InOctets: uint64(in), OutOctets: uint64(out)})
+		}
+	}
+	tests := []struct {
+		name  string
+		steps []func(s *Storage) error
+	}{
+		{"npppd first", []func(s *Storage) error{npppdStart, acct(AcctStart, 0, 0, 0), acct(AcctInterim, 60, 100, 10), npppdStop, acct(AcctStop, 120, 300, 30)}},
+		{"radius first", []func(s *Storage) error{acct(AcctStart, 0, 0, 0), npppdStart, acct(AcctStop, 120, 300, 30), npppdStop}},
+		{"radius stop first", []func(s *Storage) error{npppdStart, acct(AcctStop, 120, 300, 30), npppdStop}},
+		{"only stops", []func(s *Storage) error{acct(AcctStop, 120, 300, 30), npppdStop}},
+		{"npppd stop only then radius", []func(s *Storage) error{npppdStop, acct(AcctStop, 120, 300, 30)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStorage(t)
+			subid := testSub(t, s)
+			for _, step := range tt.steps {
+				if err := step(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var sessions []Session
+			s.DB.Find(&sessions)
+			if len(sessions) != 1 {
+				t.Fatalf("%d sessions", len(sessions))
+			}
+			if sess := sessions[0]; sess.AcctSessionId != "a1" || sess.PppId != 7 || sess.StoppedAt == nil || sess.InOctets != 300 {
+				t.Errorf("session %+v", sess)
+			}
+			total, err := s.Usage(subid, start, start.Add(24*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total.InOctets != 300 || total.OutOctets != 30 || total.Sessions != 1 {
+				t.Errorf("usage %+v", total)
+			}
+		})
+	}
+
+	// Another session of the user at another time is not a twin
+	s := testStorage(t)
+	npppdStart(s)
+	s.Account(&Record{Status: AcctStart, Host: "nas", SessionId: "a2", Username: "bob", FramedIp: "10.0.0.2", Time: start.Add(time.Hour)})
+	var n int64
+	s.DB.Model(&Session{}).Count(&n)
+	if n != 2 {
+		t.Errorf("%d sessions", n)
+	}
+}
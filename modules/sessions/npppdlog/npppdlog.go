@@ -0,0 +1,114 @@
+// Package npppdlog - npppd(8) syslog parser feeding the session history
+package npppdlog
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rbaylon/arkgate/modules/localutils/tail"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+)
+
+const (
+	TunnelStart = "TUNNELSTART"
+	TunnelUsage = "TUNNELUSAGE"
+)
+
+var ErrNotSession = errors.New("not an npppd session line")
+
+// Line - A parsed npppd ppp log line
+type Line struct {
+	Time    time.Time
+	Host    string
+	PppId   int
+	LogType string
+	Fields  map[string]string
+}
+
+var (
+	syslogRe = regexp.MustCompile(`^(\w{3} [ \d]\d \d\d:\d\d:\d\d) (\S+) npppd\[\d+\]: ppp id=(\d+) layer=base (.*)$`)
+	kvRe     = regexp.MustCompile(`(\w+)=("[^"]*"|\S*)`)
+)
+
+// Parse - Split an npppd "ppp id=N layer=base logtype=..." line into its
+// key=value fields. Only TUNNELSTART and TUNNELUSAGE lines are accepted.
+func Parse(line string, now time.Time) (*Line, error) {
+	m := syslogRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, ErrNotSession
+	}
+	ts, err := time.ParseInLocation("Jan _2 15:04:05", m[1], now.Location())
+	if err != nil {
+		return nil, err
+	}
+	ts = ts.AddDate(now.Year(), 0, 0)
+	if ts.After(now.AddDate(0, 0, 1)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	id, _ := strconv.Atoi(m[3])
+	l := &Line{Time: ts, Host: m[2], PppId: id, Fields: map[string]string{}}
+	for _, kv := range kvRe.FindAllStringSubmatch(m[4], -1) {
+		l.Fields[kv[1]] = strings.Trim(kv[2], `"`)
+	}
+	l.LogType = l.Fields["logtype"]
+	if l.LogType != TunnelStart && l.LogType != TunnelUsage {
+		return nil, ErrNotSession
+	}
+	return l, nil
+}
+
+// Session - Map the parsed line to a session record
+func (l *Line) Session() *sessionmodel.Session {
+	sess := &sessionmodel.Session{
+		Host:       l.Host,
+		PppId:      l.PppId,
+		Username:   l.Fields["user"],
+		FramedIp:   l.Fields["ip"],
+		Tunnel:     l.Fields["layer2"],
+		Layer2From: l.Fields["layer2from"],
+		Auth:       l.Fields["auth"],
+		Iface:      l.Fields["iface"],
+		StartedAt:  l.Time,
+	}
+	if l.LogType == TunnelUsage {
+		stopped := l.Time
+		sess.StoppedAt = &stopped
+		sess.Duration = leadingInt(l.Fields["duration"])
+		sess.InOctets = uint64(leadingInt(l.Fields["data_in"]))
+		sess.OutOctets = uint64(leadingInt(l.Fields["data_out"]))
+	}
+	return sess
+}
+
+// leadingInt - "1234bytes,56packets" -> 1234, "90sec" -> 90
+func leadingInt(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+// Ingest - Follow the npppd log and record session starts and stops
+func Ingest(path string, db sessionmodel.Crud) {
+	tail.Follow(path, false, func(line string) {
+		l, err := Parse(line, time.Now())
+		if err != nil {
+			return
+		}
+		sess := l.Session()
+		if l.LogType == TunnelStart {
+			err = db.Start(sess)
+		} else {
+			err = db.Stop(sess)
+		}
+		if err != nil {
+			log.Println("Session history error: ", err)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Package sessionroutes - Arkgate API Session history module
+//
+//	Module Routes:
+//	  /api/v1/sessions
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: active=true for sessions still up
+//	    Return: JSON object with list of session objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/sessions/lookup?ip=<framed ip>&at=<RFC3339 time>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON list of sessions holding ip at that time, with their sub
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/sessions/<sessionId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON session object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+package sessionroutes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/rbaylon/arkgate/modules/security"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func SessionRouter(db sessionmodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetAll(r.URL.Query().Get("active") == "true")
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/lookup", func(w http.ResponseWriter, r *http.Request) {
+		ip := r.URL.Query().Get("ip")
+		if net.ParseIP(ip) == nil {
+			render.Render(w, r, utils.ErrInvalidRequest(fmt.Errorf("invalid ip %q", ip), "Bad request", http.StatusBadRequest))
+			return
+		}
+		at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid time, RFC3339 expected", http.StatusBadRequest))
+			return
+		}
+		res, errdb := db.Lookup(ip, at)
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/{sessionId}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "sessionId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid session ID %s", chi.URLParam(r, "sessionId")), http.StatusBadRequest))
+			return
+		}
+		sess, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, sess)
+	})
+	return r
+}
@@ -0,0 +1,215 @@
+// Package streamroutes - Arkgate API Live stream module
+//
+//	Module Routes:
+//	  /api/v1/stream/sse
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: kind=event,alert type=<event type> src=<ip> rule=<alert rule>
+//	           severity=<minimum alert severity>
+//	    Return: text/event-stream of "event" and "alert" messages, a
+//	            "dropped" message reports messages lost to backpressure
+//	    Return-Status: 200 on Success
+//
+//	  /api/v1/stream/ws
+//	    Method: GET (WebSocket upgrade)
+//	    Headers: Authorization Bearer, or from browsers the subprotocols
+//	             "bearer" and the token: new WebSocket(url, ["bearer", jwt])
+//	    Query: same as /sse
+//	    Return: one JSON message per event, alert or drop report
+//	    Return-Status: 101 on Success
+//	                   401 on Missing or invalid token
+//	                   403 on Origin not allowed
+//	                   400 on Bad request
+//
+// Browser upgrades are only accepted from the API's own host and the
+// origins in STREAM_ALLOWED_ORIGINS.
+package streamroutes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+	"github.com/rbaylon/arkgate/modules/security"
+	"github.com/rbaylon/arkgate/modules/stream"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+// Ping - Keepalive interval for idle streams
+var Ping = 15 * time.Second
+
+// Origins - Browser origins besides the API host allowed to open /ws,
+// "*" allows any
+var Origins []string
+
+// protocol - Subprotocol a browser offers ahead of its token, it can not
+// set the Authorization header on an upgrade
+const protocol = "bearer"
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{protocol},
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin - Clients without an Origin are not browsers, browsers have
+// to come from the API host or an allowed origin
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range Origins {
+		if o == "*" || strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsToken - Bearer token of an upgrade from the Authorization header or
+// the subprotocol following "bearer"
+func wsToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > len("Bearer ") {
+		return h[len("Bearer "):]
+	}
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == protocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+func StreamRouter(hub *stream.Hub) chi.Router {
+	r := chi.NewRouter()
+
+	r.With(security.TokenRequired).Get("/sse", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		sub := hub.Subscribe(stream.ParseFilter(r.URL.Query()))
+		defer hub.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ping := time.NewTicker(Ping)
+		defer ping.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-sub.Done:
+				fmt.Fprint(w, "event: error\ndata: {\"error\":\"slow consumer disconnected\"}\n\n")
+				flusher.Flush()
+				return
+			case m := <-sub.C:
+				if n := sub.Dropped(); n > 0 {
+					fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n)
+				}
+				b, err := json.Marshal(m)
+				if err != nil {
+					log.Println("Stream marshal error: ", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Kind, b)
+				flusher.Flush()
+			case <-ping.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+	r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
+		token := wsToken(r)
+		if token == "" {
+			render.Render(w, r, utils.ErrInvalidRequest(errors.New("JWT error"), "Authorization Bearer not found.", http.StatusUnauthorized))
+			return
+		}
+		if err := security.ValidateToken(token); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid token", http.StatusUnauthorized))
+			return
+		}
+		if !checkOrigin(r) {
+			render.Render(w, r, utils.ErrInvalidRequest(errors.New("origin not allowed"), "Origin not allowed", http.StatusForbidden))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied to the client
+			return
+		}
+		defer conn.Close()
+		sub := hub.Subscribe(stream.ParseFilter(r.URL.Query()))
+		defer hub.Unsubscribe(sub)
+
+		// Reader only exists to notice the client going away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(Ping)
+		defer ping.Stop()
+		write := func(v interface{}) bool {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			return conn.WriteJSON(v) == nil
+		}
+		for {
+			select {
+			case <-closed:
+				return
+			case <-sub.Done:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow consumer"), time.Now().Add(time.Second))
+				return
+			case m := <-sub.C:
+				if n := sub.Dropped(); n > 0 {
+					if !write(map[string]interface{}{"kind": "dropped", "dropped": n}) {
+						return
+					}
+				}
+				if !write(m) {
+					return
+				}
+			case <-ping.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+					return
+				}
+			}
+		}
+	})
+	return r
+}
@@ -0,0 +1,166 @@
+// Package stream - In-process pub/sub hub for live events and alerts
+package stream
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+const (
+	KindEvent = "event"
+	KindAlert = "alert"
+)
+
+type Message struct {
+	Kind  string            `json:"kind"`
+	Event *eventmodel.Event `json:"event,omitempty"`
+	Alert *alertmodel.Alert `json:"alert,omitempty"`
+}
+
+// Filter - Client supplied selection, empty fields match anything
+type Filter struct {
+	Kinds       map[string]bool
+	Type        string
+	SrcIp       string
+	Rule        string
+	MinSeverity string
+}
+
+// ParseFilter - kind=event,alert type=auth src=1.2.3.4 rule=x severity=high
+func ParseFilter(q url.Values) *Filter {
+	f := &Filter{
+		Kinds:       map[string]bool{},
+		Type:        q.Get("type"),
+		SrcIp:       q.Get("src"),
+		Rule:        q.Get("rule"),
+		MinSeverity: q.Get("severity"),
+	}
+	for _, k := range strings.Split(q.Get("kind"), ",") {
+		if k != "" {
+			f.Kinds[k] = true
+		}
+	}
+	return f
+}
+
+func (f *Filter) Match(m *Message) bool {
+	if len(f.Kinds) > 0 && !f.Kinds[m.Kind] {
+		return false
+	}
+	switch m.Kind {
+	case KindEvent:
+		ev := m.Event
+		if f.Rule != "" || f.MinSeverity != "" {
+			return false
+		}
+		return (f.Type == "" || f.Type == ev.Type) && (f.SrcIp == "" || f.SrcIp == ev.SrcIp)
+	case KindAlert:
+		a := m.Alert
+		if f.Type != "" {
+			return false
+		}
+		return (f.SrcIp == "" || f.SrcIp == a.SrcIp) &&
+			(f.Rule == "" || f.Rule == a.Rule) &&
+			alertmodel.Severities[a.Severity] >= alertmodel.Severities[f.MinSeverity]
+	}
+	return false
+}
+
+type Subscription struct {
+	C       chan Message
+	Done    chan struct{}
+	filter  *Filter
+	dropped int64
+	total   int64
+	once    sync.Once
+}
+
+// Dropped - Messages lost since the last call because the client was slow
+func (s *Subscription) Dropped() int64 {
+	return atomic.SwapInt64(&s.dropped, 0)
+}
+
+type Hub struct {
+	// Buffer - Messages queued per subscriber before dropping
+	Buffer int
+	// MaxDrops - A subscriber that lost this many messages is disconnected
+	MaxDrops int64
+	mu       sync.RWMutex
+	subs     map[*Subscription]struct{}
+}
+
+func New() *Hub {
+	return &Hub{
+		Buffer:   256,
+		MaxDrops: 1024,
+		subs:     map[*Subscription]struct{}{},
+	}
+}
+
+func (h *Hub) Subscribe(f *Filter) *Subscription {
+	s := &Subscription{
+		C:      make(chan Message, h.Buffer),
+		Done:   make(chan struct{}),
+		filter: f,
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+	s.once.Do(func() { close(s.Done) })
+}
+
+// Publish - Fan out without ever blocking the publisher. Slow subscribers
+// lose messages and are cut off once they lost MaxDrops in total.
+func (h *Hub) Publish(m Message) {
+	var slow []*Subscription
+	h.mu.RLock()
+	for s := range h.subs {
+		if !s.filter.Match(&m) {
+			continue
+		}
+		select {
+		case s.C <- m:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+			if atomic.AddInt64(&s.total, 1) >= h.MaxDrops {
+				slow = append(slow, s)
+			}
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range slow {
+		h.Unsubscribe(s)
+	}
+}
+
+// Consume - ingest.Sink, publishes stored events
+func (h *Hub) Consume(events []eventmodel.Event) {
+	for i := range events {
+		ev := events[i]
+		h.Publish(Message{Kind: KindEvent, Event: &ev})
+	}
+}
+
+// Name - alertmodel.Notifier, publishes new alerts
+func (h *Hub) Name() string {
+	return "stream"
+}
+
+func (h *Hub) Notify(alert *alertmodel.Alert) error {
+	a := *alert
+	a.Events = nil
+	h.Publish(Message{Kind: KindAlert, Alert: &a})
+	return nil
+}
@@ -0,0 +1,373 @@
+// Package bulk - Subscriber import and export in CSV and JSON. Rows are
+// validated one by one, an import can be a dry run or all or nothing.
+package bulk
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+
+	// MaxRows - Largest import accepted
+	MaxRows = 20000
+)
+
+// Row states
+const (
+	RowValid   = "valid"
+	RowCreated = "created"
+	RowError   = "error"
+)
+
+// Fields - Sub fields of an import and the columns of an export. Plan and
+// npppd are looked up by name, planid and npppdid by ID only when there is
+// no name as IDs differ between installations.
+var Fields = []string{"username", "password", "fip", "plan", "planid", "npppd", "npppdid", "isactive", "activated_at", "expires_at"}
+
+var errRollback = errors.New("rollback")
+
+// Options - How rows are read and applied
+type Options struct {
+	Format string
+	// Mapping - Import field to source column, fields not mapped are read
+	// from the column of the same name
+	Mapping map[string]string
+	// DryRun - Validate every row and roll everything back
+	DryRun bool
+	// Atomic - Import nothing if any row fails, otherwise the valid rows are
+	// imported and the failed ones reported
+	Atomic bool
+	// NoPassword - Accept rows without a password, as in an export. Their
+	// subs get a random secret nobody knows and can not log in until a
+	// password is set.
+	NoPassword bool
+}
+
+// RowResult - Outcome of one source row, rows count from 1 without the
+// CSV header
+type RowResult struct {
+	Row      int    `json:"row"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	SubID    uint   `json:"subid,omitempty"`
+	FramedIp string `json:"fip,omitempty"`
+}
+
+type Result struct {
+	DryRun    bool        `json:"dryrun"`
+	Atomic    bool        `json:"atomic"`
+	Committed bool        `json:"committed"`
+	Total     int         `json:"total"`
+	Valid     int         `json:"valid"`
+	Failed    int         `json:"failed"`
+	Rows      []RowResult `json:"rows"`
+}
+
+// ParseMapping - field:column pairs separated by commas
+func ParseMapping(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		field, column, ok := strings.Cut(pair, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || !known(field) {
+			return nil, fmt.Errorf("invalid mapping %s", pair)
+		}
+		m[field] = strings.TrimSpace(column)
+	}
+	return m, nil
+}
+
+func known(field string) bool {
+	for _, f := range Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Read - Rows of r as column to value maps, column names lower cased
+func Read(r io.Reader, format string) ([]map[string]string, error) {
+	var rows []map[string]string
+	switch format {
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.TrimLeadingSpace = true
+		header, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		for i := range header {
+			header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		}
+		for {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			row := map[string]string{}
+			for i, v := range rec {
+				row[header[i]] = v
+			}
+			rows = append(rows, row)
+			if len(rows) > MaxRows {
+				return nil, fmt.Errorf("more than %d rows", MaxRows)
+			}
+		}
+	case FormatJSON:
+		var objs []map[string]interface{}
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		if err := dec.Decode(&objs); err != nil {
+			return nil, err
+		}
+		if len(objs) > MaxRows {
+			return nil, fmt.Errorf("more than %d rows", MaxRows)
+		}
+		for _, obj := range objs {
+			row := map[string]string{}
+			for k, v := range obj {
+				if v != nil {
+					row[strings.ToLower(k)] = fmt.Sprint(v)
+				}
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	return rows, nil
+}
+
+// Importer - Creates subs from rows
+type Importer struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Importer {
+	return &Importer{DB: db}
+}
+
+// Import - Create a sub per row. Every row runs in a savepoint of one
+// transaction so failed rows leave nothing behind, the transaction is rolled
+// back for a dry run or an atomic import with failed rows. The npppd users
+// are rewritten after a committed import.
+func (im *Importer) Import(rows []map[string]string, opts *Options) (*Result, error) {
+	res := &Result{DryRun: opts.DryRun, Atomic: opts.Atomic, Total: len(rows), Rows: []RowResult{}}
+	now := time.Now()
+	err := im.DB.Transaction(func(tx *gorm.DB) error {
+		l := &lookup{tx: tx, plans: map[string]*planmodel.Plan{}, npppds: map[string]*npppdmodel.Npppd{}}
+		for i, row := range rows {
+			rr := RowResult{Row: i + 1}
+			if err := tx.SavePoint("row").Error; err != nil {
+				return err
+			}
+			sub, err := l.sub(row, opts)
+			if sub != nil {
+				rr.Username = sub.Username
+			}
+			if err == nil {
+				err = create(tx, sub, now)
+			}
+			if err != nil {
+				if rberr := tx.RollbackTo("row").Error; rberr != nil {
+					return rberr
+				}
+				rr.Status, rr.Error = RowError, err.Error()
+				res.Failed++
+			} else {
+				rr.Status, rr.SubID, rr.FramedIp = RowValid, sub.ID, sub.FramedIp
+				res.Valid++
+			}
+			res.Rows = append(res.Rows, rr)
+		}
+		if opts.DryRun || opts.Atomic && res.Failed > 0 || res.Valid == 0 {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollback) {
+		return nil, err
+	}
+	res.Committed = err == nil
+	for i := range res.Rows {
+		if !res.Committed {
+			res.Rows[i].SubID = 0
+		} else if res.Rows[i].Status == RowValid {
+			res.Rows[i].Status = RowCreated
+		}
+	}
+	if res.Committed {
+		if err := npppdmodel.New(im.DB).WriteConfig(); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// create - Store sub with its framed IP checked or allocated, subs with a
+// plan duration and no expiry get their first period
+func create(tx *gorm.DB, sub *submodel.Sub, now time.Time) error {
+	subs := submodel.New(tx)
+	if _, err := subs.GetByUsername(sub.Username); err == nil {
+		return fmt.Errorf("username %s exists", sub.Username)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err := npppdmodel.New(tx).AssignIp(sub, func() error { return subs.Add(sub) }); err != nil {
+		return err
+	}
+	if sub.IsActive && sub.ExpiresAt == nil {
+		return expiry.New(subs, planmodel.New(tx)).Activate(sub, now)
+	}
+	return nil
+}
+
+// lookup - Plans and npppds by name and ID, cached for the import
+type lookup struct {
+	tx     *gorm.DB
+	plans  map[string]*planmodel.Plan
+	npppds map[string]*npppdmodel.Npppd
+}
+
+func (l *lookup) plan(key string, byName bool) (*planmodel.Plan, error) {
+	if p, ok := l.plans[fmt.Sprint(byName, key)]; ok {
+		return p, nil
+	}
+	var p planmodel.Plan
+	q := l.tx.Where("id = ?", key)
+	if byName {
+		q = l.tx.Where("name = ?", key)
+	}
+	if err := q.First(&p).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("unknown plan %s", key)
+	} else if err != nil {
+		return nil, err
+	}
+	l.plans[fmt.Sprint(byName, key)] = &p
+	return &p, nil
+}
+
+func (l *lookup) npppd(key string, byName bool) (*npppdmodel.Npppd, error) {
+	if n, ok := l.npppds[fmt.Sprint(byName, key)]; ok {
+		return n, nil
+	}
+	var n npppdmodel.Npppd
+	q := l.tx.Where("id = ?", key)
+	if byName {
+		q = l.tx.Where("name = ?", key)
+	}
+	if err := q.First(&n).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("unknown npppd %s", key)
+	} else if err != nil {
+		return nil, err
+	}
+	l.npppds[fmt.Sprint(byName, key)] = &n
+	return &n, nil
+}
+
+// sub - Sub of a row, the username is known as soon as it was read
+func (l *lookup) sub(row map[string]string, opts *Options) (*submodel.Sub, error) {
+	get := func(field string) string {
+		column := field
+		if c, ok := opts.Mapping[field]; ok {
+			column = strings.ToLower(c)
+		}
+		return strings.TrimSpace(row[column])
+	}
+	sub := &submodel.Sub{Username: get("username"), FramedIp: get("fip"), IsActive: true}
+	if sub.Username == "" {
+		return nil, errors.New("username is required")
+	}
+	if err := submodel.ValidUsername(sub.Username); err != nil {
+		return sub, err
+	}
+	password := get("password")
+	if password == "" && !opts.NoPassword {
+		return sub, errors.New("password is required")
+	} else if password == "" {
+		raw := make([]byte, 24)
+		if _, err := rand.Read(raw); err != nil {
+			return sub, err
+		}
+		password = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if err := sub.SetPassword(password); err != nil {
+		return sub, err
+	}
+	if v := get("isactive"); v != "" {
+		active, err := parseBool(v)
+		if err != nil {
+			return sub, fmt.Errorf("invalid isactive %s", v)
+		}
+		sub.IsActive = active
+	}
+	if v, byName := get("plan"), true; v != "" || get("planid") != "" {
+		if v == "" {
+			v, byName = get("planid"), false
+		}
+		p, err := l.plan(v, byName)
+		if err != nil {
+			return sub, err
+		}
+		sub.PlanID = p.ID
+	}
+	if v, byName := get("npppd"), true; v != "" || get("npppdid") != "" {
+		if v == "" {
+			v, byName = get("npppdid"), false
+		}
+		n, err := l.npppd(v, byName)
+		if err != nil {
+			return sub, err
+		}
+		sub.NpppdID = n.ID
+	}
+	for field, t := range map[string]**time.Time{"activated_at": &sub.ActivatedAt, "expires_at": &sub.ExpiresAt} {
+		v := get(field)
+		if v == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if at, err = time.Parse(time.DateOnly, v); err != nil {
+				return sub, fmt.Errorf("invalid %s %s", field, v)
+			}
+		}
+		at = at.UTC()
+		*t = &at
+	}
+	return sub, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "y", "on", "active":
+		return true, nil
+	case "no", "n", "off", "inactive":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
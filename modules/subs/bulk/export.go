@@ -0,0 +1,86 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+// exportFields - Fields without the password
+var exportFields = append([]string{Fields[0]}, Fields[2:]...)
+
+// Export - Every sub as an import row without its password, secrets never
+// leave the server
+func (im *Importer) Export(w io.Writer, format string) error {
+	var subs []submodel.Sub
+	if err := im.DB.Order("id").Find(&subs).Error; err != nil {
+		return err
+	}
+	var plans []planmodel.Plan
+	if err := im.DB.Find(&plans).Error; err != nil {
+		return err
+	}
+	var npppds []npppdmodel.Npppd
+	if err := im.DB.Find(&npppds).Error; err != nil {
+		return err
+	}
+	planNames, npppdNames := map[uint]string{}, map[uint]string{}
+	for _, p := range plans {
+		planNames[p.ID] = p.Name
+	}
+	for _, n := range npppds {
+		npppdNames[n.ID] = n.Name
+	}
+	date := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	id := func(id uint) string {
+		if id == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	rows := make([]map[string]string, 0, len(subs))
+	for _, sub := range subs {
+		row := map[string]string{
+			"username":     sub.Username,
+			"fip":          sub.FramedIp,
+			"plan":         planNames[sub.PlanID],
+			"planid":       id(sub.PlanID),
+			"npppd":        npppdNames[sub.NpppdID],
+			"npppdid":      id(sub.NpppdID),
+			"isactive":     strconv.FormatBool(sub.IsActive),
+			"activated_at": date(sub.ActivatedAt),
+			"expires_at":   date(sub.ExpiresAt),
+		}
+		rows = append(rows, row)
+	}
+
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(exportFields)
+		for _, row := range rows {
+			rec := make([]string, len(exportFields))
+			for i, f := range exportFields {
+				rec[i] = row[f]
+			}
+			cw.Write(rec)
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(rows)
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
@@ -0,0 +1,195 @@
+// Package expiry - Subscription periods from plan durations, deactivation of
+// expired subscribers and renewals
+package expiry
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rbaylon/arkgate/database"
+	"github.com/rbaylon/arkgate/modules/localutils"
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+// DefaultTable - pf table holding the addresses of expired subscribers
+const DefaultTable = "arkgate_expired"
+
+var ErrNoDuration = errors.New("plan has no duration")
+
+// Renewal - Request body of a renewal
+type Renewal struct {
+	Periods int `json:"periods"`
+}
+
+// Bind interface as required by go-chi/render
+func (a *Renewal) Bind(r *http.Request) error {
+	return nil
+}
+
+// Disconnecter - Ends the live sessions of a subscriber on a NAS
+type Disconnecter interface {
+	Disconnect(sub *submodel.Sub) error
+}
+
+type Scheduler struct {
+	Subs  submodel.Crud
+	Plans planmodel.Crud
+	// Table - pf table expired addresses are added to, from EXPIRED_TABLE
+	Table         string
+	Disconnecters []Disconnecter
+}
+
+func New(subs submodel.Crud, plans planmodel.Crud) *Scheduler {
+	table := database.GetEnvVariable("EXPIRED_TABLE")
+	if table == "" {
+		table = DefaultTable
+	}
+	return &Scheduler{
+		Subs:  subs,
+		Plans: plans,
+		Table: table,
+	}
+}
+
+func (s *Scheduler) AddDisconnecter(d Disconnecter) {
+	s.Disconnecters = append(s.Disconnecters, d)
+}
+
+// Run - Deactivate expired subscribers every interval
+func (s *Scheduler) Run(interval time.Duration) {
+	for {
+		if _, err := s.Expire(time.Now()); err != nil {
+			log.Println("Subscription expiry error: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Expire - Deactivate every active subscriber whose period ended before now
+func (s *Scheduler) Expire(now time.Time) ([]submodel.Sub, error) {
+	subs, err := s.Subs.GetExpired(now)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for i := range subs {
+		if err := s.Deactivate(&subs[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subs[i].Username, err))
+		}
+	}
+	if len(subs) > 0 {
+		if err := s.writeNpppd(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return subs, errors.Join(errs...)
+}
+
+// Deactivate - Mark sub inactive, block its address, kill its pf states and
+// disconnect its sessions. The npppd users file is left to the caller.
+func (s *Scheduler) Deactivate(sub *submodel.Sub) error {
+	sub.IsActive = false
+	if err := s.Subs.Update(sub); err != nil {
+		return err
+	}
+	var errs []error
+	if sub.FramedIp != "" {
+		if err := localutils.SendCmd(fmt.Sprintf("PFTABLE ADD %s %s", s.Table, sub.FramedIp)); err != nil {
+			errs = append(errs, err)
+		}
+		if err := localutils.SendCmd("PFSTATE KILL " + sub.FramedIp); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := localutils.SendCmd("NPPPD DISCONNECT " + sub.Username); err != nil {
+		errs = append(errs, err)
+	}
+	for _, d := range s.Disconnecters {
+		if err := d.Disconnect(sub); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Activate - Start a period of the sub's plan now if it has none yet, subs
+// without a plan or a plan duration never expire
+func (s *Scheduler) Activate(sub *submodel.Sub, now time.Time) error {
+	if sub.ExpiresAt != nil || sub.PlanID == 0 {
+		return nil
+	}
+	plan, err := s.Plans.GetById(sub.PlanID)
+	if err != nil || plan.Duration <= 0 {
+		return err
+	}
+	expires := now.AddDate(0, 0, plan.Duration)
+	sub.ActivatedAt, sub.ExpiresAt = &now, &expires
+	return s.Subs.Update(sub)
+}
+
+// Renew - Extend the subscription by periods plan durations (days). An
+// active period is extended from its current expiry, a lapsed one starts
+// again now. The sub is reactivated and unblocked unless it is on billing
+// hold.
+func (s *Scheduler) Renew(sub *submodel.Sub, periods int, now time.Time) error {
+	if sub.PlanID == 0 {
+		return errors.New("sub has no plan")
+	}
+	plan, err := s.Plans.GetById(sub.PlanID)
+	if err != nil {
+		return err
+	}
+	if plan.Duration <= 0 {
+		return ErrNoDuration
+	}
+	if periods < 1 {
+		periods = 1
+	}
+	from := now
+	if sub.ExpiresAt != nil && sub.ExpiresAt.After(now) {
+		from = *sub.ExpiresAt
+	} else {
+		sub.ActivatedAt = &now
+	}
+	expires := from.AddDate(0, 0, plan.Duration*periods)
+	sub.ExpiresAt = &expires
+	return s.Reactivate(sub)
+}
+
+// Reactivate - Mark sub active and undo Deactivate. Failing to unblock is
+// only logged, the sub is active either way. Subs suspended for overdue
+// invoices are only saved, billing reactivates them once paid.
+func (s *Scheduler) Reactivate(sub *submodel.Sub) error {
+	if sub.BillingHold {
+		return s.Subs.Update(sub)
+	}
+	wasActive := sub.IsActive
+	sub.IsActive = true
+	if !wasActive {
+		sub.Resume(time.Now())
+	}
+	if err := s.Subs.Update(sub); err != nil {
+		return err
+	}
+	if wasActive {
+		return nil
+	}
+	if sub.FramedIp != "" {
+		if err := localutils.SendCmd(fmt.Sprintf("PFTABLE DEL %s %s", s.Table, sub.FramedIp)); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := s.writeNpppd(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (s *Scheduler) writeNpppd() error {
+	return npppdmodel.New(s.Subs.GetDB()).WriteConfig()
+}
@@ -2,20 +2,48 @@
 package submodel
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/rbaylon/arkgate/modules/subs/secret"
 	"gorm.io/gorm"
 )
 
+// Quota states of a sub in its current billing period
+const (
+	QuotaWarned    = "warned"
+	QuotaThrottled = "throttled"
+	QuotaBlocked   = "blocked"
+)
+
 type Sub struct {
 	gorm.Model
 	Username string `json:"username" bson:"username"`
-	Password string `json:"password" bson:"password"`
+	// Password - Encrypted secret, accepted in clear on create and update
+	// and never rendered
+	Password string `json:"password,omitempty" bson:"password"`
 	FramedIp string `json:"fip" bson:"fip"`
 	PlanID   uint   `json:"planid" bson:"planid"`
 	NpppdID  uint   `json:"npppdid" bson:"npppdid"`
 	IsActive bool   `json:"isactive" bson:"isactive"`
+	// ActivatedAt, ExpiresAt - Current subscription period, no expiry when nil
+	ActivatedAt *time.Time `json:"activated_at" bson:"activated_at"`
+	ExpiresAt   *time.Time `json:"expires_at" bson:"expires_at" gorm:"index"`
+	// QuotaState - Set when the plan quota was reached in the billing period
+	// starting at QuotaPeriod
+	QuotaState  string     `json:"quotastate" bson:"quotastate"`
+	QuotaPeriod *time.Time `json:"quota_period" bson:"quota_period"`
+	// BilledUntil - End of the last invoiced billing cycle, BillingHold is
+	// set while the sub is suspended for overdue invoices
+	BilledUntil *time.Time `json:"billed_until" bson:"billed_until"`
+	BillingHold bool       `json:"billinghold" bson:"billinghold"`
 }
 
 // MigrateDB - Create the table if not exist in DB
@@ -24,13 +52,105 @@ func MigrateDB(db *gorm.DB) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if err = migrateUTC(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateUTC - Rewrite subscription periods stored with a local offset in
+// UTC, expires_at is compared as text
+func migrateUTC(db *gorm.DB) error {
+	var subs []Sub
+	err := db.Unscoped().Select("id, activated_at, expires_at").
+		Where("activated_at NOT LIKE ? OR expires_at NOT LIKE ?", "%+00:00", "%+00:00").Find(&subs).Error
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		sub.utc()
+		err := db.Unscoped().Model(&Sub{}).Where("id = ?", sub.ID).
+			UpdateColumns(map[string]interface{}{"activated_at": sub.ActivatedAt, "expires_at": sub.ExpiresAt}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utc - Subscription period in UTC, the form it is stored and compared in
+func (a *Sub) utc() {
+	for _, t := range []**time.Time{&a.ActivatedAt, &a.ExpiresAt} {
+		if *t != nil {
+			v := (*t).UTC()
+			*t = &v
+		}
+	}
 }
 
 // Bind interface as required by go-chi/render
 func (a *Sub) Bind(r *http.Request) error {
+	if a.Username != "" {
+		if err := ValidUsername(a.Username); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsFunc(a.Password, unicode.IsControl) {
+		return ErrPasswordControl
+	}
+	a.utc()
+	return nil
+}
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]{0,63}$`)
+
+// ErrPasswordControl - Secrets are written to npppd-users and sent over
+// RADIUS, control characters have no place in them
+var ErrPasswordControl = errors.New("password contains control characters")
+
+// ValidUsername - Usernames name the npppd-users records, so only letters,
+// digits and . _ @ + - are allowed
+func ValidUsername(name string) error {
+	if !usernameRe.MatchString(name) {
+		return fmt.Errorf("invalid username %q, use up to 64 letters, digits and . _ @ + -", name)
+	}
 	return nil
 }
 
+// MarshalJSON - Subs are rendered without their secret
+func (a Sub) MarshalJSON() ([]byte, error) {
+	type sub Sub
+	s := sub(a)
+	s.Password = ""
+	return json.Marshal(s)
+}
+
+// Resume - Restart a billing cycle that lapsed while the sub was inactive
+// at now, the time without service is not billed
+func (a *Sub) Resume(now time.Time) {
+	if a.BilledUntil != nil && a.BilledUntil.Before(now) {
+		a.BilledUntil = &now
+	}
+}
+
+// SetPassword - Store plain encrypted with the current master key
+func (a *Sub) SetPassword(plain string) error {
+	if strings.ContainsFunc(plain, unicode.IsControl) {
+		return ErrPasswordControl
+	}
+	enc, err := secret.Encrypt(plain)
+	if err != nil {
+		return err
+	}
+	a.Password = enc
+	return nil
+}
+
+// Secret - Clear text password, only for npppd-users and RADIUS
+func (a *Sub) Secret() (string, error) {
+	return secret.Decrypt(a.Password)
+}
+
 type Crud interface {
 	GetAll() ([]Sub, error)
 	GetById(uid uint) (*Sub, error)
@@ -38,6 +158,9 @@ type Crud interface {
 	Update(sub *Sub) error
 	Delete(sub *Sub) error
 	GetByUsername(username string) (*Sub, error)
+	GetExpired(at time.Time) ([]Sub, error)
+	SetQuotaState(sub *Sub, old string) (bool, error)
+	Reencrypt() (int, error)
 	GetDB() *gorm.DB
 }
 
@@ -56,6 +179,7 @@ func (s *Storage) GetDB() *gorm.DB {
 }
 
 func (s *Storage) Add(sub *Sub) error {
+	sub.utc()
 	result := s.DB.Create(sub)
 	if result.Error != nil {
 		return result.Error
@@ -90,7 +214,72 @@ func (s *Storage) GetByUsername(username string) (*Sub, error) {
 	return &sub, nil
 }
 
+// GetExpired - Active subs whose subscription ended before at
+func (s *Storage) GetExpired(at time.Time) ([]Sub, error) {
+	var subs []Sub
+	result := s.DB.Where("is_active = ? AND expires_at IS NOT NULL AND expires_at <= ?", true, at.UTC()).Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return subs, nil
+}
+
+// Reencrypt - Encrypt every secret not encrypted with the current master
+// key with it, legacy base64 passwords included. Returns the number of subs
+// changed.
+func (s *Storage) Reencrypt() (int, error) {
+	k, err := secret.Default()
+	if err != nil {
+		return 0, err
+	}
+	current, err := k.Current()
+	if err != nil {
+		return 0, err
+	}
+	var subs []Sub
+	result := s.DB.Unscoped().Where("password <> ''").Find(&subs)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	n := 0
+	var errs []error
+	for _, sub := range subs {
+		if v, _, ok := secret.Parse(sub.Password); ok && v == current {
+			continue
+		}
+		plain, err := k.Decrypt(sub.Password)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.Username, err))
+			continue
+		}
+		enc, err := k.Encrypt(plain)
+		if err != nil {
+			return n, err
+		}
+		// Only the secret, the sub may change meanwhile
+		result = s.DB.Unscoped().Model(&Sub{}).Where("id = ? AND password = ?", sub.ID, sub.Password).Update("password", enc)
+		if result.Error != nil {
+			return n, result.Error
+		}
+		n += int(result.RowsAffected)
+	}
+	return n, errors.Join(errs...)
+}
+
+// SetQuotaState - Save the quota state and period of sub if its stored
+// state is still old. Only these columns are written so edits made since
+// sub was read are kept, ok is false when the state moved meanwhile.
+func (s *Storage) SetQuotaState(sub *Sub, old string) (bool, error) {
+	result := s.DB.Model(&Sub{}).Where("id = ? AND quota_state = ?", sub.ID, old).
+		Updates(map[string]interface{}{"quota_state": sub.QuotaState, "quota_period": sub.QuotaPeriod})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
 func (s *Storage) Update(sub *Sub) error {
+	sub.utc()
 	result := s.DB.Save(sub)
 	if result.Error != nil {
 		return result.Error
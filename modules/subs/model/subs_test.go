@@ -0,0 +1,66 @@
+package submodel
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	MigrateDB(db)
+	return New(db)
+}
+
+func TestGetExpired(t *testing.T) {
+	s := testStorage(t)
+	west := time.FixedZone("PST", -8*3600)
+	expires := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	sub := &Sub{Username: "bob", IsActive: true, ExpiresAt: &expires}
+	if err := s.Add(sub); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"utc before", expires.Add(-time.Minute), 0},
+		{"utc at", expires, 1},
+		// 23:00 of the day before in PST, after the expiry
+		{"local after", expires.Add(time.Hour).In(west), 1},
+		// Later in the text ordering, still before the expiry
+		{"local before", expires.Add(-time.Hour).In(west), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subs, err := s.GetExpired(tt.at)
+			if err != nil || len(subs) != tt.want {
+				t.Errorf("got %d subs, %v", len(subs), err)
+			}
+		})
+	}
+
+	// Periods set in another zone are stored in UTC
+	local := expires.In(west)
+	sub.ExpiresAt = &local
+	if err := s.Update(sub); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	s.DB.Raw("SELECT expires_at || '' FROM subs WHERE id = ?", sub.ID).Scan(&stored)
+	if stored != "2026-03-01 00:00:00+00:00" {
+		t.Errorf("stored %s", stored)
+	}
+}
@@ -0,0 +1,39 @@
+package quota
+
+import (
+	"fmt"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+)
+
+// Alerts - Raises quota warnings and overruns as alerts so they reach the
+// alert notifiers (webhook, mail, syslog)
+type Alerts struct {
+	Alerts alertmodel.Crud
+}
+
+func NewAlerts(alerts alertmodel.Crud) *Alerts {
+	return &Alerts{Alerts: alerts}
+}
+
+func (a *Alerts) Name() string {
+	return "alerts"
+}
+
+func (a *Alerts) NotifyQuota(n *Notice) error {
+	severity := "medium"
+	switch n.Kind {
+	case NoticeReset:
+		return nil
+	case NoticeWarning:
+		severity = "low"
+	}
+	_, err := a.Alerts.Raise(&alertmodel.Alert{
+		Rule:     "quota-" + n.Kind,
+		Severity: severity,
+		SrcIp:    n.Sub.FramedIp,
+		Summary: fmt.Sprintf("%s used %.0f%% of the %s quota (%d of %d bytes) in the period since %s, state %q",
+			n.Sub.Username, n.Percent, n.Plan, n.Used, n.Quota, n.Since.Format("2006-01-02"), n.State),
+	})
+	return err
+}
@@ -0,0 +1,334 @@
+// Package quota - Per plan data caps. Usage comes from the session usage
+// ledger plus, for open npppd sessions that only reach the ledger when they
+// stop, the pflow traffic of the sub so far. A sub over its plan quota is
+// throttled or blocked until the billing period rolls over.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rbaylon/arkgate/database"
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	"github.com/rbaylon/arkgate/modules/localutils"
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+)
+
+const (
+	ActionThrottle = planmodel.QuotaThrottle
+	ActionBlock    = planmodel.QuotaBlock
+
+	DefaultThrottleTable = "arkgate_throttled"
+	DefaultBlockTable    = "arkgate_quota"
+)
+
+// Notice kinds
+const (
+	NoticeWarning  = "warning"
+	NoticeExceeded = "exceeded"
+	NoticeReset    = "reset"
+)
+
+// Status - Quota use of a sub in its current billing period
+type Status struct {
+	SubID    uint      `json:"subid"`
+	Username string    `json:"username"`
+	Plan     string    `json:"plan"`
+	Quota    uint64    `json:"quota"`
+	Used     uint64    `json:"used"`
+	Live     uint64    `json:"live"` // part of Used from open sessions' flows
+	Percent  float64   `json:"percent"`
+	Action   string    `json:"action"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// Notice - Sent to notifiers when a sub's quota state changes
+type Notice struct {
+	Kind string
+	Sub  submodel.Sub
+	*Status
+}
+
+// Notifier - Receives quota notices
+type Notifier interface {
+	Name() string
+	NotifyQuota(n *Notice) error
+}
+
+// NAS - Applies a changed quota state to the sub's live sessions
+type NAS interface {
+	Disconnect(sub *submodel.Sub) error
+	Reauthorize(sub *submodel.Sub) error
+}
+
+type Enforcer struct {
+	Subs     submodel.Crud
+	Plans    planmodel.Crud
+	Sessions sessionmodel.Crud
+	// Flows - pflow buckets metering open npppd sessions, nil to count the
+	// ledger only
+	Flows flowmodel.Crud
+	// WarnPercent - Share of the quota that sends a warning notice, 0 for none
+	WarnPercent float64
+	// ThrottleTable, BlockTable - pf tables of throttled and blocked addresses
+	ThrottleTable string
+	BlockTable    string
+
+	nas       []NAS
+	notifiers []Notifier
+}
+
+func New(subs submodel.Crud, plans planmodel.Crud, sessions sessionmodel.Crud) *Enforcer {
+	e := &Enforcer{
+		Subs:          subs,
+		Plans:         plans,
+		Sessions:      sessions,
+		Flows:         flowmodel.New(subs.GetDB()),
+		WarnPercent:   80,
+		ThrottleTable: database.GetEnvVariable("QUOTA_THROTTLE_TABLE"),
+		BlockTable:    database.GetEnvVariable("QUOTA_BLOCK_TABLE"),
+	}
+	if e.ThrottleTable == "" {
+		e.ThrottleTable = DefaultThrottleTable
+	}
+	if e.BlockTable == "" {
+		e.BlockTable = DefaultBlockTable
+	}
+	return e
+}
+
+func (e *Enforcer) AddNAS(n NAS) {
+	e.nas = append(e.nas, n)
+}
+
+func (e *Enforcer) AddNotifier(n Notifier) {
+	e.notifiers = append(e.notifiers, n)
+}
+
+// Period - Billing period of sub at now. Subs with a plan duration cycle
+// from their activation, others by calendar month.
+func Period(sub *submodel.Sub, plan *planmodel.Plan, now time.Time) (time.Time, time.Time) {
+	if sub.ActivatedAt != nil && plan.Duration > 0 && !sub.ActivatedAt.After(now) {
+		start := *sub.ActivatedAt
+		for {
+			next := start.AddDate(0, 0, plan.Duration)
+			if next.After(now) {
+				return start, next
+			}
+			start = next
+		}
+	}
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Status - Quota use of sub, nil when its plan has no quota
+func (e *Enforcer) Status(sub *submodel.Sub, now time.Time) (*Status, *planmodel.Plan, error) {
+	if sub.PlanID == 0 {
+		return nil, nil, nil
+	}
+	plan, err := e.Plans.GetById(sub.PlanID)
+	if err != nil {
+		return nil, nil, err
+	}
+	since, until := Period(sub, plan, now)
+	st := &Status{
+		SubID:    sub.ID,
+		Username: sub.Username,
+		Plan:     plan.Name,
+		Quota:    plan.Quota,
+		Action:   plan.QuotaAction,
+		State:    sub.QuotaState,
+		Since:    since,
+		Until:    until,
+	}
+	if st.Action == "" {
+		st.Action = ActionThrottle
+	}
+	// The ledger is daily, the whole first day of the period is counted
+	usage, err := e.Sessions.Usage(sub.ID, since, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st.Live, err = e.live(sub.ID, usage.Active, since); err != nil {
+		return nil, nil, err
+	}
+	st.Used = usage.InOctets + usage.OutOctets + st.Live
+	if plan.Quota > 0 {
+		st.Percent = float64(st.Used) * 100 / float64(plan.Quota)
+	}
+	return st, plan, nil
+}
+
+// live - Traffic of open sessions not in the ledger yet. Sessions from the
+// npppd log are only added when they stop, their traffic so far is read
+// from the sub's flow buckets since the earliest start in the period.
+// RADIUS sessions are left out, their interim updates move the ledger.
+func (e *Enforcer) live(subid uint, open []sessionmodel.Session, since time.Time) (uint64, error) {
+	if e.Flows == nil {
+		return 0, nil
+	}
+	var from time.Time
+	for _, sess := range open {
+		if sess.AcctSessionId != "" {
+			continue
+		}
+		start := sess.StartedAt
+		if start.Before(since) {
+			start = since
+		}
+		if from.IsZero() || start.Before(from) {
+			from = start
+		}
+	}
+	if from.IsZero() {
+		return 0, nil
+	}
+	// Buckets start on the minute, the one the session started in counts
+	tops, err := e.Flows.Top(&flowmodel.Filter{SubID: subid, Since: from.Truncate(time.Minute)}, "sub")
+	if err != nil {
+		return 0, err
+	}
+	var octets uint64
+	for _, t := range tops {
+		octets += t.Octets
+	}
+	return octets, nil
+}
+
+// Run - Check every sub every interval
+func (e *Enforcer) Run(interval time.Duration) {
+	for {
+		if err := e.Check(time.Now()); err != nil {
+			log.Println("Quota check error: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Check - Move every active sub with a plan quota to the state its usage
+// calls for, resetting the ones whose billing period rolled over
+func (e *Enforcer) Check(now time.Time) error {
+	subs, err := e.Subs.GetAll()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	changed := false
+	for i := range subs {
+		c, err := e.CheckSub(&subs[i], now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subs[i].Username, err))
+		}
+		changed = changed || c
+	}
+	if changed {
+		if err := npppdmodel.New(e.Subs.GetDB()).WriteConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckSub - Apply the quota state of one sub, changed reports whether its
+// npppd users entry has to be rewritten
+func (e *Enforcer) CheckSub(sub *submodel.Sub, now time.Time) (bool, error) {
+	if !sub.IsActive && sub.QuotaState == "" {
+		return false, nil
+	}
+	st, plan, err := e.Status(sub, now)
+	if err != nil || st == nil {
+		return false, err
+	}
+	// Usage restarts with each billing period, so does the state
+	state := ""
+	switch {
+	case plan.Quota == 0:
+	case st.Used >= plan.Quota:
+		if st.Action == ActionBlock {
+			state = submodel.QuotaBlocked
+		} else {
+			state = submodel.QuotaThrottled
+		}
+	case e.WarnPercent > 0 && st.Percent >= e.WarnPercent:
+		state = submodel.QuotaWarned
+	}
+	if state == sub.QuotaState {
+		return false, nil
+	}
+	old := sub.QuotaState
+	sub.QuotaState = state
+	sub.QuotaPeriod = &st.Since
+	if state == "" {
+		sub.QuotaPeriod = nil
+	}
+	// Another check or an API edit moved the state first, the next run
+	// starts from the stored one
+	if ok, err := e.Subs.SetQuotaState(sub, old); err != nil || !ok {
+		return false, err
+	}
+	st.State = state
+	errs := e.apply(sub, old, state)
+	kind := NoticeExceeded
+	switch state {
+	case "":
+		kind = NoticeReset
+	case submodel.QuotaWarned:
+		kind = NoticeWarning
+	}
+	e.notify(&Notice{Kind: kind, Sub: *sub, Status: st})
+	return old == submodel.QuotaBlocked || state == submodel.QuotaBlocked, errs
+}
+
+// apply - Move the sub's address between the pf tables and update its live
+// sessions
+func (e *Enforcer) apply(sub *submodel.Sub, old, state string) error {
+	var errs []error
+	send := func(cmd string) {
+		if err := localutils.SendCmd(cmd); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	table := map[string]string{submodel.QuotaThrottled: e.ThrottleTable, submodel.QuotaBlocked: e.BlockTable}
+	if sub.FramedIp != "" {
+		if t, ok := table[old]; ok {
+			send(fmt.Sprintf("PFTABLE DEL %s %s", t, sub.FramedIp))
+		}
+		if t, ok := table[state]; ok {
+			send(fmt.Sprintf("PFTABLE ADD %s %s", t, sub.FramedIp))
+			// Existing states keep their queue, drop them
+			send("PFSTATE KILL " + sub.FramedIp)
+		}
+	}
+	for _, n := range e.nas {
+		var err error
+		switch {
+		case state == submodel.QuotaBlocked:
+			err = n.Disconnect(sub)
+		case state == submodel.QuotaThrottled || old == submodel.QuotaThrottled:
+			err = n.Reauthorize(sub)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Enforcer) notify(n *Notice) {
+	for _, nt := range e.notifiers {
+		go func(nt Notifier) {
+			if err := nt.NotifyQuota(n); err != nil {
+				log.Printf("Quota notifier %s: %v\n", nt.Name(), err)
+			}
+		}(nt)
+	}
+}
@@ -0,0 +1,123 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	flowmodel "github.com/rbaylon/arkgate/modules/flows/model"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testEnforcer - Enforcer over an in-memory DB with a plan of 1000 bytes
+// blocking once used up and an active sub on it
+func testEnforcer(t *testing.T) (*Enforcer, *submodel.Sub) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqldb, _ := db.DB()
+	// One connection, every new in-memory connection is a new database
+	sqldb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqldb.Close() })
+	submodel.MigrateDB(db)
+	planmodel.MigrateDB(db)
+	sessionmodel.MigrateDB(db)
+	flowmodel.MigrateDB(db)
+	plan := &planmodel.Plan{Name: "capped", Quota: 1000, QuotaAction: ActionBlock}
+	db.Create(plan)
+	sub := &submodel.Sub{Username: "bob", IsActive: true, PlanID: plan.ID}
+	db.Create(sub)
+	e := &Enforcer{
+		Subs:     submodel.New(db),
+		Plans:    planmodel.New(db),
+		Sessions: sessionmodel.New(db),
+		Flows:    flowmodel.New(db),
+	}
+	return e, sub
+}
+
+func TestLiveUsage(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		acct    string
+		started time.Duration
+		octets  []uint64 // flows at now - 1m, now - 2h
+		live    uint64
+	}{
+		{"npppd session", "", 30 * time.Minute, []uint64{600, 500}, 600},
+		{"npppd session over the cap", "", 3 * time.Hour, []uint64{600, 500}, 1100},
+		{"radius session", "acct-1", 3 * time.Hour, []uint64{600, 500}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, sub := testEnforcer(t)
+			sess := &sessionmodel.Session{Host: "gw", PppId: 1, Username: sub.Username, SubID: sub.ID,
+				AcctSessionId: tt.acct, StartedAt: now.Add(-tt.started)}
+			if err := e.Sessions.Start(sess); err != nil {
+				t.Fatal(err)
+			}
+			e.Flows.AddBatch([]flowmodel.Flow{
+				{BucketStart: now.Add(-time.Minute).Truncate(time.Minute), SubID: sub.ID, Direction: flowmodel.DirectionOut, Octets: tt.octets[0]},
+				{BucketStart: now.Add(-2 * time.Hour).Truncate(time.Minute), SubID: sub.ID, Direction: flowmodel.DirectionIn, Octets: tt.octets[1]},
+			})
+			st, _, err := e.Status(sub, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Live != tt.live || st.Used != tt.live {
+				t.Errorf("live %d, used %d, want %d", st.Live, st.Used, tt.live)
+			}
+			changed, err := e.CheckSub(sub, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocked := tt.live >= 1000
+			if changed != blocked || (sub.QuotaState == submodel.QuotaBlocked) != blocked {
+				t.Errorf("changed %v, state %q", changed, sub.QuotaState)
+			}
+		})
+	}
+}
+
+func TestCheckSubKeepsEdits(t *testing.T) {
+	e, sub := testEnforcer(t)
+	e.Flows.AddBatch([]flowmodel.Flow{{BucketStart: time.Now().Add(-time.Minute), SubID: sub.ID, Octets: 2000}})
+	e.Sessions.Start(&sessionmodel.Session{Host: "gw", PppId: 1, SubID: sub.ID, StartedAt: time.Now().Add(-time.Hour)})
+
+	// Edited through the API after the check read the sub
+	stale := *sub
+	edited := *sub
+	edited.FramedIp = "10.0.0.9"
+	edited.IsActive = false
+	if err := e.Subs.Update(&edited); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.CheckSub(&stale, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := e.Subs.GetById(sub.ID)
+	if got.FramedIp != "10.0.0.9" || got.IsActive || got.QuotaState != submodel.QuotaBlocked {
+		t.Errorf("stored %+v", got)
+	}
+
+	// A state moved by another check is not overwritten
+	stale.QuotaState = ""
+	if changed, err := e.CheckSub(&stale, time.Now()); err != nil || changed {
+		t.Errorf("changed %v, %v", changed, err)
+	}
+}
+
+func TestPlanQuotaAction(t *testing.T) {
+	for action, ok := range map[string]bool{"": true, ActionThrottle: true, ActionBlock: true, "drop": false} {
+		if err := (&planmodel.Plan{QuotaAction: action}).Bind(nil); (err == nil) != ok {
+			t.Errorf("%q: %v", action, err)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 // Package subroutes - Arkgate API Sub module
 //
+// Every change regenerates npppd-users and reloads npppd, only active subs
+// can authenticate. A sub with an npppdid and no fip gets the next free
+// address of that npppd pool, a given fip has to be in the pool and not
+// used by another sub.
+//
 //	Module Routes:
 //	  /api/v1/subs
 //	    Method: GET
@@ -14,6 +19,73 @@
 //	    Return: JSON sub object ( exept for delete method )
 //	    Return-Status: 200 on Success
 //	                   500 on Error
+//	                   409 on Framed IP assigned to another sub
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/<subId>/sessions
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with the PPP session history of the sub
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/<subId>/usage
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: since, until (RFC 3339 or YYYY-MM-DD, default the last 30
+//	           days up to now)
+//	    Return: JSON object with octet, online time and session totals of the
+//	            usage ledger, the daily entries and the open sessions
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/<subId>/quota
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with quota, bytes used and state in the current
+//	            billing period, null if the sub has no plan
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/<subId>/renew
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object {"periods": <plan durations, default 1>}
+//	    Return: JSON sub object, expiry extended from the current one if it
+//	            has not passed yet, reactivated if expired
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/import
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Query: format (csv or json, default from the Content-Type), map
+//	           (field:column pairs separated by commas), dryrun (true to
+//	           only validate), atomic (true to import nothing if a row fails),
+//	           nopassword (true to accept rows without a password, as in an
+//	           export, their subs can not log in until a password is set)
+//	    Body: CSV with a header row or a JSON list of objects with username,
+//	          password, fip, plan (name) or planid, npppd (name) or npppdid,
+//	          isactive (default true), activated_at and expires_at. Names
+//	          win over IDs when a row has both.
+//	    Return: JSON object with totals, whether the import was committed
+//	            and the status and error of each row
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/subs/export
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Query: format (csv or json, default csv)
+//	    Return: Every sub with the import fields but the password, import
+//	            it again with nopassword=true
+//	    Return-Status: 200 on Success
+//	                   500 on Error
 //	                   400 on Bad request
 //
 //	  /api/v1/subs/create
@@ -22,28 +94,59 @@
 //	    Return: JSON sub object ( exept for delete method )
 //	    Return-Status: 200 on Success
 //	                   500 on Error
+//	                   409 on Framed IP assigned to another sub
 //	                   400 on Bad request
 package subroutes
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/go-chi/render"
+	billingmodel "github.com/rbaylon/arkgate/modules/billing/model"
 	"github.com/rbaylon/arkgate/modules/localutils"
+	npppdmodel "github.com/rbaylon/arkgate/modules/npppd/model"
 	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
 	"github.com/rbaylon/arkgate/modules/security"
+	sessionmodel "github.com/rbaylon/arkgate/modules/sessions/model"
+	"github.com/rbaylon/arkgate/modules/subs/bulk"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
 	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"github.com/rbaylon/arkgate/modules/subs/quota"
 	"github.com/rbaylon/arkgate/utils"
 	"gorm.io/gorm"
 )
 
 var tokenAuth *jwtauth.JWTAuth
 
+// writeNpppd - Regenerate the npppd users after a sub change
+func writeNpppd(db submodel.Crud) {
+	ns := npppdmodel.New(db.GetDB())
+	if err := ns.WriteConfig(); err != nil {
+		log.Println(err)
+	}
+}
+
+// poolError - Render a rejected framed IP, reports whether err was one
+func poolError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, npppdmodel.ErrIpInUse):
+		render.Render(w, r, utils.ErrInvalidRequest(err, "Framed IP in use", http.StatusConflict))
+	case errors.Is(err, npppdmodel.ErrOutsidePool), errors.Is(err, npppdmodel.ErrPoolFull):
+		render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid framed IP", http.StatusBadRequest))
+	default:
+		return false
+	}
+	return true
+}
+
 func SubRouter(db submodel.Crud) chi.Router {
 	r := chi.NewRouter()
 	r.Use(security.TokenRequired)
@@ -56,6 +159,58 @@ func SubRouter(db submodel.Crud) chi.Router {
 		}
 		render.JSON(w, r, res)
 	})
+	r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		opts := &bulk.Options{
+			Format:     q.Get("format"),
+			DryRun:     q.Get("dryrun") == "true",
+			Atomic:     q.Get("atomic") == "true",
+			NoPassword: q.Get("nopassword") == "true",
+		}
+		if opts.Format == "" {
+			opts.Format = bulk.FormatJSON
+			if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+				opts.Format = bulk.FormatCSV
+			}
+		}
+		mapping, err := bulk.ParseMapping(q.Get("map"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid mapping", http.StatusBadRequest))
+			return
+		}
+		opts.Mapping = mapping
+		rows, err := bulk.Read(http.MaxBytesReader(w, r.Body, 32<<20), opts.Format)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Invalid import", http.StatusBadRequest))
+			return
+		}
+		res, err := bulk.New(db.GetDB()).Import(rows, opts)
+		if res == nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", bulk.FormatCSV:
+			format = bulk.FormatCSV
+			w.Header().Set("Content-Type", "text/csv")
+		case bulk.FormatJSON:
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			render.Render(w, r, utils.ErrInvalidRequest(fmt.Errorf("unknown format %s", format), "Invalid format", http.StatusBadRequest))
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=subs."+format)
+		if err := bulk.New(db.GetDB()).Export(w, format); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Export error", http.StatusInternalServerError))
+		}
+	})
 	r.Get("/{subId}", func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
 		if err != nil {
@@ -69,6 +224,93 @@ func SubRouter(db submodel.Crud) chi.Router {
 		}
 		render.JSON(w, r, sub)
 	})
+	r.Get("/{subId}/sessions", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		ss := sessionmodel.New(db.GetDB())
+		res, err := ss.GetBySub(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/{subId}/usage", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		until, since := time.Now(), time.Time{}
+		for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+			v := r.URL.Query().Get(param)
+			if v == "" {
+				continue
+			}
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				if *t, err = time.Parse(time.DateOnly, v); err != nil {
+					render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid %s %s", param, v), http.StatusBadRequest))
+					return
+				}
+			}
+		}
+		if since.IsZero() {
+			since = until.AddDate(0, 0, -30)
+		}
+		ss := sessionmodel.New(db.GetDB())
+		res, err := ss.Usage(uint(id), since, until)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Get("/{subId}/quota", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		sub, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		dbconn := db.GetDB()
+		q := quota.New(db, planmodel.New(dbconn), sessionmodel.New(dbconn))
+		res, _, err := q.Status(sub, time.Now())
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/{subId}/renew", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid sub ID %s", chi.URLParam(r, "subId")), http.StatusBadRequest))
+			return
+		}
+		req := &expiry.Renewal{}
+		if err = render.Bind(r, req); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		sub, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		sched := expiry.New(db, planmodel.New(db.GetDB()))
+		if err = sched.Renew(sub, req.Periods, time.Now()); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Renewal error", http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, sub)
+	})
 	r.Put("/{subId}", func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "subId"))
 		if err != nil {
@@ -81,10 +323,33 @@ func SubRouter(db submodel.Crud) chi.Router {
 			return
 		}
 		sub.ID = uint(id)
-		if _, err := localutils.B64StdDecode(sub.Password); err != nil {
-			sub.Password = localutils.B64StdEncode(sub.Password)
+		// The subscription period is kept unless given, it moves with renewals
+		old, err := db.GetById(sub.ID)
+		if err == nil {
+			if sub.ActivatedAt == nil {
+				sub.ActivatedAt = old.ActivatedAt
+			}
+			if sub.ExpiresAt == nil {
+				sub.ExpiresAt = old.ExpiresAt
+			}
+			sub.QuotaState, sub.QuotaPeriod = old.QuotaState, old.QuotaPeriod
+			sub.BilledUntil, sub.BillingHold = old.BilledUntil, old.BillingHold
+			if !old.IsActive && sub.IsActive && !sub.BillingHold {
+				sub.Resume(time.Now())
+			}
+		}
+		// Secrets are never rendered, an update without one keeps it
+		if sub.Password == "" && old != nil {
+			sub.Password = old.Password
+		} else if err := sub.SetPassword(sub.Password); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Secret error", http.StatusInternalServerError))
+			return
+		}
+		ns := npppdmodel.New(db.GetDB())
+		errupdate := ns.AssignIp(sub, func() error { return db.Update(sub) })
+		if poolError(w, r, errupdate) {
+			return
 		}
-		errupdate := db.Update(sub)
 		if int(sub.PlanID) > 0 {
 			planid := uint(sub.PlanID)
 			dbconn := db.GetDB()
@@ -99,6 +364,13 @@ func SubRouter(db submodel.Crud) chi.Router {
 			}
 		}
 		if errupdate == nil {
+			// A plan change in the middle of an invoiced cycle is prorated
+			if old != nil && old.PlanID != sub.PlanID {
+				if _, err := billingmodel.New(db.GetDB()).ChangePlan(sub, old.PlanID, time.Now()); err != nil {
+					log.Println("Proration error: ", err)
+				}
+			}
+			writeNpppd(db)
 			render.JSON(w, r, sub)
 			return
 		}
@@ -110,8 +382,15 @@ func SubRouter(db submodel.Crud) chi.Router {
 			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
 			return
 		}
-		sub.Password = localutils.B64StdEncode(sub.Password)
-		erradd := db.Add(sub)
+		if err := sub.SetPassword(sub.Password); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Secret error", http.StatusInternalServerError))
+			return
+		}
+		ns := npppdmodel.New(db.GetDB())
+		erradd := ns.AssignIp(sub, func() error { return db.Add(sub) })
+		if poolError(w, r, erradd) {
+			return
+		}
 		if int(sub.PlanID) > 0 {
 			planid := uint(sub.PlanID)
 			dbconn := db.GetDB()
@@ -130,6 +409,13 @@ func SubRouter(db submodel.Crud) chi.Router {
 			if cmderr != nil {
 				log.Println(cmderr)
 			}
+			if sub.IsActive {
+				sched := expiry.New(db, planmodel.New(db.GetDB()))
+				if err := sched.Activate(sub, time.Now()); err != nil {
+					log.Println(err)
+				}
+			}
+			writeNpppd(db)
 			render.JSON(w, r, sub)
 			return
 		}
@@ -149,6 +435,7 @@ func SubRouter(db submodel.Crud) chi.Router {
 		sub.ID = uint(id)
 		err = db.Delete(sub)
 		if err == nil {
+			writeNpppd(db)
 			render.JSON(w, r, sub)
 			return
 		}
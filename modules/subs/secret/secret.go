@@ -0,0 +1,264 @@
+// Package secret - Subscriber secrets encrypted with AES-256-GCM under a
+// versioned master key. Stored values look like "enc:v<version>:<base64
+// nonce and ciphertext>", values without the prefix are the base64 encoded
+// clear text of older releases.
+package secret
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rbaylon/arkgate/database"
+)
+
+// DefaultKeyFile - Key file used when SUB_SECRET_KEYFILE is not set
+const DefaultKeyFile = "/etc/arkgate/sub-secrets.key"
+
+const prefix = "enc:v"
+
+var (
+	ErrUnknownKey = errors.New("secret encrypted with an unknown key version")
+	ErrCorrupt    = errors.New("secret can not be decrypted")
+)
+
+// Keyring - Master keys by version from a key file of "<version> <base64
+// 32 byte key>" lines. The highest version encrypts, every version
+// decrypts. The file is read again when it changes so a rotation by
+// another process is picked up.
+type Keyring struct {
+	path    string
+	mu      sync.Mutex
+	keys    map[int]cipher.AEAD
+	current int
+	mod     time.Time
+}
+
+// Load - Keyring of the key file at path, created with its directory and a
+// first key if it does not exist
+func Load(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := k.add(1); err != nil {
+			return nil, err
+		}
+	}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+var (
+	defaultMu   sync.Mutex
+	defaultRing *Keyring
+)
+
+// Default - Keyring of SUB_SECRET_KEYFILE, loaded on first use
+func Default() (*Keyring, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultRing != nil {
+		return defaultRing, nil
+	}
+	path := database.GetEnvVariable("SUB_SECRET_KEYFILE")
+	if path == "" {
+		path = DefaultKeyFile
+	}
+	k, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	defaultRing = k
+	return k, nil
+}
+
+// Encrypt - plain encrypted with the default keyring
+func Encrypt(plain string) (string, error) {
+	k, err := Default()
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(plain)
+}
+
+// Decrypt - Clear text of a stored secret with the default keyring
+func Decrypt(stored string) (string, error) {
+	k, err := Default()
+	if err != nil {
+		return "", err
+	}
+	return k.Decrypt(stored)
+}
+
+// refresh - Read the key file if it changed since it was last read
+func (k *Keyring) refresh() error {
+	st, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if k.keys != nil && st.ModTime().Equal(k.mod) {
+		return nil
+	}
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys, current := map[int]cipher.AEAD{}, 0
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want <version> <key>", k.path, n)
+		}
+		v, err := strconv.Atoi(fields[0])
+		if err != nil || v < 1 {
+			return fmt.Errorf("%s:%d: invalid version %s", k.path, n, fields[0])
+		}
+		raw, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("%s:%d: key is not 32 bytes of base64", k.path, n)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return err
+		}
+		if keys[v], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+		if v > current {
+			current = v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("%s: no keys", k.path)
+	}
+	k.keys, k.current, k.mod = keys, current, st.ModTime()
+	return nil
+}
+
+// add - Append a new random key with version v to the key file
+func (k *Keyring) add(v int) (int, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fmt.Fprintf(f, "%d %s\n", v, base64.StdEncoding.EncodeToString(raw))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return v, err
+}
+
+// Rotate - Add a new key version that encrypts from now on, older
+// versions are kept to decrypt until every secret was re-encrypted
+func (k *Keyring) Rotate() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.refresh(); err != nil {
+		return 0, err
+	}
+	v, err := k.add(k.current + 1)
+	if err != nil {
+		return 0, err
+	}
+	// The modification time may not have moved within its resolution
+	k.keys = nil
+	return v, k.refresh()
+}
+
+// Current - Version new secrets are encrypted with
+func (k *Keyring) Current() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.refresh(); err != nil {
+		return 0, err
+	}
+	return k.current, nil
+}
+
+func (k *Keyring) Encrypt(plain string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.refresh(); err != nil {
+		return "", err
+	}
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	label := prefix + strconv.Itoa(k.current)
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(label))
+	return label + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt - Clear text of stored, legacy values are base64 decoded
+func (k *Keyring) Decrypt(stored string) (string, error) {
+	v, data, ok := Parse(stored)
+	if !ok {
+		plain, err := base64.StdEncoding.DecodeString(stored)
+		if err != nil {
+			return "", ErrCorrupt
+		}
+		return string(plain), nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.refresh(); err != nil {
+		return "", err
+	}
+	aead, ok := k.keys[v]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrCorrupt
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(prefix+strconv.Itoa(v)))
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(plain), nil
+}
+
+// Parse - Key version and payload of an encrypted value, ok is false for
+// legacy values
+func Parse(stored string) (int, string, bool) {
+	rest, found := strings.CutPrefix(stored, prefix)
+	if !found {
+		return 0, "", false
+	}
+	ver, data, found := strings.Cut(rest, ":")
+	v, err := strconv.Atoi(ver)
+	if !found || err != nil {
+		return 0, "", false
+	}
+	return v, data, true
+}
@@ -0,0 +1,169 @@
+package secret
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) (*Keyring, string) {
+	t.Helper()
+	path := t.TempDir() + "/keys/sub-secrets.key"
+	k, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, path
+}
+
+func TestLoad(t *testing.T) {
+	k, path := testKeyring(t)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v", st.Mode().Perm())
+	}
+	if v, err := k.Current(); err != nil || v != 1 {
+		t.Errorf("current %d, %v", v, err)
+	}
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name, file string
+		err        bool
+	}{
+		{"comments and blanks", "# keys\n\n1 " + key + "\n", false},
+		{"missing key", "1\n", true},
+		{"extra field", "1 " + key + " x\n", true},
+		{"version", "0 " + key + "\n", true},
+		{"not base64", "1 !!!\n", true},
+		{"short key", "1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n", true},
+		{"no keys", "# empty\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/keys"
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(path); (err != nil) != tt.err {
+				t.Errorf("got %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, _ := testKeyring(t)
+	for _, plain := range []string{"", "pw1", "p:w\\^\x00ü"} {
+		stored, err := k.Encrypt(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(stored, "enc:v1:") {
+			t.Errorf("stored %q", stored)
+		}
+		if got, err := k.Decrypt(stored); err != nil || got != plain {
+			t.Errorf("Decrypt(%q) = %q, %v", stored, got, err)
+		}
+	}
+	a, _ := k.Encrypt("pw1")
+	b, _ := k.Encrypt("pw1")
+	if a == b {
+		t.Error("same ciphertext for the same secret")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	k, path := testKeyring(t)
+	old, _ := k.Encrypt("pw1")
+	if v, err := k.Rotate(); err != nil || v != 2 {
+		t.Fatalf("rotated to %d, %v", v, err)
+	}
+	stored, _ := k.Encrypt("pw2")
+	if !strings.HasPrefix(stored, "enc:v2:") {
+		t.Errorf("encrypted with %q after rotation", stored)
+	}
+	if got, err := k.Decrypt(old); err != nil || got != "pw1" {
+		t.Errorf("old secret %q, %v", got, err)
+	}
+
+	// Another process rotating the same file
+	other, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := other.Rotate(); err != nil || v != 3 {
+		t.Fatalf("rotated to %d, %v", v, err)
+	}
+	stored, _ = other.Encrypt("pw3")
+	k.keys = nil // modification time may not have moved
+	if got, err := k.Decrypt(stored); err != nil || got != "pw3" {
+		t.Errorf("secret of the other keyring %q, %v", got, err)
+	}
+	if v, _ := k.Current(); v != 3 {
+		t.Errorf("current %d after reload", v)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	k, _ := testKeyring(t)
+	stored, _ := k.Encrypt("pw1")
+	_, data, _ := Parse(stored)
+	sealed, _ := base64.StdEncoding.DecodeString(data)
+	sealed[len(sealed)-1] ^= 1
+	tampered := "enc:v1:" + base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name, stored, want string
+		err                error
+	}{
+		{"legacy", base64.StdEncoding.EncodeToString([]byte("pw1")), "pw1", nil},
+		{"legacy empty", "", "", nil},
+		{"legacy not base64", "pw1!", "", ErrCorrupt},
+		{"unknown version", "enc:v9:" + data, "", ErrUnknownKey},
+		{"tampered", tampered, "", ErrCorrupt},
+		{"payload not base64", "enc:v1:!!!", "", ErrCorrupt},
+		{"payload short", "enc:v1:AAAA", "", ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.Decrypt(tt.stored)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("got %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	// The version is authenticated, a payload moved to another key fails
+	k.Rotate()
+	if _, err := k.Decrypt("enc:v2:" + data); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("relabelled secret: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		stored string
+		v      int
+		data   string
+		ok     bool
+	}{
+		{"enc:v1:abc", 1, "abc", true},
+		{"enc:v12:", 12, "", true},
+		{"enc:v1", 0, "", false},
+		{"enc:vx:abc", 0, "", false},
+		{"cHcx", 0, "", false},
+		{"", 0, "", false},
+	}
+	for _, tt := range tests {
+		v, data, ok := Parse(tt.stored)
+		if v != tt.v || data != tt.data || ok != tt.ok {
+			t.Errorf("Parse(%q) = %d, %q, %v", tt.stored, v, data, ok)
+		}
+	}
+}
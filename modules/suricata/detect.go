@@ -0,0 +1,49 @@
+package suricata
+
+import (
+	"fmt"
+
+	alertmodel "github.com/rbaylon/arkgate/modules/alerts/model"
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+)
+
+var alertSeverity = map[int]string{
+	1: "low",
+	2: "medium",
+	3: "high",
+}
+
+// IdsAlert - Raise an arkgate alert for every IDS alert at or above
+// MinSeverity. Rules are named after the signature so noisy signatures can
+// be suppressed on their own and auto-ban thresholds apply per signature.
+type IdsAlert struct {
+	MinSeverity string
+}
+
+func NewIdsAlert(minSeverity string) *IdsAlert {
+	return &IdsAlert{
+		MinSeverity: minSeverity,
+	}
+}
+
+func (d *IdsAlert) Name() string {
+	return "suricata"
+}
+
+func (d *IdsAlert) Inspect(ev *eventmodel.Event) []*alertmodel.Alert {
+	if ev.Type != "ids" || ev.SignatureId == 0 {
+		return nil
+	}
+	sev := alertSeverity[ev.Severity]
+	if alertmodel.Severities[sev] < alertmodel.Severities[d.MinSeverity] {
+		return nil
+	}
+	return []*alertmodel.Alert{{
+		Rule:     fmt.Sprintf("%s-%d", d.Name(), ev.SignatureId),
+		Severity: sev,
+		SrcIp:    ev.SrcIp,
+		DstIp:    ev.DstIp,
+		Summary:  fmt.Sprintf("%s [%s] %s -> %s", ev.Signature, ev.Category, ev.SrcIp, ev.DstIp),
+		Events:   []eventmodel.Event{*ev},
+	}}
+}
@@ -0,0 +1,195 @@
+// Package suricata - Suricata EVE JSON ingestion and IDS alert detection
+package suricata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	eventmodel "github.com/rbaylon/arkgate/modules/events/model"
+	"github.com/rbaylon/arkgate/modules/ingest"
+	"github.com/rbaylon/arkgate/modules/localutils/tail"
+)
+
+// ErrIgnored - EVE record of an event type that is not ingested
+var ErrIgnored = errors.New("eve event type not ingested")
+
+// Types - EVE event types mapped into arkgate events and the event Type
+// they are stored as
+var Types = map[string]string{
+	"alert": "ids",
+	"dns":   "dns",
+	"http":  "http",
+	"tls":   "tls",
+	"flow":  "flow",
+}
+
+const timeLayout = "2006-01-02T15:04:05.999999-0700"
+
+type endpoint struct {
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+type dnsQuery struct {
+	Rrname string `json:"rrname"`
+	Rrtype string `json:"rrtype"`
+}
+
+// Record - Fields of an EVE record used by the mapping
+type Record struct {
+	Timestamp string `json:"timestamp"`
+	EventType string `json:"event_type"`
+	Host      string `json:"host"`
+	InIface   string `json:"in_iface"`
+	SrcIp     string `json:"src_ip"`
+	SrcPort   int    `json:"src_port"`
+	DestIp    string `json:"dest_ip"`
+	DestPort  int    `json:"dest_port"`
+	Proto     string `json:"proto"`
+	AppProto  string `json:"app_proto"`
+	Alert     *struct {
+		Action      string    `json:"action"`
+		SignatureId int       `json:"signature_id"`
+		Signature   string    `json:"signature"`
+		Category    string    `json:"category"`
+		Severity    int       `json:"severity"`
+		Source      *endpoint `json:"source"`
+		Target      *endpoint `json:"target"`
+	} `json:"alert"`
+	Dns *struct {
+		Type    string     `json:"type"`
+		Rrname  string     `json:"rrname"`
+		Rrtype  string     `json:"rrtype"`
+		Rcode   string     `json:"rcode"`
+		Queries []dnsQuery `json:"queries"`
+	} `json:"dns"`
+	Http *struct {
+		Hostname  string `json:"hostname"`
+		Url       string `json:"url"`
+		Method    string `json:"http_method"`
+		Status    int    `json:"status"`
+		UserAgent string `json:"http_user_agent"`
+	} `json:"http"`
+	Tls *struct {
+		Sni     string `json:"sni"`
+		Version string `json:"version"`
+		Subject string `json:"subject"`
+	} `json:"tls"`
+	Flow *struct {
+		PktsToServer  int64  `json:"pkts_toserver"`
+		PktsToClient  int64  `json:"pkts_toclient"`
+		BytesToServer int64  `json:"bytes_toserver"`
+		BytesToClient int64  `json:"bytes_toclient"`
+		State         string `json:"state"`
+		Reason        string `json:"reason"`
+	} `json:"flow"`
+}
+
+// Severity - Suricata severity 1 (high) to 3 (low) as arkgate event
+// severity, higher is worse
+func Severity(s int) int {
+	switch {
+	case s == 1:
+		return 3
+	case s == 2:
+		return 2
+	}
+	return 1
+}
+
+// Parse - Map one EVE JSON line into the arkgate event schema
+func Parse(line string) (*eventmodel.Event, error) {
+	var rec Record
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		return nil, err
+	}
+	typ, ok := Types[rec.EventType]
+	if !ok {
+		return nil, ErrIgnored
+	}
+	ts, err := time.Parse(timeLayout, rec.Timestamp)
+	if err != nil {
+		if ts, err = time.Parse(time.RFC3339Nano, rec.Timestamp); err != nil {
+			ts = time.Now()
+		}
+	}
+	ev := &eventmodel.Event{
+		Timestamp: ts,
+		Type:      typ,
+		Source:    "suricata",
+		SrcIp:     rec.SrcIp,
+		SrcPort:   rec.SrcPort,
+		DstIp:     rec.DestIp,
+		DstPort:   rec.DestPort,
+		Protocol:  strings.ToLower(rec.Proto),
+		Raw:       line,
+	}
+	if rec.Host != "" {
+		ev.Source = rec.Host
+	}
+	if rec.AppProto != "" && rec.AppProto != "failed" {
+		ev.Protocol = rec.AppProto
+	}
+
+	switch rec.EventType {
+	case "alert":
+		if rec.Alert == nil {
+			return nil, ErrIgnored
+		}
+		ev.Action = rec.Alert.Action
+		ev.Severity = Severity(rec.Alert.Severity)
+		ev.SignatureId = rec.Alert.SignatureId
+		ev.Signature = rec.Alert.Signature
+		ev.Category = rec.Alert.Category
+		ev.Message = rec.Alert.Signature
+		// Rules with target metadata know who the attacker is, which
+		// is not always the packet source
+		if rec.Alert.Source != nil && rec.Alert.Target != nil && rec.Alert.Source.Ip != "" {
+			ev.SrcIp, ev.SrcPort = rec.Alert.Source.Ip, rec.Alert.Source.Port
+			ev.DstIp, ev.DstPort = rec.Alert.Target.Ip, rec.Alert.Target.Port
+		}
+	case "dns":
+		if rec.Dns != nil {
+			ev.Action = rec.Dns.Type
+			ev.Domain, ev.QueryType = rec.Dns.Rrname, rec.Dns.Rrtype
+			if ev.Domain == "" && len(rec.Dns.Queries) > 0 {
+				ev.Domain, ev.QueryType = rec.Dns.Queries[0].Rrname, rec.Dns.Queries[0].Rrtype
+			}
+			ev.Domain = strings.ToLower(strings.TrimSuffix(ev.Domain, "."))
+			ev.Rcode = rec.Dns.Rcode
+			ev.Message = strings.TrimSpace(ev.Domain + " " + ev.QueryType + " " + ev.Rcode)
+		}
+	case "http":
+		if rec.Http != nil {
+			ev.Action = rec.Http.Method
+			ev.Domain = rec.Http.Hostname
+			ev.Message = fmt.Sprintf("%s %s %d %s", rec.Http.Method, rec.Http.Url, rec.Http.Status, rec.Http.UserAgent)
+		}
+	case "tls":
+		if rec.Tls != nil {
+			ev.Domain = rec.Tls.Sni
+			ev.Message = strings.TrimSpace(rec.Tls.Version + " " + rec.Tls.Subject)
+		}
+	case "flow":
+		if rec.Flow != nil {
+			ev.Action = rec.Flow.State
+			ev.Message = fmt.Sprintf("%d/%d pkts %d/%d bytes %s", rec.Flow.PktsToServer, rec.Flow.PktsToClient,
+				rec.Flow.BytesToServer, rec.Flow.BytesToClient, rec.Flow.Reason)
+		}
+	}
+	return ev, nil
+}
+
+// Ingest - Follow an EVE JSON file and publish its events to the pipeline
+func Ingest(path string, p *ingest.Pipeline) {
+	tail.Follow(path, false, func(line string) {
+		ev, err := Parse(line)
+		if err != nil {
+			return
+		}
+		p.Publish(*ev)
+	})
+}
@@ -0,0 +1,131 @@
+package vouchermodel
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+)
+
+// WriteCSV - One row per voucher of a loaded batch
+func WriteCSV(w io.Writer, batch *Batch, plan *planmodel.Plan) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"code", "batch", "plan", "days", "status", "redeem_before", "redeemed_at", "subid"})
+	expires := ""
+	if batch.ExpiresAt != nil {
+		expires = batch.ExpiresAt.Format(time.RFC3339)
+	}
+	for _, v := range batch.Vouchers {
+		redeemed := ""
+		if v.RedeemedAt != nil {
+			redeemed = v.RedeemedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{Format(v.Code), batch.Name, plan.Name, strconv.Itoa(plan.Duration * batch.Periods),
+			v.Status, expires, redeemed, strconv.FormatUint(uint64(v.SubID), 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Card grid of the printable batch, A4 portrait in points
+const (
+	pageWidth  = 595
+	pageHeight = 842
+	margin     = 36
+	cols       = 2
+	rows       = 8
+)
+
+// pdfText - Escape s for a PDF string literal, the standard fonts only
+// cover ASCII
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 32 || c > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// WritePDF - Printable cards of the unused vouchers of a loaded batch, cut
+// lines around each card
+func WritePDF(w io.Writer, batch *Batch, plan *planmodel.Plan) error {
+	var codes []string
+	for _, v := range batch.Vouchers {
+		if v.Status == StatusUnused {
+			codes = append(codes, Format(v.Code))
+		}
+	}
+	validity := fmt.Sprintf("%s - %d days", plan.Name, plan.Duration*batch.Periods)
+	before := ""
+	if batch.ExpiresAt != nil {
+		before = "Redeem before " + batch.ExpiresAt.Format("2006-01-02")
+	}
+	cardW := float64(pageWidth-2*margin) / cols
+	cardH := float64(pageHeight-2*margin) / rows
+
+	var pages []string
+	for start := 0; start < len(codes) || start == 0; start += cols * rows {
+		var c bytes.Buffer
+		c.WriteString("0.5 w\n")
+		for i := start; i < len(codes) && i < start+cols*rows; i++ {
+			n := i - start
+			x := margin + float64(n%cols)*cardW
+			y := pageHeight - margin - float64(n/cols+1)*cardH
+			fmt.Fprintf(&c, "%.1f %.1f %.1f %.1f re S\n", x, y, cardW, cardH)
+			text := func(font string, size int, dy float64, s string) {
+				fmt.Fprintf(&c, "BT /%s %d Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x+12, y+cardH-dy, pdfText(s))
+			}
+			text("F1", 9, 18, batch.Name)
+			text("F2", 18, 46, codes[i])
+			text("F1", 10, 66, validity)
+			if before != "" {
+				text("F1", 8, 82, before)
+			}
+		}
+		pages = append(pages, c.String())
+	}
+
+	// Objects: catalog, page tree, two fonts, then a page and its content
+	// stream per page
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>")
+	for i, content := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,400 @@
+// Package vouchers - Prepaid voucher batches bound to a plan, redeemed for a
+// new or extended subscriber
+package vouchermodel
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	"github.com/rbaylon/arkgate/modules/subs/expiry"
+	submodel "github.com/rbaylon/arkgate/modules/subs/model"
+	"gorm.io/gorm"
+)
+
+// Voucher states, derived from the timestamps
+const (
+	StatusUnused   = "unused"
+	StatusRedeemed = "redeemed"
+	StatusRevoked  = "revoked"
+	StatusExpired  = "expired"
+)
+
+// MaxBatch - Largest number of vouchers generated at once
+const MaxBatch = 10000
+
+// alphabet - Code characters, without the easily confused 0/O and 1/I/L
+const alphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+var (
+	ErrNotFound = errors.New("voucher not found")
+	ErrUsed     = errors.New("voucher already redeemed")
+	ErrRevoked  = errors.New("voucher revoked")
+	ErrExpired  = errors.New("voucher expired")
+)
+
+type Batch struct {
+	gorm.Model
+	Name   string `json:"name" bson:"name"`
+	PlanID uint   `json:"planid" bson:"planid"`
+	Count  int    `json:"count" bson:"count"`
+	// Periods - Plan durations granted by each voucher
+	Periods int `json:"periods" bson:"periods"`
+	// CodeLength - Characters per code, grouped by four when printed
+	CodeLength int `json:"codelength" bson:"codelength"`
+	// ExpiresAt - Vouchers of the batch can not be redeemed after it
+	ExpiresAt *time.Time `json:"expires_at" bson:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at" bson:"revoked_at"`
+	CreatedBy string     `json:"createdby" bson:"createdby"`
+	Vouchers  []Voucher  `json:"vouchers,omitempty"`
+}
+
+type Voucher struct {
+	gorm.Model
+	BatchID    uint       `json:"batchid" bson:"batchid" gorm:"index"`
+	Code       string     `json:"code" bson:"code" gorm:"uniqueIndex"`
+	RedeemedAt *time.Time `json:"redeemed_at" bson:"redeemed_at"`
+	SubID      uint       `json:"subid" bson:"subid" gorm:"index"`
+	RevokedAt  *time.Time `json:"revoked_at" bson:"revoked_at"`
+	Status     string     `json:"status" gorm:"-"`
+}
+
+// Redemption - Redeem request. Without a username a new sub named after the
+// code is created, an existing username is extended.
+type Redemption struct {
+	Code     string `json:"code"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Redeemed - Result of a redemption, Password is only set for a new sub
+// whose password was generated
+type Redeemed struct {
+	Voucher  *Voucher      `json:"voucher"`
+	Sub      *submodel.Sub `json:"sub"`
+	Created  bool          `json:"created"`
+	Password string        `json:"password,omitempty"`
+}
+
+// MigrateDB - Create the table if not exist in DB
+func MigrateDB(db *gorm.DB) {
+	err := db.AutoMigrate(&Batch{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&Voucher{})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Bind interface as required by go-chi/render
+func (a *Batch) Bind(r *http.Request) error {
+	if a.PlanID == 0 {
+		return errors.New("planid is required")
+	}
+	if a.Count < 1 || a.Count > MaxBatch {
+		return fmt.Errorf("count must be between 1 and %d", MaxBatch)
+	}
+	if a.Periods < 1 {
+		a.Periods = 1
+	}
+	if a.CodeLength == 0 {
+		a.CodeLength = 12
+	}
+	if a.CodeLength < 8 || a.CodeLength > 32 {
+		return errors.New("codelength must be between 8 and 32")
+	}
+	return nil
+}
+
+func (a *Redemption) Bind(r *http.Request) error {
+	if a.Code == "" {
+		return errors.New("code is required")
+	}
+	return nil
+}
+
+// username - Of the sub the voucher is redeemed for, the code itself when
+// none was given
+func (a *Redemption) username(v *Voucher) string {
+	if username := strings.TrimSpace(a.Username); username != "" {
+		return username
+	}
+	return v.Code
+}
+
+// Normalize - Code as stored, user input may be lower case and grouped
+func Normalize(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+// Format - Code grouped by four for printing
+func Format(code string) string {
+	var b strings.Builder
+	for i, c := range code {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// State - Status of v in batch b at now
+func (v *Voucher) State(b *Batch, now time.Time) string {
+	switch {
+	case v.RedeemedAt != nil:
+		return StatusRedeemed
+	case v.RevokedAt != nil || b.RevokedAt != nil:
+		return StatusRevoked
+	case b.ExpiresAt != nil && !now.Before(*b.ExpiresAt):
+		return StatusExpired
+	}
+	return StatusUnused
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range b {
+		r, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[r.Int64()]
+	}
+	return string(b), nil
+}
+
+type Crud interface {
+	GetBatches() ([]Batch, error)
+	GetBatch(id uint) (*Batch, error)
+	Generate(batch *Batch) error
+	RevokeBatch(batch *Batch) error
+	GetById(id uint) (*Voucher, *Batch, error)
+	Revoke(v *Voucher) error
+	Redeem(req *Redemption) (*Redeemed, error)
+	GetDB() *gorm.DB
+}
+
+type Storage struct {
+	DB    *gorm.DB
+	Subs  submodel.Crud
+	Plans planmodel.Crud
+}
+
+func New(db *gorm.DB) *Storage {
+	return &Storage{
+		DB:    db,
+		Subs:  submodel.New(db),
+		Plans: planmodel.New(db),
+	}
+}
+
+func (s *Storage) GetDB() *gorm.DB {
+	return s.DB
+}
+
+func (s *Storage) GetBatches() ([]Batch, error) {
+	var batches []Batch
+	result := s.DB.Order("id desc").Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return batches, nil
+}
+
+// GetBatch - Batch with its vouchers and their state
+func (s *Storage) GetBatch(id uint) (*Batch, error) {
+	var batch Batch
+	result := s.DB.Preload("Vouchers").First(&batch, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	now := time.Now()
+	for i := range batch.Vouchers {
+		batch.Vouchers[i].Status = batch.Vouchers[i].State(&batch, now)
+	}
+	return &batch, nil
+}
+
+// Generate - Store batch with Count new unique codes
+func (s *Storage) Generate(batch *Batch) error {
+	plan, err := s.Plans.GetById(batch.PlanID)
+	if err != nil {
+		return err
+	}
+	if plan.Duration <= 0 {
+		return expiry.ErrNoDuration
+	}
+	batch.ID = 0
+	batch.RevokedAt = nil
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Vouchers").Create(batch).Error; err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		batch.Vouchers = make([]Voucher, 0, batch.Count)
+		for len(batch.Vouchers) < batch.Count {
+			code, err := randomString(batch.CodeLength)
+			if err != nil {
+				return err
+			}
+			if seen[code] {
+				continue
+			}
+			var n int64
+			if err := tx.Model(&Voucher{}).Unscoped().Where("code = ?", code).Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+			seen[code] = true
+			batch.Vouchers = append(batch.Vouchers, Voucher{BatchID: batch.ID, Code: code, Status: StatusUnused})
+		}
+		return tx.CreateInBatches(batch.Vouchers, 500).Error
+	})
+}
+
+// RevokeBatch - Revoke every unused voucher of batch
+func (s *Storage) RevokeBatch(batch *Batch) error {
+	now := time.Now()
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(batch).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Voucher{}).Where("batch_id = ? AND redeemed_at IS NULL AND revoked_at IS NULL", batch.ID).
+			Update("revoked_at", now).Error
+	})
+}
+
+func (s *Storage) GetById(id uint) (*Voucher, *Batch, error) {
+	var v Voucher
+	result := s.DB.First(&v, id)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	var b Batch
+	result = s.DB.First(&b, v.BatchID)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	v.Status = v.State(&b, time.Now())
+	return &v, &b, nil
+}
+
+// Revoke - Revoke an unused voucher
+func (s *Storage) Revoke(v *Voucher) error {
+	result := s.DB.Model(&Voucher{}).Where("id = ? AND redeemed_at IS NULL", v.ID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUsed
+	}
+	return s.DB.First(v, v.ID).Error
+}
+
+// Redeem - Claim the voucher, then create or extend the sub by the batch
+// periods of its plan. The claim is a conditional update so a code is only
+// ever redeemed once, it is released again if the sub can not be saved.
+func (s *Storage) Redeem(req *Redemption) (*Redeemed, error) {
+	code := Normalize(req.Code)
+	var v Voucher
+	result := s.DB.Where("code = ?", code).First(&v)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	var b Batch
+	if err := s.DB.First(&b, v.BatchID).Error; err != nil {
+		return nil, err
+	}
+	switch v.State(&b, time.Now()) {
+	case StatusRedeemed:
+		return nil, ErrUsed
+	case StatusRevoked:
+		return nil, ErrRevoked
+	case StatusExpired:
+		return nil, ErrExpired
+	}
+	// Checked before the claim, a sub that can not be stored would burn it
+	if err := submodel.ValidUsername(req.username(&v)); err != nil {
+		return nil, err
+	}
+	if strings.ContainsFunc(req.Password, unicode.IsControl) {
+		return nil, submodel.ErrPasswordControl
+	}
+	now := time.Now()
+	result = s.DB.Model(&Voucher{}).Where("id = ? AND redeemed_at IS NULL AND revoked_at IS NULL", v.ID).
+		Update("redeemed_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrUsed
+	}
+	res, err := s.apply(req, &v, &b, now)
+	if err != nil {
+		s.DB.Model(&Voucher{}).Where("id = ?", v.ID).Update("redeemed_at", nil)
+		return nil, err
+	}
+	v.RedeemedAt = &now
+	v.SubID = res.Sub.ID
+	v.Status = StatusRedeemed
+	if err := s.DB.Model(&v).Update("sub_id", v.SubID).Error; err != nil {
+		return nil, err
+	}
+	res.Voucher = &v
+	return res, nil
+}
+
+func (s *Storage) apply(req *Redemption, v *Voucher, b *Batch, now time.Time) (*Redeemed, error) {
+	res := &Redeemed{}
+	username := req.username(v)
+	sub, err := s.Subs.GetByUsername(username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if sub == nil {
+		res.Created = true
+		password := req.Password
+		if password == "" {
+			if password, err = randomString(10); err != nil {
+				return nil, err
+			}
+			res.Password = password
+		}
+		sub = &submodel.Sub{Username: username, PlanID: b.PlanID}
+		if err := sub.SetPassword(password); err != nil {
+			return nil, err
+		}
+		if err := s.Subs.Add(sub); err != nil {
+			return nil, err
+		}
+	} else if sub.PlanID != b.PlanID {
+		// A voucher for another plan starts a new period on that plan
+		sub.PlanID = b.PlanID
+		sub.ExpiresAt = nil
+	}
+	sched := expiry.New(s.Subs, s.Plans)
+	if err := sched.Renew(sub, b.Periods, now); err != nil {
+		if res.Created {
+			s.Subs.GetDB().Unscoped().Delete(sub)
+		}
+		return nil, err
+	}
+	res.Sub = sub
+	return res, nil
+}
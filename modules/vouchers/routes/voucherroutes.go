@@ -0,0 +1,236 @@
+// Package voucherroutes - Arkgate API prepaid voucher module
+//
+// Batches of single use codes are generated for a plan. Redeeming a code
+// creates a new subscriber or extends an existing one by the batch periods.
+//
+//	Module Routes:
+//	  /api/v1/vouchers/batches
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON object with list of batch objects
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//
+//	  /api/v1/vouchers/batches/create
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON batch object with name, planid, count, periods (default 1),
+//	          codelength (default 12) and expires_at (optional)
+//	    Return: JSON batch object with its vouchers
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/batches/<batchId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON batch object with its vouchers and their status
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/batches/<batchId>/revoke
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON batch object, unused vouchers are revoked
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/batches/<batchId>/export?format=csv|pdf
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: CSV of every voucher, or PDF cards of the unused ones
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/redeem
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Body: JSON object with code, username (optional, existing subs are
+//	          extended) and password (optional for new subs)
+//	    Return: JSON object with voucher, sub, created and the generated
+//	            password of a new sub
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   404 on Unknown code
+//	                   409 on Redeemed, revoked or expired voucher
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/<voucherId>
+//	    Method: GET
+//	    Headers: Authorization Bearer
+//	    Return: JSON voucher object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   400 on Bad request
+//
+//	  /api/v1/vouchers/<voucherId>/revoke
+//	    Method: POST
+//	    Headers: Authorization Bearer
+//	    Return: JSON voucher object
+//	    Return-Status: 200 on Success
+//	                   500 on Error
+//	                   409 on Redeemed voucher
+//	                   400 on Bad request
+package voucherroutes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/render"
+	planmodel "github.com/rbaylon/arkgate/modules/plans/model"
+	"github.com/rbaylon/arkgate/modules/security"
+	vouchermodel "github.com/rbaylon/arkgate/modules/vouchers/model"
+	"github.com/rbaylon/arkgate/utils"
+)
+
+var tokenAuth *jwtauth.JWTAuth
+
+func VoucherRouter(db vouchermodel.Crud) chi.Router {
+	r := chi.NewRouter()
+	r.Use(security.TokenRequired)
+
+	// loadBatch - Batch of the batchId URL parameter, renders the error itself
+	loadBatch := func(w http.ResponseWriter, r *http.Request) *vouchermodel.Batch {
+		id, err := strconv.Atoi(chi.URLParam(r, "batchId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid batch ID %s", chi.URLParam(r, "batchId")), http.StatusBadRequest))
+			return nil
+		}
+		batch, err := db.GetBatch(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return nil
+		}
+		return batch
+	}
+	// load - Voucher of the voucherId URL parameter
+	load := func(w http.ResponseWriter, r *http.Request) *vouchermodel.Voucher {
+		id, err := strconv.Atoi(chi.URLParam(r, "voucherId"))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, fmt.Sprintf("Invalid voucher ID %s", chi.URLParam(r, "voucherId")), http.StatusBadRequest))
+			return nil
+		}
+		v, _, err := db.GetById(uint(id))
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return nil
+		}
+		return v
+	}
+
+	r.Get("/batches", func(w http.ResponseWriter, r *http.Request) {
+		res, errdb := db.GetBatches()
+		if errdb != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(errdb, "DB error", http.StatusInternalServerError))
+			return
+		}
+		render.JSON(w, r, res)
+	})
+	r.Post("/batches/create", func(w http.ResponseWriter, r *http.Request) {
+		batch := &vouchermodel.Batch{}
+		if err := render.Bind(r, batch); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		batch.CreatedBy = security.Username(r)
+		if err := db.Generate(batch); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Error generating vouchers", http.StatusBadRequest))
+			return
+		}
+		render.JSON(w, r, batch)
+	})
+	r.Get("/batches/{batchId}", func(w http.ResponseWriter, r *http.Request) {
+		if batch := loadBatch(w, r); batch != nil {
+			render.JSON(w, r, batch)
+		}
+	})
+	r.Post("/batches/{batchId}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		batch := loadBatch(w, r)
+		if batch == nil {
+			return
+		}
+		if err := db.RevokeBatch(batch); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if batch = loadBatch(w, r); batch != nil {
+			render.JSON(w, r, batch)
+		}
+	})
+	r.Get("/batches/{batchId}/export", func(w http.ResponseWriter, r *http.Request) {
+		batch := loadBatch(w, r)
+		if batch == nil {
+			return
+		}
+		plan, err := planmodel.New(db.GetDB()).GetById(batch.PlanID)
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		name := fmt.Sprintf("vouchers-%d", batch.ID)
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", name))
+			err = vouchermodel.WriteCSV(w, batch, plan)
+		case "pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", name))
+			err = vouchermodel.WritePDF(w, batch, plan)
+		default:
+			render.Render(w, r, utils.ErrInvalidRequest(fmt.Errorf("unknown format %s", format), "Invalid format", http.StatusBadRequest))
+			return
+		}
+		if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Export error", http.StatusInternalServerError))
+		}
+	})
+	r.Post("/redeem", func(w http.ResponseWriter, r *http.Request) {
+		req := &vouchermodel.Redemption{}
+		if err := render.Bind(r, req); err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Bind error", http.StatusBadRequest))
+			return
+		}
+		res, err := db.Redeem(req)
+		switch {
+		case errors.Is(err, vouchermodel.ErrNotFound):
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Unknown voucher", http.StatusNotFound))
+		case errors.Is(err, vouchermodel.ErrUsed), errors.Is(err, vouchermodel.ErrRevoked), errors.Is(err, vouchermodel.ErrExpired):
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Voucher not redeemable", http.StatusConflict))
+		case err != nil:
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Error redeeming voucher", http.StatusBadRequest))
+		default:
+			render.JSON(w, r, res)
+		}
+	})
+	r.Get("/{voucherId}", func(w http.ResponseWriter, r *http.Request) {
+		if v := load(w, r); v != nil {
+			render.JSON(w, r, v)
+		}
+	})
+	r.Post("/{voucherId}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		v := load(w, r)
+		if v == nil {
+			return
+		}
+		if err := db.Revoke(v); errors.Is(err, vouchermodel.ErrUsed) {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "Voucher not revocable", http.StatusConflict))
+			return
+		} else if err != nil {
+			render.Render(w, r, utils.ErrInvalidRequest(err, "DB error", http.StatusInternalServerError))
+			return
+		}
+		if v = load(w, r); v != nil {
+			render.JSON(w, r, v)
+		}
+	})
+	return r
+}